@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/configfile"
+	"github.com/angenalZZZ/gofunc/log"
+)
+
+var (
+	configInfo *Config
+	configFile = "kvserver.yaml"
+	configMod  time.Time
+)
+
+// Config The Config Info For kvserver.yaml
+type Config struct {
+	KV     string // the url of kv.Open
+	Wal    string
+	Tcp    string
+	Http   string
+	Leader string
+	Token  string // authorizes the admin requests and the replication
+	// WalSize the size of the WAL in MB to compact it to a snapshot, 64 by default, -1 never.
+	WalSize int
+	Log     *log.Config
+}
+
+func initConfig() error {
+	configInfo = new(Config)
+
+	if isConfigMod() {
+		if err := configfile.YamlTo(configFile, configInfo); err != nil {
+			return err
+		}
+	}
+
+	if configInfo.KV == "" {
+		configInfo.KV = "memory://"
+	}
+	if configInfo.Wal == "" {
+		configInfo.Wal = "kvserver.wal"
+	}
+	if configInfo.Tcp == "" {
+		configInfo.Tcp = "127.0.0.1:7070"
+	}
+	if configInfo.WalSize == 0 {
+		configInfo.WalSize = 64
+	}
+	if configInfo.Log == nil {
+		configInfo.Log = &log.Config{Writers: "stdout", Level: "info", TimeFormat: "15:04:05.000"}
+	}
+
+	return nil
+}
+
+func isConfigMod() bool {
+	if configFile == "" {
+		return false
+	}
+	info, err := os.Stat(configFile)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if t := info.ModTime(); t.Unix() != configMod.Unix() {
+		configMod = t
+		return true
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/angenalZZZ/gofunc/data/kv"
+	"github.com/angenalZZZ/gofunc/log"
+)
+
+var (
+	flagConfig = flag.String("c", "kvserver.yaml", "sets config file")
+	flagKV     = flag.String("kv", "", "the kv backend url, e.g. badger://./data")
+	flagWal    = flag.String("wal", "", "the write-ahead log file")
+	flagTcp    = flag.String("tcp", "", "the binary protocol address")
+	flagHttp   = flag.String("http", "", "the HTTP/JSON address")
+	flagLeader = flag.String("leader", "", "follows the leader's binary protocol address")
+	flagToken  = flag.String("token", "", "authorizes the admin requests and the replication")
+)
+
+var (
+	kvServer   *Server
+	tcpService *tcpServer
+	httpServer *http.Server
+)
+
+func initArgs() {
+	flag.Usage = func() {
+		fmt.Printf(" Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+}
+
+func checkArgs() {
+	if *flagConfig != "" {
+		configFile = *flagConfig
+	}
+
+	if err := initConfig(); err != nil {
+		panic(err)
+	}
+
+	if *flagKV != "" {
+		configInfo.KV = *flagKV
+	}
+	if *flagWal != "" {
+		configInfo.Wal = *flagWal
+	}
+	if *flagTcp != "" {
+		configInfo.Tcp = *flagTcp
+	}
+	if *flagHttp != "" {
+		configInfo.Http = *flagHttp
+	}
+	if *flagLeader != "" {
+		configInfo.Leader = *flagLeader
+	}
+	if *flagToken != "" {
+		configInfo.Token = *flagToken
+	}
+
+	if log.Log == nil {
+		log.Log = log.Init(configInfo.Log)
+	}
+	log.Log.Debug().Msgf("configuration complete")
+}
+
+func runServer() {
+	db, err := kv.Open(configInfo.KV)
+	if err != nil {
+		log.Log.Error().Msgf("[kvserver] failed open %s: %v\n", configInfo.KV, err)
+		os.Exit(1)
+	}
+	wal, err := OpenWAL(configInfo.Wal)
+	if err != nil {
+		_ = db.Close()
+		log.Log.Error().Msgf("[kvserver] failed open wal %s: %v\n", configInfo.Wal, err)
+		os.Exit(1)
+	}
+	kvServer = NewServer(db, wal, log.Log)
+	kvServer.Token = configInfo.Token
+	if configInfo.WalSize > 0 {
+		kvServer.MaxWalSize = int64(configInfo.WalSize) << 20
+	}
+	if configInfo.Leader != "" {
+		kvServer.Follow(configInfo.Leader)
+		log.Log.Info().Msgf("[kvserver] following %s from seq %d", configInfo.Leader, wal.Seq())
+	} else if !wal.HasSnapshot() {
+		// the followers receive the data saved before the WAL by the snapshot
+		if err = kvServer.Snapshot(); err != nil {
+			log.Log.Error().Msgf("[kvserver] failed snapshot: %v\n", err)
+		}
+	}
+
+	tcpService = newTcpServer(kvServer, configInfo.Tcp)
+	go func() {
+		if err := tcpService.Serve(); err != nil {
+			log.Log.Error().Msgf("[kvserver] tcp server stopped: %v\n", err)
+			os.Exit(1)
+		}
+	}()
+
+	if configInfo.Http == "" {
+		return
+	}
+	httpServer = &http.Server{Addr: configInfo.Http, Handler: httpHandler(kvServer)}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Log.Error().Msgf("[kvserver] http server stopped: %v\n", err)
+		}
+	}()
+	log.Log.Info().Msgf("[kvserver] http listening on %s", configInfo.Http)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/kv"
+)
+
+// httpHandler serves the kv over HTTP/JSON:
+//
+//	GET    /kv/{key}            get a value
+//	PUT    /kv/{key}?ttl=60     set a value with the request body
+//	POST   /kv/{key}?incr=1     increment a value
+//	DELETE /kv/{key}            delete a key
+//	GET    /kv?prefix=&start=&end=&limit=&reverse=  scan the keys and values
+//	POST   /mget ["k1","k2"]    POST /mset {"k1":"v1"}
+//	POST   /batch [{"del":false,"key":"k1","value":"v1","ttl":60}]
+//	GET    /status              POST /admin/promote  POST /admin/gc  POST /admin/snapshot
+//
+// The admin requests are authorized by the header "Authorization: Bearer {token}" when the Token is set,
+// the request bodies are limited to the MaxBodySize.
+func httpHandler(s *Server) http.Handler {
+	mux := http.NewServeMux()
+	maxBodySize := s.MaxBodySize
+	if maxBodySize <= 0 || maxBodySize > maxWalFrame {
+		maxBodySize = maxWalFrame
+	}
+
+	mux.HandleFunc("/kv/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/kv/")
+		if key == "" {
+			httpError(w, http.StatusBadRequest, errRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			v, err := s.DB.GetBytes([]byte(key))
+			if err != nil {
+				httpError(w, 0, err)
+				return
+			}
+			if ttl := s.DB.TTL(key); ttl > 0 {
+				w.Header().Set("X-TTL", strconv.FormatInt(ttl, 10))
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(v)
+		case http.MethodPut:
+			v, err := readBody(w, r, maxBodySize)
+			if err != nil {
+				httpError(w, http.StatusBadRequest, err)
+				return
+			}
+			ttl, _ := strconv.Atoi(r.URL.Query().Get("ttl"))
+			httpResult(w, nil, s.Set([]byte(key), v, ttl))
+		case http.MethodPost:
+			by, err := strconv.ParseInt(r.URL.Query().Get("incr"), 10, 64)
+			if err != nil {
+				httpError(w, http.StatusBadRequest, err)
+				return
+			}
+			n, err := s.Incr(key, by)
+			httpResult(w, n, err)
+		case http.MethodDelete:
+			httpResult(w, nil, s.Del([]string{key}))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/kv", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		if limit <= 0 {
+			limit = 100
+		}
+		reverse, _ := strconv.ParseBool(q.Get("reverse"))
+		it := s.DB.Scan(q.Get("start"), q.Get("end"), limit, reverse)
+		if prefix := q.Get("prefix"); prefix != "" {
+			_ = it.Close()
+			it = s.DB.ScanPrefix(prefix, limit, reverse)
+		}
+		defer func() { _ = it.Close() }()
+		pairs := make([]httpPair, 0, limit)
+		for it.Next() {
+			pair := httpPair{Key: string(it.Key()), Value: string(it.Value())}
+			if ttl := it.TTL(); ttl > 0 {
+				pair.TTL = int(ttl)
+			}
+			pairs = append(pairs, pair)
+		}
+		httpResult(w, pairs, it.Err())
+	})
+
+	mux.HandleFunc("/mget", func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		if err := readJSON(w, r, maxBodySize, &keys); err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		values, result := s.DB.MGet(keys), make(map[string]string, len(keys))
+		for i, k := range keys {
+			if i < len(values) && values[i] != "" {
+				result[k] = values[i]
+			}
+		}
+		httpResult(w, result, nil)
+	})
+
+	mux.HandleFunc("/mset", func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]string
+		if err := readJSON(w, r, maxBodySize, &data); err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		httpResult(w, nil, s.MSet(data))
+	})
+
+	mux.HandleFunc("/batch", func(w http.ResponseWriter, r *http.Request) {
+		var pairs []httpPair
+		if err := readJSON(w, r, maxBodySize, &pairs); err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		ops := make([]walOp, len(pairs))
+		for i, p := range pairs {
+			ops[i] = walOp{Del: p.Del, Key: []byte(p.Key), Value: []byte(p.Value)}
+			if p.TTL > 0 && !p.Del {
+				ops[i].ExpiresAt = time.Now().Add(time.Duration(p.TTL) * time.Second).UnixNano()
+			}
+		}
+		httpResult(w, nil, s.write(ops))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		leader, role := s.Leader(), "leader"
+		if leader != "" {
+			role = "follower"
+		}
+		httpResult(w, map[string]interface{}{"role": role, "leader": leader, "seq": s.WAL.Seq(), "size": s.DB.Size()}, nil)
+	})
+
+	mux.HandleFunc("/admin/promote", httpAdmin(s, func(w http.ResponseWriter, r *http.Request) {
+		s.Promote()
+		httpResult(w, nil, nil)
+	}))
+
+	mux.HandleFunc("/admin/gc", httpAdmin(s, func(w http.ResponseWriter, r *http.Request) {
+		httpResult(w, nil, s.DB.GC())
+	}))
+
+	mux.HandleFunc("/admin/snapshot", httpAdmin(s, func(w http.ResponseWriter, r *http.Request) {
+		httpResult(w, nil, s.Snapshot())
+	}))
+
+	return mux
+}
+
+// httpAdmin wraps an admin handler, which accepts the authorized POST requests only.
+func httpAdmin(s *Server, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.Authorized(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			httpError(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// httpPair a pair of the scan and the batch.
+type httpPair struct {
+	Del   bool   `json:"del,omitempty"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   int    `json:"ttl,omitempty"`
+}
+
+// readBody reads the request body up to the maxBodySize.
+func readBody(w http.ResponseWriter, r *http.Request, maxBodySize int64) ([]byte, error) {
+	defer func() { _ = r.Body.Close() }()
+	return ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+}
+
+// readJSON decodes the JSON request body up to the maxBodySize.
+func readJSON(w http.ResponseWriter, r *http.Request, maxBodySize int64, v interface{}) error {
+	defer func() { _ = r.Body.Close() }()
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v)
+}
+
+func httpResult(w http.ResponseWriter, result interface{}, err error) {
+	if err != nil {
+		httpError(w, 0, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if result == nil {
+		result = map[string]bool{"ok": true}
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// httpError writes the error, the status is 404 for not found, 403 for read only, otherwise 500.
+func httpError(w http.ResponseWriter, status int, err error) {
+	if status == 0 {
+		switch {
+		case kv.IsNotFound(err):
+			status = http.StatusNotFound
+		case err == errReadOnly:
+			status = http.StatusForbidden
+		default:
+			status = http.StatusInternalServerError
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
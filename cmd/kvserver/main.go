@@ -0,0 +1,43 @@
+///go get github.com/angenalZZZ/gofunc/cmd/kvserver
+///go build -ldflags "-s -w" -o A:/test/cmd/kvserver/kvserver.exe ./cmd/kvserver
+///start A:/test/cmd/kvserver/kvserver.exe -c kvserver.yaml
+///start A:/test/cmd/kvserver/kvserver.exe -c kvserver.yaml -tcp 127.0.0.1:7071 -wal follower.wal -leader 127.0.0.1:7070
+
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/angenalZZZ/gofunc/f"
+)
+
+func main() {
+	// Your Arguments.
+	initArgs()
+	if len(os.Args) < 2 {
+		flag.Usage()
+		return
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(runtime.NumCPU()))
+
+	// Check Arguments And Init Config.
+	checkArgs()
+
+	// Start the tcp and http servers.
+	runServer()
+
+	// Pass the signals you want to end your application.
+	death := f.NewDeath(syscall.SIGINT, syscall.SIGTERM)
+	// When you want to block for shutdown signals.
+	death.WaitForDeathWithFunc(func() {
+		if httpServer != nil {
+			_ = httpServer.Close()
+		}
+		tcpService.Shutdown()
+		kvServer.Close()
+	})
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/kv"
+	"github.com/angenalZZZ/gofunc/log"
+)
+
+var (
+	errReadOnly     = errors.New("[kvserver] the follower is read only")
+	errRequest      = errors.New("[kvserver] invalid request")
+	errUnauthorized = errors.New("[kvserver] unauthorized")
+)
+
+// snapshotBatch the number of pairs in a frame of a snapshot.
+const snapshotBatch = 1000
+
+// Server serves a kv backend, the writes of the leader are logged to the WAL and replicated to the followers
+// asynchronously. A follower serves the reads, and it can be promoted to the leader manually.
+// The WAL is compacted to a snapshot of the database when it's larger than MaxWalSize.
+type Server struct {
+	DB  kv.KV
+	WAL *WAL
+	Log *log.Logger
+	// Token authorizes the admin requests and the replication when it's not empty, the followers send it to the leader.
+	Token string
+	// MaxWalSize the size of the WAL in bytes to compact it, 0 never.
+	MaxWalSize int64
+	// MaxBodySize the max size of a request body of HTTP in bytes, the max size of a WAL frame by default.
+	MaxBodySize int64
+
+	mu         sync.Mutex // serializes the writes and the WAL
+	leader     string     // the address of the leader when following
+	stop       chan struct{}
+	compacting int32
+	walErr     error // the writes are rejected after an append to the WAL fails
+}
+
+// NewServer creates a leader of the kv backend.
+func NewServer(db kv.KV, wal *WAL, logger *log.Logger) *Server {
+	if logger == nil {
+		logger = log.InitConsole("15:04:05.000", false)
+	}
+	return &Server{DB: db, WAL: wal, Log: logger}
+}
+
+// Leader gets the address of the leader, empty if it's the leader.
+func (s *Server) Leader() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leader
+}
+
+// Follow replicates the writes from the leader, the server becomes a read only follower.
+func (s *Server) Follow(leader string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+	}
+	s.leader, s.stop = leader, make(chan struct{})
+	go s.follow(leader, s.stop)
+}
+
+// Promote stops following, the follower becomes a leader.
+func (s *Server) Promote() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	if s.leader != "" {
+		s.Log.Info().Msgf("[kvserver] promoted to leader at seq %d, stopped following %s", s.WAL.Seq(), s.leader)
+		s.leader = ""
+	}
+}
+
+// Close stops following, and closes the WAL and the database.
+func (s *Server) Close() {
+	s.Promote()
+	_ = s.WAL.Close()
+	_ = s.DB.Close()
+}
+
+func (s *Server) follow(leader string, stop chan struct{}) {
+	for {
+		err := s.replicate(leader, stop)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+		s.Log.Error().Msgf("[kvserver] replicate from %s > %v", leader, err)
+	}
+}
+
+// replicate streams the WAL entries after the last sequence from the leader.
+func (s *Server) replicate(leader string, stop chan struct{}) error {
+	nc, err := net.DialTimeout("tcp", leader, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		_ = nc.Close()
+	}()
+
+	if err = kv.WriteRemote(nc, kv.RemoteReplicate, strconv.AppendUint(nil, s.WAL.Seq(), 10), []byte(s.Token)); err != nil {
+		return err
+	}
+	r, loading := bufio.NewReader(nc), false
+	for {
+		status, fields, err := kv.ReadRemote(r)
+		if err != nil {
+			return err
+		}
+		if status != kv.RemoteOK {
+			return fmt.Errorf("[kvserver] leader error: %s", bytes.Join(fields, nil))
+		}
+		if len(fields) == 0 {
+			continue // the ack
+		}
+		seq, ops, err := decodeWalFrame(fields[0])
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.leader != leader {
+			s.mu.Unlock()
+			return nil
+		}
+		switch {
+		case len(ops) > 0 && ops[0].Mark == walBegin:
+			loading = true
+			s.Log.Info().Msgf("[kvserver] loading the snapshot of seq %d from %s", seq, leader)
+			err = s.clear()
+		case len(ops) > 0 && ops[0].Mark == walEnd:
+			loading = false
+			err = s.WAL.Compact(seq, s.dump)
+		case loading:
+			err = s.applyDB(ops)
+		default:
+			err = s.apply(seq, ops)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// write applies the ops of a client to the database and the WAL.
+func (s *Server) write(ops []walOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leader != "" {
+		return errReadOnly
+	}
+	return s.apply(0, ops)
+}
+
+// apply applies the ops to the database in a batch, and appends them to the WAL on success, the mu must be locked.
+// The database is ahead of the WAL and the followers after an append fails, the writes are rejected since.
+func (s *Server) apply(seq uint64, ops []walOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if s.walErr != nil {
+		return s.walErr
+	}
+	if err := s.applyDB(ops); err != nil {
+		return err
+	}
+	if _, err := s.WAL.Append(seq, ops); err != nil {
+		s.walErr = fmt.Errorf("[kvserver] the writes are rejected, the wal failed: %v", err)
+		s.Log.Error().Msgf("%v", s.walErr)
+		return s.walErr
+	}
+	if s.MaxWalSize > 0 && s.WAL.Size() > s.MaxWalSize && atomic.CompareAndSwapInt32(&s.compacting, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&s.compacting, 0)
+			if err := s.Snapshot(); err != nil {
+				s.Log.Error().Msgf("[kvserver] snapshot > %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// applyDB applies the ops to the database in a batch.
+func (s *Server) applyDB(ops []walOp) error {
+	b, err := s.DB.Batch()
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if ttl := op.ttl(); op.Del || ttl < 0 {
+			err = b.Del(string(op.Key))
+		} else {
+			err = b.SetBytes(op.Key, op.Value, ttl)
+		}
+		if err != nil {
+			b.Discard()
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+// Snapshot writes a snapshot of the database, and removes the entries of the WAL before it.
+func (s *Server) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.WAL.Seq()
+	if err := s.WAL.Compact(seq, s.dump); err != nil {
+		return err
+	}
+	s.Log.Info().Msgf("[kvserver] snapshot of seq %d", seq)
+	return nil
+}
+
+// dump emits the pairs of the database in batches, the mu must be locked.
+func (s *Server) dump(emit func(ops []walOp) error) error {
+	it := s.DB.Scan("", "", 0)
+	defer func() { _ = it.Close() }()
+	ops := make([]walOp, 0, snapshotBatch)
+	for it.Next() {
+		op := walOp{Key: append([]byte{}, it.Key()...), Value: append([]byte{}, it.Value()...)}
+		if ttl := it.TTL(); ttl > 0 {
+			op.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+		}
+		if ops = append(ops, op); len(ops) == snapshotBatch {
+			if err := emit(ops); err != nil {
+				return err
+			}
+			ops = ops[:0]
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if len(ops) > 0 {
+		return emit(ops)
+	}
+	return nil
+}
+
+// clear deletes all the keys of the database before loading a snapshot, the mu must be locked.
+func (s *Server) clear() error {
+	keys := s.DB.Keys()
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > snapshotBatch {
+			n = snapshotBatch
+		}
+		if err := s.DB.Del(keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// Authorized reports whether the token of a request is the Token.
+func (s *Server) Authorized(token string) bool {
+	return s.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+// Set sets a key with the specified value and optional ttl.seconds
+func (s *Server) Set(k, v []byte, ttl int) error {
+	op := walOp{Key: k, Value: v}
+	if ttl > 0 {
+		op.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+	}
+	return s.write([]walOp{op})
+}
+
+// Incr increment the key by the specified value, the ttl of the key is kept.
+func (s *Server) Incr(k string, by int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leader != "" {
+		return 0, errReadOnly
+	}
+	v, _ := s.DB.Get(k)
+	n, _ := strconv.ParseInt(v, 10, 64)
+	n += by
+	op := walOp{Key: []byte(k), Value: strconv.AppendInt(nil, n, 10)}
+	if ttl := s.DB.TTL(k); ttl > 0 {
+		op.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+	}
+	return n, s.apply(0, []walOp{op})
+}
+
+// MSet sets multiple key-value pairs.
+func (s *Server) MSet(data map[string]string) error {
+	ops := make([]walOp, 0, len(data))
+	for k, v := range data {
+		ops = append(ops, walOp{Key: []byte(k), Value: []byte(v)})
+	}
+	return s.write(ops)
+}
+
+// Del removes key(s) from the store.
+func (s *Server) Del(keys []string) error {
+	ops := make([]walOp, 0, len(keys))
+	for _, k := range keys {
+		ops = append(ops, walOp{Del: true, Key: []byte(k)})
+	}
+	return s.write(ops)
+}
+
+// Handle handles a request of the binary protocol, returns the response.
+func (s *Server) Handle(op byte, fields [][]byte) []byte {
+	result, err := s.handle(op, fields)
+	if err != nil {
+		if kv.IsNotFound(err) {
+			return kv.EncodeRemote(kv.RemoteNotFound)
+		}
+		return kv.EncodeRemote(kv.RemoteErr, []byte(err.Error()))
+	}
+	return kv.EncodeRemote(kv.RemoteOK, result...)
+}
+
+func (s *Server) handle(op byte, fields [][]byte) ([][]byte, error) {
+	switch op {
+	case kv.RemotePing:
+		return nil, nil
+	case kv.RemoteSize:
+		return [][]byte{strconv.AppendInt(nil, s.DB.Size(), 10)}, nil
+	case kv.RemoteIncr:
+		if len(fields) != 2 {
+			return nil, errRequest
+		}
+		by, _ := strconv.ParseInt(string(fields[1]), 10, 64)
+		n, err := s.Incr(string(fields[0]), by)
+		return [][]byte{strconv.AppendInt(nil, n, 10)}, err
+	case kv.RemoteSet:
+		if len(fields) != 3 {
+			return nil, errRequest
+		}
+		ttl, _ := strconv.Atoi(string(fields[2]))
+		return nil, s.Set(fields[0], fields[1], ttl)
+	case kv.RemoteMSet:
+		if len(fields)%2 != 0 {
+			return nil, errRequest
+		}
+		data := make(map[string]string, len(fields)/2)
+		for i := 0; i < len(fields); i += 2 {
+			data[string(fields[i])] = string(fields[i+1])
+		}
+		return nil, s.MSet(data)
+	case kv.RemoteGet:
+		if len(fields) != 1 {
+			return nil, errRequest
+		}
+		v, err := s.DB.GetBytes(fields[0])
+		return [][]byte{v}, err
+	case kv.RemoteMGet:
+		values := s.DB.MGet(stringFields(fields))
+		result := make([][]byte, len(values))
+		for i, v := range values {
+			result[i] = []byte(v)
+		}
+		return result, nil
+	case kv.RemoteTTL:
+		if len(fields) != 1 {
+			return nil, errRequest
+		}
+		return [][]byte{strconv.AppendInt(nil, s.DB.TTL(string(fields[0])), 10)}, nil
+	case kv.RemoteDel:
+		return nil, s.Del(stringFields(fields))
+	case kv.RemoteKeys:
+		keys := s.DB.Keys(stringFields(fields)...)
+		result := make([][]byte, len(keys))
+		for i, k := range keys {
+			result[i] = []byte(k)
+		}
+		return result, nil
+	case kv.RemoteGC:
+		return nil, s.DB.GC()
+	case kv.RemoteScan:
+		if len(fields) != 5 {
+			return nil, errRequest
+		}
+		size, _ := strconv.Atoi(string(fields[2]))
+		return s.scanPage(fields[0], fields[1], size, len(fields[3]) > 0, fields[4])
+	case kv.RemoteBatch:
+		if len(fields)%4 != 0 {
+			return nil, errRequest
+		}
+		ops := make([]walOp, 0, len(fields)/4)
+		for i := 0; i < len(fields); i += 4 {
+			op := walOp{Del: string(fields[i]) == "d", Key: fields[i+1], Value: fields[i+2]}
+			if ttl, _ := strconv.Atoi(string(fields[i+3])); ttl > 0 && !op.Del {
+				op.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+			}
+			ops = append(ops, op)
+		}
+		return nil, s.write(ops)
+	}
+	return nil, fmt.Errorf("[kvserver] unknown op %d", op)
+}
+
+// scanPage reads a page of a scan after the last key: key, value, ttl..., done
+func (s *Server) scanPage(start, end []byte, size int, reverse bool, last []byte) ([][]byte, error) {
+	if size <= 0 {
+		size = 256
+	}
+	if len(last) > 0 {
+		if reverse {
+			end = last
+		} else {
+			start = last
+		}
+	}
+	it := s.DB.Scan(string(start), string(end), size+1, reverse)
+	defer func() { _ = it.Close() }()
+	result, n := make([][]byte, 0, 3*size+1), 0
+	for n < size && it.Next() {
+		if !reverse && len(last) > 0 && bytes.Equal(it.Key(), last) {
+			continue
+		}
+		key, value := append([]byte{}, it.Key()...), append([]byte{}, it.Value()...)
+		result = append(result, key, value, strconv.AppendInt(nil, it.TTL(), 10))
+		n++
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	done := []byte{}
+	if n < size {
+		done = []byte{1}
+	}
+	return append(result, done), nil
+}
+
+func stringFields(fields [][]byte) []string {
+	keys := make([]string, len(fields))
+	for i, field := range fields {
+		keys[i] = string(field)
+	}
+	return keys
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/kv"
+	"github.com/angenalZZZ/gofunc/net"
+)
+
+// tcpServer serves the binary protocol of kv.Remote on the net event loop.
+type tcpServer struct {
+	*net.EventServer
+	*Server
+	addr     string
+	shutdown int32
+	ready    chan struct{}
+	once     sync.Once
+}
+
+// tcpConn the context of a connection, stops the watch or the replication when it's closed.
+type tcpConn struct {
+	stop   chan struct{}
+	cancel func()
+}
+
+func newTcpServer(s *Server, addr string) *tcpServer {
+	return &tcpServer{EventServer: new(net.EventServer), Server: s, addr: addr, ready: make(chan struct{})}
+}
+
+// Serve blocks until the server is shut down.
+func (ts *tcpServer) Serve() error {
+	codec := remoteCodec{net.NewLengthFieldBasedFrameCodec(
+		net.EncoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 4},
+		net.DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 4, InitialBytesToStrip: 4})}
+	err := net.Serve(ts, "tcp://"+ts.addr,
+		net.WithMulticore(true),
+		net.WithTicker(true),
+		net.WithCodec(codec))
+	ts.once.Do(func() { close(ts.ready) })
+	return err
+}
+
+// remoteCodec decodes the frames of the binary protocol, a frame larger than kv.RemoteMaxFrame
+// is decoded as an empty frame before it's received, which is rejected and closes the connection.
+type remoteCodec struct {
+	*net.LengthFieldBasedFrameCodec
+}
+
+// Decode decodes a frame.
+func (cc remoteCodec) Decode(c net.Conn) ([]byte, error) {
+	if buf := c.Read(); len(buf) >= 4 && binary.BigEndian.Uint32(buf) > kv.RemoteMaxFrame {
+		c.ShiftN(4)
+		return []byte{}, nil
+	}
+	return cc.LengthFieldBasedFrameCodec.Decode(c)
+}
+
+// Shutdown stops the server on the next tick.
+func (ts *tcpServer) Shutdown() {
+	atomic.StoreInt32(&ts.shutdown, 1)
+}
+
+// OnInitComplete fires when the server is ready for accepting connections.
+func (ts *tcpServer) OnInitComplete(server net.Server) (action net.Action) {
+	ts.Log.Info().Msgf("[kvserver] tcp listening on %s", server.Addr.String())
+	ts.once.Do(func() { close(ts.ready) })
+	return
+}
+
+// OnOpened fires when a new connection has been opened.
+func (ts *tcpServer) OnOpened(c net.Conn) (out []byte, action net.Action) {
+	c.SetContext(&tcpConn{stop: make(chan struct{})})
+	return
+}
+
+// OnClosed fires when a connection has been closed.
+func (ts *tcpServer) OnClosed(c net.Conn, _ error) (action net.Action) {
+	if ctx, ok := c.Context().(*tcpConn); ok {
+		close(ctx.stop)
+		if ctx.cancel != nil {
+			ctx.cancel()
+		}
+	}
+	return
+}
+
+// React fires when a connection sends a request.
+func (ts *tcpServer) React(frame []byte, c net.Conn) (out []byte, action net.Action) {
+	op, fields, err := kv.DecodeRemote(append([]byte{}, frame...))
+	if err != nil {
+		return kv.EncodeRemote(kv.RemoteErr, []byte(err.Error())), net.Close
+	}
+	ctx, _ := c.Context().(*tcpConn)
+
+	switch op {
+	case kv.RemoteWatch:
+		if ctx == nil || ctx.cancel != nil || len(fields) != 1 {
+			return kv.EncodeRemote(kv.RemoteErr, []byte(errRequest.Error())), net.Close
+		}
+		events, cancel := ts.DB.Watch(string(fields[0]))
+		ctx.cancel = cancel
+		go func() {
+			for e := range events {
+				if c.AsyncWrite(kv.EncodeRemote(kv.RemoteOK, []byte{byte(e.Type)}, e.Key, e.Value)) != nil {
+					return
+				}
+			}
+		}()
+		return kv.EncodeRemote(kv.RemoteOK), net.None
+
+	case kv.RemoteReplicate:
+		if ctx == nil || len(fields) < 1 || len(fields) > 2 {
+			return kv.EncodeRemote(kv.RemoteErr, []byte(errRequest.Error())), net.Close
+		}
+		if token := fields[len(fields)-1]; !ts.Authorized(string(token)) || len(fields) == 1 && ts.Token != "" {
+			ts.Log.Error().Msgf("[kvserver] replicate to %s > %v", c.RemoteAddr(), errUnauthorized)
+			return kv.EncodeRemote(kv.RemoteErr, []byte(errUnauthorized.Error())), net.Close
+		}
+		from, _ := strconv.ParseUint(string(fields[0]), 10, 64)
+		go func() {
+			err := ts.WAL.Stream(from, ctx.stop, func(frame []byte) error {
+				return c.AsyncWrite(kv.EncodeRemote(kv.RemoteOK, frame))
+			})
+			if err != nil {
+				ts.Log.Error().Msgf("[kvserver] replicate to %s > %v", c.RemoteAddr(), err)
+				_ = c.AsyncWrite(kv.EncodeRemote(kv.RemoteErr, []byte(err.Error())))
+			}
+		}()
+		ts.Log.Info().Msgf("[kvserver] replicate to %s from seq %d", c.RemoteAddr(), from)
+		return kv.EncodeRemote(kv.RemoteOK), net.None
+	}
+
+	return ts.Handle(op, fields), net.None
+}
+
+// Tick shuts down the server when it's requested.
+func (ts *tcpServer) Tick() (delay time.Duration, action net.Action) {
+	if atomic.LoadInt32(&ts.shutdown) == 1 {
+		action = net.Shutdown
+	}
+	delay = 100 * time.Millisecond
+	return
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// walOp a write of the leader, replicated to the followers.
+type walOp struct {
+	Del       bool
+	Key       []byte
+	Value     []byte
+	ExpiresAt int64 // unix nano, 0 means no expiration
+	Mark      byte  // walBegin or walEnd of a snapshot, the other fields are empty
+}
+
+// the marks of the first and the last frames of a snapshot.
+const (
+	walBegin byte = 'b'
+	walEnd   byte = 'e'
+)
+
+// maxWalFrame the max length of a frame, a larger length field is invalid.
+const maxWalFrame = 64 << 20
+
+// ttl gets the time.seconds to live of a put (rounded up), -1 if it's expired.
+func (op *walOp) ttl() int {
+	if op.ExpiresAt <= 0 {
+		return 0
+	}
+	d := op.ExpiresAt - time.Now().UnixNano()
+	if d <= 0 {
+		return -1
+	}
+	return int((d + int64(time.Second) - 1) / int64(time.Second))
+}
+
+var errWalFrame = errors.New("[kvserver] invalid wal frame")
+
+// WAL the write-ahead log of the leader, the entries are streamed to the followers.
+//
+// The file is a sequence of frames: crc32(4) length(4) seq(8) ops..., an op is:
+// kind(1) key(uvarint length) value(uvarint length) expiresAt(8), a torn frame at the end is truncated on open.
+//
+// Compact writes a snapshot of the database to the file path.snap, which is the frames of the snapshot seq
+// between a walBegin and a walEnd frame, and removes the frames of the WAL up to the seq.
+// The followers behind the snapshot, or new, receive the snapshot before the frames after it.
+type WAL struct {
+	path    string
+	mu      sync.Mutex
+	file    *os.File
+	seq     uint64
+	size    int64
+	snap    bool   // a snapshot exists
+	snapSeq uint64 // the seq of the snapshot
+	gen     int    // the generation of the file, increased when it's compacted
+	notify  chan struct{}
+}
+
+// OpenWAL opens or creates the write-ahead log file.
+func OpenWAL(path string) (*WAL, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{path: path, file: file, notify: make(chan struct{})}
+
+	if snap, err := os.Open(w.snapPath()); err == nil {
+		frame, err := readWalFrame(bufio.NewReader(snap))
+		_ = snap.Close()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		w.snap, w.snapSeq, w.seq = true, walSeq(frame), walSeq(frame)
+	}
+
+	r := bufio.NewReader(file)
+	for {
+		frame, err := readWalFrame(r)
+		if err != nil {
+			break
+		}
+		w.seq, w.size = walSeq(frame), w.size+int64(len(frame))
+	}
+	if err = file.Truncate(w.size); err == nil {
+		_, err = file.Seek(w.size, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Seq gets the sequence of the last entry.
+func (w *WAL) Seq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// Size gets the size of the file.
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// HasSnapshot reports whether a snapshot exists.
+func (w *WAL) HasSnapshot() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.snap
+}
+
+// Compact writes the snapshot of the seq with the ops of dump, and removes the frames up to the seq.
+// The writes must be stopped until it returns, so the snapshot is the database at the seq.
+func (w *WAL) Compact(seq uint64, dump func(emit func(ops []walOp) error) error) error {
+	tmp := w.snapPath() + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(file)
+	_, err = bw.Write(encodeWalFrame(seq, []walOp{{Mark: walBegin}}))
+	if err == nil {
+		err = dump(func(ops []walOp) error {
+			_, err := bw.Write(encodeWalFrame(seq, ops))
+			return err
+		})
+	}
+	if err == nil {
+		_, err = bw.Write(encodeWalFrame(seq, []walOp{{Mark: walEnd}}))
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp, w.snapPath())
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err = w.truncate(seq); err != nil {
+		return err
+	}
+	w.snap, w.snapSeq = true, seq
+	if w.seq < seq {
+		w.seq = seq
+	}
+	w.gen++
+	close(w.notify)
+	w.notify = make(chan struct{})
+	return nil
+}
+
+// truncate rewrites the file with the frames after the seq, the mu must be locked.
+func (w *WAL) truncate(seq uint64) error {
+	tmp := w.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	var size int64
+	r := bufio.NewReader(io.NewSectionReader(w.file, 0, w.size))
+	for err == nil {
+		var frame []byte
+		if frame, err = readWalFrame(r); err == nil && walSeq(frame) > seq {
+			_, err = file.Write(frame)
+			size += int64(len(frame))
+		}
+	}
+	if err == io.EOF {
+		err = file.Sync()
+	}
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		_ = w.file.Close()
+		err = os.Rename(tmp, w.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if w.file, err = os.OpenFile(w.path, os.O_RDWR, 0644); err == nil {
+		_, err = w.file.Seek(size, io.SeekStart)
+	}
+	w.size = size
+	return err
+}
+
+func (w *WAL) snapPath() string {
+	return w.path + ".snap"
+}
+
+// Append appends an entry of the ops, the seq is the next sequence when it's 0.
+func (w *WAL) Append(seq uint64, ops []walOp) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq == 0 {
+		seq = w.seq + 1
+	}
+	frame := encodeWalFrame(seq, ops)
+	if _, err := w.file.Write(frame); err != nil {
+		return 0, err
+	}
+	w.seq, w.size = seq, w.size+int64(len(frame))
+	close(w.notify)
+	w.notify = make(chan struct{})
+	return seq, nil
+}
+
+// Stream calls fn with the frames after the sequence, and waits for the new frames until stop is closed.
+// The snapshot is streamed first if the sequence is behind it, or 0.
+func (w *WAL) Stream(from uint64, stop <-chan struct{}, fn func(frame []byte) error) error {
+	var (
+		file   *os.File
+		offset int64
+		gen    = -1
+	)
+	defer func() {
+		if file != nil {
+			_ = file.Close()
+		}
+	}()
+
+	for first := true; ; first = false {
+		w.mu.Lock()
+		size, notify, snap, snapSeq := w.size, w.notify, w.snap, w.snapSeq
+		// reopen the compacted file
+		if gen != w.gen {
+			if file != nil {
+				_ = file.Close()
+			}
+			var err error
+			if file, err = os.Open(w.path); err != nil {
+				w.mu.Unlock()
+				return err
+			}
+			offset, gen = 0, w.gen
+		}
+		w.mu.Unlock()
+
+		if snap && (from < snapSeq || from == 0 && first) {
+			if err := w.streamSnapshot(fn); err != nil {
+				return err
+			}
+			from = snapSeq
+		}
+
+		if offset < size {
+			r := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+			for offset < size {
+				frame, err := readWalFrame(r)
+				if err != nil {
+					return err
+				}
+				offset += int64(len(frame))
+				if seq := walSeq(frame); seq > from {
+					if err = fn(frame); err != nil {
+						return err
+					}
+					from = seq
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-notify:
+		}
+	}
+}
+
+// streamSnapshot calls fn with the frames of the snapshot.
+func (w *WAL) streamSnapshot(fn func(frame []byte) error) error {
+	file, err := os.Open(w.snapPath())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	r := bufio.NewReader(file)
+	for {
+		frame, err := readWalFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the file.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+func encodeWalFrame(seq uint64, ops []walOp) []byte {
+	buf := make([]byte, 16, 16+len(ops)*32)
+	binary.BigEndian.PutUint64(buf[8:16], seq)
+	var l [binary.MaxVarintLen64]byte
+	for _, op := range ops {
+		kind := byte('s')
+		if op.Del {
+			kind = 'd'
+		} else if op.Mark != 0 {
+			kind = op.Mark
+		}
+		buf = append(buf, kind)
+		buf = append(append(buf, l[:binary.PutUvarint(l[:], uint64(len(op.Key)))]...), op.Key...)
+		buf = append(append(buf, l[:binary.PutUvarint(l[:], uint64(len(op.Value)))]...), op.Value...)
+		var exp [8]byte
+		binary.BigEndian.PutUint64(exp[:], uint64(op.ExpiresAt))
+		buf = append(buf, exp[:]...)
+	}
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(buf)-8))
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// decodeWalFrame decodes a frame: seq and ops.
+func decodeWalFrame(frame []byte) (uint64, []walOp, error) {
+	if len(frame) < 16 || int(binary.BigEndian.Uint32(frame[4:8]))+8 != len(frame) ||
+		crc32.ChecksumIEEE(frame[4:]) != binary.BigEndian.Uint32(frame[0:4]) {
+		return 0, nil, errWalFrame
+	}
+	var ops []walOp
+	for p := frame[16:]; len(p) > 0; {
+		op := walOp{Del: p[0] == 'd'}
+		if p[0] == walBegin || p[0] == walEnd {
+			op.Mark = p[0]
+		}
+		p = p[1:]
+		for _, field := range []*[]byte{&op.Key, &op.Value} {
+			l, n := binary.Uvarint(p)
+			if n <= 0 || uint64(len(p)-n) < l {
+				return 0, nil, errWalFrame
+			}
+			*field, p = append([]byte{}, p[n:n+int(l)]...), p[n+int(l):]
+		}
+		if len(p) < 8 {
+			return 0, nil, errWalFrame
+		}
+		op.ExpiresAt, p = int64(binary.BigEndian.Uint64(p[:8])), p[8:]
+		ops = append(ops, op)
+	}
+	return walSeq(frame), ops, nil
+}
+
+func readWalFrame(r io.Reader) ([]byte, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[4:8])
+	if n < 8 || n > maxWalFrame {
+		return nil, errWalFrame
+	}
+	frame := make([]byte, 8+n)
+	copy(frame, head)
+	if _, err := io.ReadFull(r, frame[8:]); err != nil {
+		return nil, err
+	}
+	if len(frame) < 16 || crc32.ChecksumIEEE(frame[4:]) != binary.BigEndian.Uint32(frame[0:4]) {
+		return nil, errWalFrame
+	}
+	return frame, nil
+}
+
+func walSeq(frame []byte) uint64 {
+	return binary.BigEndian.Uint64(frame[8:16])
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"io/ioutil"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/kv"
+)
+
+// testServe serves a server with the optional token of the replication.
+func testServe(t *testing.T, dir, name string, token ...string) (*Server, *tcpServer) {
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	db, err := kv.Open("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal, err := OpenWAL(filepath.Join(dir, name+".wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(db, wal, nil)
+	if len(token) > 0 {
+		s.Token = token[0]
+	}
+	ts := newTcpServer(s, addr)
+	go func() { _ = ts.Serve() }()
+	<-ts.ready
+	return s, ts
+}
+
+func testEventually(t *testing.T, fn func() bool) {
+	for i := 0; i < 100; i++ {
+		if fn() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+func TestReplication(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvserver")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	leader, lt := testServe(t, dir, "leader")
+	defer func() { lt.Shutdown(); leader.Close() }()
+
+	client, err := kv.NewRemote(lt.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	events, cancel := client.Watch("a")
+	defer cancel()
+
+	if err = client.Set("a1", "v1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Incr("n", 2); err != nil || n != 2 {
+		t.Fatalf("incr %d %v", n, err)
+	}
+	b, _ := client.Batch()
+	_ = b.Set("a2", "v2", 60)
+	_ = b.Set("b1", "v3", 0)
+	_ = b.Del("a1")
+	if err = b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Get("a1"); err != kv.ErrNotFound {
+		t.Fatalf("get a deleted key: %v", err)
+	}
+	if ttl := client.TTL("a2"); ttl < 59 || ttl > 60 {
+		t.Fatalf("ttl %d", ttl)
+	}
+	var keys []string
+	for it := client.Scan("", "", 0); it.Next(); {
+		keys = append(keys, string(it.Key()))
+	}
+	if strings.Join(keys, ",") != "a2,b1,n" {
+		t.Fatalf("scan %v", keys)
+	}
+	for _, want := range []string{"put a1", "put a2", "delete a1"} {
+		select {
+		case e := <-events:
+			if got := e.Type.String() + " " + string(e.Key); got != want {
+				t.Fatalf("watch %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("watch %q timeout", want)
+		}
+	}
+
+	// The follower replicates the WAL of the leader, and rejects the writes.
+	follower, ft := testServe(t, dir, "follower")
+	defer func() { ft.Shutdown(); follower.Close() }()
+	follower.Follow(lt.addr)
+	testEventually(t, func() bool { return follower.WAL.Seq() == leader.WAL.Seq() })
+	if v, err := follower.DB.Get("b1"); err != nil || v != "v3" {
+		t.Fatalf("follower get %q %v", v, err)
+	}
+	_ = client.Set("c1", "v4", 0)
+	testEventually(t, func() bool { v, _ := follower.DB.Get("c1"); return v == "v4" })
+
+	remote, err := kv.NewRemote(ft.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = remote.Close() }()
+	if err = remote.Set("c2", "v5", 0); err == nil || !strings.Contains(err.Error(), "read only") {
+		t.Fatalf("follower write: %v", err)
+	}
+	if v, err := remote.Get("n"); err != nil || v != "2" {
+		t.Fatalf("follower read %q %v", v, err)
+	}
+
+	// The promoted follower accepts the writes, and stops replicating.
+	follower.Promote()
+	if err = remote.Set("c2", "v5", 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Set("c3", "v6", 0)
+	time.Sleep(100 * time.Millisecond)
+	if _, err = remote.Get("c3"); err != kv.ErrNotFound {
+		t.Fatalf("promoted follower replicated: %v", err)
+	}
+	if follower.WAL.Seq() != leader.WAL.Seq() {
+		t.Fatalf("seq %d, leader %d", follower.WAL.Seq(), leader.WAL.Seq())
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvserver")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db, _ := kv.Open("memory://")
+	wal, err := OpenWAL(filepath.Join(dir, "http.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(db, wal, nil)
+	s.MaxBodySize = 64
+	defer s.Close()
+	ts := httptest.NewServer(httpHandler(s))
+	defer ts.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = res.Body.Close() }()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+		result             string
+	}{
+		{"PUT", "/kv/k1", "v1", 200, `{"ok":true}`},
+		{"GET", "/kv/k1", "", 200, "v1"},
+		{"POST", "/kv/n?incr=3", "", 200, "3"},
+		{"POST", "/mset", `{"k2":"v2","p1":"v3"}`, 200, `{"ok":true}`},
+		{"POST", "/mget", `["k1","k2","k3"]`, 200, `{"k1":"v1","k2":"v2"}`},
+		{"POST", "/batch", `[{"key":"k3","value":"v4","ttl":60},{"del":true,"key":"k1"}]`, 200, `{"ok":true}`},
+		{"GET", "/kv/k1", "", 404, `{"error":"key not found"}`},
+		{"GET", "/kv?prefix=k", "", 200, `[{"key":"k2","value":"v2"},{"key":"k3","value":"v4","ttl":60}]`},
+		{"DELETE", "/kv/k2", "", 200, `{"ok":true}`},
+		{"GET", "/kv?start=k&end=p&reverse=true", "", 200, `[{"key":"n","value":"3"},{"key":"k3","value":"v4","ttl":60}]`},
+		{"GET", "/status", "", 200, `{"leader":"","role":"leader","seq":5,"size":10}`},
+		{"PUT", "/kv/big", strings.Repeat("v", 65), 400, `{"error":"http: request body too large"}`},
+		{"POST", "/mset", `{"big":"` + strings.Repeat("v", 65) + `"}`, 400, `{"error":"http: request body too large"}`},
+	} {
+		if status, result := do(c.method, c.path, c.body); status != c.status || result != c.result {
+			t.Fatalf("%s %s: %d %s", c.method, c.path, status, result)
+		}
+	}
+
+	s.Token = "secret"
+	if status, _ := do("POST", "/admin/gc", ""); status != http.StatusUnauthorized {
+		t.Fatalf("unauthorized admin: %d", status)
+	}
+	req, _ := http.NewRequest("POST", ts.URL+"/admin/snapshot", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("authorized admin: %v", err)
+	}
+
+	s.mu.Lock()
+	s.leader = "127.0.0.1:1"
+	s.mu.Unlock()
+	if status, _ := do("PUT", "/kv/k1", "v1"); status != http.StatusForbidden {
+		t.Fatalf("follower write: %d", status)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvserver")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	leader, lt := testServe(t, dir, "leader", "secret")
+	defer func() { lt.Shutdown(); leader.Close() }()
+
+	// the data saved before the WAL
+	_ = leader.DB.Set("k0", "v0", 0)
+	_ = leader.Set([]byte("k1"), []byte("v1"), 60)
+	_ = leader.Del([]string{"k1"})
+	_ = leader.Set([]byte("k2"), []byte("v2"), 60)
+	size := leader.WAL.Size()
+	if err := leader.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if leader.WAL.Size() != 0 || leader.WAL.Seq() != 3 || size == 0 {
+		t.Fatalf("wal size %d seq %d after snapshot", leader.WAL.Size(), leader.WAL.Seq())
+	}
+	_ = leader.Set([]byte("k3"), []byte("v3"), 0)
+	if n, err := leader.Incr("k2", 1); err != nil || n != 1 || leader.DB.TTL("k2") < 59 {
+		t.Fatalf("incr %d %v ttl %d", n, err, leader.DB.TTL("k2"))
+	}
+
+	// the follower with a wrong token is rejected
+	intruder, it := testServe(t, dir, "intruder", "wrong")
+	defer func() { it.Shutdown(); intruder.Close() }()
+	intruder.Follow(lt.addr)
+	time.Sleep(200 * time.Millisecond)
+	if intruder.WAL.Seq() != 0 {
+		t.Fatalf("unauthorized follower replicated to seq %d", intruder.WAL.Seq())
+	}
+
+	// the new follower loads the snapshot, then the entries after it
+	follower, ft := testServe(t, dir, "follower", "secret")
+	defer func() { ft.Shutdown(); follower.Close() }()
+	_ = follower.DB.Set("stale", "v", 0)
+	follower.Follow(lt.addr)
+	testEventually(t, func() bool { return follower.WAL.Seq() == leader.WAL.Seq() })
+	for k, want := range map[string]string{"k0": "v0", "k1": "", "k2": "1", "k3": "v3", "stale": ""} {
+		if v, _ := follower.DB.Get(k); v != want {
+			t.Fatalf("follower get %s %q, want %q", k, v, want)
+		}
+	}
+	if !follower.WAL.HasSnapshot() || follower.DB.TTL("k2") < 59 {
+		t.Fatalf("follower snapshot %v ttl %d", follower.WAL.HasSnapshot(), follower.DB.TTL("k2"))
+	}
+
+	// the WAL and the snapshot are reopened
+	follower.Promote()
+	wal, err := OpenWAL(filepath.Join(dir, "leader.wal"))
+	if err != nil || wal.Seq() != leader.WAL.Seq() || !wal.HasSnapshot() {
+		t.Fatalf("reopen wal %v", err)
+	}
+	_ = wal.Close()
+
+	// the length of a frame is limited
+	if _, err = readWalFrame(strings.NewReader("\x00\x00\x00\x00\xff\xff\xff\xff")); err != errWalFrame {
+		t.Fatalf("read a huge frame: %v", err)
+	}
+	if _, _, err = kv.ReadRemote(strings.NewReader("\xff\xff\xff\xff")); err == nil {
+		t.Fatal("read a huge remote frame")
+	}
+}
+
+func TestFrameLimit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvserver")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	s, ts := testServe(t, dir, "limit")
+	defer func() { ts.Shutdown(); s.Close() }()
+
+	// a huge frame is rejected before it's received, and the connection is closed
+	nc, err := stdnet.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = nc.Close() }()
+	_ = nc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = nc.Write([]byte("\xff\xff\xff\xff")); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, err := kv.ReadRemote(nc); err != nil || status != kv.RemoteErr {
+		t.Fatalf("huge frame: %d %v", status, err)
+	}
+	if _, _, err = kv.ReadRemote(nc); err == nil {
+		t.Fatal("the connection is not closed")
+	}
+}
+
+// testFailedDB a database of which the batches fail.
+type testFailedDB struct {
+	kv.KV
+}
+
+func (db testFailedDB) Batch() (kv.Batch, error) {
+	return nil, errRequest
+}
+
+func TestApplyFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kvserver")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db, _ := kv.Open("memory://")
+	wal, err := OpenWAL(filepath.Join(dir, "failure.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(testFailedDB{db}, wal, nil)
+	defer s.Close()
+
+	// the ops failed by the database are not appended to the WAL
+	if err = s.Set([]byte("k"), []byte("v"), 0); err != errRequest {
+		t.Fatalf("set: %v", err)
+	}
+	if seq := s.WAL.Seq(); seq != 0 {
+		t.Fatalf("the failed ops are appended to the wal: %d", seq)
+	}
+
+	// the writes are rejected after an append to the WAL fails
+	s.DB = db
+	_ = s.WAL.file.Close()
+	if err = s.Set([]byte("k"), []byte("v"), 0); err == nil || s.walErr == nil {
+		t.Fatalf("set with a closed wal: %v", err)
+	}
+	if err = s.Set([]byte("k2"), []byte("v"), 0); err != s.walErr {
+		t.Fatalf("set after the wal failed: %v", err)
+	}
+}
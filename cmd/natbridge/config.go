@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/configfile"
+	"github.com/angenalZZZ/gofunc/log"
+	"github.com/angenalZZZ/gofunc/rpc/bridge"
+	nat "github.com/angenalZZZ/gofunc/rpc/nats"
+)
+
+var (
+	configInfo *Config
+	configFile = "natbridge.yaml"
+	configMod  time.Time
+)
+
+// Config The Config Info For natbridge.yaml
+type Config struct {
+	Nats     *nat.Connection
+	Longpoll struct {
+		Addr string
+		Path string
+	}
+	Routes []*bridge.RouteConfig
+	Log    *log.Config
+}
+
+func initConfig() error {
+	configInfo = new(Config)
+
+	if isConfigMod() == false {
+		return os.ErrNotExist
+	}
+
+	if err := configfile.YamlTo(configFile, configInfo); err != nil {
+		return err
+	}
+
+	if configInfo.Nats == nil {
+		configInfo.Nats = new(nat.Connection)
+	}
+	if configInfo.Log == nil {
+		configInfo.Log = &log.Config{Writers: "stdout", Level: "info", TimeFormat: "15:04:05.000"}
+	}
+
+	return nil
+}
+
+func isConfigMod() bool {
+	if configFile == "" {
+		return false
+	}
+	info, err := os.Stat(configFile)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if t := info.ModTime(); t.Unix() != configMod.Unix() {
+		configMod = t
+		return true
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/angenalZZZ/gofunc/http/longpoll"
+	"github.com/angenalZZZ/gofunc/log"
+	"github.com/angenalZZZ/gofunc/rpc/bridge"
+	nat "github.com/angenalZZZ/gofunc/rpc/nats"
+)
+
+var (
+	flagConfig = flag.String("c", "natbridge.yaml", "sets config file")
+	flagAddr   = flag.String("a", "", "the NatS-Server address")
+	flagToken  = flag.String("token", "", "the NatS-Token auth string [required]")
+	flagCred   = flag.String("cred", "", "the NatS-Cred file")
+	flagCert   = flag.String("cert", "", "the NatS-TLS cert file")
+	flagKey    = flag.String("key", "", "the NatS-TLS key file")
+)
+
+var (
+	natBridge   *bridge.Bridge
+	lpManager   *longpoll.LongpollManager
+	routeConfig *bridge.Config
+)
+
+func initArgs() {
+	flag.Usage = func() {
+		fmt.Printf(" Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+}
+
+func checkArgs() {
+	if *flagConfig != "" {
+		configFile = *flagConfig
+	}
+
+	if err := initConfig(); err != nil {
+		panic(err)
+	}
+
+	if *flagAddr != "" {
+		configInfo.Nats.Addr = *flagAddr
+	}
+	if *flagToken != "" {
+		configInfo.Nats.Token = *flagToken
+	}
+	if *flagCred != "" {
+		configInfo.Nats.Cred = *flagCred
+	}
+	if *flagCert != "" {
+		configInfo.Nats.Cert = *flagCert
+	}
+	if *flagKey != "" {
+		configInfo.Nats.Key = *flagKey
+	}
+
+	if log.Log == nil {
+		log.Log = log.Init(configInfo.Log)
+	}
+	if nat.Log == nil {
+		nat.Log = log.Log
+	}
+	routeConfig = &bridge.Config{Routes: configInfo.Routes}
+	log.Log.Debug().Msgf("configuration complete")
+}
+
+func natClientConnect() {
+	var err error
+
+	// NatS
+	nat.Subject = "natbridge"
+	nat.Conn, err = nat.New("natbridge", configInfo.Nats.Addr, configInfo.Nats.Cred, configInfo.Nats.Token, configInfo.Nats.Cert, configInfo.Nats.Key)
+	if err != nil {
+		nat.Log.Error().Msgf("[nats] failed connect to server: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runLongpoll() {
+	if configInfo.Longpoll.Addr == "" {
+		return
+	}
+
+	var err error
+	lpManager, err = longpoll.StartLongpoll(longpoll.Options{})
+	if err != nil {
+		log.Log.Error().Msgf("[bridge] failed start longpoll: %v\n", err)
+		os.Exit(1)
+	}
+
+	path := configInfo.Longpoll.Path
+	if path == "" {
+		path = "/events"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, lpManager.SubscriptionHandler)
+	go func() {
+		if err := http.ListenAndServe(configInfo.Longpoll.Addr, mux); err != nil {
+			log.Log.Error().Msgf("[bridge] longpoll server stopped: %v\n", err)
+		}
+	}()
+	log.Log.Info().Msgf("[bridge] longpoll listening on %s%s", configInfo.Longpoll.Addr, path)
+}
+
+func runInit() {
+	var err error
+
+	natBridge, err = bridge.New(nat.Conn, routeConfig, lpManager)
+	if err != nil {
+		log.Log.Error().Msgf("%v\n", err)
+		os.Exit(1)
+	}
+	if err = natBridge.Start(); err != nil {
+		natBridge.Stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,49 @@
+///go get github.com/angenalZZZ/gofunc/cmd/natbridge
+///go build -ldflags "-s -w" -o A:/test/cmd/natbridge/natbridge.exe ./cmd/natbridge
+///start A:/test/cmd/natbridge/natbridge.exe -c natbridge.yaml
+
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/angenalZZZ/gofunc/f"
+	nat "github.com/angenalZZZ/gofunc/rpc/nats"
+)
+
+func main() {
+	// Your Arguments.
+	initArgs()
+	if len(os.Args) < 2 {
+		flag.Usage()
+		return
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(runtime.NumCPU()))
+
+	// Check Arguments And Init Config.
+	checkArgs()
+
+	// New Client Connect.
+	natClientConnect()
+
+	// Start the longpoll sinks.
+	runLongpoll()
+
+	// Init complete.
+	runInit()
+
+	// Pass the signals you want to end your application.
+	death := f.NewDeath(syscall.SIGINT, syscall.SIGTERM)
+	// When you want to block for shutdown signals.
+	death.WaitForDeathWithFunc(func() {
+		natBridge.Stop()
+		if lpManager != nil {
+			lpManager.Shutdown()
+		}
+		_ = nat.Conn.Drain()
+	})
+}
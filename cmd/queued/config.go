@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/configfile"
+	"github.com/angenalZZZ/gofunc/log"
+)
+
+var (
+	configInfo *Config
+	configFile = "queued.yaml"
+	configMod  time.Time
+)
+
+// Config The Config Info For queued.yaml
+type Config struct {
+	Data        string
+	Tcp         string
+	Http        string
+	MsgTimeout  time.Duration
+	MaxMsgSize  int
+	MaxBodySize int
+	Log         *log.Config
+}
+
+func initConfig() error {
+	configInfo = new(Config)
+
+	if isConfigMod() {
+		if err := configfile.YamlTo(configFile, configInfo); err != nil {
+			return err
+		}
+	}
+
+	if configInfo.Data == "" {
+		configInfo.Data = "data"
+	}
+	if configInfo.Tcp == "" {
+		configInfo.Tcp = "127.0.0.1:4150"
+	}
+	if configInfo.MsgTimeout <= 0 {
+		configInfo.MsgTimeout = time.Minute
+	}
+	if configInfo.MaxMsgSize <= 0 {
+		configInfo.MaxMsgSize = 1024 * 1024
+	}
+	if configInfo.MaxBodySize < configInfo.MaxMsgSize {
+		configInfo.MaxBodySize = 5 * configInfo.MaxMsgSize
+	}
+	if configInfo.Log == nil {
+		configInfo.Log = &log.Config{Writers: "stdout", Level: "info", TimeFormat: "15:04:05.000"}
+	}
+
+	return nil
+}
+
+func isConfigMod() bool {
+	if configFile == "" {
+		return false
+	}
+	info, err := os.Stat(configFile)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if t := info.ModTime(); t.Unix() != configMod.Unix() {
+		configMod = t
+		return true
+	}
+	return false
+}
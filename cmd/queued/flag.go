@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/angenalZZZ/gofunc/log"
+)
+
+var (
+	flagConfig = flag.String("c", "queued.yaml", "sets config file")
+	flagData   = flag.String("data", "", "the data directory of the queues")
+	flagTcp    = flag.String("tcp", "", "the NSQ TCP protocol address")
+	flagHttp   = flag.String("http", "", "the HTTP address")
+)
+
+var (
+	queueServer *Server
+	tcpService  *tcpServer
+	httpServer  *http.Server
+)
+
+func initArgs() {
+	flag.Usage = func() {
+		fmt.Printf(" Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+}
+
+func checkArgs() {
+	if *flagConfig != "" {
+		configFile = *flagConfig
+	}
+
+	if err := initConfig(); err != nil {
+		panic(err)
+	}
+
+	if *flagData != "" {
+		configInfo.Data = *flagData
+	}
+	if *flagTcp != "" {
+		configInfo.Tcp = *flagTcp
+	}
+	if *flagHttp != "" {
+		configInfo.Http = *flagHttp
+	}
+
+	if log.Log == nil {
+		log.Log = log.Init(configInfo.Log)
+	}
+	log.Log.Debug().Msgf("configuration complete")
+}
+
+func runServer() {
+	var err error
+	queueServer, err = NewServer(configInfo.Data, log.Log)
+	if err != nil {
+		log.Log.Error().Msgf("[queued] failed open %s: %v\n", configInfo.Data, err)
+		os.Exit(1)
+	}
+
+	tcpService = newTcpServer(queueServer, configInfo.Tcp, configInfo.MsgTimeout, configInfo.MaxMsgSize, configInfo.MaxBodySize)
+	go func() {
+		if err := tcpService.Serve(); err != nil {
+			log.Log.Error().Msgf("[queued] tcp server stopped: %v\n", err)
+			os.Exit(1)
+		}
+	}()
+
+	if configInfo.Http == "" {
+		return
+	}
+	httpServer = &http.Server{Addr: configInfo.Http, Handler: httpHandler(queueServer, configInfo.MaxBodySize)}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Log.Error().Msgf("[queued] http server stopped: %v\n", err)
+		}
+	}()
+	log.Log.Info().Msgf("[queued] http listening on %s", configInfo.Http)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/queue"
+)
+
+// httpHandler serves the named queues and the topics over HTTP:
+//
+//	POST /queue/{name}?type=fifo&priority=0&prefix=p  enqueue the request body, the type is fifo, priority or prefix
+//	POST /queue/{name}/reserve?type=fifo&timeout=30   reserve the next item of a fifo queue with a lease of the timeout
+//	                                                  in seconds, the priority and prefix queues have no leases
+//	POST /queue/{name}/dequeue?type=priority&prefix=p remove the next item of a queue and return it, it's lost
+//	                                                  if the consumer crashes before it's processed
+//	POST /queue/{name}/ack?id=1&lease=1               ack a reserved item of a fifo queue by the X-Lease token of reserve
+//	POST /queue/{name}/nack?id=1&lease=1&delay=0      requeue a reserved item of a fifo queue after the delay in ms
+//	POST /pub?topic=t      POST /mpub?topic=t         publish a message, or the messages separated by newline
+//	GET  /stats            GET  /ping
+//
+// The request body is limited to the maxBodySize.
+func httpHandler(s *Server, maxBodySize int) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/queue/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		params := r.URL.Query()
+		typ := params.Get("type")
+		if typ == "" {
+			typ = typeFIFO
+		}
+		name, op := strings.TrimPrefix(r.URL.Path, "/queue/"), ""
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name, op = name[:i], name[i+1:]
+		}
+		q, err := s.Queue(name, typ)
+		if err != nil {
+			httpError(w, 0, err)
+			return
+		}
+
+		switch op {
+		case "":
+			v, err := readBody(r, maxBodySize)
+			if err != nil {
+				httpError(w, 0, err)
+				return
+			}
+			var id uint64
+			switch q := q.(type) {
+			case *queue.Queue:
+				var item *queue.Item
+				if item, err = q.Enqueue(v); err == nil {
+					id = item.ID
+				}
+			case *queue.PriorityQueue:
+				priority, _ := strconv.ParseUint(params.Get("priority"), 10, 8)
+				var item *queue.PriorityItem
+				if item, err = q.Enqueue(uint8(priority), v); err == nil {
+					id = item.ID
+				}
+			case *queue.PrefixQueue:
+				var item *queue.Item
+				if item, err = q.Enqueue([]byte(params.Get("prefix")), v); err == nil {
+					id = item.ID
+				}
+			}
+			httpResult(w, map[string]uint64{"id": id}, err)
+
+		case "reserve", "dequeue":
+			var (
+				item *queue.Item
+				pi   *queue.PriorityItem
+			)
+			switch q := q.(type) {
+			case *queue.Queue:
+				if op == "dequeue" {
+					item, err = q.Dequeue()
+					break
+				}
+				timeout, _ := strconv.Atoi(params.Get("timeout"))
+				if timeout <= 0 {
+					timeout = 30
+				}
+				item, err = q.Reserve(time.Duration(timeout) * time.Second)
+			case *queue.PriorityQueue:
+				if op == "reserve" {
+					err = errReserve
+					break
+				}
+				if pi, err = q.Dequeue(); err == nil {
+					item = &queue.Item{ID: pi.ID, Value: pi.Value}
+					w.Header().Set("X-Priority", strconv.Itoa(int(pi.Priority)))
+				}
+			case *queue.PrefixQueue:
+				if op == "reserve" {
+					err = errReserve
+					break
+				}
+				item, err = q.Dequeue([]byte(params.Get("prefix")))
+			}
+			if err != nil {
+				httpError(w, 0, err)
+				return
+			}
+			w.Header().Set("X-Id", strconv.FormatUint(item.ID, 10))
+			if item.Attempts > 0 {
+				w.Header().Set("X-Attempts", strconv.FormatUint(uint64(item.Attempts), 10))
+				w.Header().Set("X-Lease", strconv.FormatUint(item.Lease, 10))
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(item.Value)
+
+		case "ack", "nack":
+			fifo, ok := q.(*queue.Queue)
+			id, err := strconv.ParseUint(params.Get("id"), 10, 64)
+			if !ok || err != nil {
+				httpError(w, http.StatusBadRequest, errRequest)
+				return
+			}
+			lease, err := strconv.ParseUint(params.Get("lease"), 10, 64)
+			if err != nil {
+				httpError(w, http.StatusBadRequest, errRequest)
+				return
+			}
+			if op == "ack" {
+				err = fifo.Ack(id, lease)
+			} else {
+				delay, _ := strconv.Atoi(params.Get("delay"))
+				err = fifo.Nack(id, lease, time.Duration(delay)*time.Millisecond)
+			}
+			httpResult(w, nil, err)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	mux.HandleFunc("/pub", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := readBody(r, maxBodySize)
+		if err == nil && len(v) == 0 {
+			err = errRequest
+		}
+		if err != nil {
+			httpError(w, 0, err)
+			return
+		}
+		httpResult(w, nil, s.Publish(r.URL.Query().Get("topic"), v))
+	})
+
+	mux.HandleFunc("/mpub", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := readBody(r, maxBodySize)
+		if err != nil {
+			httpError(w, 0, err)
+			return
+		}
+		var bodies [][]byte
+		for _, b := range bytes.Split(v, []byte{'\n'}) {
+			if len(b) > 0 {
+				bodies = append(bodies, b)
+			}
+		}
+		if len(bodies) == 0 {
+			httpError(w, http.StatusBadRequest, errRequest)
+			return
+		}
+		httpResult(w, nil, s.Publish(r.URL.Query().Get("topic"), bodies...))
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		httpResult(w, s.Stats(), nil)
+	})
+
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(nsqOK)
+	})
+
+	return mux
+}
+
+// readBody reads the request body up to the maxBodySize, errTooLarge is returned if it's larger.
+func readBody(r *http.Request, maxBodySize int) ([]byte, error) {
+	defer func() { _ = r.Body.Close() }()
+	if r.ContentLength > int64(maxBodySize) {
+		return nil, errTooLarge
+	}
+	v, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxBodySize)+1))
+	if err != nil {
+		return nil, errRequest
+	}
+	if len(v) > maxBodySize {
+		return nil, errTooLarge
+	}
+	return v, nil
+}
+
+func httpResult(w http.ResponseWriter, result interface{}, err error) {
+	if err != nil {
+		httpError(w, 0, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if result == nil {
+		result = map[string]bool{"ok": true}
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// httpError writes the error, the status is 404 for empty or not reserved, 409 for incompatible type,
+// 400 for invalid request, 413 for too large body, otherwise 500.
+func httpError(w http.ResponseWriter, status int, err error) {
+	if status == 0 {
+		switch err {
+		case queue.ErrEmpty, queue.ErrNotReserved:
+			status = http.StatusNotFound
+		case queue.ErrIncompatibleType:
+			status = http.StatusConflict
+		case errName, errType, errRequest, errReserve:
+			status = http.StatusBadRequest
+		case errTooLarge:
+			status = http.StatusRequestEntityTooLarge
+		default:
+			status = http.StatusInternalServerError
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,42 @@
+///go get github.com/angenalZZZ/gofunc/cmd/queued
+///go build -ldflags "-s -w" -o A:/test/cmd/queued/queued.exe ./cmd/queued
+///start A:/test/cmd/queued/queued.exe -c queued.yaml
+
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/angenalZZZ/gofunc/f"
+)
+
+func main() {
+	// Your Arguments.
+	initArgs()
+	if len(os.Args) < 2 {
+		flag.Usage()
+		return
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(runtime.NumCPU()))
+
+	// Check Arguments And Init Config.
+	checkArgs()
+
+	// Start the tcp and http servers.
+	runServer()
+
+	// Pass the signals you want to end your application.
+	death := f.NewDeath(syscall.SIGINT, syscall.SIGTERM)
+	// When you want to block for shutdown signals.
+	death.WaitForDeathWithFunc(func() {
+		if httpServer != nil {
+			_ = httpServer.Close()
+		}
+		tcpService.Shutdown()
+		queueServer.Close()
+	})
+}
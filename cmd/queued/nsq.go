@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/queue"
+	"github.com/angenalZZZ/gofunc/net"
+)
+
+// The frame types of the NSQ protocol.
+const (
+	frameTypeResponse int32 = 0
+	frameTypeError    int32 = 1
+	frameTypeMessage  int32 = 2
+)
+
+const (
+	nsqMaxRdyCount     = 2500
+	nsqMaxMsgTimeout   = 15 * time.Minute
+	nsqDefaultInterval = 30 * time.Second
+	nsqPollInterval    = 100 * time.Millisecond // redelivers the expired and the requeued messages
+)
+
+var (
+	nsqMagic     = []byte("  V2")
+	nsqOK        = []byte("OK")
+	nsqHeartbeat = []byte("_heartbeat_")
+	nsqCloseWait = []byte("CLOSE_WAIT")
+
+	errIncomplete = errors.New("[queued] incomplete frame")
+)
+
+// tcpServer serves a subset of the NSQ TCP protocol on the net event loop:
+// IDENTIFY, PUB, MPUB, SUB, RDY, FIN, REQ, TOUCH, NOP and CLS.
+type tcpServer struct {
+	*net.EventServer
+	*Server
+	addr        string
+	msgTimeout  time.Duration
+	maxMsgSize  int
+	maxBodySize int
+	shutdown    int32
+	ready       chan struct{}
+	once        sync.Once
+}
+
+// nsqClient the context of a connection, the pump delivers the messages of the subscribed channel.
+type nsqClient struct {
+	conn       net.Conn
+	magic      bool // accessed by the event loop only
+	msgTimeout time.Duration
+	heartbeat  time.Duration
+	pumping    bool
+	stop       chan struct{}
+	wake       chan struct{}
+
+	mu       sync.Mutex
+	channel  *channel
+	rdy      int64
+	inFlight map[uint64]*nsqInFlight // the leases of the delivered messages
+	closing  bool
+}
+
+// nsqInFlight the lease of a delivered message.
+type nsqInFlight struct {
+	lease    uint64 // the lease token of the reserved item
+	deadline time.Time
+}
+
+// nsqIdentify the identify data of a client.
+type nsqIdentify struct {
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+	MsgTimeout        int64 `json:"msg_timeout"`
+}
+
+func newTcpServer(s *Server, addr string, msgTimeout time.Duration, maxMsgSize, maxBodySize int) *tcpServer {
+	return &tcpServer{EventServer: new(net.EventServer), Server: s, addr: addr, msgTimeout: msgTimeout,
+		maxMsgSize: maxMsgSize, maxBodySize: maxBodySize, ready: make(chan struct{})}
+}
+
+// Serve blocks until the server is shut down.
+func (ts *tcpServer) Serve() error {
+	err := net.Serve(ts, "tcp://"+ts.addr,
+		net.WithMulticore(true),
+		net.WithTicker(true),
+		net.WithCodec(&nsqCodec{maxBodySize: ts.maxBodySize}))
+	ts.once.Do(func() { close(ts.ready) })
+	return err
+}
+
+// Shutdown stops the server on the next tick.
+func (ts *tcpServer) Shutdown() {
+	atomic.StoreInt32(&ts.shutdown, 1)
+}
+
+// OnInitComplete fires when the server is ready for accepting connections.
+func (ts *tcpServer) OnInitComplete(server net.Server) (action net.Action) {
+	ts.Log.Info().Msgf("[queued] tcp listening on %s", server.Addr.String())
+	ts.once.Do(func() { close(ts.ready) })
+	return
+}
+
+// OnOpened fires when a new connection has been opened.
+func (ts *tcpServer) OnOpened(c net.Conn) (out []byte, action net.Action) {
+	c.SetContext(&nsqClient{
+		conn:       c,
+		msgTimeout: ts.msgTimeout,
+		heartbeat:  nsqDefaultInterval,
+		stop:       make(chan struct{}),
+		wake:       make(chan struct{}, 1),
+		inFlight:   make(map[uint64]*nsqInFlight),
+	})
+	return
+}
+
+// OnClosed fires when a connection has been closed, the in-flight messages are requeued,
+// the expired ones are redelivered by the channel, maybe to another client.
+func (ts *tcpServer) OnClosed(c net.Conn, _ error) (action net.Action) {
+	client, ok := c.Context().(*nsqClient)
+	if !ok {
+		return
+	}
+	close(client.stop)
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.channel != nil {
+		now := time.Now()
+		for id, m := range client.inFlight {
+			if m.deadline.After(now) {
+				_ = client.channel.Nack(id, m.lease, 0)
+			}
+		}
+		client.channel.addClient(-1)
+		client.channel.notify()
+	}
+	client.inFlight = nil
+	return
+}
+
+// React fires when a connection sends a command.
+func (ts *tcpServer) React(frame []byte, c net.Conn) (out []byte, action net.Action) {
+	client, ok := c.Context().(*nsqClient)
+	if !ok {
+		return nil, net.Close
+	}
+	if !client.magic {
+		if !bytes.Equal(frame, nsqMagic) {
+			return nsqFrame(frameTypeError, []byte("E_BAD_PROTOCOL unsupported protocol version")), net.Close
+		}
+		client.magic = true
+		return
+	}
+
+	line, body := frame, []byte(nil)
+	if i := bytes.IndexByte(frame, '\n'); i >= 0 {
+		line, body = frame[:i], frame[i+1:]
+	}
+	params := bytes.Split(bytes.TrimSuffix(line, []byte{'\r'}), []byte{' '})
+	if len(body) >= 4 {
+		if size := int(binary.BigEndian.Uint32(body)); size > ts.maxBodySize || size != len(body)-4 {
+			return nsqError("E_BAD_BODY", "%s invalid body size %d", params[0], size), net.Close
+		}
+		body = body[4:]
+	}
+
+	switch string(params[0]) {
+	case "IDENTIFY":
+		return ts.identify(client, body)
+	case "PUB":
+		if len(params) != 2 {
+			return nsqError("E_INVALID", "PUB insufficient number of parameters"), net.Close
+		}
+		if len(body) == 0 || len(body) > ts.maxMsgSize {
+			return nsqError("E_BAD_MESSAGE", "PUB invalid message body size %d", len(body)), net.Close
+		}
+		if err := ts.Publish(string(params[1]), append([]byte(nil), body...)); err != nil {
+			return ts.pubError(err)
+		}
+		return nsqFrame(frameTypeResponse, nsqOK), net.None
+	case "MPUB":
+		if len(params) != 2 {
+			return nsqError("E_INVALID", "MPUB insufficient number of parameters"), net.Close
+		}
+		bodies, err := readMPUB(body, ts.maxMsgSize)
+		if err != nil {
+			return nsqError("E_BAD_BODY", "MPUB %v", err), net.Close
+		}
+		if err = ts.Publish(string(params[1]), bodies...); err != nil {
+			return ts.pubError(err)
+		}
+		return nsqFrame(frameTypeResponse, nsqOK), net.None
+	case "SUB":
+		return ts.sub(client, params)
+	case "RDY":
+		return ts.rdy(client, params)
+	case "FIN", "REQ", "TOUCH":
+		return ts.finish(client, params)
+	case "DPUB":
+		return nsqError("E_INVALID", "DPUB is not supported"), net.Close
+	case "NOP":
+		return
+	case "CLS":
+		client.mu.Lock()
+		client.closing, client.rdy = true, 0
+		client.mu.Unlock()
+		return nsqFrame(frameTypeResponse, nsqCloseWait), net.None
+	}
+	return nsqError("E_INVALID", "invalid command %s", params[0]), net.Close
+}
+
+// Tick shuts down the server when it's requested.
+func (ts *tcpServer) Tick() (delay time.Duration, action net.Action) {
+	if atomic.LoadInt32(&ts.shutdown) == 1 {
+		action = net.Shutdown
+	}
+	delay = 100 * time.Millisecond
+	return
+}
+
+// identify negotiates the heartbeat interval and the msg timeout, the features of tls, deflate,
+// snappy and auth are not supported.
+func (ts *tcpServer) identify(client *nsqClient, body []byte) ([]byte, net.Action) {
+	if client.pumping {
+		return nsqError("E_INVALID", "cannot IDENTIFY in current state"), net.Close
+	}
+	var data nsqIdentify
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nsqError("E_BAD_BODY", "IDENTIFY failed to decode JSON body"), net.Close
+	}
+	if data.HeartbeatInterval < 0 {
+		client.heartbeat = 0
+	} else if data.HeartbeatInterval >= 1000 {
+		client.heartbeat = time.Duration(data.HeartbeatInterval) * time.Millisecond
+	}
+	if data.MsgTimeout > 0 {
+		client.msgTimeout = time.Duration(data.MsgTimeout) * time.Millisecond
+		if client.msgTimeout > nsqMaxMsgTimeout {
+			client.msgTimeout = nsqMaxMsgTimeout
+		}
+	}
+	resp, _ := json.Marshal(map[string]interface{}{
+		"max_rdy_count":      nsqMaxRdyCount,
+		"version":            "queued",
+		"max_msg_timeout":    int64(nsqMaxMsgTimeout / time.Millisecond),
+		"msg_timeout":        int64(client.msgTimeout / time.Millisecond),
+		"heartbeat_interval": int64(client.heartbeat / time.Millisecond),
+		"tls_v1":             false,
+		"deflate":            false,
+		"snappy":             false,
+		"auth_required":      false,
+	})
+	ts.startPump(client)
+	return nsqFrame(frameTypeResponse, resp), net.None
+}
+
+// sub subscribes the client to the channel of the topic.
+func (ts *tcpServer) sub(client *nsqClient, params [][]byte) ([]byte, net.Action) {
+	if len(params) != 3 {
+		return nsqError("E_INVALID", "SUB insufficient number of parameters"), net.Close
+	}
+	client.mu.Lock()
+	subscribed := client.channel != nil
+	client.mu.Unlock()
+	if subscribed {
+		return nsqError("E_INVALID", "cannot SUB in current state"), net.Close
+	}
+
+	ch, err := ts.Channel(string(params[1]), string(params[2]))
+	if err == errName {
+		return nsqError("E_BAD_TOPIC", "SUB topic or channel name is invalid"), net.Close
+	} else if err != nil {
+		ts.Log.Error().Msgf("[queued] SUB %s %s > %v", params[1], params[2], err)
+		return nsqError("E_SUB_FAILED", "SUB failed %v", err), net.Close
+	}
+	ch.addClient(1)
+	client.mu.Lock()
+	client.channel = ch
+	client.mu.Unlock()
+	ts.startPump(client)
+	return nsqFrame(frameTypeResponse, nsqOK), net.None
+}
+
+// rdy updates the count of the messages that the client is ready to receive.
+func (ts *tcpServer) rdy(client *nsqClient, params [][]byte) ([]byte, net.Action) {
+	count := int64(1)
+	if len(params) > 1 {
+		n, err := strconv.ParseInt(string(params[1]), 10, 64)
+		if err != nil || n < 0 || n > nsqMaxRdyCount {
+			return nsqError("E_INVALID", "RDY count %s out of range 0-%d", params[1], nsqMaxRdyCount), net.Close
+		}
+		count = n
+	}
+	client.mu.Lock()
+	if !client.closing {
+		client.rdy = count
+	}
+	client.mu.Unlock()
+	client.signal()
+	return nil, net.None
+}
+
+// finish acks (FIN), requeues (REQ) or extends the msg timeout (TOUCH) of an in-flight message.
+func (ts *tcpServer) finish(client *nsqClient, params [][]byte) ([]byte, net.Action) {
+	cmd := string(params[0])
+	if len(params) < 2 || (cmd == "REQ" && len(params) < 3) {
+		return nsqError("E_INVALID", "%s insufficient number of parameters", cmd), net.Close
+	}
+	id, err := strconv.ParseUint(string(params[1]), 16, 64)
+	if err != nil || len(params[1]) != 16 {
+		return nsqError("E_INVALID", "%s invalid message id %s", cmd, params[1]), net.Close
+	}
+	var delay time.Duration
+	if cmd == "REQ" {
+		ms, err := strconv.ParseInt(string(params[2]), 10, 64)
+		if err != nil || ms < 0 {
+			return nsqError("E_INVALID", "REQ could not parse timeout %s", params[2]), net.Close
+		}
+		delay = time.Duration(ms) * time.Millisecond
+	}
+
+	client.mu.Lock()
+	defer client.signal()
+	defer client.mu.Unlock()
+	m, ok := client.inFlight[id]
+	if ok && !m.deadline.After(time.Now()) {
+		// The expired message is redelivered by the channel, maybe to another client.
+		delete(client.inFlight, id)
+		ok = false
+	}
+	if !ok || client.channel == nil {
+		return nsqError("E_"+cmd+"_FAILED", "%s %s failed message ID not in flight", cmd, params[1]), net.None
+	}
+	switch cmd {
+	case "FIN":
+		err = client.channel.Ack(id, m.lease)
+		delete(client.inFlight, id)
+	case "REQ":
+		err = client.channel.Nack(id, m.lease, delay)
+		delete(client.inFlight, id)
+	case "TOUCH":
+		var lease uint64
+		if lease, err = client.channel.Touch(id, m.lease, client.msgTimeout); err == nil {
+			m.lease, m.deadline = lease, time.Now().Add(client.msgTimeout)
+		}
+	}
+	if err != nil {
+		return nsqError("E_"+cmd+"_FAILED", "%s %s failed %v", cmd, params[1], err), net.None
+	}
+	return nil, net.None
+}
+
+// pubError returns the error of PUB and MPUB.
+func (ts *tcpServer) pubError(err error) ([]byte, net.Action) {
+	if err == errName {
+		return nsqError("E_BAD_TOPIC", "PUB topic name is invalid"), net.Close
+	}
+	ts.Log.Error().Msgf("[queued] PUB > %v", err)
+	return nsqError("E_PUB_FAILED", "PUB failed %v", err), net.Close
+}
+
+// startPump starts the pump of the client once.
+func (ts *tcpServer) startPump(client *nsqClient) {
+	if client.pumping {
+		return
+	}
+	client.pumping = true
+	go ts.pump(client)
+}
+
+// pump delivers the messages of the subscribed channel up to the RDY count, and sends the heartbeats.
+func (ts *tcpServer) pump(client *nsqClient) {
+	var heartbeat <-chan time.Time
+	if client.heartbeat > 0 {
+		ticker := time.NewTicker(client.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	poll := time.NewTicker(nsqPollInterval)
+	defer poll.Stop()
+
+	for {
+		var published <-chan struct{}
+		client.mu.Lock()
+		if ch := client.channel; ch != nil {
+			published = ch.wait()
+			for client.canSend() {
+				item, err := ch.Reserve(client.msgTimeout)
+				if err != nil {
+					if err != queue.ErrEmpty && err != queue.ErrDBClosed {
+						ts.Log.Error().Msgf("[queued] %s/%s reserve > %v", ch.topic, ch.name, err)
+					}
+					break
+				}
+				client.inFlight[item.ID] = &nsqInFlight{lease: item.Lease, deadline: time.Now().Add(client.msgTimeout)}
+				_ = client.conn.AsyncWrite(nsqMessage(item))
+			}
+		}
+		client.mu.Unlock()
+
+		select {
+		case <-client.stop:
+			return
+		case <-client.wake:
+		case <-published:
+		case <-poll.C:
+		case <-heartbeat:
+			_ = client.conn.AsyncWrite(nsqFrame(frameTypeResponse, nsqHeartbeat))
+		}
+	}
+}
+
+// canSend checks the in-flight messages of the client is less than the RDY count, client.mu must be locked.
+func (client *nsqClient) canSend() bool {
+	if client.closing || client.inFlight == nil {
+		return false
+	}
+	now, n := time.Now(), int64(0)
+	for id, m := range client.inFlight {
+		if m.deadline.Before(now) {
+			delete(client.inFlight, id) // the expired message is redelivered by the channel
+			continue
+		}
+		n++
+	}
+	return n < client.rdy
+}
+
+// signal wakes the pump of the client.
+func (client *nsqClient) signal() {
+	select {
+	case client.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nsqCodec decodes the magic and the commands of the NSQ protocol: a line ends with '\n',
+// and the body of IDENTIFY, PUB, MPUB and DPUB: size(4) + data.
+type nsqCodec struct {
+	maxBodySize int
+}
+
+// Encode the frames are encoded by the server.
+func (cc *nsqCodec) Encode(c net.Conn, buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+// Decode decodes a command, the body is decoded after it's received completely.
+func (cc *nsqCodec) Decode(c net.Conn) ([]byte, error) {
+	buf := c.Read()
+	if client, ok := c.Context().(*nsqClient); ok && !client.magic {
+		if len(buf) < len(nsqMagic) {
+			return nil, errIncomplete
+		}
+		c.ShiftN(len(nsqMagic))
+		return buf[:len(nsqMagic)], nil
+	}
+
+	i := bytes.IndexByte(buf, '\n')
+	if i < 0 {
+		return nil, errIncomplete
+	}
+	n := i + 1
+	switch cmd := buf[:i]; {
+	case bytes.HasPrefix(cmd, []byte("IDENTIFY")), bytes.HasPrefix(cmd, []byte("PUB ")),
+		bytes.HasPrefix(cmd, []byte("MPUB ")), bytes.HasPrefix(cmd, []byte("DPUB ")):
+		if len(buf) < n+4 {
+			return nil, errIncomplete
+		}
+		// The body that is too big is rejected by the server.
+		size := int(binary.BigEndian.Uint32(buf[n:]))
+		if size > cc.maxBodySize {
+			n += 4
+		} else if len(buf) < n+4+size {
+			return nil, errIncomplete
+		} else {
+			n += 4 + size
+		}
+	}
+	c.ShiftN(n)
+	return buf[:n], nil
+}
+
+// readMPUB reads the messages of MPUB: num(4) + [size(4) + data]...
+func readMPUB(body []byte, maxMsgSize int) ([][]byte, error) {
+	if len(body) < 4 {
+		return nil, errRequest
+	}
+	num := int(binary.BigEndian.Uint32(body))
+	body = body[4:]
+	if num <= 0 || num > len(body)/4 {
+		return nil, fmt.Errorf("invalid message count %d", num)
+	}
+	bodies := make([][]byte, 0, num)
+	for i := 0; i < num; i++ {
+		if len(body) < 4 {
+			return nil, errRequest
+		}
+		size := int(binary.BigEndian.Uint32(body))
+		if size <= 0 || size > maxMsgSize || size > len(body)-4 {
+			return nil, fmt.Errorf("invalid message size %d", size)
+		}
+		bodies = append(bodies, append([]byte(nil), body[4:4+size]...))
+		body = body[4+size:]
+	}
+	return bodies, nil
+}
+
+// nsqFrame encodes a frame: size(4) + frame type(4) + data.
+func nsqFrame(frameType int32, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(b, uint32(4+len(data)))
+	binary.BigEndian.PutUint32(b[4:], uint32(frameType))
+	return append(b, data...)
+}
+
+func nsqError(code, format string, args ...interface{}) []byte {
+	return nsqFrame(frameTypeError, []byte(code+" "+fmt.Sprintf(format, args...)))
+}
+
+// nsqMessage encodes a message frame: timestamp(8) + attempts(2) + id(16) + body.
+func nsqMessage(item *queue.Item) []byte {
+	data := make([]byte, 0, 26+len(item.Value)-8)
+	data = append(data, item.Value[:8]...)
+	data = append(data, byte(item.Attempts>>8), byte(item.Attempts))
+	data = append(data, fmt.Sprintf("%016x", item.ID)...)
+	data = append(data, item.Value[8:]...)
+	return nsqFrame(frameTypeMessage, data)
+}
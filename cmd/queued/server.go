@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/queue"
+	"github.com/angenalZZZ/gofunc/log"
+)
+
+var (
+	errName     = errors.New("[queued] invalid name")
+	errType     = errors.New("[queued] invalid queue type")
+	errRequest  = errors.New("[queued] invalid request")
+	errTooLarge = errors.New("[queued] request body too large")
+	errReserve  = errors.New("[queued] reserve of a fifo queue only, dequeue the others")
+)
+
+// validName the names of the queues, the topics and the channels are the directories of the data.
+var validName = regexp.MustCompile(`^[.a-zA-Z0-9_-]{1,64}$`)
+
+// isValidName checks the name is valid, the names "." and ".." and the names containing ".." are rejected,
+// they are out of the directories of the data.
+func isValidName(name string) bool {
+	return validName.MatchString(name) && strings.Trim(name, ".") != "" && !strings.Contains(name, "..")
+}
+
+// The types of the named queues.
+const (
+	typeFIFO     = "fifo"
+	typePriority = "priority"
+	typePrefix   = "prefix"
+)
+
+// Server serves the named LevelDB queues, and the topics of the NSQ protocol:
+//
+//	<data>/queue/<name>              the named queues of the HTTP api
+//	<data>/topic/<topic>             the messages of a topic without any channel
+//	<data>/channel/<topic>/<channel> the messages of a channel, each channel gets a copy of the topic
+type Server struct {
+	DataDir string
+	Log     *log.Logger
+
+	mu     sync.Mutex             // guards the maps, the queues are written without it
+	queues map[string]interface{} // *queue.Queue, *queue.PriorityQueue or *queue.PrefixQueue
+	topics map[string]*topic
+}
+
+// topic the channels of a topic, the messages are buffered until the first channel is created.
+type topic struct {
+	name   string
+	buffer *queue.Queue
+
+	mu       sync.RWMutex // read locked by Publish, locked by the first channel that moves the buffer
+	channels map[string]*channel
+}
+
+// channel a reliable queue of the messages: timestamp(8) + body, the clients reserve the messages
+// with a lease of the msg timeout, FIN acks them, REQ nacks them.
+type channel struct {
+	*queue.Queue
+	topic, name string
+
+	mu      sync.Mutex
+	ready   chan struct{} // closed when a message is published
+	clients int
+}
+
+// NewServer opens the topics and the channels in the data directory.
+func NewServer(dataDir string, logger *log.Logger) (*Server, error) {
+	if logger == nil {
+		logger = log.InitConsole("15:04:05.000", false)
+	}
+	s := &Server{DataDir: dataDir, Log: logger, queues: make(map[string]interface{}), topics: make(map[string]*topic)}
+
+	dirs, _ := ioutil.ReadDir(filepath.Join(dataDir, "channel"))
+	for _, dir := range dirs {
+		channels, _ := ioutil.ReadDir(filepath.Join(dataDir, "channel", dir.Name()))
+		for _, c := range channels {
+			if _, err := s.Channel(dir.Name(), c.Name()); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// Queue opens the named queue of the type, queue.ErrIncompatibleType is returned
+// if the queue is of another type.
+func (s *Server) Queue(name, typ string) (interface{}, error) {
+	if !isValidName(name) {
+		return nil, errName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if q, ok := s.queues[name]; ok {
+		if queueType(q) != typ {
+			return nil, queue.ErrIncompatibleType
+		}
+		return q, nil
+	}
+
+	var (
+		q   interface{}
+		err error
+		dir = filepath.Join(s.DataDir, "queue", name)
+	)
+	switch typ {
+	case typeFIFO:
+		q, err = queue.OpenQueue(dir)
+	case typePriority:
+		q, err = queue.OpenPriorityQueue(dir, queue.ASC)
+	case typePrefix:
+		q, err = queue.OpenPrefixQueue(dir)
+	default:
+		return nil, errType
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.queues[name] = q
+	return q, nil
+}
+
+// Publish adds the message to each channel of the topic, or the buffer of the topic if it has no channel.
+func (s *Server) Publish(topicName string, bodies ...[]byte) error {
+	t, err := s.topic(topicName)
+	if err != nil {
+		return err
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	for _, body := range bodies {
+		value := encodeMessage(now, body)
+		if len(t.channels) == 0 {
+			if _, err = t.buffer.Enqueue(value); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, c := range t.channels {
+			if _, err = c.Enqueue(value); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range t.channels {
+		c.notify()
+	}
+	return nil
+}
+
+// Channel opens the channel of the topic, the buffered messages of the topic are moved to the first channel.
+func (s *Server) Channel(topicName, channelName string) (*channel, error) {
+	if !isValidName(channelName) {
+		return nil, errName
+	}
+	t, err := s.topic(topicName)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.channels[channelName]; ok {
+		return c, nil
+	}
+	q, err := queue.OpenQueue(filepath.Join(s.DataDir, "channel", topicName, channelName))
+	if err != nil {
+		return nil, err
+	}
+	c := &channel{Queue: q, topic: topicName, name: channelName, ready: make(chan struct{})}
+	if len(t.channels) == 0 {
+		for {
+			item, err := t.buffer.Dequeue()
+			if err == queue.ErrEmpty {
+				break
+			} else if err != nil {
+				_ = q.Close()
+				return nil, err
+			}
+			if _, err = q.Enqueue(item.Value); err != nil {
+				_ = q.Close()
+				return nil, err
+			}
+		}
+	}
+	t.channels[channelName] = c
+	return c, nil
+}
+
+// Stats gets the depths of the queues, the topics and the channels.
+func (s *Server) Stats() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queues := make(map[string]interface{}, len(s.queues))
+	for name, q := range s.queues {
+		stat := map[string]interface{}{"type": queueType(q)}
+		switch q := q.(type) {
+		case *queue.Queue:
+			q.RLock()
+			stat["depth"] = q.Length()
+			q.RUnlock()
+			stat["reserved"], stat["dead"] = q.ReservedLength(), q.DeadLetterLength()
+		case *queue.PriorityQueue:
+			stat["depth"] = q.Length()
+		case *queue.PrefixQueue:
+			q.RLock()
+			stat["depth"] = q.Length()
+			q.RUnlock()
+		}
+		queues[name] = stat
+	}
+
+	topics := make(map[string]interface{}, len(s.topics))
+	for name, t := range s.topics {
+		t.buffer.RLock()
+		depth := t.buffer.Length()
+		t.buffer.RUnlock()
+		t.mu.RLock()
+		channels := make(map[string]interface{}, len(t.channels))
+		for _, c := range t.channels {
+			c.RLock()
+			stat := map[string]interface{}{"depth": c.Length()}
+			c.RUnlock()
+			stat["in_flight"] = c.ReservedLength()
+			c.mu.Lock()
+			stat["clients"] = c.clients
+			c.mu.Unlock()
+			channels[c.name] = stat
+		}
+		t.mu.RUnlock()
+		topics[name] = map[string]interface{}{"depth": depth, "channels": channels}
+	}
+
+	return map[string]interface{}{"queues": queues, "topics": topics}
+}
+
+// Close closes the queues, the topics and the channels.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, q := range s.queues {
+		closeQueue(q)
+		delete(s.queues, name)
+	}
+	for name, t := range s.topics {
+		t.mu.Lock()
+		_ = t.buffer.Close()
+		for _, c := range t.channels {
+			_ = c.Close()
+			c.notify()
+		}
+		t.mu.Unlock()
+		delete(s.topics, name)
+	}
+}
+
+// topic opens the buffer of the topic.
+func (s *Server) topic(name string) (*topic, error) {
+	if !isValidName(name) {
+		return nil, errName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.topics[name]; ok {
+		return t, nil
+	}
+	q, err := queue.OpenQueue(filepath.Join(s.DataDir, "topic", name))
+	if err != nil {
+		return nil, err
+	}
+	t := &topic{name: name, buffer: q, channels: make(map[string]*channel)}
+	s.topics[name] = t
+	return t, nil
+}
+
+// wait gets the channel that is closed when a message is published.
+func (c *channel) wait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ready
+}
+
+// notify wakes the clients of the channel.
+func (c *channel) notify() {
+	c.mu.Lock()
+	close(c.ready)
+	c.ready = make(chan struct{})
+	c.mu.Unlock()
+}
+
+// addClient counts the subscribed clients.
+func (c *channel) addClient(n int) {
+	c.mu.Lock()
+	c.clients += n
+	c.mu.Unlock()
+}
+
+func queueType(q interface{}) string {
+	switch q.(type) {
+	case *queue.Queue:
+		return typeFIFO
+	case *queue.PriorityQueue:
+		return typePriority
+	case *queue.PrefixQueue:
+		return typePrefix
+	}
+	return ""
+}
+
+// closeQueue closes the named queue.
+func closeQueue(q interface{}) {
+	switch q := q.(type) {
+	case *queue.Queue:
+		_ = q.Close()
+	case *queue.PriorityQueue:
+		_ = q.Close()
+	case *queue.PrefixQueue:
+		_ = q.Close()
+	}
+}
+
+// encodeMessage encodes the message of a channel: timestamp(8) + body.
+func encodeMessage(timestamp int64, body []byte) []byte {
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint64(b, uint64(timestamp))
+	return append(b, body...)
+}
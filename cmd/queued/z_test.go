@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/queue"
+	"github.com/angenalZZZ/gofunc/data/queue/consumer"
+	"github.com/angenalZZZ/gofunc/data/queue/message"
+	"github.com/angenalZZZ/gofunc/data/queue/producer"
+	"github.com/nsqio/go-nsq"
+)
+
+func testServe(t *testing.T, s *Server) *tcpServer {
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	ts := newTcpServer(s, addr, time.Minute, 1024*1024, 5*1024*1024)
+	go func() { _ = ts.Serve() }()
+	<-ts.ready
+	return ts
+}
+
+func testEventually(t *testing.T, fn func() bool) {
+	for i := 0; i < 100; i++ {
+		if fn() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+func TestNSQ(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queued")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	s, err := NewServer(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := testServe(t, s)
+	defer func() { ts.Shutdown(); s.Close() }()
+
+	// The messages are buffered in the topic until the first channel is created.
+	p, err := producer.NewNsqProducer(ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	if err = p.Publish("t", []byte("m1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.MultiPublish("t", [][]byte{[]byte("m2"), []byte("m3")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is closed after a fatal error.
+	bad, _ := producer.NewNsqProducer(ts.addr)
+	defer bad.Stop()
+	if err = bad.Publish("bad/topic", []byte("m")); err == nil || !strings.Contains(err.Error(), "E_BAD_TOPIC") {
+		t.Fatalf("publish to an invalid topic: %v", err)
+	}
+
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	config := nsq.NewConfig()
+	_ = config.Set("max_in_flight", 2)
+	_ = config.Set("default_requeue_delay", 10*time.Millisecond)
+	_ = config.Set("backoff_multiplier", 10*time.Millisecond)
+	_ = config.Set("max_backoff_duration", 50*time.Millisecond)
+	c := consumer.NewNsqConsumer()
+	c.Config = config
+	err = c.Register("t", "c", 2, func(m *message.NsqMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		// The failed message is requeued, and redelivered.
+		if string(m.Body) == "m2" && m.Attempts == 1 {
+			return errors.New("retry")
+		}
+		received = append(received, string(m.Body)+":"+strconv.Itoa(int(m.Attempts)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Connect(ts.addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	if err = p.Publish("t", []byte("m4")); err != nil {
+		t.Fatal(err)
+	}
+	testEventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 4
+	})
+	mu.Lock()
+	sort.Strings(received)
+	if got := strings.Join(received, ","); got != "m1:1,m2:2,m3:1,m4:1" {
+		t.Fatalf("received %s", got)
+	}
+	mu.Unlock()
+
+	ch, _ := s.Channel("t", "c")
+	testEventually(t, func() bool { return ch.ReservedLength() == 0 })
+	stats := s.Stats()["topics"].(map[string]interface{})["t"].(map[string]interface{})
+	if stat := stats["channels"].(map[string]interface{})["c"].(map[string]interface{}); stat["depth"] != uint64(0) || stat["clients"] != 1 {
+		t.Fatalf("stats %v", stats)
+	}
+}
+
+func TestNSQStaleClient(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queued")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	s, err := NewServer(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ch, _ := s.Channel("t", "c")
+	if err = s.Publish("t", []byte("m1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTcpServer(s, "", time.Minute, 1024, 1024)
+	newClient := func(item *queue.Item, timeout time.Duration) *nsqClient {
+		return &nsqClient{channel: ch, wake: make(chan struct{}, 1), inFlight: map[uint64]*nsqInFlight{
+			item.ID: {lease: item.Lease, deadline: time.Now().Add(timeout)},
+		}}
+	}
+	fin := func(client *nsqClient, item *queue.Item) string {
+		out, _ := ts.finish(client, [][]byte{[]byte("FIN"), []byte(fmt.Sprintf("%016x", item.ID))})
+		return string(out)
+	}
+
+	// The expired message is redelivered to another client.
+	item1, _ := ch.Reserve(10 * time.Millisecond)
+	stale := newClient(item1, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	item2, err := ch.Reserve(time.Minute)
+	if err != nil || item2.ID != item1.ID {
+		t.Fatalf("reserve %v %v", item2, err)
+	}
+	client := newClient(item2, time.Minute)
+
+	// The stale client can't ack the copy of the other client, by the deadline or by the lease.
+	if out := fin(stale, item1); !strings.Contains(out, "E_FIN_FAILED") || len(stale.inFlight) != 0 {
+		t.Fatalf("FIN of the expired message %q", out)
+	}
+	stale = newClient(item1, time.Minute)
+	if out := fin(stale, item1); !strings.Contains(out, "E_FIN_FAILED") || ch.ReservedLength() != 1 {
+		t.Fatalf("FIN of the stale lease %q", out)
+	}
+	if out := fin(client, item2); out != "" || ch.ReservedLength() != 0 {
+		t.Fatalf("FIN %q", out)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queued")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	s, err := NewServer(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewServer(httpHandler(s, 16))
+	defer hs.Close()
+
+	// lease is the X-Lease token of the last reserve, it replaces {lease} in the path.
+	var lease string
+	do := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, hs.URL+strings.Replace(path, "{lease}", lease, 1), strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = res.Body.Close() }()
+		if l := res.Header.Get("X-Lease"); l != "" {
+			lease = l
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, strings.TrimSpace(res.Header.Get("X-Id") + " " + string(b))
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+		result             string
+	}{
+		{"POST", "/queue/q1", "v1", 200, `{"id":1}`},
+		{"POST", "/queue/q1", "v2", 200, `{"id":2}`},
+		{"POST", "/queue/q1/reserve?timeout=60", "", 200, `1 v1`},
+		{"POST", "/queue/q1/nack?id=1", "", 400, `{"error":"[queued] invalid request"}`},
+		{"POST", "/queue/q1/nack?id=1&lease={lease}", "", 200, `{"ok":true}`},
+		{"POST", "/queue/q1/reserve", "", 200, `1 v1`},
+		{"POST", "/queue/q1/ack?id=1&lease=1", "", 404, `{"error":"queue: Item is not reserved"}`},
+		{"POST", "/queue/q1/ack?id=1&lease={lease}", "", 200, `{"ok":true}`},
+		{"POST", "/queue/q1/ack?id=1&lease={lease}", "", 404, `{"error":"queue: Item is not reserved"}`},
+		{"POST", "/queue/q1?type=priority", "v", 409, `{"error":"queue: Opener type is incompatible with stored queue type"}`},
+		{"POST", "/queue/p1?type=priority&priority=9", "low", 200, `{"id":1}`},
+		{"POST", "/queue/p1?type=priority&priority=1", "high", 200, `{"id":1}`},
+		{"POST", "/queue/p1/reserve?type=priority", "", 400, `{"error":"[queued] reserve of a fifo queue only, dequeue the others"}`},
+		{"POST", "/queue/p1/dequeue?type=priority", "", 200, `1 high`},
+		{"POST", "/queue/x1?type=prefix&prefix=a", "va", 200, `{"id":1}`},
+		{"POST", "/queue/x1/dequeue?type=prefix&prefix=b", "", 404, `{"error":"queue: Stack or queue is empty"}`},
+		{"POST", "/queue/x1/dequeue?type=prefix&prefix=a", "", 200, `1 va`},
+		{"POST", "/queue/a$b?type=fifo", "", 400, `{"error":"[queued] invalid name"}`},
+		{"POST", "/queue/a..b?type=fifo", "v", 400, `{"error":"[queued] invalid name"}`},
+		{"POST", "/pub?topic=..", "v", 400, `{"error":"[queued] invalid name"}`},
+		{"POST", "/queue/q2?type=stack", "", 400, `{"error":"[queued] invalid queue type"}`},
+		{"POST", "/mpub?topic=t", "m1\nm2\n", 200, `{"ok":true}`},
+		{"POST", "/pub?topic=t", "a message over 16", 413, `{"error":"[queued] request body too large"}`},
+		{"GET", "/stats", "", 200, `{"queues":{"p1":{"depth":1,"type":"priority"},"q1":{"dead":0,"depth":1,"reserved":0,"type":"fifo"},` +
+			`"x1":{"depth":0,"type":"prefix"}},"topics":{"t":{"channels":{},"depth":2}}}`},
+	} {
+		if status, result := do(c.method, c.path, c.body); status != c.status || result != c.result {
+			t.Fatalf("%s %s: %d %s", c.method, c.path, status, result)
+		}
+	}
+
+	// The names out of the directories of the data are rejected.
+	for _, name := range []string{".", "..", "...", "a..b"} {
+		if _, err = s.Queue(name, typeFIFO); err != errName {
+			t.Fatalf("queue %q: %v", name, err)
+		}
+		if _, err = s.Channel("t", name); err != errName {
+			t.Fatalf("channel %q: %v", name, err)
+		}
+		if err = s.Publish(name, []byte("v")); err != errName {
+			t.Fatalf("topic %q: %v", name, err)
+		}
+	}
+
+	// The queues, the topics and the channels persist.
+	if _, err = s.Channel("t", "c"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if s, err = NewServer(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ch, err := s.Channel("t", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, err := ch.Reserve(time.Minute); err != nil || string(item.Value[8:]) != "m1" {
+		t.Fatalf("reserve %v %v", item, err)
+	}
+}
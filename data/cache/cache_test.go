@@ -1,7 +1,42 @@
 package cache
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/cache/store"
+)
 
 func TestNewChain(t *testing.T) {
 	t.Log(new(Cache).GetType())
 }
+
+func TestChainMemoryL1(t *testing.T) {
+	l1 := New(store.NewMemory(nil, &store.MemoryOptions{MaxCost: 1 << 10, Policy: store.TinyLFU}))
+	l2 := New(store.NewMemory(nil))
+	chain := NewChain(l1, l2)
+
+	_ = l2.Set("k", "v", &store.Options{Expiration: time.Minute})
+	if v, err := chain.Get("k"); err != nil || v != "v" {
+		t.Fatalf("get %v %v", v, err)
+	}
+	// l1 is set in the background
+	deadline := time.Now().Add(time.Second)
+	v, err := l1.Get("k")
+	for err != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		v, err = l1.Get("k")
+	}
+	if err != nil || v != "v" {
+		t.Fatalf("l1 get %v %v", v, err)
+	}
+	if ttl, err := l1.TTL("k"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("l1 ttl %v %v", ttl, err)
+	}
+
+	_ = chain.Set("t", "v", &store.Options{Tags: []string{"tag"}})
+	_ = chain.Invalidate(store.InvalidateOptions{Tags: []string{"tag"}})
+	if _, err := chain.Get("t"); err == nil {
+		t.Fatal("t is not invalidated")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/angenalZZZ/gofunc/data/cache/store"
 	"github.com/angenalZZZ/gofunc/f"
 	"github.com/panjf2000/ants/v2"
+	"sync"
 	"time"
 )
 
@@ -25,6 +26,8 @@ type chainKeyValue struct {
 type ChainCache struct {
 	caches []StorageInterface
 	pool   *ants.PoolWithFunc
+	busMu  sync.RWMutex
+	bus    *InvalidationBus
 }
 
 // NewChain create a new cache aggregator
@@ -103,6 +106,9 @@ func (c *ChainCache) Set(key string, value interface{}, options *store.Options)
 			}
 		}
 	}
+	if bus := c.getBus(); bus != nil {
+		bus.publish(&invalidationMessage{Keys: []string{key}})
+	}
 	return nil
 }
 
@@ -111,6 +117,9 @@ func (c *ChainCache) Delete(key string) error {
 	for _, cache := range c.caches {
 		_ = cache.Delete(key)
 	}
+	if bus := c.getBus(); bus != nil {
+		bus.publish(&invalidationMessage{Keys: []string{key}})
+	}
 	return nil
 }
 
@@ -124,6 +133,9 @@ func (c *ChainCache) Invalidate(options store.InvalidateOptions) error {
 	for _, cache := range c.caches {
 		_ = cache.Invalidate(options)
 	}
+	if bus := c.getBus(); bus != nil && len(options.Tags) > 0 {
+		bus.publish(&invalidationMessage{Tags: options.Tags})
+	}
 	return nil
 }
 
@@ -134,9 +146,19 @@ func (c *ChainCache) Clear() error {
 		_ = cache.Clear()
 	}
 	c.pool.Reboot()
+	if bus := c.getBus(); bus != nil {
+		bus.publish(&invalidationMessage{Clear: true})
+	}
 	return nil
 }
 
+// getBus returns the invalidation bus of the chain, nil if it's not attached
+func (c *ChainCache) getBus() *InvalidationBus {
+	c.busMu.RLock()
+	defer c.busMu.RUnlock()
+	return c.bus
+}
+
 // GetCaches returns all chain caches
 func (c *ChainCache) GetCaches() []StorageInterface {
 	return c.caches
@@ -0,0 +1,132 @@
+package fastcache
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// MaxSubvalueLen the max length of a sub-value, the (subkey, sub-value) pair fits a chunk.
+// The values of the short keys up to the length are stored by Set, the larger by SetBig.
+const MaxSubvalueLen = chunkSize - 16 - 4 - 1
+
+// maxKeyLen the max length of a key, larger keys aren't stored in the cache.
+const maxKeyLen = 256 - 1
+
+// SetBig sets (k, v) to c where len(v) may exceed 64KB.
+//
+// GetBig must be used for reading stored values.
+//
+// The stored entry may be evicted at any time either due to cache
+// overflow or due to unlikely hash collision.
+// Pass higher maxBytes value to New if the added items disappear
+// frequently.
+//
+// It is safe to store entries smaller than 64KB with SetBig.
+//
+// k and v contents may be modified after returning from SetBig.
+func (c *Cache) SetBig(k, v []byte) {
+	c.write(walSetBig, k, v, 0)
+}
+
+// SetBigWithTTL works identically to SetBig, but the entry expires after ttl.
+//
+// ttl <= 0 means no expiration.
+func (c *Cache) SetBigWithTTL(k, v []byte, ttl time.Duration) {
+	c.write(walSetBig, k, v, deadline(ttl))
+}
+
+func (c *Cache) setBig(k, v []byte, deadline int64) {
+	atomic.AddUint64(&c.bigStats.SetBigCalls, 1)
+	if len(k) > maxKeyLen {
+		atomic.AddUint64(&c.bigStats.TooBigKeyErrors, 1)
+		return
+	}
+	valueLen := len(v)
+	valueHash := xxhash.Sum64(v)
+
+	// Split v into sub-values, they are stored by the subkeys (valueHash, index).
+	var subkey [16]byte
+	binary.BigEndian.PutUint64(subkey[:8], valueHash)
+	for i := uint64(0); len(v) > 0; i++ {
+		binary.BigEndian.PutUint64(subkey[8:], i)
+		subvalueLen := MaxSubvalueLen
+		if len(v) < subvalueLen {
+			subvalueLen = len(v)
+		}
+		c.set(subkey[:], v[:subvalueLen], kindBigSub, 0)
+		v = v[subvalueLen:]
+	}
+
+	// Store the metavalue (valueHash, valueLen) by k, the sub-values expire with it.
+	var metavalue [16]byte
+	binary.BigEndian.PutUint64(metavalue[:8], valueHash)
+	binary.BigEndian.PutUint64(metavalue[8:], uint64(valueLen))
+	c.set(k, metavalue[:], kindBigMeta, deadline)
+}
+
+// GetBig searches for the value for the given k, appends it to dst
+// and returns the result.
+//
+// GetBig returns only values stored via SetBig. It doesn't work
+// with values stored via other methods.
+//
+// k contents may be modified after returning from GetBig.
+func (c *Cache) GetBig(dst, k []byte) []byte {
+	atomic.AddUint64(&c.bigStats.GetBigCalls, 1)
+	var buf [16]byte
+	metavalue, ok := c.HasGet(buf[:0], k)
+	if !ok {
+		return dst
+	}
+	dst, _ = c.getBig(dst, metavalue)
+	return dst
+}
+
+// getBig appends the value of the metavalue to dst, and verifies its length and hash.
+func (c *Cache) getBig(dst, metavalue []byte) ([]byte, bool) {
+	if len(metavalue) != 16 {
+		atomic.AddUint64(&c.bigStats.InvalidMetavalueErrors, 1)
+		return dst, false
+	}
+	valueHash := binary.BigEndian.Uint64(metavalue)
+	valueLen := binary.BigEndian.Uint64(metavalue[8:])
+
+	// Collect the sub-values.
+	dstLen := len(dst)
+	if n := dstLen + int(valueLen) - cap(dst); n > 0 {
+		dst = append(dst[:cap(dst)], make([]byte, n)...)
+	}
+	dst = dst[:dstLen]
+	var subkey [16]byte
+	binary.BigEndian.PutUint64(subkey[:8], valueHash)
+	for i := uint64(0); uint64(len(dst)-dstLen) < valueLen; i++ {
+		binary.BigEndian.PutUint64(subkey[8:], i)
+		dstNew, ok := c.HasGet(dst, subkey[:])
+		if !ok || len(dstNew) == len(dst) {
+			// The sub-value is evicted.
+			return dst[:dstLen], false
+		}
+		dst = dstNew
+	}
+
+	// Verify the value.
+	v := dst[dstLen:]
+	if uint64(len(v)) != valueLen {
+		atomic.AddUint64(&c.bigStats.InvalidValueLenErrors, 1)
+		return dst[:dstLen], false
+	}
+	if xxhash.Sum64(v) != valueHash {
+		atomic.AddUint64(&c.bigStats.InvalidValueHashErrors, 1)
+		return dst[:dstLen], false
+	}
+	return dst, true
+}
+
+func (c *Cache) set(k, v []byte, kind byte, deadline int64) {
+	h := xxhash.Sum64(k)
+	idx := h % bucketsCount
+	c.buckets[idx].Set(k, v, h, kind, deadline)
+}
@@ -0,0 +1,127 @@
+package fastcache
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestSetGetBig(t *testing.T) {
+	c := New(256 * 1024 * 1024)
+	defer c.Reset()
+
+	const valuesCount = 10
+	for _, valueSize := range []int{0, 1, 100, 65535, 65536, 65537, 200 * 1024, 1024 * 1024} {
+		for i := 0; i < valuesCount; i++ {
+			k := []byte(fmt.Sprintf("key %d %d", valueSize, i))
+			v := createValue(valueSize, i)
+			c.SetBig(k, v)
+			vv := c.GetBig(nil, k)
+			if !bytes.Equal(vv, v) {
+				t.Fatalf("unexpected value got for key=%q; got len=%d; want len=%d", k, len(vv), len(v))
+			}
+			// dst is kept.
+			vv = c.GetBig([]byte("dst"), k)
+			if !bytes.Equal(vv, append([]byte("dst"), v...)) {
+				t.Fatalf("unexpected value with dst got for key=%q; got len=%d", k, len(vv))
+			}
+		}
+	}
+
+	var s Stats
+	c.UpdateStats(&s)
+	if s.SetBigCalls != 80 || s.GetBigCalls != 160 {
+		t.Fatalf("unexpected stats %+v", s.BigStats)
+	}
+	if s.InvalidMetavalueErrors != 0 || s.InvalidValueLenErrors != 0 || s.InvalidValueHashErrors != 0 {
+		t.Fatalf("unexpected errors %+v", s.BigStats)
+	}
+
+	// Too big key.
+	c.SetBig(make([]byte, 256), []byte("v"))
+	c.UpdateStats(&s)
+	if s.TooBigKeyErrors != 1 {
+		t.Fatalf("unexpected TooBigKeyErrors=%d", s.TooBigKeyErrors)
+	}
+
+	// Invalid metavalue.
+	c.Set([]byte("small"), []byte("v"))
+	if vv := c.GetBig(nil, []byte("small")); len(vv) > 0 {
+		t.Fatalf("unexpected non-empty value got for a small value: %q", vv)
+	}
+	s.Reset()
+	c.UpdateStats(&s)
+	if s.InvalidMetavalueErrors != 1 {
+		t.Fatalf("unexpected InvalidMetavalueErrors=%d", s.InvalidMetavalueErrors)
+	}
+}
+
+func TestVisit(t *testing.T) {
+	c := New(256 * 1024 * 1024)
+	defer c.Reset()
+
+	m := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		k, v := fmt.Sprintf("key %d", i), createValue(i, i)
+		c.Set([]byte(k), v)
+		m[k] = v
+	}
+	for i := 0; i < 3; i++ {
+		k, v := fmt.Sprintf("big %d", i), createValue(300*1024, i)
+		c.SetBig([]byte(k), v)
+		m[k] = v
+	}
+	c.Del([]byte("key 0"))
+	delete(m, "key 0")
+
+	n := 0
+	c.Visit(func(k, v []byte) bool {
+		n++
+		if vv, ok := m[string(k)]; !ok || !bytes.Equal(v, vv) {
+			t.Fatalf("unexpected entry visited for key=%q; len=%d", k, len(v))
+		}
+		delete(m, string(k))
+		return true
+	})
+	if len(m) != 0 || n != 1002 {
+		t.Fatalf("%d entries visited; %d entries missing", n, len(m))
+	}
+
+	n = 0
+	c.Visit(func(k, v []byte) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("unexpected entries visited after stop: %d", n)
+	}
+}
+
+func TestGetAny(t *testing.T) {
+	c := New(256 * 1024 * 1024)
+	defer c.Reset()
+
+	// The values of 16 bytes set by Set aren't taken for the metavalues of SetBig.
+	for _, valueSize := range []int{0, 16, MaxSubvalueLen, MaxSubvalueLen + 1, 1024 * 1024} {
+		k, v := []byte(fmt.Sprintf("key %d", valueSize)), createValue(valueSize, valueSize)
+		if valueSize <= MaxSubvalueLen {
+			c.Set(k, v)
+		} else {
+			c.SetBig(k, v)
+		}
+		if vv, ok := c.GetAny([]byte("dst"), k); !ok || !bytes.Equal(vv, append([]byte("dst"), v...)) {
+			t.Fatalf("unexpected value got for key=%q; got len=%d; want len=%d", k, len(vv), len(v))
+		}
+	}
+	if vv, ok := c.GetAny(nil, []byte("missing")); ok || len(vv) != 0 {
+		t.Fatalf("unexpected value got for a missing key: %q", vv)
+	}
+}
+
+func createValue(size, seed int) []byte {
+	var buf []byte
+	for i := 0; i < size; i++ {
+		buf = append(buf, byte(i+seed))
+	}
+	return buf
+}
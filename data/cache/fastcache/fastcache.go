@@ -2,9 +2,11 @@
 package fastcache
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 )
@@ -21,6 +23,17 @@ const maxGen = 1<<genSizeBits - 1
 
 const maxBucketSize uint64 = 1 << bucketSizeBits
 
+// the kind of an entry, it's encoded in the high byte of the key length,
+// since the key is smaller than 256 bytes.
+const (
+	kindValue byte = iota
+	kindBigMeta
+	kindBigSub
+)
+
+// kindTTL flags the entry with the expiration deadline (unix nano) after the length.
+const kindTTL byte = 0x80
+
 // Stats represents cache stats.
 //
 // Use Cache.UpdateStats for obtaining fresh stats from the cache.
@@ -45,6 +58,9 @@ type Stats struct {
 	// Corruptions may occur when corrupted cache is loaded from file.
 	Corruptions uint64
 
+	// Expirations is the number of the expired entries removed on read.
+	Expirations uint64
+
 	// EntriesCount is the current number of entries in the cache.
 	EntriesCount uint64
 
@@ -107,6 +123,9 @@ type Cache struct {
 	buckets [bucketsCount]bucket
 
 	bigStats BigStats
+
+	// wal logs the Set and Del operations, see OpenWAL.
+	wal *wal
 }
 
 // New returns new cache with the given maxBytes capacity in bytes.
@@ -141,9 +160,17 @@ func New(maxBytes int) *Cache {
 //
 // k and v contents may be modified after returning from Set.
 func (c *Cache) Set(k, v []byte) {
-	h := xxhash.Sum64(k)
-	idx := h % bucketsCount
-	c.buckets[idx].Set(k, v, h)
+	c.write(walSet, k, v, 0)
+}
+
+// SetWithTTL stores (k, v) in the cache, the entry expires after ttl.
+//
+// The expired entry is removed lazily on read, ttl <= 0 means no expiration.
+// (k, v) entries with summary size exceeding 64KB-12 aren't stored in the cache.
+//
+// k and v contents may be modified after returning from SetWithTTL.
+func (c *Cache) SetWithTTL(k, v []byte, ttl time.Duration) {
+	c.write(walSet, k, v, deadline(ttl))
 }
 
 // Get appends value by the key k to dst and returns the result.
@@ -156,24 +183,57 @@ func (c *Cache) Set(k, v []byte) {
 func (c *Cache) Get(dst, k []byte) []byte {
 	h := xxhash.Sum64(k)
 	idx := h % bucketsCount
-	dst, _ = c.buckets[idx].Get(dst, k, h, true)
+	dst, _, _, _ = c.buckets[idx].Get(dst, k, h, true)
 	return dst
 }
 
+// GetWithTTL works identically to HasGet, but also returns the remaining ttl
+// of the entry, 0 means no expiration.
+func (c *Cache) GetWithTTL(dst, k []byte) ([]byte, time.Duration, bool) {
+	h := xxhash.Sum64(k)
+	idx := h % bucketsCount
+	dst, exp, _, ok := c.buckets[idx].Get(dst, k, h, true)
+	if !ok || exp == 0 {
+		return dst, 0, ok
+	}
+	ttl := time.Duration(exp - time.Now().UnixNano())
+	if ttl <= 0 {
+		ttl = 1
+	}
+	return dst, ttl, true
+}
+
 // HasGet works identically to Get, but also returns whether the given key
 // exists in the cache. This method makes it possible to differentiate between a
 // stored nil/empty value versus and non-existing value.
 func (c *Cache) HasGet(dst, k []byte) ([]byte, bool) {
 	h := xxhash.Sum64(k)
 	idx := h % bucketsCount
-	return c.buckets[idx].Get(dst, k, h, true)
+	dst, _, _, ok := c.buckets[idx].Get(dst, k, h, true)
+	return dst, ok
+}
+
+// GetAny returns the value stored in c via Set or SetBig, the kind of the entry tells them apart.
+//
+// k contents may be modified after returning from GetAny.
+func (c *Cache) GetAny(dst, k []byte) ([]byte, bool) {
+	h := xxhash.Sum64(k)
+	idx := h % bucketsCount
+	dstLen := len(dst)
+	dst, _, kind, ok := c.buckets[idx].Get(dst, k, h, true)
+	if !ok || kind != kindBigMeta {
+		return dst, ok
+	}
+	atomic.AddUint64(&c.bigStats.GetBigCalls, 1)
+	metavalue := append([]byte{}, dst[dstLen:]...)
+	return c.getBig(dst[:dstLen], metavalue)
 }
 
 // Has returns true if entry for the given key k exists in the cache.
 func (c *Cache) Has(k []byte) bool {
 	h := xxhash.Sum64(k)
 	idx := h % bucketsCount
-	_, ok := c.buckets[idx].Get(nil, k, h, false)
+	_, _, _, ok := c.buckets[idx].Get(nil, k, h, false)
 	return ok
 }
 
@@ -181,13 +241,48 @@ func (c *Cache) Has(k []byte) bool {
 //
 // k contents may be modified after returning from Del.
 func (c *Cache) Del(k []byte) {
+	c.write(walDel, k, nil, 0)
+}
+
+func (c *Cache) del(k []byte) {
 	h := xxhash.Sum64(k)
 	idx := h % bucketsCount
 	c.buckets[idx].Del(h)
 }
 
+// Visit calls f for each live entry in the cache until f returns false.
+//
+// The values stored via SetBig are visited once with the whole value,
+// and the entries are visited in no particular order.
+// The entries set or deleted during the Visit may be visited or not.
+//
+// k and v contents may be modified after returning from f,
+// f may call the other methods of the cache.
+func (c *Cache) Visit(f func(k, v []byte) bool) {
+	var entries []visitEntry
+	for i := range c.buckets[:] {
+		entries = c.buckets[i].Visit(entries[:0])
+		for _, e := range entries {
+			v := e.v
+			if e.kind == kindBigMeta {
+				var ok bool
+				if v, ok = c.getBig(nil, v); !ok {
+					continue
+				}
+			}
+			if !f(e.k, v) {
+				return
+			}
+		}
+	}
+}
+
 // Reset removes all the items from the cache.
 func (c *Cache) Reset() {
+	c.write(walReset, nil, nil, 0)
+}
+
+func (c *Cache) reset() {
 	for i := range c.buckets[:] {
 		c.buckets[i].Reset()
 	}
@@ -209,6 +304,14 @@ func (c *Cache) UpdateStats(s *Stats) {
 	s.InvalidValueHashErrors += atomic.LoadUint64(&c.bigStats.InvalidValueHashErrors)
 }
 
+// deadline returns the expiration deadline of ttl in unix nano, 0 means no expiration.
+func deadline(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
 type bucket struct {
 	mu sync.RWMutex
 
@@ -230,6 +333,7 @@ type bucket struct {
 	misses      uint64
 	collisions  uint64
 	corruptions uint64
+	expirations uint64
 }
 
 func (b *bucket) Init(maxBytes uint64) {
@@ -263,6 +367,7 @@ func (b *bucket) Reset() {
 	atomic.StoreUint64(&b.misses, 0)
 	atomic.StoreUint64(&b.collisions, 0)
 	atomic.StoreUint64(&b.corruptions, 0)
+	atomic.StoreUint64(&b.expirations, 0)
 	b.mu.Unlock()
 }
 
@@ -288,6 +393,7 @@ func (b *bucket) UpdateStats(s *Stats) {
 	s.Misses += atomic.LoadUint64(&b.misses)
 	s.Collisions += atomic.LoadUint64(&b.collisions)
 	s.Corruptions += atomic.LoadUint64(&b.corruptions)
+	s.Expirations += atomic.LoadUint64(&b.expirations)
 
 	b.mu.RLock()
 	s.EntriesCount += uint64(len(b.m))
@@ -297,7 +403,7 @@ func (b *bucket) UpdateStats(s *Stats) {
 	b.mu.RUnlock()
 }
 
-func (b *bucket) Set(k, v []byte, h uint64) {
+func (b *bucket) Set(k, v []byte, h uint64, kind byte, deadline int64) {
 	setCalls := atomic.AddUint64(&b.setCalls, 1)
 	if setCalls%16384 == 0 {
 		//if setCalls%(1<<14) == 0 {
@@ -310,12 +416,18 @@ func (b *bucket) Set(k, v []byte, h uint64) {
 		// with 2 bytes (see below). Skip the entry.
 		return
 	}
-	var kvLenBuf [4]byte
-	kvLenBuf[0] = byte(uint16(len(k)) >> 8)
+	var kvLenBuf [12]byte
+	kvLenBuf[0] = kind
 	kvLenBuf[1] = byte(len(k))
 	kvLenBuf[2] = byte(uint16(len(v)) >> 8)
 	kvLenBuf[3] = byte(len(v))
-	kvLen := uint64(len(kvLenBuf) + len(k) + len(v))
+	hdrLen := 4
+	if deadline > 0 {
+		kvLenBuf[0] |= kindTTL
+		binary.BigEndian.PutUint64(kvLenBuf[4:], uint64(deadline))
+		hdrLen += 8
+	}
+	kvLen := uint64(hdrLen + len(k) + len(v))
 	if kvLen >= chunkSize {
 		// Do not store too big keys and values, since they do not
 		// fit a chunk.
@@ -349,7 +461,7 @@ func (b *bucket) Set(k, v []byte, h uint64) {
 		//chunk = getChunk()
 		chunk = chunk[:0]
 	}
-	chunk = append(chunk, kvLenBuf[:]...)
+	chunk = append(chunk, kvLenBuf[:hdrLen]...)
 	chunk = append(chunk, k...)
 	chunk = append(chunk, v...)
 	b.chunks[chunkIdx] = chunk
@@ -358,9 +470,11 @@ func (b *bucket) Set(k, v []byte, h uint64) {
 	b.mu.Unlock()
 }
 
-func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
+func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, int64, byte, bool) {
 	atomic.AddUint64(&b.getCalls, 1)
-	found := false
+	found, expired := false, false
+	var exp int64
+	var kind byte
 	b.mu.RLock()
 	v := b.m[h]
 	bGen := b.gen & ((1 << genSizeBits) - 1)
@@ -382,20 +496,33 @@ func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
 				goto end
 			}
 			kvLenBuf := chunk[idx : idx+4]
-			keyLen := (uint64(kvLenBuf[0]) << 8) | uint64(kvLenBuf[1])
+			keyLen := uint64(kvLenBuf[1])
 			valLen := (uint64(kvLenBuf[2]) << 8) | uint64(kvLenBuf[3])
 			idx += 4
+			if kvLenBuf[0]&kindTTL != 0 {
+				if idx+8 >= chunkSize {
+					// Corrupted data during the load from file. Just skip it.
+					atomic.AddUint64(&b.corruptions, 1)
+					goto end
+				}
+				exp = int64(binary.BigEndian.Uint64(chunk[idx:]))
+				idx += 8
+			}
 			if idx+keyLen+valLen >= chunkSize {
 				// Corrupted data during the load from file. Just skip it.
 				atomic.AddUint64(&b.corruptions, 1)
 				goto end
 			}
 			if string(k) == string(chunk[idx:idx+keyLen]) {
+				if exp > 0 && time.Now().UnixNano() >= exp {
+					expired = true
+					goto end
+				}
 				idx += keyLen
 				if returnDst {
 					dst = append(dst, chunk[idx:idx+valLen]...)
 				}
-				found = true
+				kind, found = kvLenBuf[0]&^kindTTL, true
 			} else {
 				atomic.AddUint64(&b.collisions, 1)
 			}
@@ -403,10 +530,19 @@ func (b *bucket) Get(dst, k []byte, h uint64, returnDst bool) ([]byte, bool) {
 	}
 end:
 	b.mu.RUnlock()
+	if expired {
+		// Remove the expired entry, unless it's overwritten.
+		atomic.AddUint64(&b.expirations, 1)
+		b.mu.Lock()
+		if b.m[h] == v {
+			delete(b.m, h)
+		}
+		b.mu.Unlock()
+	}
 	if !found {
 		atomic.AddUint64(&b.misses, 1)
 	}
-	return dst, found
+	return dst, exp, kind, found
 }
 
 func (b *bucket) Del(h uint64) {
@@ -414,3 +550,54 @@ func (b *bucket) Del(h uint64) {
 	delete(b.m, h)
 	b.mu.Unlock()
 }
+
+// visitEntry a copy of the (k, v) pair in chunks.
+type visitEntry struct {
+	k, v []byte
+	kind byte
+}
+
+// Visit appends the copies of the live entries to dst, the expired entries and
+// the sub-values of the big entries are skipped.
+func (b *bucket) Visit(dst []visitEntry) []visitEntry {
+	now := time.Now().UnixNano()
+	b.mu.RLock()
+	bGen := b.gen & ((1 << genSizeBits) - 1)
+	for _, v := range b.m {
+		gen := v >> bucketSizeBits
+		idx := v & ((1 << bucketSizeBits) - 1)
+		if !(gen == bGen && idx < b.idx || gen+1 == bGen && idx >= b.idx || gen == maxGen && bGen == 1 && idx >= b.idx) {
+			continue
+		}
+		chunkIdx := idx / chunkSize
+		if chunkIdx >= uint64(len(b.chunks)) {
+			continue
+		}
+		chunk := b.chunks[chunkIdx]
+		idx %= chunkSize
+		if idx+4 >= uint64(len(chunk)) {
+			continue
+		}
+		kvLenBuf := chunk[idx : idx+4]
+		kind := kvLenBuf[0] &^ kindTTL
+		keyLen := uint64(kvLenBuf[1])
+		valLen := (uint64(kvLenBuf[2]) << 8) | uint64(kvLenBuf[3])
+		idx += 4
+		if kvLenBuf[0]&kindTTL != 0 {
+			if idx+8 > uint64(len(chunk)) {
+				continue
+			}
+			if exp := int64(binary.BigEndian.Uint64(chunk[idx:])); now >= exp {
+				continue
+			}
+			idx += 8
+		}
+		if kind == kindBigSub || idx+keyLen+valLen > uint64(len(chunk)) {
+			continue
+		}
+		kv := append([]byte(nil), chunk[idx:idx+keyLen+valLen]...)
+		dst = append(dst, visitEntry{k: kv[:keyLen:keyLen], v: kv[keyLen:], kind: kind})
+	}
+	b.mu.RUnlock()
+	return dst
+}
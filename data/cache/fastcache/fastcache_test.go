@@ -282,3 +282,49 @@ func TestCacheResetUpdateStatsSetConcurrent(t *testing.T) {
 	statsWG.Wait()
 	resettersWG.Wait()
 }
+
+func TestCacheSetWithTTL(t *testing.T) {
+	c := New(1024)
+	defer c.Reset()
+
+	c.SetWithTTL([]byte("short"), []byte("v1"), 50*time.Millisecond)
+	c.SetWithTTL([]byte("long"), []byte("v2"), time.Hour)
+	c.SetWithTTL([]byte("none"), []byte("v3"), 0)
+	c.SetBigWithTTL([]byte("big"), make([]byte, 100*1024), 50*time.Millisecond)
+
+	v, ttl, ok := c.GetWithTTL(nil, []byte("short"))
+	if !ok || string(v) != "v1" || ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Fatalf("unexpected entry %q ttl=%s ok=%v", v, ttl, ok)
+	}
+	if v, ttl, ok = c.GetWithTTL(nil, []byte("none")); !ok || string(v) != "v3" || ttl != 0 {
+		t.Fatalf("unexpected entry without ttl %q ttl=%s ok=%v", v, ttl, ok)
+	}
+	if v = c.GetBig(nil, []byte("big")); len(v) != 100*1024 {
+		t.Fatalf("unexpected big value len=%d", len(v))
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if c.Has([]byte("short")) {
+		t.Fatalf("the expired entry is found")
+	}
+	if v = c.GetBig(nil, []byte("big")); len(v) > 0 {
+		t.Fatalf("the expired big value is found")
+	}
+	if v = c.Get(nil, []byte("long")); string(v) != "v2" {
+		t.Fatalf("unexpected entry %q", v)
+	}
+	n := 0
+	c.Visit(func(k, v []byte) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Fatalf("unexpected entries visited: %d", n)
+	}
+
+	var s Stats
+	c.UpdateStats(&s)
+	if s.Expirations != 2 || s.EntriesCount != 4 {
+		t.Fatalf("unexpected stats expirations=%d entries=%d", s.Expirations, s.EntriesCount)
+	}
+}
@@ -35,6 +35,11 @@ func (c *Cache) SaveToFile(filePath string) error {
 //
 // See also SaveToFile.
 func (c *Cache) SaveToFileConcurrent(filePath string, concurrency int) error {
+	return c.saveToFile(filePath, concurrency, 0)
+}
+
+// saveToFile saves cache data to filePath, walSeq is the last segment of the write-ahead log in the data.
+func (c *Cache) saveToFile(filePath string, concurrency int, walSeq uint64) error {
 	// Create dir if it doesn't exist.
 	dir := filepath.Dir(filePath)
 	if _, err := os.Stat(dir); err != nil {
@@ -60,7 +65,7 @@ func (c *Cache) SaveToFileConcurrent(filePath string, concurrency int) error {
 	if concurrency <= 0 || concurrency > gomaxprocs {
 		concurrency = gomaxprocs
 	}
-	if err := c.save(tmpDir, concurrency); err != nil {
+	if err := c.save(tmpDir, concurrency, walSeq); err != nil {
 		return fmt.Errorf("cannot save cache data to temporary dir %q: %s", tmpDir, err)
 	}
 
@@ -78,6 +83,8 @@ func (c *Cache) SaveToFileConcurrent(filePath string, concurrency int) error {
 
 // LoadFromFile loads cache data from the given filePath.
 //
+// The write-ahead log of filePath is replayed after the data, see OpenWAL.
+//
 // See SaveToFile* for saving cache data to file.
 func LoadFromFile(filePath string) (*Cache, error) {
 	return load(filePath, 0)
@@ -92,13 +99,20 @@ func LoadFromFileOrNew(filePath string, maxBytes int) *Cache {
 	if err == nil {
 		return c
 	}
-	return New(maxBytes)
+	c = New(maxBytes)
+	_ = c.replayWAL(filePath, 0)
+	return c
 }
 
-func (c *Cache) save(dir string, workersCount int) error {
+func (c *Cache) save(dir string, workersCount int, walSeq uint64) error {
 	if err := saveMetadata(c, dir); err != nil {
 		return err
 	}
+	if walSeq > 0 {
+		if err := saveWALSeq(dir, walSeq); err != nil {
+			return err
+		}
+	}
 
 	// Save buckets by workersCount concurrent workers.
 	workCh := make(chan int, workersCount)
@@ -181,8 +195,17 @@ func load(filePath string, maxBytes int) (*Cache, error) {
 		if len(b.chunks) == 0 {
 			b.chunks = make([][]byte, maxBucketChunks)
 			b.m = make(map[uint64]uint64)
+			b.gen = 1
 		}
 	}
+	// Replay the write-ahead log after the data.
+	walSeq, err := loadWALSeq(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.replayWAL(filePath, walSeq); err != nil {
+		return nil, err
+	}
 	return &c, nil
 }
 
@@ -271,6 +294,13 @@ func loadBuckets(buckets []bucket, dataPath string, maxChunks uint64) error {
 	}
 }
 
+// bucketFormatMagic marks the versioned format of a saved bucket in the high bits of the first uint64.
+// The unversioned format (version 0) starts with b.idx, which is smaller than maxBucketSize.
+const bucketFormatMagic uint64 = 0xfc5e << 48
+
+// bucketFormatVersion the version of the saved bucket, the version 1 adds the kind and the expiration to the entries.
+const bucketFormatVersion uint64 = 1
+
 func (b *bucket) Save(w io.Writer) error {
 	b.Clean()
 
@@ -297,6 +327,9 @@ func (b *bucket) Save(w io.Writer) error {
 		kvs = append(kvs, u64Buf[:]...)
 	}
 
+	if err := writeUint64(w, bucketFormatMagic|bucketFormatVersion); err != nil {
+		return fmt.Errorf("cannot write the format version: %s", err)
+	}
 	if err := writeUint64(w, bIdx); err != nil {
 		return fmt.Errorf("cannot write b.idx: %s", err)
 	}
@@ -332,6 +365,16 @@ func (b *bucket) Load(r io.Reader, maxChunks uint64) error {
 	if err != nil {
 		return fmt.Errorf("cannot read b.idx: %s", err)
 	}
+	if bIdx >= maxBucketSize {
+		// The versioned format, the entries of the version 0 have neither the kind nor the expiration,
+		// and they are compatible with the current version.
+		if bIdx&^0xffff != bucketFormatMagic || bIdx&0xffff > bucketFormatVersion {
+			return fmt.Errorf("unsupported format version %x", bIdx)
+		}
+		if bIdx, err = readUint64(r); err != nil {
+			return fmt.Errorf("cannot read b.idx: %s", err)
+		}
+	}
 	bGen, err := readUint64(r)
 	if err != nil {
 		return fmt.Errorf("cannot read b.gen: %s", err)
@@ -1,6 +1,8 @@
 package fastcache
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"sync"
@@ -229,3 +231,41 @@ func TestSaveLoadConcurrent(t *testing.T) {
 	close(stopCh)
 	wgWorkers.Wait()
 }
+
+func TestBucketLoadVersion0(t *testing.T) {
+	var b bucket
+	b.Init(chunkSize)
+	b.Set([]byte("k1"), []byte("v1"), 1, kindValue, 0)
+	b.Set([]byte("k2"), []byte("v2"), 2, kindValue, 0)
+
+	var buf bytes.Buffer
+	if err := b.Save(&buf); err != nil {
+		t.Fatalf("Save error: %s", err)
+	}
+	data := buf.Bytes()
+	if binary.LittleEndian.Uint64(data) != bucketFormatMagic|bucketFormatVersion {
+		t.Fatalf("unexpected format version %x", data[:8])
+	}
+
+	// The version 0 has no format version.
+	var b0 bucket
+	if err := b0.Load(bytes.NewReader(data[8:]), 1); err != nil {
+		t.Fatalf("Load version 0 error: %s", err)
+	}
+	if v, _, _, _ := b0.Get(nil, []byte("k2"), 2, true); string(v) != "v2" {
+		t.Fatalf("unexpected value %q", v)
+	}
+
+	var b1 bucket
+	if err := b1.Load(bytes.NewReader(data), 1); err != nil {
+		t.Fatalf("Load version 1 error: %s", err)
+	}
+	if v, _, _, _ := b1.Get(nil, []byte("k1"), 1, true); string(v) != "v1" {
+		t.Fatalf("unexpected value %q", v)
+	}
+
+	binary.LittleEndian.PutUint64(data, bucketFormatMagic|(bucketFormatVersion+1))
+	if err := new(bucket).Load(bytes.NewReader(data), 1); err == nil {
+		t.Fatalf("expecting an error of the unsupported version")
+	}
+}
@@ -7,16 +7,20 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // Timeline time data
 type Timeline struct {
-	CacheDir string // cache persist to disk directory
-	Frames   []*TimeFrame
-	Duration time.Duration
-	Index    int64
+	CacheDir  string // cache persist to disk directory
+	Frames    []*TimeFrame
+	Duration  time.Duration
+	Index     int64
+	Retention int // the number of past frames to keep, the older frames are removed, 0 keeps all
 }
 
 // TimeFrame time bounds on which data to retrieve.
@@ -24,6 +28,17 @@ type TimeFrame struct {
 	Cache *Cache // a fast thread-safe inmemory cache optimized for big number of entries.
 	Frame *f.TimeFrame
 	Index uint32
+
+	mu      sync.Mutex
+	saved   bool // the data is saved to disk, and the Cache is reset or reloaded
+	loaded  bool // the Cache is reloaded from disk
+	removed bool
+}
+
+// Aggregation the count and sum of the entries of a key.
+type Aggregation struct {
+	Count int64
+	Sum   float64
 }
 
 func (t *Timeline) Write(p []byte) (n int, err error) {
@@ -63,9 +78,123 @@ func (c *TimeFrame) Filename() string {
 	return fmt.Sprintf("%s.%d.json", c.Frame.Since.LocalTimeStampString(true), c.Index)
 }
 
+// Range calls fn for each entry of the frames in [since, until) by time until fn returns false,
+// the frames saved to cacheDir are reloaded lazily, and released after they are iterated.
+//
+// value contents may be modified after returning from fn.
+func (t *Timeline) Range(since, until time.Time, fn func(frame *TimeFrame, index uint32, value []byte) bool) error {
+	s, u := since.Unix(), until.Unix()
+	var value []byte
+	for _, c := range t.Frames {
+		if c.Frame.Until.UnixSecond <= s || c.Frame.Since.UnixSecond >= u {
+			continue
+		}
+		next, err := c.iterate(t.CacheDir, func(index uint32, cache *Cache) bool {
+			var ok bool
+			if value, ok = cache.HasGet(value[:0], f.BytesUint32(index)); !ok {
+				return true // evicted
+			}
+			return fn(c, index, value)
+		})
+		if err != nil {
+			return err
+		}
+		if !next {
+			break
+		}
+	}
+	return nil
+}
+
+// Aggregate counts and sums the entries of the frames in [since, until) by the key,
+// fn returns the key and the number of an entry, ok is false to skip it.
+func (t *Timeline) Aggregate(since, until time.Time, fn func(value []byte) (key string, n float64, ok bool)) (map[string]*Aggregation, error) {
+	result := make(map[string]*Aggregation)
+	err := t.Range(since, until, func(_ *TimeFrame, _ uint32, value []byte) bool {
+		if key, n, ok := fn(value); ok {
+			a := result[key]
+			if a == nil {
+				a = new(Aggregation)
+				result[key] = a
+			}
+			a.Count++
+			a.Sum += n
+		}
+		return true
+	})
+	return result, err
+}
+
+// iterate calls fn for the indexes of the entries, and returns false if fn returns false.
+func (c *TimeFrame) iterate(cacheDir string, fn func(index uint32, cache *Cache) bool) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(cacheDir); err != nil {
+		return true, err
+	}
+	if c.removed || c.saved && !c.loaded {
+		return true, nil
+	}
+	if c.saved {
+		// only a frame is resident while the saved frames are iterated
+		defer c.release()
+	}
+	for i, n := uint32(1), atomic.LoadUint32(&c.Index); i <= n; i++ {
+		if !fn(i, c.Cache) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// load reloads the data saved to cacheDir, by this frame or a previous timeline, c.mu must be locked.
+func (c *TimeFrame) load(cacheDir string) error {
+	if c.removed || c.loaded {
+		return nil
+	}
+	dirname := ""
+	if c.saved {
+		dirname = c.Dirname()
+	} else if atomic.LoadUint32(&c.Index) == 0 && c.Frame.Until.Before(time.Now()) {
+		// The past frame of a previous timeline, the max index is the last save.
+		since := c.Frame.Since.LocalTimeStampString(true)
+		dirs, _ := filepath.Glob(filepath.Join(cacheDir, since+".*"))
+		var max int64
+		for _, dir := range dirs {
+			if index, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(dir), since+"."), 10, 32); err == nil && index > max && f.IsDir(dir) {
+				max = index
+			}
+		}
+		if max == 0 {
+			return nil
+		}
+		c.Index, dirname = uint32(max), fmt.Sprintf("%s.%d", since, max)
+	} else {
+		return nil
+	}
+
+	cache, err := LoadFromFile(filepath.Join(cacheDir, dirname))
+	if err != nil {
+		return err
+	}
+	if c.Cache != nil {
+		c.Cache.Reset()
+	}
+	c.Cache, c.saved, c.loaded = cache, true, true
+	return nil
+}
+
+// release resets the reloaded data, it's reloaded by the next iterate, c.mu must be locked.
+func (c *TimeFrame) release() {
+	c.Cache.Reset()
+	c.loaded = false
+}
+
 func (c *TimeFrame) Save(cacheDir string) {
 	time.Sleep(time.Microsecond)
-	if c.Index == 0 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Index == 0 || c.saved || c.removed {
 		return
 	}
 
@@ -88,24 +217,26 @@ func (c *TimeFrame) Save(cacheDir string) {
 		logErr.Print(err)
 	} else {
 		c.Cache.Reset() // Reset removes all the items from the cache.
+		c.saved = true
 	}
 }
 
 func (c *TimeFrame) Remove(cacheDir string) {
-	if c.Index == 0 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.removed {
 		return
 	}
+	c.removed = true
+	c.Cache.Reset()
 
-	filePath := filepath.Join(cacheDir, c.Dirname())
-	err := os.Remove(filePath + ".json")
+	// The data saved by this frame or the previous timelines.
+	paths, _ := filepath.Glob(filepath.Join(cacheDir, c.Frame.Since.LocalTimeStampString(true)+".*"))
 	logErr := log.New(os.Stderr, "", 0)
-	if err != nil {
-		logErr.Print(err)
-	}
-
-	err = os.RemoveAll(filePath)
-	if err != nil {
-		logErr.Print(err)
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			logErr.Print(err)
+		}
 	}
 }
 
@@ -120,13 +251,36 @@ func (t *Timeline) init() {
 				go t.Frames[t.Index].Save(t.CacheDir)
 			}
 			atomic.StoreInt64(&t.Index, index)
+			t.retain(index)
 		}
 		time.Sleep(time.Second)
 	}
 	t.Index = -1
 }
 
-func NewTimeline(since, until time.Time, duration time.Duration, cacheDir string, maxBytes int) *Timeline {
+// retain removes the frames older than the Retention before the index.
+func (t *Timeline) retain(index int64) {
+	if t.Retention <= 0 {
+		return
+	}
+	for i := index - int64(t.Retention) - 1; i >= 0; i-- {
+		if c := t.Frames[i]; c.isRemoved() {
+			break
+		} else {
+			go c.Remove(t.CacheDir)
+		}
+	}
+}
+
+func (c *TimeFrame) isRemoved() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removed
+}
+
+// NewTimeline creates a timeline of the frames in [since, until) by the duration,
+// retention is the number of past frames to keep, the older frames are removed, 0 keeps all.
+func NewTimeline(since, until time.Time, duration time.Duration, cacheDir string, maxBytes int, retention ...int) *Timeline {
 	frames := f.NewTimeFrames(since, until, duration)
 
 	t := &Timeline{
@@ -135,6 +289,9 @@ func NewTimeline(since, until time.Time, duration time.Duration, cacheDir string
 		Duration: duration,
 		Index:    -1,
 	}
+	if len(retention) > 0 {
+		t.Retention = retention[0]
+	}
 
 	for i, frame := range frames {
 		t.Frames[i] = &TimeFrame{
@@ -1,12 +1,17 @@
 package fastcache
 
 import (
+	"fmt"
 	"github.com/angenalZZZ/gofunc/data"
 	"github.com/angenalZZZ/gofunc/data/random"
 	"github.com/angenalZZZ/gofunc/f"
+	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -66,3 +71,77 @@ func BenchmarkTimelineWriter(b *testing.B) {
 		_, _ = tl.Write(p)
 	}
 }
+
+func TestTimelineRange(t *testing.T) {
+	cacheDir := filepath.Join(os.TempDir(), "TestTimelineRange")
+	defer os.RemoveAll(cacheDir)
+	_ = os.MkdirAll(cacheDir, 0755)
+
+	since := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	tl := NewTimeline(since, since.Add(3*time.Minute), time.Minute, cacheDir, 1024)
+	for i, c := range tl.Frames {
+		for j := 0; j <= i; j++ {
+			n := atomic.AddUint32(&c.Index, 1)
+			c.Cache.Set(f.BytesUint32(n), []byte(fmt.Sprintf("k%d:%d", j%2, i+1)))
+		}
+	}
+	// The frame 0 is saved, and reloaded lazily.
+	tl.Frames[0].Save(cacheDir)
+	if tl.Frames[0].Cache.Has(f.BytesUint32(1)) {
+		t.Fatal("the saved frame isn't reset")
+	}
+
+	var values []string
+	_ = tl.Range(since, since.Add(2*time.Minute), func(frame *TimeFrame, index uint32, value []byte) bool {
+		values = append(values, string(value))
+		return true
+	})
+	if strings.Join(values, ",") != "k0:1,k0:2,k1:2" {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	aggregate := func(tl *Timeline) map[string]*Aggregation {
+		result, err := tl.Aggregate(since, since.Add(time.Hour), func(value []byte) (string, float64, bool) {
+			s := strings.Split(string(value), ":")
+			n, _ := strconv.ParseFloat(s[1], 64)
+			return s[0], n, true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if result := aggregate(tl); result["k0"].Count != 4 || result["k0"].Sum != 1+2+3+3 || result["k1"].Count != 2 || result["k1"].Sum != 2+3 {
+		t.Fatalf("unexpected aggregation %+v %+v", result["k0"], result["k1"])
+	}
+	if tl.Frames[0].loaded || tl.Frames[0].Cache.Has(f.BytesUint32(1)) {
+		t.Fatal("the reloaded frame isn't released")
+	}
+
+	// A new timeline reloads the past frames of the previous timeline.
+	tl.Save()
+	tl2 := NewTimeline(since, since.Add(3*time.Minute), time.Minute, cacheDir, 1024)
+	if result := aggregate(tl2); result["k0"].Count != 4 || result["k1"].Count != 2 {
+		t.Fatalf("unexpected aggregation after reloading %+v %+v", result["k0"], result["k1"])
+	}
+
+	// Retention removes the older frames.
+	tl2.Retention = 1
+	tl2.retain(2)
+	for !tl2.Frames[0].isRemoved() {
+		time.Sleep(time.Millisecond)
+	}
+	if tl2.Frames[1].isRemoved() || f.PathExists(filepath.Join(cacheDir, tl2.Frames[0].Dirname())) {
+		t.Fatal("unexpected retention")
+	}
+	if result := aggregate(tl2); result["k0"].Count != 3 || result["k1"].Count != 2 {
+		t.Fatalf("unexpected aggregation after retention %+v %+v", result["k0"], result["k1"])
+	}
+
+	// Retention removes the frames saved by the previous timelines, which aren't reloaded.
+	tl3 := NewTimeline(since, since.Add(3*time.Minute), time.Minute, cacheDir, 1024, 0)
+	tl3.Frames[1].Remove(cacheDir)
+	if paths, _ := filepath.Glob(filepath.Join(cacheDir, tl3.Frames[1].Frame.Since.LocalTimeStampString(true)+".*")); len(paths) != 0 {
+		t.Fatalf("the frame of the previous timeline isn't removed: %v", paths)
+	}
+}
@@ -0,0 +1,575 @@
+package fastcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// SyncPolicy is the fsync policy of the write-ahead log.
+type SyncPolicy int
+
+const (
+	// SyncInterval flushes and fsyncs the log every WALOptions.SyncInterval.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways flushes and fsyncs the log on every operation.
+	SyncAlways
+	// SyncNone flushes the log every WALOptions.SyncInterval, and leaves fsync to the OS.
+	SyncNone
+)
+
+// WALOptions represents the options of the write-ahead log.
+type WALOptions struct {
+	// Sync is the fsync policy of the log.
+	// Optional. Default: SyncInterval
+	Sync SyncPolicy
+	// SyncInterval is the interval to flush the log.
+	// Optional. Default: 1 second
+	SyncInterval time.Duration
+	// CheckpointSize is the size of the log to save a full checkpoint, < 0 disables it.
+	// Optional. Default: 64MB
+	CheckpointSize int64
+	// CheckpointInterval is the interval to save a full checkpoint.
+	// Optional. Default: 0, disabled
+	CheckpointInterval time.Duration
+	// Concurrency is the CPU cores to save a checkpoint.
+	// Optional. Default: GOMAXPROCS
+	Concurrency int
+}
+
+// the operations of the write-ahead log
+const (
+	walSet byte = iota + 1
+	walSetBig
+	walDel
+	walReset
+)
+
+// walHeaderSize the record header: crc32(4) of the payload, len(4) of the payload
+const walHeaderSize = 8
+
+// walPayloadSize the payload header: op(1), deadline(8), keyLen(2)
+const walPayloadSize = 11
+
+// walSeqFile the file of the last segment of the log in the saved data
+const walSeqFile = "wal.bin"
+
+// walStripeSize the size of the records buffered by a stripe, the log is flushed when it's exceeded
+const walStripeSize = 64 * 1024
+
+var walCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var walFileRegexp = regexp.MustCompile(`^([0-9a-f]{16})\.log$`)
+
+// ErrWALClosed is returned when the write-ahead log isn't opened.
+var ErrWALClosed = errors.New("fastcache: the write-ahead log isn't opened")
+
+// wal the write-ahead log of a cache, the segments are in the dir filePath.wal.
+//
+// The records are buffered by the stripe of the bucket of the key, so the operations
+// on the different buckets don't wait for each other, and the records of a key are in
+// the same order as the cache. mu is locked before the stripes.
+type wal struct {
+	mu   sync.Mutex
+	path string
+	dir  string
+	opts WALOptions
+
+	stripes [bucketsCount]walStripe
+
+	seq  uint64
+	f    *os.File
+	w    *bufio.Writer
+	size int64 // the size of the segments since the last checkpoint
+	err  error // the first error of writing the log, a checkpoint recovers it
+
+	closed bool
+
+	checkpointMu   sync.Mutex
+	checkpointing  int32
+	lastCheckpoint time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// walStripe the records of the keys of a bucket, which aren't written to the segment yet
+type walStripe struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// OpenWAL opens the write-ahead log of the cache data saved to filePath.
+//
+// The Set, Del and Reset operations are appended to the log, and Checkpoint saves the
+// full data to filePath and removes the log before it. LoadFromFile* replays the log
+// after the data, so restart time and I/O scale with the changes rather than the size.
+//
+// Call CloseWAL before Reset, if the cache is no longer needed, and the data is kept.
+// OpenWAL and CloseWAL mustn't be called concurrently with other operations.
+func (c *Cache) OpenWAL(filePath string, options ...*WALOptions) error {
+	if c.wal != nil {
+		return fmt.Errorf("fastcache: the write-ahead log of %q is opened", c.wal.path)
+	}
+	w := &wal{path: filePath, dir: filePath + ".wal", lastCheckpoint: time.Now()}
+	if len(options) > 0 && options[0] != nil {
+		w.opts = *options[0]
+	}
+	if w.opts.SyncInterval <= 0 {
+		w.opts.SyncInterval = time.Second
+	}
+	if w.opts.CheckpointSize == 0 {
+		w.opts.CheckpointSize = 64 * 1024 * 1024
+	}
+
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return fmt.Errorf("cannot create dir %q: %s", w.dir, err)
+	}
+	walSeq, err := loadWALSeq(filePath)
+	if err != nil {
+		return err
+	}
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	// Never append to the existing segments, a new segment follows them.
+	w.seq = walSeq
+	for _, s := range segments {
+		if s.seq > w.seq {
+			w.seq = s.seq
+		}
+		if s.seq > walSeq {
+			w.size += s.size
+		}
+	}
+	if err = w.open(w.seq + 1); err != nil {
+		return err
+	}
+
+	w.stop, w.done = make(chan struct{}), make(chan struct{})
+	go w.run(c)
+	c.wal = w
+	return nil
+}
+
+// CloseWAL flushes and closes the write-ahead log, and returns the first error of writing the log.
+// The records are dropped after an error until the next checkpoint, which is saved automatically.
+func (c *Cache) CloseWAL() error {
+	w := c.wal
+	if w == nil {
+		return ErrWALClosed
+	}
+	close(w.stop)
+	<-w.done
+	w.checkpointMu.Lock()
+	defer w.checkpointMu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sync(true)
+	if err := w.f.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	w.closed = true
+	c.wal = nil
+	return w.err
+}
+
+// Checkpoint saves the full data to the filePath of the write-ahead log, and removes the log before it.
+//
+// Checkpoint may be called concurrently with other operations on the cache.
+func (c *Cache) Checkpoint() error {
+	w := c.wal
+	if w == nil {
+		return ErrWALClosed
+	}
+	return w.checkpoint(c)
+}
+
+// WALError returns the first error of writing the write-ahead log since the last checkpoint.
+func (c *Cache) WALError() error {
+	w := c.wal
+	if w == nil {
+		return ErrWALClosed
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// write applies the operation to the cache, and appends it to the write-ahead log.
+func (c *Cache) write(op byte, k, v []byte, deadline int64) {
+	w := c.wal
+	if w == nil {
+		c.apply(op, k, v, deadline)
+		return
+	}
+	if op == walReset {
+		w.reset(c)
+		return
+	}
+	// The records of a key are in the same order as the cache.
+	s := &w.stripes[xxhash.Sum64(k)%bucketsCount]
+	s.mu.Lock()
+	c.apply(op, k, v, deadline)
+	s.buf = appendWALRecord(s.buf, op, k, v, deadline)
+	flush := len(s.buf) >= walStripeSize
+	s.mu.Unlock()
+
+	if flush || w.opts.Sync == SyncAlways {
+		w.mu.Lock()
+		w.sync(w.opts.Sync == SyncAlways)
+		w.mu.Unlock()
+	}
+}
+
+func (c *Cache) apply(op byte, k, v []byte, deadline int64) {
+	switch op {
+	case walSet:
+		c.set(k, v, kindValue, deadline)
+	case walSetBig:
+		c.setBig(k, v, deadline)
+	case walDel:
+		c.del(k)
+	case walReset:
+		c.reset()
+	}
+}
+
+// replayWAL replays the segments of the write-ahead log of filePath after walSeq.
+func (c *Cache) replayWAL(filePath string, walSeq uint64) error {
+	segments, err := walSegments(filePath + ".wal")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, s := range segments {
+		if s.seq <= walSeq {
+			continue
+		}
+		if err = c.replaySegment(s.path, s.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment replays a segment, and truncates the corrupted tail of it.
+func (c *Cache) replaySegment(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %s", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	r := bufio.NewReaderSize(file, 64*1024)
+	var (
+		offset int64
+		header [walHeaderSize]byte
+		buf    []byte
+	)
+	for {
+		if _, err = io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		n := int64(binary.LittleEndian.Uint32(header[4:]))
+		if n < walPayloadSize || offset+walHeaderSize+n > size {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		if int64(cap(buf)) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err = io.ReadFull(r, buf); err != nil {
+			break
+		}
+		if crc32.Checksum(buf, walCastagnoli) != binary.LittleEndian.Uint32(header[:]) {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		op, deadline, keyLen := buf[0], int64(binary.LittleEndian.Uint64(buf[1:])), int64(binary.LittleEndian.Uint16(buf[9:]))
+		if walPayloadSize+keyLen > n {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		k, v := buf[walPayloadSize:walPayloadSize+keyLen], buf[walPayloadSize+keyLen:]
+		c.apply(op, k, v, deadline)
+		offset += walHeaderSize + n
+	}
+	if err == io.EOF {
+		return nil
+	}
+	if err == io.ErrUnexpectedEOF {
+		// Truncate the corrupted tail.
+		if err = file.Truncate(offset); err != nil {
+			return fmt.Errorf("cannot truncate %q to %d: %s", path, offset, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot read %q: %s", path, err)
+}
+
+func (w *wal) open(seq uint64) error {
+	path := filepath.Join(w.dir, fmt.Sprintf("%016x.log", seq))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %s", path, err)
+	}
+	w.seq, w.f = seq, file
+	if w.w == nil {
+		w.w = bufio.NewWriterSize(file, 256*1024)
+	} else {
+		w.w.Reset(file)
+	}
+	return nil
+}
+
+func (w *wal) checkpoint(c *Cache) error {
+	w.checkpointMu.Lock()
+	defer w.checkpointMu.Unlock()
+
+	// Rotate the segment, the operations after it are replayed after the data.
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrWALClosed
+	}
+	seq, size := w.seq, w.size
+	w.sync(true)
+	_ = w.f.Close()
+	if err := w.open(seq + 1); err != nil {
+		w.err = err
+		w.mu.Unlock()
+		return err
+	}
+	lost := w.err
+	w.err = nil
+	w.mu.Unlock()
+
+	if err := c.saveToFile(w.path, w.opts.Concurrency, seq); err != nil {
+		if lost != nil {
+			w.mu.Lock()
+			if w.err == nil {
+				w.err = lost
+			}
+			w.mu.Unlock()
+		}
+		return err
+	}
+	if segments, err := walSegments(w.dir); err == nil {
+		for _, s := range segments {
+			if s.seq <= seq {
+				_ = os.Remove(s.path)
+			}
+		}
+	}
+
+	w.mu.Lock()
+	w.size -= size
+	w.lastCheckpoint = time.Now()
+	w.mu.Unlock()
+	return nil
+}
+
+// reset resets the cache, and appends the record after the records of all the stripes.
+func (w *wal) reset(c *Cache) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.stripes {
+		w.stripes[i].mu.Lock()
+	}
+	for i := range w.stripes {
+		w.drain(&w.stripes[i])
+	}
+	c.apply(walReset, nil, nil, 0)
+	w.write(appendWALRecord(nil, walReset, nil, nil, 0))
+	for i := range w.stripes {
+		w.stripes[i].mu.Unlock()
+	}
+	if w.opts.Sync == SyncAlways {
+		w.sync(true)
+	}
+}
+
+// drain writes the records of a stripe to the segment, w.mu and s.mu must be locked.
+func (w *wal) drain(s *walStripe) {
+	if len(s.buf) == 0 {
+		return
+	}
+	w.write(s.buf)
+	if cap(s.buf) > 4*walStripeSize {
+		s.buf = nil
+	} else {
+		s.buf = s.buf[:0]
+	}
+}
+
+// write writes the records to the segment, they are dropped after an error, w.mu must be locked.
+func (w *wal) write(records []byte) {
+	if w.err != nil {
+		return
+	}
+	if _, err := w.w.Write(records); err != nil {
+		w.err = err
+		return
+	}
+	w.size += int64(len(records))
+}
+
+// appendWALRecord appends a record of the operation to dst.
+func appendWALRecord(dst []byte, op byte, k, v []byte, deadline int64) []byte {
+	n := walPayloadSize + len(k) + len(v)
+	i := len(dst)
+	if cap(dst)-i < walHeaderSize+n {
+		buf := make([]byte, i, 2*cap(dst)+walHeaderSize+n)
+		copy(buf, dst)
+		dst = buf
+	}
+	buf := dst[i : i+walHeaderSize+n]
+	payload := buf[walHeaderSize:]
+	payload[0] = op
+	binary.LittleEndian.PutUint64(payload[1:], uint64(deadline))
+	binary.LittleEndian.PutUint16(payload[9:], uint16(len(k)))
+	copy(payload[walPayloadSize:], k)
+	copy(payload[walPayloadSize+len(k):], v)
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(payload, walCastagnoli))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(n))
+	return dst[:i+walHeaderSize+n]
+}
+
+// sync writes the records of the stripes, flushes the log, and fsyncs it if fsync is true, w.mu must be locked.
+func (w *wal) sync(fsync bool) {
+	for i := range w.stripes {
+		s := &w.stripes[i]
+		s.mu.Lock()
+		w.drain(s)
+		s.mu.Unlock()
+	}
+	if w.err != nil {
+		return
+	}
+	if err := w.w.Flush(); err != nil {
+		w.err = err
+		return
+	}
+	if fsync {
+		if err := w.f.Sync(); err != nil {
+			w.err = err
+		}
+	}
+}
+
+// run flushes the log, and saves the checkpoints in the background.
+func (w *wal) run(c *Cache) {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		// A checkpoint recovers the records dropped after an error.
+		w.mu.Lock()
+		w.sync(w.opts.Sync != SyncNone)
+		checkpoint := w.err != nil || w.opts.CheckpointSize > 0 && w.size >= w.opts.CheckpointSize ||
+			w.opts.CheckpointInterval > 0 && time.Since(w.lastCheckpoint) >= w.opts.CheckpointInterval
+		w.mu.Unlock()
+
+		if checkpoint && atomic.CompareAndSwapInt32(&w.checkpointing, 0, 1) {
+			go func() {
+				defer atomic.StoreInt32(&w.checkpointing, 0)
+				if err := w.checkpoint(c); err != nil && err != ErrWALClosed {
+					w.mu.Lock()
+					if w.err == nil {
+						w.err = err
+					}
+					w.mu.Unlock()
+				}
+			}()
+		}
+	}
+}
+
+// walSegment a segment file of the log
+type walSegment struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+// walSegments returns the segments in the dir by the sequence.
+func walSegments(dir string) ([]walSegment, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []walSegment
+	for _, fi := range fis {
+		m := walFileRegexp.FindStringSubmatch(fi.Name())
+		if fi.IsDir() || m == nil {
+			continue
+		}
+		seq, _ := strconv.ParseUint(m[1], 16, 64)
+		segments = append(segments, walSegment{seq: seq, path: filepath.Join(dir, fi.Name()), size: fi.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	return segments, nil
+}
+
+func saveWALSeq(dir string, walSeq uint64) error {
+	path := dir + "/" + walSeqFile
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %s", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if err := writeUint64(file, walSeq); err != nil {
+		return fmt.Errorf("cannot write walSeq=%d to %q: %s", walSeq, path, err)
+	}
+	return nil
+}
+
+// loadWALSeq returns the last segment of the log in the saved data, 0 if the data is saved without the log.
+func loadWALSeq(dir string) (uint64, error) {
+	path := dir + "/" + walSeqFile
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("cannot open %q: %s", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	walSeq, err := readUint64(file)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read walSeq from %q: %s", path, err)
+	}
+	return walSeq, nil
+}
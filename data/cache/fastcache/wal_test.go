@@ -0,0 +1,237 @@
+package fastcache
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	const filePath = "TestWALReplay.fastcache"
+	defer func() {
+		_ = os.RemoveAll(filePath)
+		_ = os.RemoveAll(filePath + ".wal")
+	}()
+	const maxBytes = 32 * 1024 * 1024
+
+	c := New(maxBytes)
+	if err := c.OpenWAL(filePath, &WALOptions{Sync: SyncAlways}); err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	c.Del([]byte("key 0"))
+	c.SetWithTTL([]byte("ttl"), []byte("v"), time.Hour)
+	c.SetWithTTL([]byte("expired"), []byte("v"), time.Millisecond)
+	c.SetBig([]byte("big"), make([]byte, 200*1024))
+	if err := c.CloseWAL(); err != nil {
+		t.Fatalf("CloseWAL error: %s", err)
+	}
+	c.Reset()
+	time.Sleep(2 * time.Millisecond)
+
+	// There is no checkpoint, the log is replayed to a new cache.
+	c = LoadFromFileOrNew(filePath, maxBytes)
+	checkWALCache := func(c *Cache, n int) {
+		t.Helper()
+		for i := 1; i < n; i++ {
+			if v := c.Get(nil, []byte(fmt.Sprintf("key %d", i))); string(v) != fmt.Sprintf("value %d", i) {
+				t.Fatalf("unexpected value for key %d: %q", i, v)
+			}
+		}
+		if c.Has([]byte("key 0")) || c.Has([]byte("expired")) {
+			t.Fatalf("the deleted or expired entry is found")
+		}
+		if _, ttl, ok := c.GetWithTTL(nil, []byte("ttl")); !ok || ttl <= 0 || ttl > time.Hour {
+			t.Fatalf("unexpected ttl=%s ok=%v", ttl, ok)
+		}
+		if v := c.GetBig(nil, []byte("big")); len(v) != 200*1024 {
+			t.Fatalf("unexpected big value len=%d", len(v))
+		}
+	}
+	checkWALCache(c, 100)
+
+	// The checkpoint and the log after it.
+	if err := c.OpenWAL(filePath); err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	if err := c.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint error: %s", err)
+	}
+	segments, _ := walSegments(filePath + ".wal")
+	if len(segments) != 1 {
+		t.Fatalf("unexpected segments after the checkpoint: %v", segments)
+	}
+	for i := 100; i < 200; i++ {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err := c.CloseWAL(); err != nil {
+		t.Fatalf("CloseWAL error: %s", err)
+	}
+	c.Reset()
+
+	// The corrupted tail is truncated.
+	segments, _ = walSegments(filePath + ".wal")
+	last := segments[len(segments)-1]
+	file, _ := os.OpenFile(last.path, os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = file.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20})
+	_ = file.Close()
+
+	c, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c.Reset()
+	checkWALCache(c, 200)
+	if fi, _ := os.Stat(last.path); fi.Size() != last.size {
+		t.Fatalf("the corrupted tail isn't truncated: %d; want %d", fi.Size(), last.size)
+	}
+
+	// Reset is replayed.
+	if err = c.OpenWAL(filePath); err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	c.Reset()
+	c.Set([]byte("after"), []byte("reset"))
+	if err = c.CloseWAL(); err != nil {
+		t.Fatalf("CloseWAL error: %s", err)
+	}
+	c1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c1.Reset()
+	if c1.Has([]byte("key 1")) || string(c1.Get(nil, []byte("after"))) != "reset" {
+		t.Fatalf("Reset isn't replayed")
+	}
+}
+
+func TestWALCheckpointSize(t *testing.T) {
+	const filePath = "TestWALCheckpointSize.fastcache"
+	defer func() {
+		_ = os.RemoveAll(filePath)
+		_ = os.RemoveAll(filePath + ".wal")
+	}()
+
+	c := New(32 * 1024 * 1024)
+	defer c.Reset()
+	if err := c.OpenWAL(filePath, &WALOptions{SyncInterval: 10 * time.Millisecond, CheckpointSize: 1024}); err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		c.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if walSeq, _ := loadWALSeq(filePath); walSeq > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the checkpoint isn't saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Set([]byte("key 100"), []byte("value 100"))
+	if err := c.CloseWAL(); err != nil {
+		t.Fatalf("CloseWAL error: %s", err)
+	}
+
+	c1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c1.Reset()
+	for i := 0; i <= 100; i++ {
+		if v := c1.Get(nil, []byte(fmt.Sprintf("key %d", i))); string(v) != fmt.Sprintf("value %d", i) {
+			t.Fatalf("unexpected value for key %d: %q", i, v)
+		}
+	}
+}
+
+func TestWALConcurrent(t *testing.T) {
+	const filePath = "TestWALConcurrent.fastcache"
+	defer func() {
+		_ = os.RemoveAll(filePath)
+		_ = os.RemoveAll(filePath + ".wal")
+	}()
+
+	c := New(32 * 1024 * 1024)
+	defer c.Reset()
+	if err := c.OpenWAL(filePath, &WALOptions{SyncInterval: time.Millisecond}); err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	// The records of a key are in the order of the cache.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := []byte(fmt.Sprintf("key %d", i%100))
+				c.Set(k, []byte(fmt.Sprintf("value %d %d", g, i)))
+				if i%7 == 0 {
+					c.Del(k)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := c.CloseWAL(); err != nil {
+		t.Fatalf("CloseWAL error: %s", err)
+	}
+
+	c1 := LoadFromFileOrNew(filePath, 32*1024*1024)
+	defer c1.Reset()
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v, ok := c.HasGet(nil, k)
+		if v1, ok1 := c1.HasGet(nil, k); ok != ok1 || string(v) != string(v1) {
+			t.Fatalf("unexpected value for key %d: %q, want %q", i, v1, v)
+		}
+	}
+}
+
+func TestWALErrorCheckpoint(t *testing.T) {
+	const filePath = "TestWALErrorCheckpoint.fastcache"
+	defer func() {
+		_ = os.RemoveAll(filePath)
+		_ = os.RemoveAll(filePath + ".wal")
+	}()
+
+	c := New(32 * 1024 * 1024)
+	defer c.Reset()
+	if err := c.OpenWAL(filePath, &WALOptions{SyncInterval: 10 * time.Millisecond, CheckpointSize: -1}); err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	// The segment fails, the records are dropped until the checkpoint.
+	c.wal.mu.Lock()
+	_ = c.wal.f.Close()
+	c.wal.mu.Unlock()
+	c.Set([]byte("key"), []byte("value"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if walSeq, _ := loadWALSeq(filePath); walSeq > 0 && c.WALError() == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the checkpoint isn't saved after the error: %v", c.WALError())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Set([]byte("after"), []byte("checkpoint"))
+	if err := c.CloseWAL(); err != nil {
+		t.Fatalf("CloseWAL error: %s", err)
+	}
+
+	c1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer c1.Reset()
+	if string(c1.Get(nil, []byte("key"))) != "value" || string(c1.Get(nil, []byte("after"))) != "checkpoint" {
+		t.Fatalf("the records are lost after the error")
+	}
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/angenalZZZ/gofunc/data/cache/metrics"
+	"github.com/angenalZZZ/gofunc/data/cache/store"
+	"github.com/go-redis/redis/v7"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/xid"
+)
+
+// InvalidationTransport publishes and subscribes the invalidation messages of the chain caches across instances
+type InvalidationTransport interface {
+	Publish(data []byte) error
+	Subscribe(handler func(data []byte)) (unsubscribe func() error, err error)
+}
+
+// InvalidationOptions represents the invalidation bus options
+type InvalidationOptions struct {
+	// Origin identifies the instance, the messages of itself are ignored, default a random id
+	Origin string
+	// Metrics records the invalidations sent and received
+	Metrics metrics.InvalidationMetricsInterface
+}
+
+// InvalidationStats allows to returns some statistics of the invalidation bus
+type InvalidationStats struct {
+	Sent      int64
+	SendError int64
+	Received  int64
+	Ignored   int64 // the messages of itself
+}
+
+// invalidationMessage the invalidation of the keys, tags or all data
+type invalidationMessage struct {
+	Origin string   `json:"o"`
+	Keys   []string `json:"k,omitempty"`
+	Tags   []string `json:"t,omitempty"`
+	Clear  bool     `json:"c,omitempty"`
+}
+
+// InvalidationBus publishes the Set, Delete, Invalidate and Clear of a chain to the other instances,
+// and evicts the local caches of the chain (all but the last shared cache, e.g. Redis) on their messages
+type InvalidationBus struct {
+	origin      string
+	chain       *ChainCache
+	transport   InvalidationTransport
+	metrics     metrics.InvalidationMetricsInterface
+	stats       InvalidationStats
+	unsubscribe func() error
+}
+
+// NewInvalidationBus creates an invalidation bus of the chain, and subscribes the messages of the other instances
+func NewInvalidationBus(chain *ChainCache, transport InvalidationTransport, options ...*InvalidationOptions) (*InvalidationBus, error) {
+	bus := &InvalidationBus{chain: chain, transport: transport}
+	if len(options) > 0 && options[0] != nil {
+		bus.origin, bus.metrics = options[0].Origin, options[0].Metrics
+	}
+	if bus.origin == "" {
+		bus.origin = xid.New().String()
+	}
+
+	unsubscribe, err := transport.Subscribe(bus.receive)
+	if err != nil {
+		return nil, err
+	}
+	bus.unsubscribe = unsubscribe
+	chain.busMu.Lock()
+	chain.bus = bus
+	chain.busMu.Unlock()
+	return bus, nil
+}
+
+// Origin returns the id of the instance
+func (b *InvalidationBus) Origin() string {
+	return b.origin
+}
+
+// Stats returns the statistics of the invalidations
+func (b *InvalidationBus) Stats() InvalidationStats {
+	return InvalidationStats{
+		Sent:      atomic.LoadInt64(&b.stats.Sent),
+		SendError: atomic.LoadInt64(&b.stats.SendError),
+		Received:  atomic.LoadInt64(&b.stats.Received),
+		Ignored:   atomic.LoadInt64(&b.stats.Ignored),
+	}
+}
+
+// Close unsubscribes the messages, and detaches the bus from the chain
+func (b *InvalidationBus) Close() error {
+	b.chain.busMu.Lock()
+	if b.chain.bus == b {
+		b.chain.bus = nil
+	}
+	b.chain.busMu.Unlock()
+	return b.unsubscribe()
+}
+
+func (b *InvalidationBus) publish(msg *invalidationMessage) {
+	msg.Origin = b.origin
+	data, _ := json.Marshal(msg)
+	if err := b.transport.Publish(data); err != nil {
+		atomic.AddInt64(&b.stats.SendError, 1)
+	} else {
+		atomic.AddInt64(&b.stats.Sent, 1)
+	}
+	b.record()
+}
+
+func (b *InvalidationBus) receive(data []byte) {
+	msg := new(invalidationMessage)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return
+	}
+	if msg.Origin == b.origin {
+		atomic.AddInt64(&b.stats.Ignored, 1)
+		return
+	}
+	atomic.AddInt64(&b.stats.Received, 1)
+
+	for _, cache := range b.locals() {
+		if msg.Clear {
+			_ = cache.Clear()
+			continue
+		}
+		for _, key := range msg.Keys {
+			_ = cache.Delete(key)
+		}
+		if len(msg.Tags) > 0 {
+			_ = cache.Invalidate(store.InvalidateOptions{Tags: msg.Tags})
+		}
+	}
+	b.record()
+}
+
+// locals returns the local caches of the chain.
+func (b *InvalidationBus) locals() []StorageInterface {
+	caches := b.chain.GetCaches()
+	if len(caches) > 1 {
+		return caches[:len(caches)-1]
+	}
+	return caches
+}
+
+func (b *InvalidationBus) record() {
+	if b.metrics != nil {
+		stats := b.Stats()
+		b.metrics.RecordInvalidation(stats.Sent, stats.SendError, stats.Received, stats.Ignored)
+	}
+}
+
+// redisTransport Redis pub/sub
+type redisTransport struct {
+	client  *redis.Client
+	channel string
+}
+
+// NewRedisTransport creates an invalidation transport over Redis pub/sub
+func NewRedisTransport(client *redis.Client, channel string) InvalidationTransport {
+	return &redisTransport{client: client, channel: channel}
+}
+
+func (t *redisTransport) Publish(data []byte) error {
+	return t.client.Publish(t.channel, data).Err()
+}
+
+func (t *redisTransport) Subscribe(handler func(data []byte)) (func() error, error) {
+	sub := t.client.Subscribe(t.channel)
+	if _, err := sub.Receive(); err != nil {
+		_ = sub.Close()
+		return nil, err
+	}
+	go func() {
+		for msg := range sub.Channel() {
+			handler([]byte(msg.Payload))
+		}
+	}()
+	return sub.Close, nil
+}
+
+// natsTransport NATS
+type natsTransport struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNatsTransport creates an invalidation transport over NATS
+func NewNatsTransport(conn *nats.Conn, subject string) InvalidationTransport {
+	return &natsTransport{conn: conn, subject: subject}
+}
+
+func (t *natsTransport) Publish(data []byte) error {
+	return t.conn.Publish(t.subject, data)
+}
+
+func (t *natsTransport) Subscribe(handler func(data []byte)) (func() error, error) {
+	sub, err := t.conn.Subscribe(t.subject, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub.Unsubscribe, nil
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/cache/store"
+	"github.com/go-redis/redis/v7"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// testHub a transport of the instances in process.
+type testHub struct {
+	sync.Mutex
+	handlers map[int]func(data []byte)
+	next     int
+}
+
+func (h *testHub) Publish(data []byte) error {
+	h.Lock()
+	defer h.Unlock()
+	for _, handler := range h.handlers {
+		handler(data)
+	}
+	return nil
+}
+
+func (h *testHub) Subscribe(handler func(data []byte)) (func() error, error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.handlers == nil {
+		h.handlers = make(map[int]func(data []byte))
+	}
+	id := h.next
+	h.handlers[id], h.next = handler, h.next+1
+	return func() error {
+		h.Lock()
+		defer h.Unlock()
+		delete(h.handlers, id)
+		return nil
+	}, nil
+}
+
+func TestInvalidationBus(t *testing.T) {
+	hub, l2 := new(testHub), New(store.NewMemory(nil))
+	l1a, l1b := New(store.NewMemory(nil)), New(store.NewMemory(nil))
+	a, b := NewChain(l1a, l2), NewChain(l1b, l2)
+	busA, _ := NewInvalidationBus(a, hub)
+	busB, _ := NewInvalidationBus(b, hub)
+	defer func() { _ = busA.Close(); _ = busB.Close() }()
+
+	setSync := &store.Options{Tags: []string{"tag"}}
+	_ = l1a.Set("k", "v1", setSync)
+	_ = l1b.Set("k", "v1", setSync)
+	_ = l2.Set("k", "v1", setSync)
+
+	// The Set of a evicts the stale L1 of b, and keeps the L1 of a.
+	_ = a.Set("k", "v2", &store.Options{})
+	if _, err := l1b.Get("k"); err == nil {
+		t.Fatal("the stale L1 of b is not evicted")
+	}
+	if v, _ := l1a.Get("k"); v != "v2" {
+		t.Fatalf("the L1 of a: %v", v)
+	}
+
+	_ = l1b.Set("t", "v", setSync)
+	_ = a.Invalidate(store.InvalidateOptions{Tags: []string{"tag"}})
+	if _, err := l1b.Get("t"); err == nil {
+		t.Fatal("the tag of b is not invalidated")
+	}
+
+	_ = l1a.Set("d", "v", nil)
+	_ = b.Delete("d")
+	if _, err := l1a.Get("d"); err == nil {
+		t.Fatal("the key of a is not deleted")
+	}
+
+	if s := busA.Stats(); s.Sent != 2 || s.Received != 1 || s.Ignored != 2 {
+		t.Fatalf("stats of a %+v", s)
+	}
+	if s := busB.Stats(); s.Sent != 1 || s.Received != 2 || s.Ignored != 1 {
+		t.Fatalf("stats of b %+v", s)
+	}
+}
+
+func TestNatsTransport(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testTransport(t, NewNatsTransport(conn, "cache.invalidation"))
+}
+
+func TestRedisTransport(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	defer func() { _ = client.Close() }()
+	if err := client.Ping().Err(); err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+	testTransport(t, NewRedisTransport(client, "cache.invalidation"))
+}
+
+// testTransport the Set of an instance evicts the L1 of the other instance by the transport.
+func testTransport(t *testing.T, transport InvalidationTransport) {
+	l2 := New(store.NewMemory(nil))
+	l1a, l1b := New(store.NewMemory(nil)), New(store.NewMemory(nil))
+	a, b := NewChain(l1a, l2), NewChain(l1b, l2)
+	busA, err := NewInvalidationBus(a, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	busB, err := NewInvalidationBus(b, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = busA.Close(); _ = busB.Close() }()
+
+	_ = l1b.Set("k", "v1", nil)
+	_ = a.Set("k", "v2", &store.Options{})
+	deadline := time.Now().Add(time.Second)
+	_, err = l1b.Get("k")
+	for err == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		_, err = l1b.Get("k")
+	}
+	if err == nil {
+		t.Fatal("the stale L1 of b is not evicted")
+	}
+	if s := busB.Stats(); s.Received != 1 {
+		t.Fatalf("stats of b %+v", s)
+	}
+}
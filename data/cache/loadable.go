@@ -2,6 +2,9 @@ package cache
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/angenalZZZ/gofunc/data/cache/store"
@@ -12,60 +15,240 @@ const (
 	LoadableType = "loadable"
 )
 
-type loadableKeyValue struct {
-	key   string
-	value interface{}
+type loadFunction func(key interface{}) (interface{}, error)
+
+// LoadableOptions represents the loadable cache options
+type LoadableOptions struct {
+	// Expiration is the time a loaded value stays fresh, 0 means the value is set with the default options
+	// of the cache and never refreshed
+	Expiration time.Duration
+
+	// StaleTTL is the time a value is served stale after the expiration, while it's refreshed in the background
+	StaleTTL time.Duration
+
+	// Beta refreshes a value early before the expiration with a probability that grows as the expiration
+	// approaches and the load takes longer (XFetch), 1.0 is the usual value, 0 disables the early refresh
+	Beta float64
+
+	// ErrorTTL caches the errors of the load function for the time, 0 disables the negative caching
+	ErrorTTL time.Duration
 }
 
-type loadFunction func(key interface{}) (interface{}, error)
+// loadableItem the freshness of a loaded value
+type loadableItem struct {
+	freshUntil time.Time
+	delta      time.Duration // the time it took to load
+}
 
-// LoadableCache represents a cache that uses a function to load data
+// loadableError a cached error of the load function
+type loadableError struct {
+	err       error
+	expiresAt time.Time
+}
+
+// loadableCall an in-flight load, the concurrent loads of a key wait for it
+type loadableCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+
+	// mu guards the generation, which starts at 0 when the call is registered and is bumped
+	// by Delete, Set and Clear, the loaded value is not written back when it has changed
+	mu  sync.Mutex
+	gen int
+}
+
+// LoadableCache represents a cache that uses a function to load data,
+// the concurrent loads of a key are coalesced into a single call of the function
 type LoadableCache struct {
-	loadFunc   loadFunction
-	cache      Interface
-	setChannel chan *loadableKeyValue
+	loadFunc loadFunction
+	cache    Interface
+	options  LoadableOptions
+
+	mu      sync.Mutex
+	calls   map[string]*loadableCall
+	items   map[string]*loadableItem
+	errors  map[string]*loadableError
+	pruneAt int
 }
 
 // NewLoadable create a new cache that uses a function to load data
-func NewLoadable(loadFunc loadFunction, cache Interface) *LoadableCache {
+func NewLoadable(loadFunc loadFunction, cache Interface, options ...*LoadableOptions) *LoadableCache {
 	loadable := &LoadableCache{
-		loadFunc:   loadFunc,
-		cache:      cache,
-		setChannel: make(chan *loadableKeyValue, 10000),
+		loadFunc: loadFunc,
+		cache:    cache,
+		calls:    make(map[string]*loadableCall),
+		items:    make(map[string]*loadableItem),
+		errors:   make(map[string]*loadableError),
+		pruneAt:  1024,
 	}
+	if len(options) > 0 && options[0] != nil {
+		loadable.options = *options[0]
+	}
+	return loadable
+}
+
+// Get returns the object stored in cache if it exists, otherwise loads it from the load function.
+// A stale or nearly expired object is returned while it's refreshed in the background.
+func (c *LoadableCache) Get(key string) (object interface{}, err error) {
+	now := time.Now()
 
-	go loadable.setter()
+	c.mu.Lock()
+	if e, ok := c.errors[key]; ok {
+		if now.Before(e.expiresAt) {
+			c.mu.Unlock()
+			return nil, e.err
+		}
+		delete(c.errors, key)
+	}
+	item := c.items[key]
+	c.mu.Unlock()
 
-	return loadable
+	object, err = c.cache.Get(key)
+	if err != nil {
+		// Unable to find in cache, try to load it from load function
+		return c.load(key, true)
+	}
+
+	if item != nil && (!now.Before(item.freshUntil) || c.early(now, item)) {
+		_, _ = c.load(key, false)
+	}
+	return
 }
 
-func (c *LoadableCache) setter() {
-	for item := range c.setChannel {
-		_ = c.Set(item.key, item.value, nil)
+// early determines whether to refresh a fresh item before the expiration.
+func (c *LoadableCache) early(now time.Time, item *loadableItem) bool {
+	if c.options.Beta <= 0 {
+		return false
 	}
+	gap := time.Duration(float64(item.delta) * c.options.Beta * -math.Log(rand.Float64()))
+	return !now.Add(gap).Before(item.freshUntil)
 }
 
-// Get returns the object stored in cache if it exists
-func (c *LoadableCache) Get(key string) (object interface{}, err error) {
-	object, err = c.cache.Get(key)
-	if err == nil {
+// load calls the load function once for the concurrent loads of a key,
+// it waits for the result or refreshes the key in the background.
+func (c *LoadableCache) load(key string, wait bool) (interface{}, error) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		if !wait {
+			return nil, nil
+		}
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	call := new(loadableCall)
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	if !wait {
+		go c.call(key, call)
+		return nil, nil
+	}
+	c.call(key, call)
+	return call.value, call.err
+}
+
+func (c *LoadableCache) call(key string, call *loadableCall) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	start := time.Now()
+	call.value, call.err = c.loadOnce(key)
+	now := time.Now()
+
+	// the key is deleted, set or cleared since the call is registered, the result is dropped
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	if call.gen != 0 {
 		return
 	}
 
-	// Unable to find in cache, try to load it from load function
-	object, err = c.loadFunc(key)
-	if err != nil {
-		_ = fmt.Errorf("An error has occurred while trying to load item from load function: %v\n", err)
+	if call.err != nil {
+		if c.options.ErrorTTL > 0 {
+			c.mu.Lock()
+			c.errors[key] = &loadableError{err: call.err, expiresAt: now.Add(c.options.ErrorTTL)}
+			c.prune(now)
+			c.mu.Unlock()
+		}
 		return
 	}
 
 	// Then, put it back in cache
-	c.setChannel <- &loadableKeyValue{key, object}
-	return
+	var options *store.Options
+	if c.options.Expiration > 0 {
+		options = &store.Options{Expiration: c.options.Expiration + c.options.StaleTTL}
+	}
+	if err := c.cache.Set(key, call.value, options); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.errors, key)
+	if c.options.Expiration > 0 {
+		c.items[key] = &loadableItem{freshUntil: now.Add(c.options.Expiration), delta: now.Sub(start)}
+		c.prune(now)
+	}
+	c.mu.Unlock()
+}
+
+// loadOnce calls the load function, a panic is returned as the error.
+func (c *LoadableCache) loadOnce(key string) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = nil, fmt.Errorf("unable to load the key '%s': %v", key, r)
+		}
+	}()
+	return c.loadFunc(key)
+}
+
+// prune removes the items evicted by the cache and the expired errors, the mu must be locked.
+func (c *LoadableCache) prune(now time.Time) {
+	if len(c.items)+len(c.errors) < c.pruneAt {
+		return
+	}
+	for key, item := range c.items {
+		if now.After(item.freshUntil.Add(c.options.StaleTTL)) {
+			delete(c.items, key)
+		}
+	}
+	for key, e := range c.errors {
+		if now.After(e.expiresAt) {
+			delete(c.errors, key)
+		}
+	}
+	if n := 2 * (len(c.items) + len(c.errors)); n > c.pruneAt {
+		c.pruneAt = n
+	}
+}
+
+// forget removes the freshness and the cached error of a key, and drops the result of its in-flight load.
+func (c *LoadableCache) forget(key string) {
+	c.mu.Lock()
+	delete(c.items, key)
+	delete(c.errors, key)
+	call := c.calls[key]
+	c.mu.Unlock()
+	if call != nil {
+		call.bump()
+	}
+}
+
+// bump bumps the generation of the call, it waits for the write back in progress.
+func (call *loadableCall) bump() {
+	call.mu.Lock()
+	call.gen++
+	call.mu.Unlock()
 }
 
 // Set sets a value in available caches
 func (c *LoadableCache) Set(key string, object interface{}, options *store.Options) error {
+	c.forget(key)
 	return c.cache.Set(key, object, options)
 }
 
@@ -76,6 +259,7 @@ func (c *LoadableCache) TTL(key string) (time.Duration, error) {
 
 // Delete removes a value from cache
 func (c *LoadableCache) Delete(key string) error {
+	c.forget(key)
 	return c.cache.Delete(key)
 }
 
@@ -86,6 +270,17 @@ func (c *LoadableCache) Invalidate(options store.InvalidateOptions) error {
 
 // Clear resets all cache data
 func (c *LoadableCache) Clear() error {
+	c.mu.Lock()
+	c.items = make(map[string]*loadableItem)
+	c.errors = make(map[string]*loadableError)
+	calls := make([]*loadableCall, 0, len(c.calls))
+	for _, call := range c.calls {
+		calls = append(calls, call)
+	}
+	c.mu.Unlock()
+	for _, call := range calls {
+		call.bump()
+	}
 	return c.cache.Clear()
 }
 
@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/cache/store"
+)
+
+// testMapCache a cache of a map with the expiration.
+type testMapCache struct {
+	sync.Mutex
+	items map[string]testMapItem
+}
+
+type testMapItem struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+func newTestMapCache() *testMapCache {
+	return &testMapCache{items: make(map[string]testMapItem)}
+}
+
+func (c *testMapCache) Get(key string) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+	item, ok := c.items[key]
+	if !ok || (!item.expiresAt.IsZero() && time.Now().After(item.expiresAt)) {
+		return nil, errors.New("not found")
+	}
+	return item.value, nil
+}
+
+func (c *testMapCache) Set(key string, object interface{}, options *store.Options) error {
+	c.Lock()
+	defer c.Unlock()
+	item := testMapItem{value: object}
+	if options != nil && options.Expiration > 0 {
+		item.expiresAt = time.Now().Add(options.Expiration)
+	}
+	c.items[key] = item
+	return nil
+}
+
+func (c *testMapCache) TTL(key string) (time.Duration, error) { return 0, nil }
+
+func (c *testMapCache) Delete(key string) error {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.items, key)
+	return nil
+}
+
+func (c *testMapCache) Invalidate(options store.InvalidateOptions) error { return nil }
+
+func (c *testMapCache) Clear() error {
+	c.Lock()
+	defer c.Unlock()
+	c.items = make(map[string]testMapItem)
+	return nil
+}
+
+func (c *testMapCache) GetType() string { return "map" }
+
+func TestLoadableSingleflight(t *testing.T) {
+	var calls int32
+	loadable := NewLoadable(func(key interface{}) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return "value", nil
+	}, newTestMapCache())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := loadable.Get("hot"); err != nil || v != "value" {
+				t.Errorf("get %v %v", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("load calls %d", calls)
+	}
+	if _, err := loadable.Get("hot"); err != nil || calls != 1 {
+		t.Fatalf("load calls %d %v", calls, err)
+	}
+}
+
+func TestLoadableStaleWhileRevalidate(t *testing.T) {
+	var calls int32
+	loadable := NewLoadable(func(key interface{}) (interface{}, error) {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return n, nil
+	}, newTestMapCache(), &LoadableOptions{Expiration: 50 * time.Millisecond, StaleTTL: time.Second})
+
+	if v, _ := loadable.Get("k"); v != int32(1) {
+		t.Fatalf("get %v", v)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// The stale value is served, and refreshed in the background.
+	for i := 0; i < 10; i++ {
+		if v, _ := loadable.Get("k"); v != int32(1) {
+			t.Fatalf("get stale %v", v)
+		}
+	}
+	time.Sleep(40 * time.Millisecond)
+	if v, _ := loadable.Get("k"); v != int32(2) || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("get refreshed %v, calls %d", v, calls)
+	}
+}
+
+func TestLoadableEarlyRefresh(t *testing.T) {
+	var calls int32
+	loadable := NewLoadable(func(key interface{}) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return atomic.AddInt32(&calls, 1), nil
+	}, newTestMapCache(), &LoadableOptions{Expiration: 100 * time.Millisecond, Beta: 100})
+
+	_, _ = loadable.Get("k")
+	// The load takes 10ms, so a beta of 100 refreshes the value early almost surely.
+	for i := 0; i < 10 && atomic.LoadInt32(&calls) == 1; i++ {
+		_, _ = loadable.Get("k")
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&calls) < 2 {
+		t.Fatalf("no early refresh")
+	}
+}
+
+func TestLoadableNegativeCaching(t *testing.T) {
+	var calls int32
+	errLoad := errors.New("db is down")
+	loadable := NewLoadable(func(key interface{}) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errLoad
+	}, newTestMapCache(), &LoadableOptions{ErrorTTL: 50 * time.Millisecond})
+
+	for i := 0; i < 10; i++ {
+		if _, err := loadable.Get("k"); err != errLoad {
+			t.Fatalf("get %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("load calls %d", calls)
+	}
+	time.Sleep(60 * time.Millisecond)
+	_, _ = loadable.Get("k")
+	if calls != 2 {
+		t.Fatalf("load calls %d after the error ttl", calls)
+	}
+
+	// Set forgets the error.
+	_ = loadable.Set("k", "v", nil)
+	if v, err := loadable.Get("k"); err != nil || v != "v" {
+		t.Fatalf("get %v %v", v, err)
+	}
+}
+
+func TestLoadableDeleteWhileLoading(t *testing.T) {
+	loading, release := make(chan struct{}), make(chan struct{})
+	cache := newTestMapCache()
+	loadable := NewLoadable(func(key interface{}) (interface{}, error) {
+		close(loading)
+		<-release
+		return "old", nil
+	}, cache, &LoadableOptions{Expiration: time.Minute})
+
+	done := make(chan interface{})
+	go func() {
+		v, _ := loadable.Get("k")
+		done <- v
+	}()
+	<-loading
+	_ = loadable.Delete("k")
+	close(release)
+	if v := <-done; v != "old" {
+		t.Fatalf("get %v", v)
+	}
+	if v, err := cache.Get("k"); err == nil {
+		t.Fatalf("the deleted key is written back: %v", v)
+	}
+}
+
+func TestLoadableSetWhileRefreshing(t *testing.T) {
+	var calls int32
+	loading, release := make(chan struct{}), make(chan struct{})
+	cache := newTestMapCache()
+	loadable := NewLoadable(func(key interface{}) (interface{}, error) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			return "v1", nil
+		case 2:
+			close(loading)
+			<-release
+		}
+		return "old", nil
+	}, cache, &LoadableOptions{Expiration: time.Millisecond, StaleTTL: time.Minute})
+
+	if v, err := loadable.Get("k"); err != nil || v != "v1" {
+		t.Fatalf("get %v %v", v, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// the background refresh is slow, the key is set meanwhile
+	if v, err := loadable.Get("k"); err != nil || v != "v1" {
+		t.Fatalf("get stale %v %v", v, err)
+	}
+	<-loading
+	_ = loadable.Set("k", "new", nil)
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for loadable.inFlight("k") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if v, err := cache.Get("k"); err != nil || v != "new" {
+		t.Fatalf("the refreshed value overwrites the set value: %v %v", v, err)
+	}
+
+	// the key is set after the refresh is registered, before its goroutine starts
+	call := new(loadableCall)
+	call.wg.Add(1)
+	loadable.mu.Lock()
+	loadable.calls["k"] = call
+	loadable.mu.Unlock()
+	_ = loadable.Set("k", "newer", nil)
+	loadable.call("k", call)
+	if v, err := cache.Get("k"); err != nil || v != "newer" {
+		t.Fatalf("the refreshed value overwrites the set value: %v %v", v, err)
+	}
+}
+
+// inFlight reports whether the key is loading.
+func (c *LoadableCache) inFlight(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.calls[key]
+	return ok
+}
+
+func TestLoadablePanic(t *testing.T) {
+	var calls int32
+	cache := newTestMapCache()
+	loadable := NewLoadable(func(key interface{}) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			panic("db is down")
+		}
+		return "v", nil
+	}, cache, &LoadableOptions{Expiration: time.Millisecond, StaleTTL: time.Minute})
+
+	if v, err := loadable.Get("k"); err != nil || v != "v" {
+		t.Fatalf("get %v %v", v, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// the background refresh panics
+	if v, err := loadable.Get("k"); err != nil || v != "v" {
+		t.Fatalf("get stale %v %v", v, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	_ = cache.Delete("k")
+	if _, err := loadable.Get("k"); err == nil {
+		t.Fatal("the panic is not returned")
+	}
+}
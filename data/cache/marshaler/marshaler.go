@@ -3,20 +3,25 @@ package marshaler
 import (
 	"github.com/angenalZZZ/gofunc/data/cache"
 	"github.com/angenalZZZ/gofunc/data/cache/store"
-	"github.com/vmihailenco/msgpack"
 	"time"
 )
 
 // Marshaler is the struct that marshal and unmarshal cache values
 type Marshaler struct {
-	cache cache.Interface
+	cache      cache.Interface
+	serializer Serializer
 }
 
-// New creates a new marshaler that marshals/unmarshals cache values
-func New(cache cache.Interface) *Marshaler {
-	return &Marshaler{
-		cache: cache,
+// New creates a new marshaler that marshals/unmarshals cache values, the serializer is Msgpack by default
+func New(cache cache.Interface, serializer ...Serializer) *Marshaler {
+	m := &Marshaler{
+		cache:      cache,
+		serializer: Msgpack,
 	}
+	if len(serializer) > 0 && serializer[0] != nil {
+		m.serializer = serializer[0]
+	}
+	return m
 }
 
 // Get obtains a value from cache and unmarshal value with given object
@@ -28,10 +33,10 @@ func (c *Marshaler) Get(key string, returnObj interface{}) (interface{}, error)
 
 	switch result.(type) {
 	case []byte:
-		err = msgpack.Unmarshal(result.([]byte), returnObj)
+		err = c.serializer.Unmarshal(result.([]byte), returnObj)
 
 	case string:
-		err = msgpack.Unmarshal([]byte(result.(string)), returnObj)
+		err = c.serializer.Unmarshal([]byte(result.(string)), returnObj)
 	}
 
 	if err != nil {
@@ -43,7 +48,7 @@ func (c *Marshaler) Get(key string, returnObj interface{}) (interface{}, error)
 
 // Set sets a value in cache by marshaling value
 func (c *Marshaler) Set(key string, object interface{}, options *store.Options) error {
-	bytes, err := msgpack.Marshal(object)
+	bytes, err := c.serializer.Marshal(object)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,43 @@
+package marshaler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/cache"
+	"github.com/angenalZZZ/gofunc/data/cache/store"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+type testBook struct {
+	ID    int
+	Name  string
+	Price float64
+}
+
+func TestMarshalerSerializers(t *testing.T) {
+	fast := cache.New(store.NewFastcache(32<<20, ""))
+
+	for name, serializer := range map[string]Serializer{"json": JSON, "msgpack": Msgpack, "gob": Gob, "default": nil} {
+		m := New(fast, serializer)
+		book := &testBook{ID: 1, Name: name, Price: 9.9}
+		if err := m.Set(name, book, &store.Options{Expiration: time.Minute}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		v, err := m.Get(name, new(testBook))
+		if err != nil || *v.(*testBook) != *book {
+			t.Fatalf("%s: %v %v", name, v, err)
+		}
+	}
+
+	m := New(fast, Protobuf)
+	if err := m.Set("pb", &wrappers.StringValue{Value: "protobuf"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.Get("pb", new(wrappers.StringValue)); err != nil || v.(*wrappers.StringValue).Value != "protobuf" {
+		t.Fatalf("protobuf: %v %v", v, err)
+	}
+	if err := m.Set("pb", testBook{}, nil); err != ErrNotProtoMessage {
+		t.Fatalf("protobuf: %v", err)
+	}
+}
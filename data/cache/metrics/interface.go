@@ -6,3 +6,8 @@ import "github.com/angenalZZZ/gofunc/data/cache/codec"
 type MetricsInterface interface {
 	RecordFromCodec(codec codec.CodecInterface)
 }
+
+// InvalidationMetricsInterface represents the metrics interface of the invalidations across instances
+type InvalidationMetricsInterface interface {
+	RecordInvalidation(sent, sendError, received, ignored int64)
+}
@@ -75,3 +75,11 @@ func (m *Prometheus) recorder() {
 func (m *Prometheus) RecordFromCodec(codec codec.CodecInterface) {
 	m.codecChannel <- codec
 }
+
+// RecordInvalidation records the invalidations of a chain sent and received across instances
+func (m *Prometheus) RecordInvalidation(sent, sendError, received, ignored int64) {
+	m.record("invalidation", "sent", float64(sent))
+	m.record("invalidation", "send_error", float64(sendError))
+	m.record("invalidation", "received", float64(received))
+	m.record("invalidation", "ignored", float64(ignored))
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/cache/fastcache"
+	"github.com/angenalZZZ/gofunc/f"
+)
+
+const (
+	// FastcacheType represents the storage type as a string value
+	FastcacheType = "fastcache"
+	// FastcacheTagPattern represents the tag pattern to be used as the prefix of the keys of a tag in specified storage
+	FastcacheTagPattern = "gocache_tag_%s"
+)
+
+// fastcacheHeaderSize the value header: expiresAt(8) unix nano, 0 means no expiration, kind(1)
+const fastcacheHeaderSize = 9
+
+// the kind of a value, the value is returned as it's set
+const (
+	fastcacheBytes byte = iota
+	fastcacheString
+)
+
+// fastcacheMaxEntrySize the max size of key and value, the larger entries aren't stored by fastcache
+const fastcacheMaxEntrySize = 64*1024 - 4
+
+// ErrValueType is returned when the value of a bytes store is not []byte or string, use a marshaler for the others
+var ErrValueType = errors.New("value must be []byte or string")
+
+// FastcacheStore is a store for fastcache, the TTL is encoded in the value header
+type FastcacheStore struct {
+	client  *fastcache.Cache
+	options *Options
+	dir     string
+}
+
+// NewFastcache creates a new store to fastcache, the data is loaded from the snapshot dir if it's not empty
+func NewFastcache(maxBytes int, dir string, options ...*Options) *FastcacheStore {
+	option := &Options{}
+	if len(options) > 0 && options[0] != nil {
+		option = options[0]
+	}
+
+	var client *fastcache.Cache
+	if dir != "" {
+		client = fastcache.LoadFromFileOrNew(dir, maxBytes)
+	} else {
+		client = fastcache.New(maxBytes)
+	}
+
+	return &FastcacheStore{
+		client:  client,
+		options: option,
+		dir:     dir,
+	}
+}
+
+// Get returns data stored from a given key
+func (s *FastcacheStore) Get(key string) (interface{}, error) {
+	data, ok := s.client.HasGet(nil, f.Bytes(key))
+	if !ok || len(data) < fastcacheHeaderSize {
+		return nil, ErrNotFound
+	}
+	if exp := int64(binary.BigEndian.Uint64(data)); exp > 0 && time.Now().UnixNano() >= exp {
+		s.client.Del(f.Bytes(key))
+		return nil, ErrNotFound
+	}
+
+	if data[8] == fastcacheString {
+		return string(data[fastcacheHeaderSize:]), nil
+	}
+	return data[fastcacheHeaderSize:], nil
+}
+
+// TTL returns a expiration time, 0 means no expiration
+func (s *FastcacheStore) TTL(key string) (time.Duration, error) {
+	data, ok := s.client.HasGet(nil, f.Bytes(key))
+	if !ok || len(data) < fastcacheHeaderSize {
+		return 0, ErrNotFound
+	}
+	exp := int64(binary.BigEndian.Uint64(data))
+	if exp == 0 {
+		return 0, nil
+	}
+	d := time.Duration(exp - time.Now().UnixNano())
+	if d <= 0 {
+		s.client.Del(f.Bytes(key))
+		return 0, ErrNotFound
+	}
+	return d, nil
+}
+
+// Set defines data in fastcache for given key identifier, the value must be []byte or string
+func (s *FastcacheStore) Set(key string, value interface{}, options *Options) error {
+	if options == nil {
+		options = s.options
+	}
+
+	var (
+		kind byte
+		v    []byte
+	)
+	switch value := value.(type) {
+	case []byte:
+		kind, v = fastcacheBytes, value
+	case string:
+		kind, v = fastcacheString, f.Bytes(value)
+	default:
+		return ErrValueType
+	}
+	if len(key)+fastcacheHeaderSize+len(v) > fastcacheMaxEntrySize {
+		return fmt.Errorf("the entry of key %q exceeds 64KB", key)
+	}
+
+	data := make([]byte, fastcacheHeaderSize, fastcacheHeaderSize+len(v))
+	if options.Expiration > 0 {
+		binary.BigEndian.PutUint64(data, uint64(time.Now().Add(options.Expiration).UnixNano()))
+	}
+	data[8] = kind
+	s.client.Set(f.Bytes(key), append(data, v...))
+
+	if tags := options.TagsValue(); len(tags) > 0 {
+		return s.setTags(key, tags, options.Expiration)
+	}
+
+	return nil
+}
+
+// setTags sets an entry of each tag and key, which has the expiration of the value.
+// The entries of a tag are found by the prefix, so the keys may contain any characters.
+func (s *FastcacheStore) setTags(key string, tags []string, expiration time.Duration) error {
+	for _, tag := range tags {
+		if err := s.Set(fastcacheTagPrefix(tag)+key, "", &Options{Expiration: expiration}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fastcacheTagPrefix the prefix of the entries of a tag.
+func fastcacheTagPrefix(tag string) string {
+	return fmt.Sprintf(FastcacheTagPattern, tag) + "\x00"
+}
+
+// Delete removes data from fastcache for given key identifier
+func (s *FastcacheStore) Delete(key string) error {
+	s.client.Del(f.Bytes(key))
+	return nil
+}
+
+// Invalidate invalidates some cache data in fastcache for given options,
+// the entries of the tags are found by visiting all the entries
+func (s *FastcacheStore) Invalidate(options InvalidateOptions) error {
+	tags := options.TagsValue()
+	if len(tags) == 0 {
+		return nil
+	}
+
+	prefixes := make([][]byte, len(tags))
+	for i, tag := range tags {
+		prefixes[i] = []byte(fastcacheTagPrefix(tag))
+	}
+	var keys [][]byte
+	s.client.Visit(func(k, v []byte) bool {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(k, prefix) {
+				keys = append(keys, append([]byte{}, k...), append([]byte{}, k[len(prefix):]...))
+				break
+			}
+		}
+		return true
+	})
+	for _, k := range keys {
+		s.client.Del(k)
+	}
+
+	return nil
+}
+
+// Clear resets all data in the store
+func (s *FastcacheStore) Clear() error {
+	s.client.Reset()
+	return nil
+}
+
+// Save saves a snapshot of the data to the dir, it may be called concurrently with other operations
+func (s *FastcacheStore) Save() error {
+	if s.dir == "" {
+		return nil
+	}
+	return s.client.SaveToFileConcurrent(s.dir, 0)
+}
+
+// Close saves a snapshot of the data to the dir, and releases the memory
+func (s *FastcacheStore) Close() error {
+	err := s.Save()
+	s.client.Reset()
+	return err
+}
+
+// GetType returns the store type
+func (s *FastcacheStore) GetType() string {
+	return FastcacheType
+}
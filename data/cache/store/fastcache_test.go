@@ -0,0 +1,99 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFastcache(t *testing.T) {
+	store := NewFastcache(32<<20, "")
+	defer func() { _ = store.Close() }()
+
+	_ = store.Set("b", []byte("bytes"), nil)
+	_ = store.Set("s", "string", &Options{Expiration: 50 * time.Millisecond, Tags: []string{"tag"}})
+	if v, err := store.Get("b"); err != nil || string(v.([]byte)) != "bytes" {
+		t.Fatalf("get %v %v", v, err)
+	}
+	if v, err := store.Get("s"); err != nil || v != "string" {
+		t.Fatalf("get %v %v", v, err)
+	}
+	if ttl, err := store.TTL("s"); err != nil || ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Fatalf("ttl %v %v", ttl, err)
+	}
+	if ttl, err := store.TTL("b"); err != nil || ttl != 0 {
+		t.Fatalf("ttl %v %v", ttl, err)
+	}
+	if err := store.Set("i", 1, nil); err != ErrValueType {
+		t.Fatalf("set int: %v", err)
+	}
+	if err := store.Set("big", make([]byte, 64*1024), nil); err == nil {
+		t.Fatal("set big")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := store.Get("s"); err != ErrNotFound {
+		t.Fatal("s is not expired")
+	}
+
+	_ = store.Set("t", "v", &Options{Tags: []string{"tag"}})
+	_ = store.Invalidate(InvalidateOptions{Tags: []string{"tag"}})
+	if _, err := store.Get("t"); err != ErrNotFound {
+		t.Fatal("t is not invalidated")
+	}
+
+	_ = store.Clear()
+	if _, err := store.Get("b"); err != ErrNotFound {
+		t.Fatal("not cleared")
+	}
+}
+
+func TestFastcacheTags(t *testing.T) {
+	store := NewFastcache(32<<20, "")
+	defer func() { _ = store.Close() }()
+
+	// The keys of a tag exceed 64KB, and contain the commas.
+	for i := 0; i < 10000; i++ {
+		if err := store.Set(fmt.Sprintf("k,%d", i), "v", &Options{Tags: []string{"tag"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = store.Set("k", "v", &Options{Tags: []string{"tag2"}})
+	_ = store.Invalidate(InvalidateOptions{Tags: []string{"tag"}})
+	for i := 0; i < 10000; i++ {
+		if _, err := store.Get(fmt.Sprintf("k,%d", i)); err != ErrNotFound {
+			t.Fatalf("k,%d is not invalidated", i)
+		}
+	}
+	if _, err := store.Get("k"); err != nil {
+		t.Fatal("k of tag2 is invalidated")
+	}
+
+	if err := store.Set(string(make([]byte, 64*1024-20)), "v", &Options{Tags: []string{"tag"}}); err == nil {
+		t.Fatal("the tag of a big key is set")
+	}
+}
+
+func TestFastcacheSnapshot(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fastcache")
+	defer func() { _ = os.RemoveAll(dir) }()
+	dir = filepath.Join(dir, "snapshot")
+
+	store := NewFastcache(32<<20, dir)
+	_ = store.Set("k", "v", &Options{Expiration: time.Hour})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = NewFastcache(32<<20, dir)
+	defer func() { _ = store.Close() }()
+	if v, err := store.Get("k"); err != nil || v != "v" {
+		t.Fatalf("get %v %v", v, err)
+	}
+	if ttl, _ := store.TTL("k"); ttl <= 59*time.Minute {
+		t.Fatalf("ttl %v", ttl)
+	}
+}
@@ -0,0 +1,470 @@
+package store
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// MemoryType represents the storage type as a string value
+	MemoryType = "memory"
+)
+
+// ErrNotFound is returned when the key is not found or expired
+var ErrNotFound = errors.New("value not found in store")
+
+// EvictionPolicy represents the eviction policy of the memory store
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently used item
+	LRU EvictionPolicy = iota
+	// LFU evicts the least frequently used item of a few sampled items
+	LFU
+	// TinyLFU evicts the least recently used item, and admits a new item only when it's used more frequently
+	// than the evicted items, the frequencies are estimated by a count-min sketch
+	TinyLFU
+)
+
+// MemoryOptions represents the memory store options
+type MemoryOptions struct {
+	// Shards is the number of shards (power of 2), default 64
+	Shards int
+	// MaxCost is the capacity of the store, 0 means unlimited,
+	// an item is rejected when its cost is larger than the capacity of a shard
+	MaxCost int64
+	// Policy is the eviction policy, default LRU
+	Policy EvictionPolicy
+	// Cost calculates the cost of a value when Options.Cost is not set, default 1
+	Cost func(value interface{}) int64
+}
+
+// MemoryStore is a sharded in-process store with cost-based admission, eviction, expiration and tags
+type MemoryStore struct {
+	options *Options
+	policy  EvictionPolicy
+	cost    func(value interface{}) int64
+	shards  []*memoryShard
+	mask    uint64
+
+	tagMu sync.Mutex
+	tags  map[string]map[string]struct{}
+}
+
+type memoryEntry struct {
+	key       string
+	value     interface{}
+	cost      int64
+	expiresAt int64 // unix nano, 0 means no expiration
+	freq      uint32
+	tags      []string
+	elem      *list.Element
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	items   map[string]*memoryEntry
+	lru     *list.List // the front is the most recently used
+	cost    int64
+	maxCost int64
+	sketch  *cmSketch
+	sets    int
+}
+
+// memorySampleSize the number of the sampled items of LFU
+const memorySampleSize = 5
+
+// memorySweepInterval sweeps the expired items of a shard after the number of sets
+const memorySweepInterval = 1024
+
+// NewMemory creates a new in-process memory store
+func NewMemory(option *Options, memoryOptions ...*MemoryOptions) *MemoryStore {
+	if option == nil {
+		option = &Options{}
+	}
+	mo := &MemoryOptions{}
+	if len(memoryOptions) > 0 && memoryOptions[0] != nil {
+		mo = memoryOptions[0]
+	}
+	n := 64
+	if mo.Shards > 0 {
+		for n = 1; n < mo.Shards; n <<= 1 {
+		}
+	}
+	// a shard holds at least an item of the cost 1, the total cost doesn't exceed the max cost
+	for mo.MaxCost > 0 && int64(n) > mo.MaxCost {
+		n >>= 1
+	}
+
+	s := &MemoryStore{
+		options: option,
+		policy:  mo.Policy,
+		cost:    mo.Cost,
+		shards:  make([]*memoryShard, n),
+		mask:    uint64(n - 1),
+		tags:    make(map[string]map[string]struct{}),
+	}
+	for i := range s.shards {
+		shard := &memoryShard{items: make(map[string]*memoryEntry), lru: list.New()}
+		if mo.MaxCost > 0 {
+			shard.maxCost = mo.MaxCost / int64(n)
+		}
+		if mo.Policy == TinyLFU {
+			shard.sketch = newCmSketch(4096)
+		}
+		s.shards[i] = shard
+	}
+	return s
+}
+
+func memoryHash(key string) uint64 {
+	// FNV-1a
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// Get returns data stored from a given key
+func (s *MemoryStore) Get(key string) (interface{}, error) {
+	h := memoryHash(key)
+	shard := s.shards[h&s.mask]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.sketch != nil {
+		shard.sketch.increment(h)
+	}
+	e, ok := shard.items[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if e.expiresAt > 0 && time.Now().UnixNano() >= e.expiresAt {
+		s.remove(shard, e)
+		return nil, ErrNotFound
+	}
+	if s.policy == LFU {
+		if e.freq < ^uint32(0) {
+			e.freq++
+		}
+	} else {
+		shard.lru.MoveToFront(e.elem)
+	}
+	return e.value, nil
+}
+
+// TTL returns a expiration time, 0 means no expiration
+func (s *MemoryStore) TTL(key string) (time.Duration, error) {
+	shard := s.shards[memoryHash(key)&s.mask]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	e, ok := shard.items[key]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if e.expiresAt == 0 {
+		return 0, nil
+	}
+	d := time.Duration(e.expiresAt - time.Now().UnixNano())
+	if d <= 0 {
+		s.remove(shard, e)
+		return 0, ErrNotFound
+	}
+	return d, nil
+}
+
+// Set defines data in the store for given key identifier,
+// the item is silently dropped when it's not admitted
+func (s *MemoryStore) Set(key string, value interface{}, options *Options) error {
+	if options == nil {
+		options = s.options
+	}
+	cost := options.CostValue()
+	if cost <= 0 {
+		if s.cost != nil {
+			cost = s.cost(value)
+		} else {
+			cost = 1
+		}
+	}
+	var expiresAt int64
+	if options.Expiration > 0 {
+		expiresAt = time.Now().Add(options.Expiration).UnixNano()
+	}
+
+	h := memoryHash(key)
+	shard := s.shards[h&s.mask]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.sketch != nil {
+		shard.sketch.increment(h)
+	}
+	if shard.sets++; shard.sets%memorySweepInterval == 0 {
+		s.sweep(shard)
+	}
+
+	e, ok := shard.items[key]
+	if shard.maxCost > 0 && cost > shard.maxCost {
+		if ok {
+			s.remove(shard, e)
+		}
+		return nil
+	}
+	if ok {
+		shard.cost += cost - e.cost
+		e.value, e.cost, e.expiresAt = value, cost, expiresAt
+		s.setTags(e, options.TagsValue())
+		if s.policy != LFU {
+			shard.lru.MoveToFront(e.elem)
+		}
+		s.evict(shard, e, h, false)
+		return nil
+	}
+
+	e = &memoryEntry{key: key, value: value, cost: cost, expiresAt: expiresAt, freq: 1}
+	if !s.evict(shard, e, h, true) {
+		return nil
+	}
+	e.elem = shard.lru.PushFront(e)
+	shard.items[key] = e
+	shard.cost += cost
+	s.setTags(e, options.TagsValue())
+	return nil
+}
+
+// evict evicts the items until the cost of the entry fits in the shard,
+// a new entry is rejected when TinyLFU estimates it's used less frequently than a live victim.
+func (s *MemoryStore) evict(shard *memoryShard, e *memoryEntry, h uint64, isNew bool) bool {
+	if shard.maxCost <= 0 {
+		return true
+	}
+	extra := int64(0)
+	if isNew {
+		extra = e.cost
+	}
+	now := time.Now().UnixNano()
+	for shard.cost+extra > shard.maxCost {
+		victim := s.victim(shard, e)
+		if victim == nil {
+			return false
+		}
+		expired := victim.expiresAt > 0 && now >= victim.expiresAt
+		if isNew && shard.sketch != nil && !expired &&
+			shard.sketch.estimate(memoryHash(victim.key)) > shard.sketch.estimate(h) {
+			return false
+		}
+		s.remove(shard, victim)
+	}
+	return true
+}
+
+// victim picks an item to evict except the entry.
+func (s *MemoryStore) victim(shard *memoryShard, except *memoryEntry) *memoryEntry {
+	if s.policy != LFU {
+		for elem := shard.lru.Back(); elem != nil; elem = elem.Prev() {
+			if e := elem.Value.(*memoryEntry); e != except {
+				return e
+			}
+		}
+		return nil
+	}
+
+	var victim *memoryEntry
+	now, n := time.Now().UnixNano(), 0
+	for _, e := range shard.items {
+		if e == except {
+			continue
+		}
+		if e.expiresAt > 0 && now >= e.expiresAt {
+			return e
+		}
+		if victim == nil || e.freq < victim.freq {
+			victim = e
+		}
+		if n++; n == memorySampleSize {
+			break
+		}
+	}
+	return victim
+}
+
+// sweep removes the expired items of the shard.
+func (s *MemoryStore) sweep(shard *memoryShard) {
+	now := time.Now().UnixNano()
+	for _, e := range shard.items {
+		if e.expiresAt > 0 && now >= e.expiresAt {
+			s.remove(shard, e)
+		}
+	}
+}
+
+func (s *MemoryStore) remove(shard *memoryShard, e *memoryEntry) {
+	delete(shard.items, e.key)
+	shard.lru.Remove(e.elem)
+	shard.cost -= e.cost
+	s.setTags(e, nil)
+}
+
+// setTags replaces the tags of the entry in the tag index.
+func (s *MemoryStore) setTags(e *memoryEntry, tags []string) {
+	if len(e.tags) == 0 && len(tags) == 0 {
+		return
+	}
+	s.tagMu.Lock()
+	defer s.tagMu.Unlock()
+	for _, tag := range e.tags {
+		if keys := s.tags[tag]; keys != nil {
+			delete(keys, e.key)
+			if len(keys) == 0 {
+				delete(s.tags, tag)
+			}
+		}
+	}
+	for _, tag := range tags {
+		keys := s.tags[tag]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			s.tags[tag] = keys
+		}
+		keys[e.key] = struct{}{}
+	}
+	e.tags = append([]string(nil), tags...)
+}
+
+// Delete removes data from the store for given key identifier
+func (s *MemoryStore) Delete(key string) error {
+	shard := s.shards[memoryHash(key)&s.mask]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if e, ok := shard.items[key]; ok {
+		s.remove(shard, e)
+	}
+	return nil
+}
+
+// Invalidate invalidates some cache data in the store for given options
+func (s *MemoryStore) Invalidate(options InvalidateOptions) error {
+	for _, tag := range options.TagsValue() {
+		s.tagMu.Lock()
+		keys := make([]string, 0, len(s.tags[tag]))
+		for key := range s.tags[tag] {
+			keys = append(keys, key)
+		}
+		s.tagMu.Unlock()
+
+		for _, key := range keys {
+			_ = s.Delete(key)
+		}
+	}
+	return nil
+}
+
+// Clear resets all data in the store
+func (s *MemoryStore) Clear() error {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		shard.items = make(map[string]*memoryEntry)
+		shard.lru.Init()
+		shard.cost = 0
+		if shard.sketch != nil {
+			shard.sketch.clear()
+		}
+		shard.mu.Unlock()
+	}
+	s.tagMu.Lock()
+	s.tags = make(map[string]map[string]struct{})
+	s.tagMu.Unlock()
+	return nil
+}
+
+// Len returns the number of items in the store, including the expired items not removed yet
+func (s *MemoryStore) Len() (n int) {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		n += len(shard.items)
+		shard.mu.Unlock()
+	}
+	return
+}
+
+// Cost returns the total cost of the items in the store
+func (s *MemoryStore) Cost() (cost int64) {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		cost += shard.cost
+		shard.mu.Unlock()
+	}
+	return
+}
+
+// GetType returns the store type
+func (s *MemoryStore) GetType() string {
+	return MemoryType
+}
+
+// cmSketch is a count-min sketch of 4 rows with 8-bit counters,
+// the counters are halved after 10 × width increments so the old frequencies fade.
+type cmSketch struct {
+	rows  [4][]uint8
+	mask  uint64
+	adds  int
+	reset int
+}
+
+func newCmSketch(width int) *cmSketch {
+	n := 1
+	for n < width {
+		n <<= 1
+	}
+	c := &cmSketch{mask: uint64(n - 1), reset: 10 * n}
+	for i := range c.rows {
+		c.rows[i] = make([]uint8, n)
+	}
+	return c
+}
+
+func (c *cmSketch) index(h uint64, i int) uint64 {
+	return (h + uint64(i)*(h>>32|1)) & c.mask
+}
+
+func (c *cmSketch) increment(h uint64) {
+	for i := range c.rows {
+		if p := &c.rows[i][c.index(h, i)]; *p < 255 {
+			*p++
+		}
+	}
+	if c.adds++; c.adds >= c.reset {
+		c.adds = 0
+		for i := range c.rows {
+			for j := range c.rows[i] {
+				c.rows[i][j] >>= 1
+			}
+		}
+	}
+}
+
+func (c *cmSketch) estimate(h uint64) uint8 {
+	min := uint8(255)
+	for i := range c.rows {
+		if v := c.rows[i][c.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func (c *cmSketch) clear() {
+	c.adds = 0
+	for i := range c.rows {
+		for j := range c.rows[i] {
+			c.rows[i][j] = 0
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMemoryLRU(t *testing.T) {
+	store := NewMemory(nil, &MemoryOptions{Shards: 1, MaxCost: 3})
+	for i := 1; i <= 3; i++ {
+		_ = store.Set(fmt.Sprintf("k%d", i), i, nil)
+	}
+	_, _ = store.Get("k1")
+	_ = store.Set("k4", 4, nil)
+	if _, err := store.Get("k2"); err != ErrNotFound {
+		t.Fatal("k2 is not evicted")
+	}
+	for _, k := range []string{"k1", "k3", "k4"} {
+		if _, err := store.Get(k); err != nil {
+			t.Fatalf("%s is evicted", k)
+		}
+	}
+
+	// The cost of an item larger than the capacity is rejected.
+	_ = store.Set("big", "v", &Options{Cost: 4})
+	if _, err := store.Get("big"); err != ErrNotFound || store.Len() != 3 {
+		t.Fatalf("big is admitted: %v, len %d", err, store.Len())
+	}
+	_ = store.Set("k5", 5, &Options{Cost: 2})
+	if store.Len() != 2 || store.Cost() != 3 {
+		t.Fatalf("len %d, cost %d", store.Len(), store.Cost())
+	}
+}
+
+func TestMemoryMaxCostShards(t *testing.T) {
+	// The shards are reduced to the max cost.
+	store := NewMemory(nil, &MemoryOptions{MaxCost: 3})
+	for i := 0; i < 100; i++ {
+		_ = store.Set(fmt.Sprintf("k%d", i), i, nil)
+	}
+	if store.Len() == 0 || store.Cost() > 3 {
+		t.Fatalf("len %d, cost %d", store.Len(), store.Cost())
+	}
+}
+
+func TestMemoryLFU(t *testing.T) {
+	store := NewMemory(nil, &MemoryOptions{Shards: 1, MaxCost: 3, Policy: LFU})
+	for i := 1; i <= 3; i++ {
+		_ = store.Set(fmt.Sprintf("k%d", i), i, nil)
+	}
+	for i := 0; i < 3; i++ {
+		_, _ = store.Get("k1")
+		_, _ = store.Get("k3")
+	}
+	_ = store.Set("k4", 4, nil)
+	if _, err := store.Get("k2"); err != ErrNotFound {
+		t.Fatal("k2 is not evicted")
+	}
+}
+
+func TestMemoryTinyLFU(t *testing.T) {
+	store := NewMemory(nil, &MemoryOptions{Shards: 1, MaxCost: 2, Policy: TinyLFU})
+	_ = store.Set("k1", 1, nil)
+	_ = store.Set("k2", 2, nil)
+	for i := 0; i < 5; i++ {
+		_, _ = store.Get("k1")
+		_, _ = store.Get("k2")
+	}
+	// A one-hit key is not admitted.
+	_ = store.Set("k3", 3, nil)
+	if _, err := store.Get("k3"); err != ErrNotFound {
+		t.Fatal("k3 is admitted")
+	}
+	// A key used more frequently than the victim is admitted.
+	for i := 0; i < 10; i++ {
+		_, _ = store.Get("k4")
+	}
+	_ = store.Set("k4", 4, nil)
+	if _, err := store.Get("k4"); err != nil {
+		t.Fatal("k4 is not admitted")
+	}
+}
+
+func TestMemoryTTLAndTags(t *testing.T) {
+	store := NewMemory(&Options{Expiration: time.Hour})
+	_ = store.Set("k1", 1, &Options{Expiration: 50 * time.Millisecond, Tags: []string{"t1"}})
+	_ = store.Set("k2", 2, &Options{Tags: []string{"t1", "t2"}})
+	_ = store.Set("k3", 3, nil)
+
+	if ttl, err := store.TTL("k3"); err != nil || ttl <= 59*time.Minute {
+		t.Fatalf("ttl %v %v", ttl, err)
+	}
+	if ttl, err := store.TTL("k2"); err != nil || ttl != 0 {
+		t.Fatalf("ttl %v %v", ttl, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := store.Get("k1"); err != ErrNotFound {
+		t.Fatal("k1 is not expired")
+	}
+
+	_ = store.Invalidate(InvalidateOptions{Tags: []string{"t2"}})
+	if _, err := store.Get("k2"); err != ErrNotFound {
+		t.Fatal("k2 is not invalidated")
+	}
+	if len(store.tags) != 0 {
+		t.Fatalf("tags %v", store.tags)
+	}
+	if v, err := store.Get("k3"); err != nil || v != 3 {
+		t.Fatalf("get %v %v", v, err)
+	}
+
+	_ = store.Clear()
+	if store.Len() != 0 {
+		t.Fatal("not cleared")
+	}
+}
+
+func BenchmarkMemorySet(b *testing.B) {
+	store := NewMemory(nil, &MemoryOptions{MaxCost: 1 << 16, Policy: TinyLFU})
+
+	for k := 0.; k <= 10; k++ {
+		n := int(math.Pow(2, k))
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N*n; i++ {
+				key := fmt.Sprintf("test-%d", n)
+				value := []byte(fmt.Sprintf("value-%d", n))
+
+				_ = store.Set(key, value, &Options{
+					Tags: []string{fmt.Sprintf("tag-%d", n)},
+				})
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryGet(b *testing.B) {
+	store := NewMemory(nil, &MemoryOptions{MaxCost: 1 << 16, Policy: TinyLFU})
+
+	key := "test"
+	value := []byte("value")
+
+	_ = store.Set(key, value, nil)
+
+	for k := 0.; k <= 10; k++ {
+		n := int(math.Pow(2, k))
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N*n; i++ {
+				_, _ = store.Get(key)
+			}
+		})
+	}
+}
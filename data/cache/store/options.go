@@ -7,7 +7,7 @@ import (
 // Options represents the cache store available options
 type Options struct {
 	// Cost corresponds to the memory capacity used by the item when setting a value
-	// Actually it seems to be used by Ristretto library only
+	// Actually it's used by the memory store for the cost-based admission and eviction
 	Cost int64
 
 	// Expiration allows to specify an expiration time when setting a value
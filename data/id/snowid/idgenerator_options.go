@@ -1,5 +1,7 @@
 package snowid
 
+import "time"
+
 // IdGeneratorOptions .
 type IdGeneratorOptions struct {
 	Method            uint16 // 雪花计算方法,（1-漂移算法|2-传统算法），默认1
@@ -25,3 +27,22 @@ func NewIdGeneratorOptions(workerID uint16) *IdGeneratorOptions {
 		TopOverCostCount:  2000,
 	}
 }
+
+// Decode decodes the ID generated by the options: timestamp, worker ID and sequence number.
+func (options *IdGeneratorOptions) Decode(id uint64) (time.Time, uint16, uint32) {
+	workerIdBitLength, seqBitLength, baseTime := options.WorkerIdBitLength, options.SeqBitLength, options.BaseTime
+	if workerIdBitLength == 0 {
+		workerIdBitLength = 6
+	}
+	if seqBitLength == 0 {
+		seqBitLength = 6
+	}
+	if baseTime == 0 {
+		baseTime = 1582136402000
+	}
+
+	seq := uint32(id & (1<<seqBitLength - 1))
+	workerId := uint16(id >> seqBitLength & (1<<workerIdBitLength - 1))
+	timeTick := int64(id >> (workerIdBitLength + seqBitLength))
+	return time.Unix(0, (baseTime+timeTick)*1e6), workerId, seq
+}
@@ -0,0 +1,15 @@
+package snowid
+
+import "time"
+
+// IWorkerIdPool claims the worker IDs from a pool shared by the processes.
+type IWorkerIdPool interface {
+	// Claim claims a free worker ID in the range [1, maxWorkerId], ErrNoWorkerId is returned if none is free.
+	Claim(maxWorkerId uint16) (uint16, error)
+	// Renew renews the lease of the worker ID, ErrLeaseLost is returned if it's claimed by another process.
+	Renew(workerId uint16) error
+	// Release releases the worker ID.
+	Release(workerId uint16) error
+	// TTL gets the time to live of a lease, 0 means the lease doesn't expire.
+	TTL() time.Duration
+}
@@ -181,14 +181,14 @@ func (m1 *SnowWorkerM1) NextNormalID() uint64 {
 
 // CalcID .
 func (m1 *SnowWorkerM1) CalcID(useTimeTick int64) uint64 {
-	result := uint64(useTimeTick<<m1._TimestampShift) + uint64(m1.WorkerId<<m1.SeqBitLength) + uint64(m1._CurrentSeqNumber)
+	result := uint64(useTimeTick<<m1._TimestampShift) + uint64(m1.WorkerId)<<m1.SeqBitLength + uint64(m1._CurrentSeqNumber)
 	m1._CurrentSeqNumber++
 	return result
 }
 
 // CalcTurnBackID .
 func (m1 *SnowWorkerM1) CalcTurnBackID(useTimeTick int64) uint64 {
-	result := uint64(useTimeTick<<m1._TimestampShift) + uint64(m1.WorkerId<<m1.SeqBitLength) + uint64(m1._TurnBackIndex)
+	result := uint64(useTimeTick<<m1._TimestampShift) + uint64(m1.WorkerId)<<m1.SeqBitLength + uint64(m1._TurnBackIndex)
 	m1._TurnBackTimeTick--
 	return result
 }
@@ -35,6 +35,6 @@ func (m2 SnowWorkerM2) NextID() uint64 {
 		fmt.Println("Time error for {0} milliseconds", strconv.FormatInt(m2._LastTimeTick-currentTimeTick, 10))
 	}
 	m2._LastTimeTick = currentTimeTick
-	result := uint64(currentTimeTick<<m2._TimestampShift) + uint64(m2.WorkerId<<m2.SeqBitLength) + uint64(m2._CurrentSeqNumber)
+	result := uint64(currentTimeTick<<m2._TimestampShift) + uint64(m2.WorkerId)<<m2.SeqBitLength + uint64(m2._CurrentSeqNumber)
 	return result
 }
@@ -2,6 +2,7 @@ package snowid
 
 import (
 	"sync"
+	"time"
 )
 
 var singletonMutex sync.Mutex
@@ -25,3 +26,13 @@ func NextId() uint64 {
 
 	return idGenerator.NewLong()
 }
+
+// Decode decodes the ID created by NextId: timestamp, worker ID and sequence number.
+func Decode(id uint64) (time.Time, uint16, uint32) {
+	singletonMutex.Lock()
+	defer singletonMutex.Unlock()
+	if idGenerator == nil {
+		return NewIdGeneratorOptions(1).Decode(id)
+	}
+	return idGenerator.Options.Decode(id)
+}
@@ -1,9 +1,13 @@
 package snowid
 
 import (
+	"io/ioutil"
 	"math"
+	"os"
 	"testing"
 	"time"
+
+	"github.com/angenalZZZ/gofunc/data/kv"
 )
 
 func TestDefaultIdGenerator(t *testing.T) {
@@ -34,3 +38,138 @@ func TestNewIdGenerator(t *testing.T) {
 	qps := times * 1000 / int(math.Max(float64(1), float64(ts.Milliseconds())))
 	t.Logf("Take time %s and %d qps, total %d times", ts, qps, times)
 }
+
+func TestDecode(t *testing.T) {
+	var options = NewIdGeneratorOptions(300)
+	options.WorkerIdBitLength = 10
+	options.SeqBitLength = 8
+	generator := NewDefaultIdGenerator(options)
+
+	now := time.Now()
+	ts, workerId, seq := options.Decode(generator.NewLong())
+	if workerId != 300 || seq != options.MinSeqNumber || ts.Sub(now) > time.Second || now.Sub(ts) > time.Second {
+		t.Fatalf("Decode %s %d %d", ts, workerId, seq)
+	}
+}
+
+func TestKVWorkerIdPool(t *testing.T) {
+	db := new(kv.MemoryDB)
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// Each process claims a different worker ID.
+	p1, p2 := NewKVWorkerIdPool(db, "", time.Second), NewKVWorkerIdPool(db, "", time.Second)
+	id1, err := p1.Claim(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := p2.Claim(2)
+	if err != nil || id1 == id2 {
+		t.Fatalf("Claim %d %d %v", id1, id2, err)
+	}
+	if _, err = NewKVWorkerIdPool(db, "", time.Second).Claim(2); err != ErrNoWorkerId {
+		t.Fatalf("Expected to get no worker id error, got %v", err)
+	}
+
+	// The lease is renewed until it's released.
+	time.Sleep(time.Second)
+	if err = p1.Renew(id1); err != nil {
+		t.Fatal(err)
+	}
+	if err = p1.Release(id1); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := NewKVWorkerIdPool(db, "", time.Second).Claim(2); err != nil || id != id1 {
+		t.Fatalf("Claim %d %v", id, err)
+	}
+
+	// The lease of a stopped process expires in 2 epochs.
+	time.Sleep(2 * time.Second)
+	if err = p2.Renew(id2); err != ErrLeaseLost {
+		t.Fatalf("Expected to get lease lost error, got %v", err)
+	}
+}
+
+func TestKVWorkerIdPoolClean(t *testing.T) {
+	db := new(kv.MemoryDB)
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// The keys of a crashed process are deleted by the next claim.
+	if _, err := NewKVWorkerIdPool(db, "", 100*time.Millisecond).Claim(2); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Set("snowid:worker:other", "1", 0)
+	time.Sleep(500 * time.Millisecond)
+	if _, err := NewKVWorkerIdPool(db, "", 100*time.Millisecond).Claim(2); err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.Keys("snowid:worker:"); len(keys) != 3 {
+		t.Fatalf("Expected the keys of the claim, got %v", keys)
+	}
+}
+
+func TestFileWorkerIdPool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snowid")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	p1, p2 := NewFileWorkerIdPool(dir), NewFileWorkerIdPool(dir)
+	g1, err := NewLeasedIdGenerator(nil, p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := NewLeasedIdGenerator(nil, p2)
+	if err != nil || g1.Lease.WorkerId == g2.Lease.WorkerId {
+		t.Fatalf("Lease %d %v", g1.Lease.WorkerId, err)
+	}
+	id, err := g1.NextId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, workerId, _ := g1.generator.Options.Decode(id); workerId != g1.Lease.WorkerId {
+		t.Fatalf("Expected worker id %d, got %d", g1.Lease.WorkerId, workerId)
+	}
+
+	// The generator stops after it's closed.
+	if err = g1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g1.NextId(); err != ErrLeaseLost {
+		t.Fatalf("Expected to get lease lost error, got %v", err)
+	}
+	_ = g2.Close()
+}
+
+func TestLeasedIdGenerator(t *testing.T) {
+	db := new(kv.MemoryDB)
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	pool := NewKVWorkerIdPool(db, "", 300*time.Millisecond)
+	g, err := NewLeasedIdGenerator(nil, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = g.Close() }()
+
+	// The lease is renewed in the background.
+	time.Sleep(time.Second)
+	if _, err = g.NextId(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The generator stops after the lease is lost.
+	pool.mu.Lock()
+	delete(pool.claimed, g.Lease.WorkerId)
+	pool.mu.Unlock()
+	time.Sleep(300 * time.Millisecond)
+	if _, err = g.NextId(); err != ErrLeaseLost {
+		t.Fatalf("Expected to get lease lost error, got %v", err)
+	}
+}
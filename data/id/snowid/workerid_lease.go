@@ -0,0 +1,169 @@
+package snowid
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoWorkerId is returned when all the worker IDs of the pool are claimed.
+	ErrNoWorkerId = errors.New("snowid: no free worker id")
+
+	// ErrLeaseLost is returned when the lease of the worker ID is lost.
+	ErrLeaseLost = errors.New("snowid: worker id lease is lost")
+)
+
+// WorkerIdLease holds the lease of a worker ID, and renews it in the background.
+type WorkerIdLease struct {
+	WorkerId uint16
+	pool     IWorkerIdPool
+	ttl      time.Duration
+
+	mu       sync.Mutex
+	deadline time.Time // the lease expires, zero means never
+	err      error
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// LeaseWorkerId claims a worker ID from the pool, the lease is renewed every third of its TTL.
+func LeaseWorkerId(pool IWorkerIdPool, maxWorkerId uint16) (*WorkerIdLease, error) {
+	start := time.Now()
+	workerId, err := pool.Claim(maxWorkerId)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &WorkerIdLease{
+		WorkerId: workerId,
+		pool:     pool,
+		ttl:      pool.TTL(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if l.ttl <= 0 {
+		close(l.done)
+		return l, nil
+	}
+	l.deadline = start.Add(l.ttl)
+	go l.renew()
+	return l, nil
+}
+
+// Err gets ErrLeaseLost if the lease is lost or expired, the generated IDs may be duplicated.
+func (l *WorkerIdLease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil && !l.deadline.IsZero() && !time.Now().Before(l.deadline) {
+		l.err = ErrLeaseLost
+	}
+	return l.err
+}
+
+// Close stops renewing the lease, and releases the worker ID.
+func (l *WorkerIdLease) Close() error {
+	l.mu.Lock()
+	select {
+	case <-l.stop:
+		l.mu.Unlock()
+		return nil
+	default:
+		close(l.stop)
+	}
+	l.mu.Unlock()
+
+	<-l.done
+	err := l.pool.Release(l.WorkerId)
+	l.mu.Lock()
+	if l.err == nil {
+		l.err = ErrLeaseLost
+	}
+	l.mu.Unlock()
+	return err
+}
+
+// renew renews the lease until it's closed or lost, a failed renewal is retried until the lease expires.
+func (l *WorkerIdLease) renew() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		err := l.pool.Renew(l.WorkerId)
+		l.mu.Lock()
+		if err == nil && l.err == nil && start.Before(l.deadline) {
+			l.deadline = start.Add(l.ttl)
+		} else if err == ErrLeaseLost {
+			l.err = err
+		}
+		l.mu.Unlock()
+		if l.Err() != nil {
+			return
+		}
+	}
+}
+
+// LeasedIdGenerator generates the IDs with a worker ID leased from a pool,
+// it stops generating after the lease is lost.
+type LeasedIdGenerator struct {
+	Lease     *WorkerIdLease
+	generator *DefaultIdGenerator
+}
+
+// NewLeasedIdGenerator claims a worker ID of the options from the pool.
+func NewLeasedIdGenerator(options *IdGeneratorOptions, pool IWorkerIdPool) (*LeasedIdGenerator, error) {
+	if options == nil {
+		options = NewIdGeneratorOptions(0)
+	}
+	workerIdBitLength := options.WorkerIdBitLength
+	if workerIdBitLength == 0 {
+		workerIdBitLength = 6
+	}
+
+	lease, err := LeaseWorkerId(pool, uint16(1<<workerIdBitLength)-1)
+	if err != nil {
+		return nil, err
+	}
+	opts := *options
+	opts.WorkerId = lease.WorkerId
+	return &LeasedIdGenerator{
+		Lease:     lease,
+		generator: NewDefaultIdGenerator(&opts),
+	}, nil
+}
+
+// NextId creates a new ID, ErrLeaseLost is returned if the lease is lost.
+func (g *LeasedIdGenerator) NextId() (uint64, error) {
+	if err := g.Lease.Err(); err != nil {
+		return 0, err
+	}
+	return g.generator.NewLong(), nil
+}
+
+// Close releases the worker ID.
+func (g *LeasedIdGenerator) Close() error {
+	return g.Lease.Close()
+}
+
+// claimOrder gets the worker IDs in [1, maxWorkerId] from a random one,
+// the processes started at the same time claim different IDs first.
+func claimOrder(maxWorkerId uint16) []uint16 {
+	if maxWorkerId == 0 {
+		return nil
+	}
+	ids := make([]uint16, 0, maxWorkerId)
+	start := rand.Intn(int(maxWorkerId))
+	for i := 0; i < int(maxWorkerId); i++ {
+		ids = append(ids, uint16((start+i)%int(maxWorkerId)+1))
+	}
+	return ids
+}
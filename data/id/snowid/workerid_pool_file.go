@@ -0,0 +1,82 @@
+package snowid
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FileWorkerIdPool the worker IDs are the lock files: dir/<worker ID>.lock, for the processes of a single host.
+// A lock file is locked until the process releases it or exits, the lease doesn't expire.
+type FileWorkerIdPool struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[uint16]*os.File
+}
+
+// NewFileWorkerIdPool creates a pool in the directory, the temp directory by default.
+func NewFileWorkerIdPool(dir string) *FileWorkerIdPool {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "snowid")
+	}
+	return &FileWorkerIdPool{dir: dir, files: make(map[uint16]*os.File)}
+}
+
+// Claim locks the file of a free worker ID.
+func (p *FileWorkerIdPool) Claim(maxWorkerId uint16) (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return 0, err
+	}
+	for _, id := range claimOrder(maxWorkerId) {
+		if _, ok := p.files[id]; ok {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(p.dir, strconv.Itoa(int(id))+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, err
+		}
+		if err = lockFile(f); err != nil {
+			_ = f.Close()
+			continue
+		}
+		p.files[id] = f
+		return id, nil
+	}
+	return 0, ErrNoWorkerId
+}
+
+// Renew checks the file of the worker ID is locked.
+func (p *FileWorkerIdPool) Renew(workerId uint16) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.files[workerId]; !ok {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Release unlocks the file of the worker ID.
+func (p *FileWorkerIdPool) Release(workerId uint16) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, ok := p.files[workerId]
+	if !ok {
+		return nil
+	}
+	delete(p.files, workerId)
+	_ = unlockFile(f)
+	return f.Close()
+}
+
+// TTL the lease doesn't expire.
+func (p *FileWorkerIdPool) TTL() time.Duration {
+	return 0
+}
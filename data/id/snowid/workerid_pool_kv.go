@@ -0,0 +1,155 @@
+package snowid
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KVStore the methods of a data/kv database used by KVWorkerIdPool, Incr must be atomic.
+type KVStore interface {
+	Incr(string, int64) (int64, error)
+	Del([]string) error
+}
+
+// kvKeys the optional method of a data/kv database to list the keys with a prefix.
+type kvKeys interface {
+	Keys(...string) []string
+}
+
+// KVWorkerIdPool the worker IDs are claimed by the epochs of the TTL, a process holds the keys:
+// prefix + worker ID + ":" + epoch, of the current and the next epoch. A key is claimed by the
+// process that increments it to 1, the lease of a stopped process expires in 2 epochs.
+// The keys have no TTL, the keys of the epochs before are deleted by Claim: all the keys with the prefix
+// if the database lists the keys (KVStore with Keys, such as data/kv), otherwise the keys of the 2 epochs
+// before of the worker IDs, then the keys left by a crashed process remain if no process claims in 2 epochs.
+type KVWorkerIdPool struct {
+	db     KVStore
+	prefix string
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	claimed map[uint16]int64 // the last epochs claimed
+}
+
+// NewKVWorkerIdPool creates a pool in a data/kv database shared by the processes, such as kv.Remote,
+// the TTL is 30 seconds by default.
+func NewKVWorkerIdPool(db KVStore, prefix string, ttl time.Duration) *KVWorkerIdPool {
+	if prefix == "" {
+		prefix = "snowid:worker:"
+	}
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	return &KVWorkerIdPool{db: db, prefix: prefix, ttl: ttl, claimed: make(map[uint16]int64)}
+}
+
+// Claim claims a free worker ID for the current and the next epoch.
+func (p *KVWorkerIdPool) Claim(maxWorkerId uint16) (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	epoch := p.epoch()
+	ids := claimOrder(maxWorkerId)
+	p.clean(ids, epoch)
+	for _, id := range ids {
+		if _, ok := p.claimed[id]; ok {
+			continue
+		}
+		ok, err := p.incr(id, epoch)
+		if err == nil && ok {
+			ok, err = p.incr(id, epoch+1)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			p.claimed[id] = epoch + 1
+			return id, nil
+		}
+	}
+	return 0, ErrNoWorkerId
+}
+
+// Renew claims the worker ID until the next epoch.
+func (p *KVWorkerIdPool) Renew(workerId uint16) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	epoch := p.epoch()
+	last, ok := p.claimed[workerId]
+	if !ok || last < epoch {
+		delete(p.claimed, workerId)
+		return ErrLeaseLost
+	}
+	for ; last <= epoch; last++ {
+		ok, err := p.incr(workerId, last+1)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			delete(p.claimed, workerId)
+			return ErrLeaseLost
+		}
+		p.claimed[workerId] = last + 1
+	}
+	_ = p.db.Del([]string{p.key(workerId, epoch-1)})
+	return nil
+}
+
+// Release deletes the keys of the worker ID.
+func (p *KVWorkerIdPool) Release(workerId uint16) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	last, ok := p.claimed[workerId]
+	if !ok {
+		return nil
+	}
+	delete(p.claimed, workerId)
+	var keys []string
+	for epoch := p.epoch() - 1; epoch <= last; epoch++ {
+		keys = append(keys, p.key(workerId, epoch))
+	}
+	return p.db.Del(keys)
+}
+
+// clean deletes the keys of the epochs before the epoch, no process holds them.
+func (p *KVWorkerIdPool) clean(ids []uint16, epoch int64) {
+	var keys []string
+	if db, ok := p.db.(kvKeys); ok {
+		for _, key := range db.Keys(p.prefix) {
+			i := strings.LastIndexByte(key, ':')
+			if e, err := strconv.ParseInt(key[i+1:], 10, 64); err == nil && i >= len(p.prefix) && e < epoch {
+				keys = append(keys, key)
+			}
+		}
+	} else {
+		for _, id := range ids {
+			keys = append(keys, p.key(id, epoch-1), p.key(id, epoch-2))
+		}
+	}
+	if len(keys) > 0 {
+		_ = p.db.Del(keys)
+	}
+}
+
+// TTL gets the time to live of a lease.
+func (p *KVWorkerIdPool) TTL() time.Duration {
+	return p.ttl
+}
+
+func (p *KVWorkerIdPool) epoch() int64 {
+	return time.Now().UnixNano() / int64(p.ttl)
+}
+
+// incr reports whether the key of the epoch is claimed.
+func (p *KVWorkerIdPool) incr(workerId uint16, epoch int64) (bool, error) {
+	n, err := p.db.Incr(p.key(workerId, epoch), 1)
+	return n == 1, err
+}
+
+func (p *KVWorkerIdPool) key(workerId uint16, epoch int64) string {
+	return p.prefix + strconv.Itoa(int(workerId)) + ":" + strconv.FormatInt(epoch, 10)
+}
@@ -0,0 +1,74 @@
+package snowid
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/rs/xid"
+)
+
+// The scripts renew and release the lease only if it's held by the token.
+const (
+	redisRenewScript   = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+// RedisWorkerIdPool the worker IDs are the keys: prefix + worker ID, claimed by SETNX with the TTL.
+type RedisWorkerIdPool struct {
+	client redis.Cmdable
+	prefix string
+	ttl    time.Duration
+	token  string // identifies the process
+}
+
+// NewRedisWorkerIdPool creates a pool in Redis, the TTL is 30 seconds by default.
+func NewRedisWorkerIdPool(client redis.Cmdable, prefix string, ttl time.Duration) *RedisWorkerIdPool {
+	if prefix == "" {
+		prefix = "snowid:worker:"
+	}
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	return &RedisWorkerIdPool{client: client, prefix: prefix, ttl: ttl, token: xid.New().String()}
+}
+
+// Claim claims a free worker ID.
+func (p *RedisWorkerIdPool) Claim(maxWorkerId uint16) (uint16, error) {
+	for _, id := range claimOrder(maxWorkerId) {
+		ok, err := p.client.SetNX(p.key(id), p.token, p.ttl).Result()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return id, nil
+		}
+	}
+	return 0, ErrNoWorkerId
+}
+
+// Renew renews the TTL of the worker ID.
+func (p *RedisWorkerIdPool) Renew(workerId uint16) error {
+	n, err := p.client.Eval(redisRenewScript, []string{p.key(workerId)}, p.token, p.ttl.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Release deletes the worker ID.
+func (p *RedisWorkerIdPool) Release(workerId uint16) error {
+	return p.client.Eval(redisReleaseScript, []string{p.key(workerId)}, p.token).Err()
+}
+
+// TTL gets the time to live of a lease.
+func (p *RedisWorkerIdPool) TTL() time.Duration {
+	return p.ttl
+}
+
+func (p *RedisWorkerIdPool) key(workerId uint16) string {
+	return p.prefix + strconv.Itoa(int(workerId))
+}
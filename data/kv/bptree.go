@@ -0,0 +1,208 @@
+package kv
+
+import (
+	"bytes"
+	"sort"
+)
+
+// bptreeOrder the max number of keys in a node of bptree.
+const bptreeOrder = 64
+
+// bptree an in-memory B+tree, the leaves are linked in key order.
+// The deleted keys are removed from the leaves only, the tree is not rebalanced,
+// the empty leaves are skipped by the seeks and dropped when the tree is rebuilt.
+type bptree struct {
+	root *bptNode
+	len  int
+}
+
+type bptNode struct {
+	keys     [][]byte
+	children []*bptNode // nil for a leaf
+	values   []bptValue
+	prev     *bptNode
+	next     *bptNode
+}
+
+type bptValue struct {
+	value     []byte
+	expiresAt int64
+}
+
+func newBPTree() *bptree {
+	return &bptree{root: &bptNode{}}
+}
+
+func (n *bptNode) leaf() bool { return n.children == nil }
+
+// search gets the index of the first key >= key in a leaf.
+func (n *bptNode) search(key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) >= 0 })
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+// child gets the index of the child containing the key in an internal node.
+func (n *bptNode) child(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) > 0 })
+}
+
+func (t *bptree) leafOf(key []byte) *bptNode {
+	n := t.root
+	for !n.leaf() {
+		n = n.children[n.child(key)]
+	}
+	return n
+}
+
+func (t *bptree) first() *bptNode {
+	n := t.root
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n
+}
+
+func (t *bptree) last() *bptNode {
+	n := t.root
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n
+}
+
+func (t *bptree) get(key []byte) (bptValue, bool) {
+	n := t.leafOf(key)
+	if i, ok := n.search(key); ok {
+		return n.values[i], true
+	}
+	return bptValue{}, false
+}
+
+func (t *bptree) put(key []byte, v bptValue) {
+	if sep, right := t.insert(t.root, key, v); right != nil {
+		t.root = &bptNode{keys: [][]byte{sep}, children: []*bptNode{t.root, right}}
+	}
+}
+
+// insert puts the key in the subtree, returns the separator key and the new right node if the node is split.
+func (t *bptree) insert(n *bptNode, key []byte, v bptValue) ([]byte, *bptNode) {
+	if n.leaf() {
+		i, ok := n.search(key)
+		if ok {
+			n.values[i] = v
+			return nil, nil
+		}
+		n.keys = append(n.keys, nil)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = key
+		n.values = append(n.values, bptValue{})
+		copy(n.values[i+1:], n.values[i:])
+		n.values[i] = v
+		t.len++
+		if len(n.keys) <= bptreeOrder {
+			return nil, nil
+		}
+		m := len(n.keys) / 2
+		right := &bptNode{
+			keys:   append([][]byte(nil), n.keys[m:]...),
+			values: append([]bptValue(nil), n.values[m:]...),
+			prev:   n,
+			next:   n.next,
+		}
+		if n.next != nil {
+			n.next.prev = right
+		}
+		n.next, n.keys, n.values = right, n.keys[:m:m], n.values[:m:m]
+		return right.keys[0], right
+	}
+
+	i := n.child(key)
+	sep, right := t.insert(n.children[i], key, v)
+	if right == nil {
+		return nil, nil
+	}
+	n.keys = append(n.keys, nil)
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = sep
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right
+	if len(n.keys) <= bptreeOrder {
+		return nil, nil
+	}
+	m := len(n.keys) / 2
+	sep = n.keys[m]
+	r := &bptNode{
+		keys:     append([][]byte(nil), n.keys[m+1:]...),
+		children: append([]*bptNode(nil), n.children[m+1:]...),
+	}
+	n.keys, n.children = n.keys[:m:m], n.children[:m+1:m+1]
+	return sep, r
+}
+
+func (t *bptree) delete(key []byte) bool {
+	n := t.leafOf(key)
+	i, ok := n.search(key)
+	if !ok {
+		return false
+	}
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	n.values = append(n.values[:i], n.values[i+1:]...)
+	t.len--
+	return true
+}
+
+// seekGE gets the position of the first key >= key, or the first key when the key is nil.
+func (t *bptree) seekGE(key []byte) (*bptNode, int) {
+	n, i := t.first(), 0
+	if key != nil {
+		n = t.leafOf(key)
+		i, _ = n.search(key)
+	}
+	for n != nil && i >= len(n.keys) {
+		n, i = n.next, 0
+	}
+	return n, i
+}
+
+// seekLT gets the position of the last key < key, or the last key when the key is nil.
+func (t *bptree) seekLT(key []byte) (*bptNode, int) {
+	n := t.last()
+	i := len(n.keys)
+	if key != nil {
+		n = t.leafOf(key)
+		i, _ = n.search(key)
+	}
+	for i--; n != nil && i < 0; {
+		if n = n.prev; n != nil {
+			i = len(n.keys) - 1
+		}
+	}
+	return n, i
+}
+
+// ascend calls fn for the keys >= key in order until it returns false.
+func (t *bptree) ascend(key []byte, fn func(k []byte, v bptValue) bool) {
+	for n, i := t.seekGE(key); n != nil; n, i = n.next, 0 {
+		for ; i < len(n.keys); i++ {
+			if !fn(n.keys[i], n.values[i]) {
+				return
+			}
+		}
+	}
+}
+
+// descend calls fn for the keys < key in reverse order until it returns false.
+func (t *bptree) descend(key []byte, fn func(k []byte, v bptValue) bool) {
+	n, i := t.seekLT(key)
+	for n != nil {
+		for ; i >= 0; i-- {
+			if !fn(n.keys[i], n.values[i]) {
+				return
+			}
+		}
+		if n = n.prev; n != nil {
+			i = len(n.keys) - 1
+		}
+	}
+}
@@ -1,13 +1,23 @@
 package kv
 
 import (
+	"bytes"
+	"context"
 	"github.com/angenalZZZ/gofunc/f"
 	"github.com/dgraph-io/badger/v2"
 	"github.com/dgraph-io/badger/v2/options"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// badgerWatchPrefix the prefix of the probe keys written by Watch until its subscription receives them.
+var (
+	badgerWatchPrefix = []byte("\x00\x00kv-watch:")
+	badgerWatchID     uint64
+)
+
 /**
  * Feature							键值功能设计	https://github.com/dgraph-io/badger
  * Design							数据结构设计	LSM tree with value log, it's not a B+ tree
@@ -22,8 +32,9 @@ import (
  * 3D access (key-value-version)	3D访问（键值版本）Yes
  */
 type BadgerDB struct {
-	DB     *badger.DB
-	locker *f.Locker
+	DB       *badger.DB
+	locker   *f.Locker
+	inMemory bool
 }
 
 // Open BadgerDB represents a badger db implementation,
@@ -52,6 +63,7 @@ func (db *BadgerDB) Open(path ...string) error {
 
 	db.DB = _db
 	db.locker = f.NewLocker()
+	db.inMemory = opt.InMemory
 	if opt.InMemory {
 		return nil
 	}
@@ -75,15 +87,25 @@ func (db *BadgerDB) Incr(k string, by int64) (int64, error) {
 	db.locker.Lock(k)
 	defer db.locker.Unlock(k)
 
-	val, err := db.Get(k)
-	if err != nil || val == "" {
-		val = "0"
-	}
-
-	valFloat, _ := strconv.ParseInt(val, 10, 64)
-	valFloat += by
+	var valFloat int64
+	err := db.DB.Update(func(txn *badger.Txn) error {
+		var expires uint64
+		item, err := txn.Get(f.Bytes(k))
+		if err == nil {
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			valFloat, _ = strconv.ParseInt(f.String(val), 10, 64)
+			expires = item.ExpiresAt()
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		valFloat += by
 
-	err = db.Set(k, strconv.FormatInt(valFloat, 10), -1)
+		// The key keeps the remaining ttl.
+		return txn.SetEntry(&badger.Entry{Key: []byte(k), Value: []byte(strconv.FormatInt(valFloat, 10)), ExpiresAt: expires})
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -172,40 +194,15 @@ func (db *BadgerDB) MGet(keys []string) (data []string) {
 
 // TTL gets the time.seconds to live of the specified key's value.
 func (db *BadgerDB) TTL(key string) int64 {
-	var expires int64
-
+	expires := int64(-2)
 	_ = db.DB.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(f.Bytes(key))
-		if err != nil {
-			expires = -2
-			return nil
-		}
-
-		exp := item.ExpiresAt()
-		if exp == 0 {
-			expires = -1
-			return nil
+		if err == nil {
+			expires = ttlSeconds(int64(item.ExpiresAt()))
 		}
-
-		expires = int64(exp)
 		return nil
 	})
-
-	if expires == -2 {
-		return -2
-	}
-
-	if expires == -1 {
-		return -1
-	}
-
-	now := time.Now().Unix()
-
-	if now >= expires {
-		return -2
-	}
-
-	return (expires - now) / int64(time.Second)
+	return expires
 }
 
 // Del removes key(s) from the store.
@@ -240,11 +237,11 @@ func (db *BadgerDB) Keys(prefix ...string) []string {
 		defer it.Close()
 		if l == 0 {
 			for it.Rewind(); it.Valid(); it.Next() {
-				keys = append(keys, f.String(it.Item().Key()))
+				keys = append(keys, string(it.Item().Key()))
 			}
 		} else {
 			for it.Seek(prefixBytes); it.ValidForPrefix(prefixBytes); it.Next() {
-				keys = append(keys, f.String(it.Item().Key()))
+				keys = append(keys, string(it.Item().Key()))
 			}
 		}
 		return nil
@@ -254,6 +251,9 @@ func (db *BadgerDB) Keys(prefix ...string) []string {
 
 // GC runs the garbage collector, not in memory.
 func (db *BadgerDB) GC() error {
+	if db.inMemory {
+		return nil
+	}
 	var err error
 	for {
 		err = db.DB.RunValueLogGC(0.5)
@@ -261,5 +261,199 @@ func (db *BadgerDB) GC() error {
 			break
 		}
 	}
+	if err == badger.ErrNoRewrite {
+		return nil
+	}
 	return err
 }
+
+// Scan streams the pairs in the range [start, end), in reverse order optionally.
+func (db *BadgerDB) Scan(start, end string, limit int, reverse ...bool) Iterator {
+	return db.scan(newScanRange(start, end, limit, reverse))
+}
+
+// ScanPrefix streams the pairs of the keys with the prefix, in reverse order optionally.
+func (db *BadgerDB) ScanPrefix(prefix string, limit int, reverse ...bool) Iterator {
+	return db.scan(newPrefixRange(prefix, limit, reverse))
+}
+
+func (db *BadgerDB) scan(r *scanRange) Iterator {
+	txn := db.DB.NewTransaction(false)
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = r.reverse
+	opts.PrefetchValues = r.limit <= 0 || r.limit > opts.PrefetchSize
+	return &badgerIterator{txn: txn, it: txn.NewIterator(opts), r: r}
+}
+
+// Batch begins a read-write transaction.
+func (db *BadgerDB) Batch() (Batch, error) {
+	return &badgerBatch{txn: db.DB.NewTransaction(true)}, nil
+}
+
+type badgerIterator struct {
+	txn        *badger.Txn
+	it         *badger.Iterator
+	r          *scanRange
+	n          int
+	started    bool
+	key, value []byte
+	ttl        int64
+	err        error
+}
+
+func (it *badgerIterator) Next() bool {
+	if it.err != nil || (it.r.limit > 0 && it.n >= it.r.limit) {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		if seek := it.r.start; it.r.reverse {
+			if seek = it.r.end; seek == nil {
+				it.it.Rewind()
+			} else {
+				it.it.Seek(seek)
+			}
+		} else if seek == nil {
+			it.it.Rewind()
+		} else {
+			it.it.Seek(seek)
+		}
+	} else {
+		it.it.Next()
+	}
+
+	for ; it.it.Valid(); it.it.Next() {
+		item := it.it.Item()
+		k := item.Key()
+		if it.r.reverse {
+			if it.r.before(k) {
+				return false
+			}
+			if it.r.after(k) {
+				continue
+			}
+		} else if it.r.after(k) {
+			return false
+		}
+		it.key = item.KeyCopy(nil)
+		if it.value, it.err = item.ValueCopy(nil); it.err != nil {
+			return false
+		}
+		it.ttl = ttlSeconds(int64(item.ExpiresAt()))
+		it.n++
+		return true
+	}
+	return false
+}
+
+func (it *badgerIterator) Key() []byte   { return it.key }
+func (it *badgerIterator) Value() []byte { return it.value }
+func (it *badgerIterator) TTL() int64    { return it.ttl }
+func (it *badgerIterator) Err() error    { return it.err }
+
+func (it *badgerIterator) Close() error {
+	it.it.Close()
+	it.txn.Discard()
+	return nil
+}
+
+type badgerBatch struct {
+	txn *badger.Txn
+}
+
+func (b *badgerBatch) Set(k, v string, ttl int) error {
+	return b.SetBytes(f.Bytes(k), f.Bytes(v), ttl)
+}
+
+func (b *badgerBatch) SetBytes(k, v []byte, ttl int) error {
+	e := badger.NewEntry(k, v)
+	if ttl > 0 {
+		e = e.WithTTL(time.Duration(ttl) * time.Second)
+	}
+	return b.txn.SetEntry(e)
+}
+
+func (b *badgerBatch) Del(keys ...string) error {
+	for _, key := range keys {
+		if err := b.txn.Delete(f.Bytes(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *badgerBatch) Commit() error {
+	return b.txn.Commit()
+}
+
+func (b *badgerBatch) Discard() {
+	b.txn.Discard()
+}
+
+// Watch emits the changes of the keys with the prefix through the badger subscription,
+// which is listening when Watch returns. A change with an empty value is emitted as EventDelete
+// if the key is not found, the expired keys are not emitted.
+func (db *BadgerDB) Watch(prefix string) (<-chan Event, func()) {
+	w := newWatcher(prefix)
+	ctx, cancel := context.WithCancel(context.Background())
+	probe := strconv.AppendUint(append([]byte{}, badgerWatchPrefix...), atomic.AddUint64(&badgerWatchID, 1), 10)
+	ready, done := make(chan struct{}), make(chan struct{})
+	var readyOnce sync.Once
+	go func() {
+		defer close(done)
+		defer close(w.ch)
+		_ = db.DB.Subscribe(ctx, func(list *badger.KVList) error {
+			for _, kv := range list.Kv {
+				if bytes.HasPrefix(kv.Key, badgerWatchPrefix) {
+					if bytes.Equal(kv.Key, probe) {
+						readyOnce.Do(func() { close(ready) })
+					}
+					continue
+				}
+				e := Event{Type: EventPut, Key: kv.Key, Value: kv.Value}
+				if len(kv.Value) == 0 && db.deleted(kv.Key) {
+					e.Type = EventDelete
+				}
+				w.send(e)
+			}
+			return nil
+		}, w.prefix, probe)
+	}()
+	db.waitWatch(probe, ready, done)
+
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+}
+
+// waitWatch writes the probe key until the subscription receives it, then deletes it.
+func (db *BadgerDB) waitWatch(probe []byte, ready, done <-chan struct{}) {
+	defer func() {
+		_ = db.DB.Update(func(txn *badger.Txn) error { return txn.Delete(probe) })
+	}()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if db.DB.Update(func(txn *badger.Txn) error {
+			return txn.SetEntry(badger.NewEntry(probe, nil).WithTTL(time.Minute))
+		}) != nil {
+			return
+		}
+		select {
+		case <-ready:
+			return
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (db *BadgerDB) deleted(k []byte) bool {
+	return db.DB.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(k)
+		return err
+	}) == badger.ErrKeyNotFound
+}
@@ -1,6 +1,7 @@
 package kv
 
 import (
+	"bytes"
 	"github.com/angenalZZZ/gofunc/f"
 	"github.com/tidwall/buntdb"
 	"strconv"
@@ -13,8 +14,9 @@ import (
 // It supports custom indexes and geo-spatial data.
 // It's ideal for projects that need a dependable database and favor speed over data size.
 type BuntDB struct {
-	DB     *buntdb.DB
-	locker *f.Locker
+	DB       *buntdb.DB
+	locker   *f.Locker
+	watchers watchers
 }
 
 // Open Opens the specified path, default in memory.
@@ -30,13 +32,37 @@ func (db *BuntDB) Open(path ...string) error {
 	if err != nil {
 		return err
 	}
+	var config buntdb.Config
+	if err = db.DB.ReadConfig(&config); err != nil {
+		return err
+	}
+	// the expired keys are deleted in the background, and emitted to the watchers
+	config.OnExpiredSync = func(key, value string, tx *buntdb.Tx) error {
+		if _, err := tx.Delete(key); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+		db.watchers.notify(Event{Type: EventExpire, Key: []byte(key), Value: []byte(value)})
+		return nil
+	}
+	if err = db.DB.SetConfig(config); err != nil {
+		return err
+	}
 	db.locker = f.NewLocker()
 	return nil
 }
 
-// Size gets the size of the database in bytes.
+// Size gets the size of the live keys and values in bytes.
 func (db *BuntDB) Size() int64 {
-	return 0
+	var size int64
+	_ = db.DB.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend("", func(key, value string) bool {
+			if _, err := tx.TTL(key); err == nil {
+				size += int64(len(key) + len(value))
+			}
+			return true
+		})
+	})
+	return size
 }
 
 // Incr increment the key by the specified value.
@@ -44,15 +70,28 @@ func (db *BuntDB) Incr(k string, by int64) (int64, error) {
 	db.locker.Lock(k)
 	defer db.locker.Unlock(k)
 
-	val, err := db.get(k)
-	if err != nil || val == "" {
-		val = "0"
-	}
-
-	valFloat, _ := strconv.ParseInt(val, 10, 64)
-	valFloat += by
+	var valFloat int64
+	err := db.watchers.write(func() ([]Event, error) {
+		var v string
+		err := db.DB.Update(func(tx *buntdb.Tx) error {
+			val, err := tx.Get(k)
+			if err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+			valFloat, _ = strconv.ParseInt(val, 10, 64)
+			valFloat += by
+			v = strconv.FormatInt(valFloat, 10)
 
-	err = db.set(k, strconv.FormatInt(valFloat, 10), -1)
+			// The key keeps the remaining ttl.
+			var opts *buntdb.SetOptions
+			if d, err := tx.TTL(k); err == nil && d > 0 {
+				opts = &buntdb.SetOptions{Expires: true, TTL: d}
+			}
+			_, _, err = tx.Set(k, v, opts)
+			return err
+		})
+		return []Event{{Type: EventPut, Key: []byte(k), Value: []byte(v)}}, err
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -71,14 +110,23 @@ func (db *BuntDB) SetBytes(k, v []byte, ttl int) error {
 }
 
 // MSet sets multiple key-value pairs.
-func (db *BuntDB) MSet(data map[string]string) (err error) {
-	err = db.DB.Update(func(tx *buntdb.Tx) (err1 error) {
+func (db *BuntDB) MSet(data map[string]string) error {
+	return db.watchers.write(func() ([]Event, error) {
+		err := db.DB.Update(func(tx *buntdb.Tx) (err1 error) {
+			for k, v := range data {
+				_, _, err1 = tx.Set(k, v, nil)
+			}
+			return
+		})
+		if err != nil || !db.watchers.active() {
+			return nil, err
+		}
+		events := make([]Event, 0, len(data))
 		for k, v := range data {
-			_, _, err1 = tx.Set(k, v, nil)
+			events = append(events, Event{Type: EventPut, Key: []byte(k), Value: []byte(v)})
 		}
-		return
+		return events, nil
 	})
-	return
 }
 
 // Get fetches the value of the specified k.
@@ -110,28 +158,33 @@ func (db *BuntDB) MGet(keys []string) (data []string) {
 }
 
 // TTL gets the time.seconds to live of the specified key's value.
-func (db *BuntDB) TTL(key string) int64 {
-	ts := time.Nanosecond
-	_ = db.DB.View(func(tx *buntdb.Tx) (err1 error) {
-		ts, err1 = tx.TTL(key)
-		return
+func (db *BuntDB) TTL(key string) (ttl int64) {
+	_ = db.DB.View(func(tx *buntdb.Tx) error {
+		ttl = buntTTL(tx.TTL(key))
+		return nil
 	})
-	return int64(ts.Seconds())
+	return
 }
 
 // Del removes key(s) from the store.
-func (db *BuntDB) Del(keys []string) (err error) {
-	err = db.DB.Update(func(tx *buntdb.Tx) (err1 error) {
-		for _, k := range keys {
-			_, err1 = tx.Delete(k)
-		}
-		return
+func (db *BuntDB) Del(keys []string) error {
+	return db.watchers.write(func() ([]Event, error) {
+		var events []Event
+		err := db.DB.Update(func(tx *buntdb.Tx) (err1 error) {
+			for _, k := range keys {
+				if _, err1 = tx.Delete(k); err1 == nil {
+					events = append(events, Event{Type: EventDelete, Key: []byte(k)})
+				}
+			}
+			return
+		})
+		return events, err
 	})
-	return
 }
 
 // Close ...
 func (db *BuntDB) Close() error {
+	db.watchers.close()
 	return db.DB.Close()
 }
 
@@ -145,8 +198,11 @@ func (db *BuntDB) Keys(prefix ...string) []string {
 		l = len(prefix1)
 	}
 	_ = db.DB.View(func(tx *buntdb.Tx) (err1 error) {
-		err1 = tx.AscendKeys("", func(key, _ string) bool {
-			if l == 0 || strings.HasPrefix(key, prefix1) {
+		err1 = tx.AscendGreaterOrEqual("", prefix1, func(key, _ string) bool {
+			if l > 0 && !strings.HasPrefix(key, prefix1) {
+				return false
+			}
+			if _, err := tx.TTL(key); err == nil {
 				keys = append(keys, key)
 			}
 			return true
@@ -156,8 +212,47 @@ func (db *BuntDB) Keys(prefix ...string) []string {
 	return keys
 }
 
-// GC runs the garbage collector.
+// buntGCBatch the max number of expired keys deleted in a transaction by GC.
+const buntGCBatch = 1000
+
+// GC removes the expired keys in batches, and shrinks the file.
 func (db *BuntDB) GC() error {
+	for {
+		var keys []string
+		_ = db.DB.View(func(tx *buntdb.Tx) error {
+			return tx.Ascend("", func(key, _ string) bool {
+				if _, err := tx.TTL(key); err != nil {
+					keys = append(keys, key)
+				}
+				return len(keys) < buntGCBatch
+			})
+		})
+		if len(keys) == 0 {
+			break
+		}
+		if err := db.watchers.write(func() ([]Event, error) {
+			var events []Event
+			err := db.DB.Update(func(tx *buntdb.Tx) error {
+				for _, key := range keys {
+					value, err := tx.Delete(key)
+					if err == buntdb.ErrNotFound {
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					events = append(events, Event{Type: EventExpire, Key: []byte(key), Value: []byte(value)})
+				}
+				return nil
+			})
+			return events, err
+		}); err != nil {
+			return err
+		}
+		if len(keys) < buntGCBatch {
+			break
+		}
+	}
 	return db.DB.Shrink()
 }
 
@@ -169,10 +264,168 @@ func (db *BuntDB) get(k string) (data string, err error) {
 	return
 }
 
-func (db *BuntDB) set(k, v string, ttl int) (err error) {
-	err = db.DB.Update(func(tx *buntdb.Tx) (err1 error) {
-		_, _, err1 = tx.Set(k, v, &buntdb.SetOptions{Expires: true, TTL: time.Duration(ttl) * time.Second})
-		return
+func (db *BuntDB) set(k, v string, ttl int) error {
+	return db.watchers.write(func() ([]Event, error) {
+		err := db.DB.Update(func(tx *buntdb.Tx) (err1 error) {
+			var opts *buntdb.SetOptions
+			if ttl > 0 {
+				opts = &buntdb.SetOptions{Expires: true, TTL: time.Duration(ttl) * time.Second}
+			}
+			_, _, err1 = tx.Set(k, v, opts)
+			return
+		})
+		return []Event{{Type: EventPut, Key: []byte(k), Value: []byte(v)}}, err
 	})
-	return
+}
+
+// Scan streams the pairs in the range [start, end), in reverse order optionally.
+func (db *BuntDB) Scan(start, end string, limit int, reverse ...bool) Iterator {
+	r := newScanRange(start, end, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// ScanPrefix streams the pairs of the keys with the prefix, in reverse order optionally.
+func (db *BuntDB) ScanPrefix(prefix string, limit int, reverse ...bool) Iterator {
+	r := newPrefixRange(prefix, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// Batch begins a read-write transaction, which locks the database until it's committed or discarded.
+// The order of the writes is held until the batch is committed or discarded.
+func (db *BuntDB) Batch() (Batch, error) {
+	db.watchers.order.Lock()
+	tx, err := db.DB.Begin(true)
+	if err != nil {
+		db.watchers.order.Unlock()
+		return nil, err
+	}
+	return &buntBatch{tx: tx, watchers: &db.watchers}, nil
+}
+
+// page reads the pairs of a scan in a read-only transaction.
+func (db *BuntDB) page(r *scanRange) pageFunc {
+	return func(last []byte, size int) (pairs []kvPair, done bool, err error) {
+		done = true
+		err = db.DB.View(func(tx *buntdb.Tx) error {
+			iter := func(key, value string) bool {
+				k := []byte(key)
+				if last != nil && bytes.Equal(k, last) {
+					return true
+				}
+				if r.reverse {
+					if r.before(k) {
+						return false
+					}
+					if r.after(k) {
+						return true
+					}
+				} else if r.after(k) {
+					return false
+				}
+				ttl := buntTTL(tx.TTL(key))
+				if ttl == -2 {
+					return true // expired
+				}
+				pairs = append(pairs, kvPair{key: k, value: []byte(value), ttl: ttl})
+				// stop when the page is full, the scan is not done
+				done = len(pairs) < size
+				return done
+			}
+			switch {
+			case last != nil && r.reverse:
+				return tx.DescendLessOrEqual("", string(last), iter)
+			case last != nil:
+				return tx.AscendGreaterOrEqual("", string(last), iter)
+			case r.reverse && r.end != nil:
+				return tx.DescendLessOrEqual("", string(r.end), iter)
+			case r.reverse:
+				return tx.Descend("", iter)
+			case r.start != nil:
+				return tx.AscendGreaterOrEqual("", string(r.start), iter)
+			default:
+				return tx.Ascend("", iter)
+			}
+		})
+		return
+	}
+}
+
+type buntBatch struct {
+	tx       *buntdb.Tx
+	watchers *watchers
+	events   []Event
+	done     bool
+}
+
+func (b *buntBatch) Set(k, v string, ttl int) error {
+	var opts *buntdb.SetOptions
+	if ttl > 0 {
+		opts = &buntdb.SetOptions{Expires: true, TTL: time.Duration(ttl) * time.Second}
+	}
+	if _, _, err := b.tx.Set(k, v, opts); err != nil {
+		return err
+	}
+	b.events = append(b.events, Event{Type: EventPut, Key: []byte(k), Value: []byte(v)})
+	return nil
+}
+
+func (b *buntBatch) SetBytes(k, v []byte, ttl int) error {
+	return b.Set(f.String(k), f.String(v), ttl)
+}
+
+func (b *buntBatch) Del(keys ...string) error {
+	for _, key := range keys {
+		_, err := b.tx.Delete(key)
+		if err == buntdb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		b.events = append(b.events, Event{Type: EventDelete, Key: []byte(key)})
+	}
+	return nil
+}
+
+func (b *buntBatch) Commit() error {
+	if b.done {
+		return buntdb.ErrTxClosed
+	}
+	defer b.release()
+	events := b.events
+	b.events = nil
+	if err := b.tx.Commit(); err != nil {
+		return err
+	}
+	b.watchers.notify(events...)
+	return nil
+}
+
+func (b *buntBatch) Discard() {
+	if !b.done {
+		defer b.release()
+		_ = b.tx.Rollback()
+	}
+}
+
+// release releases the order of the writes once.
+func (b *buntBatch) release() {
+	b.done = true
+	b.watchers.order.Unlock()
+}
+
+// buntTTL gets the time.seconds to live (rounded up) from the result of tx.TTL.
+func buntTTL(d time.Duration, err error) int64 {
+	if err != nil {
+		return -2
+	}
+	if d < 0 {
+		return -1
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// Watch emits the changes of the keys with the prefix, the expired keys are emitted when they are removed in the background.
+func (db *BuntDB) Watch(prefix string) (<-chan Event, func()) {
+	return db.watchers.watch(prefix)
 }
@@ -1,7 +1,8 @@
 package kv
 
 import (
-	"errors"
+	"bytes"
+	"encoding/binary"
 	"github.com/angenalZZZ/gofunc/f"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
@@ -10,16 +11,32 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
 // LevelDB represents a leveldb db implementation.
+// The values are saved as "expiresAt;value", the keys with ttl are also saved in an expiry index,
+// which is a reserved range of keys sorted by the time of expiration, so GC removes the expired keys in batches.
 type LevelDB struct {
-	DB     *leveldb.DB
-	locker *f.Locker
+	DB       *leveldb.DB
+	locker   *f.Locker
+	mu       sync.Mutex // the write lock, the expired keys are checked and deleted under it
+	watchers watchers
 }
 
+var (
+	// levelExpiryPrefix the prefix of the expiry index: prefix + expiresAt (8 bytes big endian) + key.
+	levelExpiryPrefix = []byte("\x00\x00kv-exp:")
+	levelExpiryEnd    = prefixEnd(levelExpiryPrefix)
+	// levelExpiryIndexed the last entry of the expiry index, never reached by GC,
+	// marks that the keys with ttl saved before the index was added are indexed.
+	levelExpiryIndexed = append(append([]byte{}, levelExpiryPrefix...), "\xff\xff\xff\xff\xff\xff\xff\xff"...)
+)
+
+// levelGCBatch the max number of expired keys deleted in a batch by GC.
+const levelGCBatch = 1000
+
 // Open Opens the specified path.
 func (db *LevelDB) Open(path ...string) error {
 	filename := ""
@@ -34,9 +51,42 @@ func (db *LevelDB) Open(path ...string) error {
 		return err
 	}
 	db.locker = f.NewLocker()
+	if err = db.indexExpiry(); err != nil {
+		_ = db.DB.Close()
+		return err
+	}
 	return nil
 }
 
+// indexExpiry adds the keys with ttl to the expiry index once, which were saved without it by the old versions.
+func (db *LevelDB) indexExpiry() error {
+	if ok, err := db.DB.Has(levelExpiryIndexed, nil); ok || err != nil {
+		return err
+	}
+	iter := db.DB.NewIterator(nil, &opt.ReadOptions{DontFillCache: true})
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		if bytes.HasPrefix(iter.Key(), levelExpiryPrefix) {
+			continue
+		}
+		if exp, _, ok := levelDecode(iter.Value()); ok && exp > 0 {
+			batch.Put(levelExpiryKey(iter.Key(), exp), nil)
+		}
+		if batch.Len() >= levelGCBatch {
+			if err := db.DB.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	batch.Put(levelExpiryIndexed, nil)
+	return db.DB.Write(batch, nil)
+}
+
 // Size gets the size of the database in bytes.
 func (db *LevelDB) Size() int64 {
 	var stats leveldb.DBStats
@@ -50,20 +100,23 @@ func (db *LevelDB) Size() int64 {
 	return size
 }
 
-// Incr increment the key by the specified value.
+// Incr increment the key by the specified value, the ttl of the key is kept.
 func (db *LevelDB) Incr(k string, by int64) (int64, error) {
 	db.locker.Lock(k)
 	defer db.locker.Unlock(k)
 
+	var expires int64
 	val, err := db.get(k)
 	if err != nil || val == "" {
 		val = "0"
+	} else if item, err := db.DB.Get(f.Bytes(k), nil); err == nil {
+		expires, _, _ = levelDecode(item)
 	}
 
 	valFloat, _ := strconv.ParseInt(val, 10, 64)
 	valFloat += by
 
-	err = db.set(k, strconv.FormatInt(valFloat, 10), -1)
+	err = db.put(k, strconv.FormatInt(valFloat, 10), expires)
 	if err != nil {
 		return 0, err
 	}
@@ -84,11 +137,17 @@ func (db *LevelDB) SetBytes(k, v []byte, ttl int) error {
 // MSet sets multiple key-value pairs.
 func (db *LevelDB) MSet(data map[string]string) error {
 	batch := new(leveldb.Batch)
+	var events []Event
+	if db.watchers.active() {
+		events = make([]Event, 0, len(data))
+	}
 	for k, v := range data {
-		v = "0;" + v
-		batch.Put(f.Bytes(k), f.Bytes(v))
+		levelPut(batch, f.Bytes(k), f.Bytes(v), 0)
+		if events != nil {
+			events = append(events, Event{Type: EventPut, Key: []byte(k), Value: []byte(v)})
+		}
 	}
-	return db.DB.Write(batch, nil)
+	return db.write(batch, events...)
 }
 
 // Get fetches the value of the specified k.
@@ -126,31 +185,27 @@ func (db *LevelDB) TTL(key string) int64 {
 		return -2
 	}
 
-	parts := strings.SplitN(f.String(item), ";", 2)
-	exp, _ := strconv.ParseInt(parts[0], 10, 0)
-	if exp == 0 {
-		return -1
-	}
-
-	now := time.Now().Unix()
-	if now >= exp {
+	exp, _, ok := levelDecode(item)
+	if !ok {
 		return -2
 	}
-
-	return (exp - now) / int64(time.Second)
+	return ttlSeconds(exp)
 }
 
 // Del removes key(s) from the store.
 func (db *LevelDB) Del(keys []string) error {
 	batch := new(leveldb.Batch)
+	events := make([]Event, 0, len(keys))
 	for _, key := range keys {
 		batch.Delete(f.Bytes(key))
+		events = append(events, Event{Type: EventDelete, Key: []byte(key)})
 	}
-	return db.DB.Write(batch, nil)
+	return db.write(batch, events...)
 }
 
 // Close ...
 func (db *LevelDB) Close() error {
+	db.watchers.close()
 	return db.DB.Close()
 }
 
@@ -170,53 +225,279 @@ func (db *LevelDB) Keys(prefix ...string) []string {
 		iter = db.DB.NewIterator(util.BytesPrefix(prefixBytes), ro)
 	}
 	defer iter.Release()
+	now := time.Now().Unix()
 	for iter.Next() {
-		if iter.Error() != nil {
+		if iter.Error() != nil || bytes.HasPrefix(iter.Key(), levelExpiryPrefix) {
 			continue
 		}
-		keys = append(keys, f.String(iter.Key()))
+		if exp, _, ok := levelDecode(iter.Value()); ok && (exp == 0 || exp > now) {
+			keys = append(keys, string(iter.Key()))
+		}
 	}
 	return keys
 }
 
-// GC runs the garbage collector.
+// GC removes the expired keys in batches by the expiry index, and compacts the database.
 func (db *LevelDB) GC() error {
+	limit := make([]byte, len(levelExpiryPrefix)+8)
+	copy(limit, levelExpiryPrefix)
+	binary.BigEndian.PutUint64(limit[len(levelExpiryPrefix):], uint64(time.Now().Unix()+1))
+	for {
+		n, err := db.gcExpired(limit)
+		if err != nil {
+			return err
+		}
+		if n < levelGCBatch {
+			break
+		}
+	}
 	return db.DB.CompactRange(util.Range{})
 }
 
-func (db *LevelDB) get(k string) (string, error) {
-	var data string
-	var err error
-	var del bool
+// gcExpired removes a batch of the expired keys before the limit of the expiry index,
+// the keys updated after the index entries were written are kept.
+func (db *LevelDB) gcExpired(limit []byte) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	iter := db.DB.NewIterator(&util.Range{Start: levelExpiryPrefix, Limit: limit}, &opt.ReadOptions{DontFillCache: true})
+	batch, n := new(leveldb.Batch), 0
+	var events []Event
+	for ; n < levelGCBatch && iter.Next(); n++ {
+		index := append([]byte{}, iter.Key()...)
+		batch.Delete(index)
+		exp, key := int64(binary.BigEndian.Uint64(index[len(levelExpiryPrefix):])), index[len(levelExpiryPrefix)+8:]
+		if item, err := db.DB.Get(key, nil); err == nil {
+			if exp1, value, ok := levelDecode(item); ok && exp1 == exp {
+				batch.Delete(key)
+				events = append(events, Event{Type: EventExpire, Key: key, Value: value})
+			}
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := db.DB.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	db.watchers.notify(events...)
+	return n, nil
+}
 
+func (db *LevelDB) get(k string) (string, error) {
 	item, err := db.DB.Get(f.Bytes(k), nil)
 	if err != nil {
 		return "", err
 	}
 
-	parts := strings.SplitN(f.String(item), ";", 2)
-	expires, actual := parts[0], parts[1]
+	exp, actual, ok := levelDecode(item)
+	if !ok {
+		return "", ErrNotFound
+	}
+	if exp > 0 && time.Now().Unix() >= exp {
+		db.deleteExpired(f.Bytes(k), exp)
+		return "", ErrNotFound
+	}
+	return string(actual), nil
+}
 
-	if exp, _ := strconv.ParseInt(expires, 10, 0); exp > 0 && time.Now().Unix() >= exp {
-		del = true
-		err = errors.New("key not found")
-	} else {
-		data = actual
+// deleteExpired deletes the expired key under the write lock, if it's not updated after it was read.
+func (db *LevelDB) deleteExpired(k []byte, exp int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	item, err := db.DB.Get(k, nil)
+	if err != nil {
+		return
 	}
+	if exp1, value, ok := levelDecode(item); ok && exp1 == exp {
+		batch := new(leveldb.Batch)
+		batch.Delete(k)
+		batch.Delete(levelExpiryKey(k, exp))
+		if db.DB.Write(batch, nil) == nil {
+			db.watchers.notify(Event{Type: EventExpire, Key: []byte(string(k)), Value: value})
+		}
+	}
+}
 
-	if del {
-		_ = db.DB.Delete(f.Bytes(k), nil)
-		return data, err
+func (db *LevelDB) set(k, v string, ttl int) error {
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(time.Duration(ttl) * time.Second).Unix()
 	}
+	return db.put(k, v, expires)
+}
 
-	return data, nil
+// put puts the value with the time of expiration, 0 never expires.
+func (db *LevelDB) put(k, v string, expires int64) error {
+	batch := new(leveldb.Batch)
+	levelPut(batch, f.Bytes(k), f.Bytes(v), expires)
+	return db.write(batch, Event{Type: EventPut, Key: []byte(k), Value: []byte(v)})
 }
 
-func (db *LevelDB) set(k, v string, ttl int) error {
+// write writes the batch and notifies its events under the write lock, so the events are in the order of the writes.
+func (db *LevelDB) write(batch *leveldb.Batch, events ...Event) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.DB.Write(batch, nil); err != nil {
+		return err
+	}
+	db.watchers.notify(events...)
+	return nil
+}
+
+// levelPut puts the value and the expiry index entry of a key to the batch.
+func levelPut(batch *leveldb.Batch, k, v []byte, expires int64) {
+	batch.Put(k, append(strconv.AppendInt(make([]byte, 0, len(v)+11), expires, 10), append([]byte{';'}, v...)...))
+	if expires > 0 {
+		batch.Put(levelExpiryKey(k, expires), nil)
+	}
+}
+
+// levelExpiryKey gets the key of the expiry index entry.
+func levelExpiryKey(k []byte, expires int64) []byte {
+	index := make([]byte, len(levelExpiryPrefix)+8, len(levelExpiryPrefix)+8+len(k))
+	copy(index, levelExpiryPrefix)
+	binary.BigEndian.PutUint64(index[len(levelExpiryPrefix):], uint64(expires))
+	return append(index, k...)
+}
+
+// levelDecode decodes a value "expiresAt;value".
+func levelDecode(item []byte) (int64, []byte, bool) {
+	i := bytes.IndexByte(item, ';')
+	if i < 0 {
+		return 0, nil, false
+	}
+	exp, err := strconv.ParseInt(f.String(item[:i]), 10, 64)
+	return exp, item[i+1:], err == nil
+}
+
+// Scan streams the pairs in the range [start, end), in reverse order optionally.
+func (db *LevelDB) Scan(start, end string, limit int, reverse ...bool) Iterator {
+	return db.scan(newScanRange(start, end, limit, reverse))
+}
+
+// ScanPrefix streams the pairs of the keys with the prefix, in reverse order optionally.
+func (db *LevelDB) ScanPrefix(prefix string, limit int, reverse ...bool) Iterator {
+	return db.scan(newPrefixRange(prefix, limit, reverse))
+}
+
+func (db *LevelDB) scan(r *scanRange) Iterator {
+	ro := &opt.ReadOptions{DontFillCache: true}
+	return &levelIterator{it: db.DB.NewIterator(&util.Range{Start: r.start, Limit: r.end}, ro), r: r}
+}
+
+// Batch begins a batch of writes, which is written atomically on commit.
+func (db *LevelDB) Batch() (Batch, error) {
+	return &levelBatch{db: db, batch: new(leveldb.Batch)}, nil
+}
+
+type levelIterator struct {
+	it         iterator.Iterator
+	r          *scanRange
+	n          int
+	started    bool
+	key, value []byte
+	ttl        int64
+}
+
+func (it *levelIterator) Next() bool {
+	if it.r.limit > 0 && it.n >= it.r.limit {
+		return false
+	}
+	for it.move() {
+		exp, value, ok := levelDecode(it.it.Value())
+		if !ok {
+			continue
+		}
+		if it.ttl = ttlSeconds(exp); it.ttl == -2 {
+			continue // expired
+		}
+		it.key = append(it.key[:0], it.it.Key()...)
+		it.value = append(it.value[:0], value...)
+		it.n++
+		return true
+	}
+	return false
+}
+
+func (it *levelIterator) move() (ok bool) {
+	switch {
+	case !it.started:
+		it.started = true
+		if it.r.reverse {
+			ok = it.it.Last()
+		} else {
+			ok = it.it.First()
+		}
+	case it.r.reverse:
+		ok = it.it.Prev()
+	default:
+		ok = it.it.Next()
+	}
+	// jumps over the expiry index
+	if ok && bytes.HasPrefix(it.it.Key(), levelExpiryPrefix) {
+		if it.r.reverse {
+			ok = it.it.Seek(levelExpiryPrefix) && it.it.Prev()
+		} else {
+			ok = it.it.Seek(levelExpiryEnd)
+		}
+	}
+	return
+}
+
+func (it *levelIterator) Key() []byte   { return it.key }
+func (it *levelIterator) Value() []byte { return it.value }
+func (it *levelIterator) TTL() int64    { return it.ttl }
+func (it *levelIterator) Err() error    { return it.it.Error() }
+
+func (it *levelIterator) Close() error {
+	it.it.Release()
+	return nil
+}
+
+type levelBatch struct {
+	db     *LevelDB
+	batch  *leveldb.Batch
+	events []Event
+}
+
+func (b *levelBatch) Set(k, v string, ttl int) error {
 	var expires int64
 	if ttl > 0 {
 		expires = time.Now().Add(time.Duration(ttl) * time.Second).Unix()
 	}
-	v = strconv.FormatInt(expires, 10) + ";" + v
-	return db.DB.Put(f.Bytes(k), f.Bytes(v), nil)
+	levelPut(b.batch, []byte(k), []byte(v), expires)
+	b.events = append(b.events, Event{Type: EventPut, Key: []byte(k), Value: []byte(v)})
+	return nil
+}
+
+func (b *levelBatch) SetBytes(k, v []byte, ttl int) error {
+	return b.Set(f.String(k), f.String(v), ttl)
+}
+
+func (b *levelBatch) Del(keys ...string) error {
+	for _, key := range keys {
+		b.batch.Delete(f.Bytes(key))
+		b.events = append(b.events, Event{Type: EventDelete, Key: []byte(key)})
+	}
+	return nil
+}
+
+func (b *levelBatch) Commit() error {
+	events := b.events
+	b.events = nil
+	return b.db.write(b.batch, events...)
+}
+
+func (b *levelBatch) Discard() {
+	b.batch.Reset()
+	b.events = nil
+}
+
+// Watch emits the changes of the keys with the prefix, the expired keys are emitted when they are removed by Get or GC.
+func (db *LevelDB) Watch(prefix string) (<-chan Event, func()) {
+	return db.watchers.watch(prefix)
 }
@@ -0,0 +1,470 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/f"
+)
+
+// LogDB is a pure-Go key/value store replayed from a log, all the pairs are kept in memory,
+// sorted in a B+tree, and the writes are appended to a file which is replayed on open and compacted by GC.
+// The memory and the time to open grow with the data, it suits the data that fits in memory.
+//
+// The file is a sequence of frames: crc32(4) length(4) ops, each frame is a Set, MSet, Del or Batch,
+// a torn frame at the end of the file is truncated on open.
+type LogDB struct {
+	tree     *bptree
+	file     *os.File
+	path     string
+	temp     bool // the temp file is removed on close
+	size     int64
+	mu       sync.RWMutex
+	locker   *f.Locker
+	watchers watchers
+}
+
+const (
+	logOpSet byte = 1
+	logOpDel byte = 2
+)
+
+var errLogFrame = errors.New("[kv] invalid log frame")
+
+// Open Opens the specified file, or the file kv.log in the specified directory, default in a temp file.
+func (db *LogDB) Open(path ...string) error {
+	var filename string
+	if len(path) > 0 {
+		filename = path[0]
+		if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
+			filename = filepath.Join(filename, "kv.log")
+		} else if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+	} else {
+		file, err := ioutil.TempFile(os.TempDir(), "kv-log-*.log")
+		if err != nil {
+			return err
+		}
+		filename, db.temp = file.Name(), true
+		_ = file.Close()
+	}
+
+	db.tree, db.path, db.locker = newBPTree(), filename, f.NewLocker()
+	if err := db.load(); err != nil {
+		if db.temp {
+			_ = os.Remove(filename)
+		}
+		return err
+	}
+	return nil
+}
+
+// load replays the file into the tree frame by frame, and opens the file to append.
+func (db *LogDB) load() error {
+	file, err := os.OpenFile(db.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	now, offset, r := time.Now().UnixNano(), int64(0), bufio.NewReader(file)
+	for offset < fi.Size() {
+		n, ops, err := readLogFrame(r, fi.Size()-offset)
+		if err != nil {
+			break
+		}
+		for _, op := range ops {
+			if op.del || (op.expiresAt > 0 && op.expiresAt <= now) {
+				db.tree.delete(op.key)
+			} else {
+				db.tree.put(op.key, bptValue{value: op.value, expiresAt: op.expiresAt})
+			}
+		}
+		offset += int64(n)
+	}
+
+	if offset < fi.Size() {
+		if err = file.Truncate(offset); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if _, err = file.Seek(offset, 0); err != nil {
+		_ = file.Close()
+		return err
+	}
+	db.file, db.size = file, offset
+	return nil
+}
+
+// readLogFrame reads a frame of the length up to the max, the frame of a larger length is torn.
+func readLogFrame(r io.Reader, max int64) (int, []batchOp, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(header[4:8]))
+	if 8+n > max {
+		return 0, nil, errLogFrame
+	}
+	buf := make([]byte, 8+n)
+	copy(buf, header[:])
+	if _, err := io.ReadFull(r, buf[8:]); err != nil {
+		return 0, nil, err
+	}
+	return decodeLogFrame(buf)
+}
+
+// Size gets the size of the file in bytes.
+func (db *LogDB) Size() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.size
+}
+
+// Incr increment the key by the specified value.
+func (db *LogDB) Incr(k string, by int64) (int64, error) {
+	db.locker.Lock(k)
+	defer db.locker.Unlock(k)
+
+	val, expires := "0", int64(0)
+	db.mu.RLock()
+	if v, ok := db.tree.get(f.Bytes(k)); ok && (v.expiresAt == 0 || v.expiresAt > time.Now().UnixNano()) && len(v.value) > 0 {
+		val, expires = string(v.value), v.expiresAt
+	}
+	db.mu.RUnlock()
+
+	valFloat, _ := strconv.ParseInt(val, 10, 64)
+	valFloat += by
+
+	err := db.apply([]batchOp{{key: []byte(k), value: []byte(strconv.FormatInt(valFloat, 10)), expiresAt: expires}})
+	if err != nil {
+		return 0, err
+	}
+
+	return valFloat, nil
+}
+
+// Set sets a key with the specified value and optional ttl.seconds
+func (db *LogDB) Set(k, v string, ttl int) error {
+	return db.apply([]batchOp{{key: []byte(k), value: []byte(v), expiresAt: expiresAt(ttl)}})
+}
+
+// SetBytes sets a key with the specified value and optional ttl.seconds
+func (db *LogDB) SetBytes(k, v []byte, ttl int) error {
+	return db.apply([]batchOp{{key: append([]byte{}, k...), value: append([]byte{}, v...), expiresAt: expiresAt(ttl)}})
+}
+
+// MSet sets multiple key-value pairs.
+func (db *LogDB) MSet(data map[string]string) error {
+	ops := make([]batchOp, 0, len(data))
+	for k, v := range data {
+		ops = append(ops, batchOp{key: []byte(k), value: []byte(v)})
+	}
+	return db.apply(ops)
+}
+
+// Get fetches the value of the specified k.
+func (db *LogDB) Get(k string) (string, error) {
+	v, err := db.GetBytes(f.Bytes(k))
+	return string(v), err
+}
+
+// GetBytes fetches the value of the specified k.
+func (db *LogDB) GetBytes(k []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	v, ok := db.tree.get(k)
+	if !ok || (v.expiresAt > 0 && v.expiresAt <= time.Now().UnixNano()) {
+		return []byte{}, ErrNotFound
+	}
+	return append([]byte{}, v.value...), nil
+}
+
+// MGet fetch multiple values of the specified keys.
+func (db *LogDB) MGet(keys []string) (data []string) {
+	data = make([]string, 0, len(keys))
+	for _, key := range keys {
+		val, _ := db.Get(key)
+		data = append(data, val)
+	}
+	return data
+}
+
+// TTL gets the time.seconds to live of the specified key's value.
+func (db *LogDB) TTL(key string) int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	v, ok := db.tree.get(f.Bytes(key))
+	if !ok {
+		return -2
+	}
+	return ttlNano(v.expiresAt)
+}
+
+// Del removes key(s) from the store.
+func (db *LogDB) Del(keys []string) error {
+	ops := make([]batchOp, 0, len(keys))
+	for _, key := range keys {
+		ops = append(ops, batchOp{key: []byte(key), del: true})
+	}
+	return db.apply(ops)
+}
+
+// Close closes the file, the temp file is removed.
+func (db *LogDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.watchers.close()
+	err := db.file.Close()
+	if db.temp {
+		_ = os.Remove(db.path)
+	}
+	return err
+}
+
+// Keys gets matched keys.
+func (db *LogDB) Keys(prefix ...string) []string {
+	var keys []string
+	var r *scanRange
+	if len(prefix) > 0 {
+		r = newPrefixRange(prefix[0], 0, nil)
+	} else {
+		r = newScanRange("", "", 0, nil)
+	}
+	now := time.Now().UnixNano()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.tree.ascend(r.start, func(k []byte, v bptValue) bool {
+		if r.after(k) {
+			return false
+		}
+		if v.expiresAt == 0 || v.expiresAt > now {
+			keys = append(keys, string(k))
+		}
+		return true
+	})
+	return keys
+}
+
+// GC removes the expired keys, and rewrites the file with the live pairs only.
+func (db *LogDB) GC() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now, tree := time.Now().UnixNano(), newBPTree()
+	tmp := db.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	ops := make([]batchOp, 0, pageSize)
+	flush := func() {
+		if err == nil && len(ops) > 0 {
+			frame := encodeLogFrame(ops)
+			_, err = file.Write(frame)
+			size += int64(len(frame))
+			ops = ops[:0]
+		}
+	}
+	var expired []Event
+	db.tree.ascend(nil, func(k []byte, v bptValue) bool {
+		if v.expiresAt > 0 && v.expiresAt <= now {
+			expired = append(expired, Event{Type: EventExpire, Key: k, Value: v.value})
+			return true
+		}
+		tree.put(k, v)
+		if ops = append(ops, batchOp{key: k, value: v.value, expiresAt: v.expiresAt}); len(ops) == cap(ops) {
+			flush()
+		}
+		return err == nil
+	})
+	flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// The file is closed before it's replaced, which is required on windows, and it's reopened to append
+	// even if the rename fails, the file is not replaced then.
+	_ = db.file.Close()
+	if err = os.Rename(tmp, db.path); err != nil {
+		_ = os.Remove(tmp)
+		tree, size, expired = db.tree, db.size, nil
+	}
+	file, err1 := os.OpenFile(db.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err1 != nil {
+		return err1
+	}
+	db.file, db.tree, db.size = file, tree, size
+	db.watchers.notify(expired...)
+	return err
+}
+
+// Scan streams the pairs in the range [start, end), in reverse order optionally.
+func (db *LogDB) Scan(start, end string, limit int, reverse ...bool) Iterator {
+	r := newScanRange(start, end, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// ScanPrefix streams the pairs of the keys with the prefix, in reverse order optionally.
+func (db *LogDB) ScanPrefix(prefix string, limit int, reverse ...bool) Iterator {
+	r := newPrefixRange(prefix, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// Batch begins a batch of writes, which is written in a frame and applied atomically on commit.
+func (db *LogDB) Batch() (Batch, error) {
+	return &opBatch{apply: db.apply}, nil
+}
+
+func (db *LogDB) page(r *scanRange) pageFunc {
+	return func(last []byte, size int) ([]kvPair, bool, error) {
+		pairs, done, now := make([]kvPair, 0, size), true, time.Now().UnixNano()
+		fn := func(k []byte, v bptValue) bool {
+			if r.reverse && r.before(k) || !r.reverse && r.after(k) {
+				return false
+			}
+			if last != nil && bytes.Equal(k, last) || v.expiresAt > 0 && v.expiresAt <= now {
+				return true
+			}
+			pairs = append(pairs, kvPair{key: k, value: v.value, ttl: ttlNano(v.expiresAt)})
+			// stop when the page is full, the scan is not done
+			done = len(pairs) < size
+			return done
+		}
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		if r.reverse {
+			pivot := r.end
+			if last != nil {
+				pivot = last
+			}
+			db.tree.descend(pivot, fn)
+		} else {
+			pivot := r.start
+			if last != nil {
+				pivot = last
+			}
+			db.tree.ascend(pivot, fn)
+		}
+		return pairs, done, nil
+	}
+}
+
+// apply appends the ops in a frame to the file, then applies them to the tree.
+func (db *LogDB) apply(ops []batchOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	frame := encodeLogFrame(ops)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.file.Write(frame); err != nil {
+		return err
+	}
+	db.size += int64(len(frame))
+	for _, op := range ops {
+		if op.del {
+			db.tree.delete(op.key)
+		} else {
+			db.tree.put(op.key, bptValue{value: op.value, expiresAt: op.expiresAt})
+		}
+	}
+	db.watchers.notify(opEvents(ops)...)
+	return nil
+}
+
+func encodeLogFrame(ops []batchOp) []byte {
+	buf := make([]byte, 8, 8+len(ops)*32)
+	for _, op := range ops {
+		if op.del {
+			buf = append(buf, logOpDel)
+			buf = appendUvarintBytes(buf, op.key)
+			continue
+		}
+		buf = append(buf, logOpSet)
+		buf = appendUvarintBytes(buf, op.key)
+		buf = appendUvarintBytes(buf, op.value)
+		var exp [8]byte
+		binary.BigEndian.PutUint64(exp[:], uint64(op.expiresAt))
+		buf = append(buf, exp[:]...)
+	}
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(buf)-8))
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func decodeLogFrame(buf []byte) (int, []batchOp, error) {
+	if len(buf) < 8 {
+		return 0, nil, errLogFrame
+	}
+	n := 8 + int(binary.BigEndian.Uint32(buf[4:8]))
+	if n > len(buf) || crc32.ChecksumIEEE(buf[4:n]) != binary.BigEndian.Uint32(buf[0:4]) {
+		return 0, nil, errLogFrame
+	}
+	var ops []batchOp
+	for p := buf[8:n]; len(p) > 0; {
+		var op batchOp
+		kind := p[0]
+		p = p[1:]
+		if op.key, p = readUvarintBytes(p); op.key == nil {
+			return 0, nil, errLogFrame
+		}
+		switch kind {
+		case logOpDel:
+			op.del = true
+		case logOpSet:
+			if op.value, p = readUvarintBytes(p); op.value == nil || len(p) < 8 {
+				return 0, nil, errLogFrame
+			}
+			op.expiresAt, p = int64(binary.BigEndian.Uint64(p[:8])), p[8:]
+		default:
+			return 0, nil, errLogFrame
+		}
+		ops = append(ops, op)
+	}
+	return n, ops, nil
+}
+
+func appendUvarintBytes(buf, b []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	buf = append(buf, l[:binary.PutUvarint(l[:], uint64(len(b)))]...)
+	return append(buf, b...)
+}
+
+// readUvarintBytes reads a length-prefixed bytes, returns nil if the buffer is invalid.
+func readUvarintBytes(p []byte) ([]byte, []byte) {
+	l, n := binary.Uvarint(p)
+	if n <= 0 || uint64(len(p)-n) < l {
+		return nil, p
+	}
+	return append([]byte{}, p[n:n+int(l)]...), p[n+int(l):]
+}
+
+// Watch emits the changes of the keys with the prefix, the expired keys are emitted when they are removed by GC.
+func (db *LogDB) Watch(prefix string) (<-chan Event, func()) {
+	return db.watchers.watch(prefix)
+}
@@ -0,0 +1,371 @@
+package kv
+
+import (
+	"bytes"
+	"container/heap"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/f"
+)
+
+// memoryShards the number of shards of MemoryDB.
+const memoryShards = 32
+
+// MemoryDB is an in-memory key/value store, not persisted.
+// The keys are sharded in maps, the expired keys are removed by a TTL heap every second.
+// The scans read the pages from a sorted index of the keys.
+type MemoryDB struct {
+	shards   []*memoryShard
+	index    *bptree
+	indexMu  sync.RWMutex // a lock for the index, taken after the shard locks
+	deleted  int          // the number of keys deleted from the index since it was rebuilt
+	locker   *f.Locker
+	stop     chan struct{}
+	watchers watchers
+}
+
+type memoryShard struct {
+	sync.RWMutex
+	items  map[string]*memoryItem
+	expiry memoryExpiry
+}
+
+type memoryItem struct {
+	value     []byte
+	expiresAt int64
+}
+
+// memoryExpiry a min-heap of the expiration time, the entries of updated keys are dropped when popped.
+type memoryExpiry []memoryExpiryEntry
+
+type memoryExpiryEntry struct {
+	key       string
+	expiresAt int64
+}
+
+func (h memoryExpiry) Len() int            { return len(h) }
+func (h memoryExpiry) Less(i, j int) bool  { return h[i].expiresAt < h[j].expiresAt }
+func (h memoryExpiry) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *memoryExpiry) Push(x interface{}) { *h = append(*h, x.(memoryExpiryEntry)) }
+func (h *memoryExpiry) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Open Opens the in-memory store, the path is ignored.
+func (db *MemoryDB) Open(_ ...string) error {
+	db.shards = make([]*memoryShard, memoryShards)
+	for i := range db.shards {
+		db.shards[i] = &memoryShard{items: make(map[string]*memoryItem)}
+	}
+	db.index = newBPTree()
+	db.locker = f.NewLocker()
+	stop := make(chan struct{})
+	db.stop = stop
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_ = db.GC()
+			}
+		}
+	}()
+	return nil
+}
+
+// Size gets the size of the keys and values in bytes.
+func (db *MemoryDB) Size() int64 {
+	var size int64
+	for _, s := range db.shards {
+		s.RLock()
+		for k, item := range s.items {
+			size += int64(len(k) + len(item.value))
+		}
+		s.RUnlock()
+	}
+	return size
+}
+
+// Incr increment the key by the specified value.
+func (db *MemoryDB) Incr(k string, by int64) (int64, error) {
+	db.locker.Lock(k)
+	defer db.locker.Unlock(k)
+
+	val, expires := "0", int64(0)
+	s := db.shard(k)
+	s.RLock()
+	if item, ok := s.items[k]; ok && !item.expired(time.Now().UnixNano()) && len(item.value) > 0 {
+		val, expires = string(item.value), item.expiresAt
+	}
+	s.RUnlock()
+
+	valFloat, _ := strconv.ParseInt(val, 10, 64)
+	valFloat += by
+
+	err := db.apply([]batchOp{{key: []byte(k), value: []byte(strconv.FormatInt(valFloat, 10)), expiresAt: expires}})
+	if err != nil {
+		return 0, err
+	}
+
+	return valFloat, nil
+}
+
+// Set sets a key with the specified value and optional ttl.seconds
+func (db *MemoryDB) Set(k, v string, ttl int) error {
+	return db.SetBytes([]byte(k), []byte(v), ttl)
+}
+
+// SetBytes sets a key with the specified value and optional ttl.seconds
+func (db *MemoryDB) SetBytes(k, v []byte, ttl int) error {
+	return db.apply([]batchOp{{key: append([]byte{}, k...), value: append([]byte{}, v...), expiresAt: expiresAt(ttl)}})
+}
+
+// MSet sets multiple key-value pairs.
+func (db *MemoryDB) MSet(data map[string]string) error {
+	ops := make([]batchOp, 0, len(data))
+	for k, v := range data {
+		ops = append(ops, batchOp{key: []byte(k), value: []byte(v)})
+	}
+	return db.apply(ops)
+}
+
+// Get fetches the value of the specified k.
+func (db *MemoryDB) Get(k string) (string, error) {
+	v, err := db.GetBytes(f.Bytes(k))
+	return string(v), err
+}
+
+// GetBytes fetches the value of the specified k.
+func (db *MemoryDB) GetBytes(k []byte) ([]byte, error) {
+	s := db.shard(f.String(k))
+	s.RLock()
+	defer s.RUnlock()
+	item, ok := s.items[f.String(k)]
+	if !ok || item.expired(time.Now().UnixNano()) {
+		return []byte{}, ErrNotFound
+	}
+	return append([]byte{}, item.value...), nil
+}
+
+// MGet fetch multiple values of the specified keys.
+func (db *MemoryDB) MGet(keys []string) (data []string) {
+	data = make([]string, 0, len(keys))
+	for _, key := range keys {
+		val, _ := db.Get(key)
+		data = append(data, val)
+	}
+	return data
+}
+
+// TTL gets the time.seconds to live of the specified key's value.
+func (db *MemoryDB) TTL(key string) int64 {
+	s := db.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	item, ok := s.items[key]
+	if !ok {
+		return -2
+	}
+	return ttlNano(item.expiresAt)
+}
+
+// Del removes key(s) from the store.
+func (db *MemoryDB) Del(keys []string) error {
+	ops := make([]batchOp, 0, len(keys))
+	for _, key := range keys {
+		ops = append(ops, batchOp{key: []byte(key), del: true})
+	}
+	return db.apply(ops)
+}
+
+// Close stops removing the expired keys, and clears the store.
+func (db *MemoryDB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		db.stop = nil
+	}
+	for _, s := range db.shards {
+		s.Lock()
+		s.items, s.expiry = make(map[string]*memoryItem), nil
+		s.Unlock()
+	}
+	db.indexMu.Lock()
+	db.index = newBPTree()
+	db.indexMu.Unlock()
+	db.watchers.close()
+	return nil
+}
+
+// Keys gets matched keys, in key order.
+func (db *MemoryDB) Keys(prefix ...string) []string {
+	var prefix1 string
+	if len(prefix) > 0 {
+		prefix1 = prefix[0]
+	}
+	var keys []string
+	now := time.Now().UnixNano()
+	for _, s := range db.shards {
+		s.RLock()
+		for k, item := range s.items {
+			if strings.HasPrefix(k, prefix1) && !item.expired(now) {
+				keys = append(keys, k)
+			}
+		}
+		s.RUnlock()
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GC removes the expired keys.
+func (db *MemoryDB) GC() error {
+	now := time.Now().UnixNano()
+	for _, s := range db.shards {
+		s.Lock()
+		for len(s.expiry) > 0 && s.expiry[0].expiresAt <= now {
+			e := heap.Pop(&s.expiry).(memoryExpiryEntry)
+			if item, ok := s.items[e.key]; ok && item.expiresAt == e.expiresAt {
+				delete(s.items, e.key)
+				db.indexMu.Lock()
+				db.deleteIndex([]byte(e.key))
+				db.indexMu.Unlock()
+				db.watchers.notify(Event{Type: EventExpire, Key: []byte(e.key), Value: item.value})
+			}
+		}
+		s.Unlock()
+	}
+
+	// rebuild the index to drop the empty leaves of the deleted keys
+	db.indexMu.Lock()
+	if db.deleted > 1024 && db.deleted > db.index.len {
+		tree := newBPTree()
+		db.index.ascend(nil, func(k []byte, v bptValue) bool {
+			tree.put(k, v)
+			return true
+		})
+		db.index, db.deleted = tree, 0
+	}
+	db.indexMu.Unlock()
+	return nil
+}
+
+// Scan streams the pairs in the range [start, end), in reverse order optionally.
+// The pairs are read in pages from the sorted index, the writes between the pages are visible.
+func (db *MemoryDB) Scan(start, end string, limit int, reverse ...bool) Iterator {
+	r := newScanRange(start, end, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// ScanPrefix streams the pairs of the keys with the prefix, in reverse order optionally.
+func (db *MemoryDB) ScanPrefix(prefix string, limit int, reverse ...bool) Iterator {
+	r := newPrefixRange(prefix, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// Batch begins a batch of writes, which is applied atomically on commit.
+func (db *MemoryDB) Batch() (Batch, error) {
+	return &opBatch{apply: db.apply}, nil
+}
+
+func (db *MemoryDB) page(r *scanRange) pageFunc {
+	return func(last []byte, size int) ([]kvPair, bool, error) {
+		pairs, done, now := make([]kvPair, 0, size), true, time.Now().UnixNano()
+		fn := func(k []byte, v bptValue) bool {
+			if r.reverse && r.before(k) || !r.reverse && r.after(k) {
+				return false
+			}
+			if last != nil && bytes.Equal(k, last) || v.expiresAt > 0 && v.expiresAt <= now {
+				return true
+			}
+			pairs = append(pairs, kvPair{key: k, value: v.value, ttl: ttlNano(v.expiresAt)})
+			// stop when the page is full, the scan is not done
+			done = len(pairs) < size
+			return done
+		}
+		db.indexMu.RLock()
+		defer db.indexMu.RUnlock()
+		if r.reverse {
+			pivot := r.end
+			if last != nil {
+				pivot = last
+			}
+			db.index.descend(pivot, fn)
+		} else {
+			pivot := r.start
+			if last != nil {
+				pivot = last
+			}
+			db.index.ascend(pivot, fn)
+		}
+		return pairs, done, nil
+	}
+}
+
+// apply writes the ops atomically, all the shards of the ops are locked.
+func (db *MemoryDB) apply(ops []batchOp) error {
+	locked := make([]bool, len(db.shards))
+	for _, op := range ops {
+		locked[db.shardIndex(f.String(op.key))] = true
+	}
+	for i, s := range db.shards {
+		if locked[i] {
+			s.Lock()
+			defer s.Unlock()
+		}
+	}
+	db.indexMu.Lock()
+	defer db.indexMu.Unlock()
+	// the keys and values of the ops are not shared with the callers
+	for _, op := range ops {
+		key := string(op.key)
+		s := db.shards[db.shardIndex(key)]
+		if op.del {
+			delete(s.items, key)
+			db.deleteIndex(op.key)
+			continue
+		}
+		s.items[key] = &memoryItem{value: op.value, expiresAt: op.expiresAt}
+		db.index.put(op.key, bptValue{value: op.value, expiresAt: op.expiresAt})
+		if op.expiresAt > 0 {
+			heap.Push(&s.expiry, memoryExpiryEntry{key: key, expiresAt: op.expiresAt})
+		}
+	}
+	db.watchers.notify(opEvents(ops)...)
+	return nil
+}
+
+func (db *MemoryDB) deleteIndex(key []byte) {
+	if db.index.delete(key) {
+		db.deleted++
+	}
+}
+
+func (db *MemoryDB) shardIndex(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write(f.Bytes(key))
+	return int(h.Sum32() % memoryShards)
+}
+
+func (db *MemoryDB) shard(key string) *memoryShard {
+	return db.shards[db.shardIndex(key)]
+}
+
+func (item *memoryItem) expired(now int64) bool {
+	return item.expiresAt > 0 && item.expiresAt <= now
+}
+
+// Watch emits the changes of the keys with the prefix, the expired keys are emitted when they are removed.
+func (db *MemoryDB) Watch(prefix string) (<-chan Event, func()) {
+	return db.watchers.watch(prefix)
+}
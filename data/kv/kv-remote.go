@@ -0,0 +1,442 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RemoteAddr the default address of the binary protocol of cmd/kvserver.
+const RemoteAddr = "127.0.0.1:7070"
+
+// The ops of the binary protocol of cmd/kvserver.
+//
+// A frame is: length(4 bytes big endian) op fields..., each field is length-prefixed by an uvarint,
+// a response frame has a status instead of the op, and the fields of the result.
+const (
+	RemotePing byte = iota + 1
+	RemoteSize
+	RemoteIncr
+	RemoteSet
+	RemoteMSet
+	RemoteGet
+	RemoteMGet
+	RemoteTTL
+	RemoteDel
+	RemoteKeys
+	RemoteGC
+	RemoteScan
+	RemoteBatch
+	RemoteWatch
+	RemoteReplicate
+)
+
+// The statuses of the responses of the binary protocol.
+const (
+	RemoteOK byte = iota
+	RemoteErr
+	RemoteNotFound
+)
+
+// remotePoolSize the max number of idle connections of a Remote.
+const remotePoolSize = 8
+
+// RemoteMaxFrame the max length of a frame, a larger length field is invalid.
+const RemoteMaxFrame = 64 << 20
+
+var errRemoteFrame = errors.New("[kv] invalid remote frame")
+
+// EncodeRemote encodes a frame without the length: op (or status) and the fields.
+func EncodeRemote(op byte, fields ...[]byte) []byte {
+	n := 1
+	for _, field := range fields {
+		n += binary.MaxVarintLen32 + len(field)
+	}
+	buf := append(make([]byte, 0, n), op)
+	for _, field := range fields {
+		buf = appendUvarintBytes(buf, field)
+	}
+	return buf
+}
+
+// DecodeRemote decodes a frame without the length.
+func DecodeRemote(body []byte) (byte, [][]byte, error) {
+	if len(body) == 0 {
+		return 0, nil, errRemoteFrame
+	}
+	var fields [][]byte
+	for p := body[1:]; len(p) > 0; {
+		var field []byte
+		if field, p = readUvarintBytes(p); field == nil {
+			return 0, nil, errRemoteFrame
+		}
+		fields = append(fields, field)
+	}
+	return body[0], fields, nil
+}
+
+// WriteRemote writes a frame with the length.
+func WriteRemote(w io.Writer, op byte, fields ...[]byte) error {
+	body := EncodeRemote(op, fields...)
+	if len(body) > RemoteMaxFrame {
+		return errRemoteFrame
+	}
+	buf := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+// ReadRemote reads a frame with the length, a frame larger than RemoteMaxFrame is rejected before it's read.
+func ReadRemote(r io.Reader) (byte, [][]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > RemoteMaxFrame {
+		return 0, nil, errRemoteFrame
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return DecodeRemote(body)
+}
+
+// Remote is a client of cmd/kvserver over the binary protocol,
+// so callers can switch between the embedded and the remote storage.
+// The writes are rejected by the followers, the reads are served by the leader and the followers.
+type Remote struct {
+	Addr string
+	// Timeout of a request, default 5s.
+	Timeout time.Duration
+
+	conns    chan *remoteConn
+	mu       sync.Mutex
+	watchers map[*remoteConn]struct{}
+}
+
+type remoteConn struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// NewRemote creates a client of the kvserver at the address.
+func NewRemote(addr string) (*Remote, error) {
+	db := new(Remote)
+	if err := db.Open(addr); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Open connects to the specified address, default RemoteAddr.
+func (db *Remote) Open(addr ...string) error {
+	db.Addr = RemoteAddr
+	if len(addr) > 0 && addr[0] != "" {
+		db.Addr = addr[0]
+	}
+	if db.Timeout <= 0 {
+		db.Timeout = 5 * time.Second
+	}
+	db.conns = make(chan *remoteConn, remotePoolSize)
+	db.watchers = make(map[*remoteConn]struct{})
+	_, err := db.call(RemotePing)
+	return err
+}
+
+func (db *Remote) dial() (*remoteConn, error) {
+	nc, err := net.DialTimeout("tcp", db.Addr, db.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteConn{nc: nc, r: bufio.NewReader(nc)}, nil
+}
+
+// call sends a request and reads the response on a pooled connection.
+func (db *Remote) call(op byte, fields ...[]byte) ([][]byte, error) {
+	var c *remoteConn
+	select {
+	case c = <-db.conns:
+	default:
+		var err error
+		if c, err = db.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	_ = c.nc.SetDeadline(time.Now().Add(db.Timeout))
+	status, result, err := db.roundTrip(c, op, fields)
+	if err != nil {
+		_ = c.nc.Close()
+		return nil, err
+	}
+	select {
+	case db.conns <- c:
+	default:
+		_ = c.nc.Close()
+	}
+
+	switch status {
+	case RemoteOK:
+		return result, nil
+	case RemoteNotFound:
+		return nil, ErrNotFound
+	}
+	if len(result) > 0 {
+		return nil, errors.New(string(result[0]))
+	}
+	return nil, errRemoteFrame
+}
+
+func (db *Remote) roundTrip(c *remoteConn, op byte, fields [][]byte) (byte, [][]byte, error) {
+	if err := WriteRemote(c.nc, op, fields...); err != nil {
+		return 0, nil, err
+	}
+	return ReadRemote(c.r)
+}
+
+// Size gets the size of the database in bytes.
+func (db *Remote) Size() int64 {
+	result, err := db.call(RemoteSize)
+	if err != nil || len(result) == 0 {
+		return -1
+	}
+	return remoteInt(result[0])
+}
+
+// Incr increment the key by the specified value.
+func (db *Remote) Incr(k string, by int64) (int64, error) {
+	result, err := db.call(RemoteIncr, []byte(k), remoteBytes(by))
+	if err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, errRemoteFrame
+	}
+	return remoteInt(result[0]), nil
+}
+
+// Set sets a key with the specified value and optional ttl.seconds
+func (db *Remote) Set(k, v string, ttl int) error {
+	return db.SetBytes([]byte(k), []byte(v), ttl)
+}
+
+// SetBytes sets a key with the specified value and optional ttl.seconds
+func (db *Remote) SetBytes(k, v []byte, ttl int) error {
+	_, err := db.call(RemoteSet, k, v, remoteBytes(int64(ttl)))
+	return err
+}
+
+// MSet sets multiple key-value pairs.
+func (db *Remote) MSet(data map[string]string) error {
+	fields := make([][]byte, 0, 2*len(data))
+	for k, v := range data {
+		fields = append(fields, []byte(k), []byte(v))
+	}
+	_, err := db.call(RemoteMSet, fields...)
+	return err
+}
+
+// Get fetches the value of the specified k.
+func (db *Remote) Get(k string) (string, error) {
+	v, err := db.GetBytes([]byte(k))
+	return string(v), err
+}
+
+// GetBytes fetches the value of the specified k.
+func (db *Remote) GetBytes(k []byte) ([]byte, error) {
+	result, err := db.call(RemoteGet, k)
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(result) == 0 {
+		return []byte{}, errRemoteFrame
+	}
+	return result[0], nil
+}
+
+// MGet fetch multiple values of the specified keys.
+func (db *Remote) MGet(keys []string) []string {
+	data := make([]string, len(keys))
+	result, err := db.call(RemoteMGet, remoteFields(keys)...)
+	if err == nil {
+		for i := 0; i < len(result) && i < len(data); i++ {
+			data[i] = string(result[i])
+		}
+	}
+	return data
+}
+
+// TTL gets the time.seconds to live of the specified key's value.
+func (db *Remote) TTL(key string) int64 {
+	result, err := db.call(RemoteTTL, []byte(key))
+	if err != nil || len(result) == 0 {
+		return -2
+	}
+	return remoteInt(result[0])
+}
+
+// Del removes key(s) from the store.
+func (db *Remote) Del(keys []string) error {
+	_, err := db.call(RemoteDel, remoteFields(keys)...)
+	return err
+}
+
+// Close closes the connections and the watches.
+func (db *Remote) Close() error {
+	for {
+		select {
+		case c := <-db.conns:
+			_ = c.nc.Close()
+		default:
+			db.mu.Lock()
+			for c := range db.watchers {
+				_ = c.nc.Close()
+			}
+			db.watchers = make(map[*remoteConn]struct{})
+			db.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+// Keys gets matched keys.
+func (db *Remote) Keys(prefix ...string) []string {
+	result, _ := db.call(RemoteKeys, remoteFields(prefix)...)
+	keys := make([]string, 0, len(result))
+	for _, key := range result {
+		keys = append(keys, string(key))
+	}
+	return keys
+}
+
+// GC runs the garbage collector of the server.
+func (db *Remote) GC() error {
+	_, err := db.call(RemoteGC)
+	return err
+}
+
+// Scan streams the pairs in the range [start, end), in reverse order optionally.
+func (db *Remote) Scan(start, end string, limit int, reverse ...bool) Iterator {
+	r := newScanRange(start, end, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// ScanPrefix streams the pairs of the keys with the prefix, in reverse order optionally.
+func (db *Remote) ScanPrefix(prefix string, limit int, reverse ...bool) Iterator {
+	r := newPrefixRange(prefix, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// page requests a page of a scan: start, end, size, reverse, last => key, value, ttl..., done
+func (db *Remote) page(r *scanRange) pageFunc {
+	reverse := []byte{}
+	if r.reverse {
+		reverse = []byte{1}
+	}
+	return func(last []byte, size int) ([]kvPair, bool, error) {
+		result, err := db.call(RemoteScan, r.start, r.end, remoteBytes(int64(size)), reverse, last)
+		if err != nil {
+			return nil, true, err
+		}
+		if len(result)%3 != 1 {
+			return nil, true, errRemoteFrame
+		}
+		pairs := make([]kvPair, 0, len(result)/3)
+		for i := 0; i+2 < len(result); i += 3 {
+			pairs = append(pairs, kvPair{key: result[i], value: result[i+1], ttl: remoteInt(result[i+2])})
+		}
+		return pairs, len(result[len(result)-1]) > 0, nil
+	}
+}
+
+// Batch begins a batch of writes, which is sent on commit and applied atomically by the server.
+func (db *Remote) Batch() (Batch, error) {
+	return &opBatch{apply: db.batch}, nil
+}
+
+// batch sends the ops: kind(s|d), key, value, ttl...
+func (db *Remote) batch(ops []batchOp) error {
+	fields := make([][]byte, 0, 4*len(ops))
+	for _, op := range ops {
+		if op.del {
+			fields = append(fields, []byte{'d'}, op.key, nil, nil)
+			continue
+		}
+		ttl := ttlNano(op.expiresAt)
+		if ttl == -2 {
+			ttl = 1 // expired before commit, expires on the server soon
+		}
+		fields = append(fields, []byte{'s'}, op.key, op.value, remoteBytes(ttl))
+	}
+	_, err := db.call(RemoteBatch, fields...)
+	return err
+}
+
+// Watch emits the changes of the keys with the prefix on a dedicated connection,
+// the channel is closed when the connection is lost.
+func (db *Remote) Watch(prefix string) (<-chan Event, func()) {
+	w := newWatcher(prefix)
+	c, err := db.dial()
+	if err == nil {
+		_ = c.nc.SetDeadline(time.Now().Add(db.Timeout))
+		var status byte
+		if status, _, err = db.roundTrip(c, RemoteWatch, [][]byte{[]byte(prefix)}); err == nil && status != RemoteOK {
+			err = errRemoteFrame
+		}
+		if err != nil {
+			_ = c.nc.Close()
+		}
+	}
+	if err != nil {
+		close(w.ch)
+		return w.ch, func() {}
+	}
+
+	_ = c.nc.SetDeadline(time.Time{})
+	db.mu.Lock()
+	db.watchers[c] = struct{}{}
+	db.mu.Unlock()
+	go func() {
+		defer close(w.ch)
+		for {
+			_, fields, err := ReadRemote(c.r)
+			if err != nil {
+				return
+			}
+			if len(fields) == 3 && len(fields[0]) == 1 {
+				w.send(Event{Type: EventType(fields[0][0]), Key: fields[1], Value: fields[2]})
+			}
+		}
+	}()
+	return w.ch, func() {
+		db.mu.Lock()
+		delete(db.watchers, c)
+		db.mu.Unlock()
+		_ = c.nc.Close()
+	}
+}
+
+func remoteBytes(i int64) []byte {
+	return strconv.AppendInt(nil, i, 10)
+}
+
+func remoteInt(b []byte) int64 {
+	i, _ := strconv.ParseInt(string(b), 10, 64)
+	return i
+}
+
+func remoteFields(keys []string) [][]byte {
+	fields := make([][]byte, len(keys))
+	for i, key := range keys {
+		fields[i] = []byte(key)
+	}
+	return fields
+}
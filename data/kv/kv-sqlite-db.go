@@ -0,0 +1,354 @@
+package kv
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/f"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SqliteDB is a sqlite key/value store, the pairs are saved in the table kv.
+// It uses a single connection, so a Batch blocks the other operations until it's committed or discarded.
+type SqliteDB struct {
+	DB       *sql.DB
+	locker   *f.Locker
+	watchers watchers
+}
+
+// Open Opens the specified file, default in memory.
+func (db *SqliteDB) Open(path ...string) error {
+	filename := ":memory:"
+	if len(path) > 0 {
+		filename = path[0]
+	}
+	var err error
+	if db.DB, err = sql.Open("sqlite3", filename); err != nil {
+		return err
+	}
+	db.DB.SetMaxOpenConns(1)
+	if _, err = db.DB.Exec(`CREATE TABLE IF NOT EXISTS kv (k BLOB PRIMARY KEY, v BLOB NOT NULL, exp INTEGER NOT NULL DEFAULT 0) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS kv_exp ON kv (exp) WHERE exp > 0;`); err != nil {
+		_ = db.DB.Close()
+		return err
+	}
+	db.locker = f.NewLocker()
+	return nil
+}
+
+// Size gets the size of the database in bytes.
+func (db *SqliteDB) Size() int64 {
+	var count, size int64
+	if db.DB.QueryRow("PRAGMA page_count").Scan(&count) != nil || db.DB.QueryRow("PRAGMA page_size").Scan(&size) != nil {
+		return -1
+	}
+	return count * size
+}
+
+// Incr increment the key by the specified value.
+func (db *SqliteDB) Incr(k string, by int64) (int64, error) {
+	db.locker.Lock(k)
+	defer db.locker.Unlock(k)
+
+	var (
+		val     []byte
+		expires int64
+	)
+	err := db.DB.QueryRow("SELECT v, exp FROM kv WHERE k = ? AND (exp = 0 OR exp > ?)", []byte(k), time.Now().UnixNano()).Scan(&val, &expires)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	valFloat, _ := strconv.ParseInt(string(val), 10, 64)
+	valFloat += by
+
+	v := []byte(strconv.FormatInt(valFloat, 10))
+	err = db.watchers.write(func() ([]Event, error) {
+		_, err := db.DB.Exec("INSERT OR REPLACE INTO kv (k, v, exp) VALUES (?, ?, ?)", []byte(k), v, expires)
+		return []Event{{Type: EventPut, Key: []byte(k), Value: v}}, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return valFloat, nil
+}
+
+// Set sets a key with the specified value and optional ttl.seconds
+func (db *SqliteDB) Set(k, v string, ttl int) error {
+	return db.SetBytes([]byte(k), []byte(v), ttl)
+}
+
+// SetBytes sets a key with the specified value and optional ttl.seconds
+func (db *SqliteDB) SetBytes(k, v []byte, ttl int) error {
+	return db.watchers.write(func() ([]Event, error) {
+		_, err := db.DB.Exec("INSERT OR REPLACE INTO kv (k, v, exp) VALUES (?, ?, ?)", k, v, expiresAt(ttl))
+		return []Event{{Type: EventPut, Key: append([]byte{}, k...), Value: append([]byte{}, v...)}}, err
+	})
+}
+
+// MSet sets multiple key-value pairs.
+func (db *SqliteDB) MSet(data map[string]string) error {
+	b, err := db.Batch()
+	if err != nil {
+		return err
+	}
+	for k, v := range data {
+		if err = b.Set(k, v, 0); err != nil {
+			b.Discard()
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+// Get fetches the value of the specified k.
+func (db *SqliteDB) Get(k string) (string, error) {
+	v, err := db.GetBytes([]byte(k))
+	return string(v), err
+}
+
+// GetBytes fetches the value of the specified k.
+func (db *SqliteDB) GetBytes(k []byte) ([]byte, error) {
+	var v []byte
+	err := db.DB.QueryRow("SELECT v FROM kv WHERE k = ? AND (exp = 0 OR exp > ?)", k, time.Now().UnixNano()).Scan(&v)
+	if err == sql.ErrNoRows {
+		return []byte{}, ErrNotFound
+	}
+	return v, err
+}
+
+// MGet fetch multiple values of the specified keys.
+func (db *SqliteDB) MGet(keys []string) (data []string) {
+	data = make([]string, 0, len(keys))
+	for _, key := range keys {
+		val, _ := db.Get(key)
+		data = append(data, val)
+	}
+	return data
+}
+
+// TTL gets the time.seconds to live of the specified key's value.
+func (db *SqliteDB) TTL(key string) int64 {
+	var exp int64
+	if db.DB.QueryRow("SELECT exp FROM kv WHERE k = ?", []byte(key)).Scan(&exp) != nil {
+		return -2
+	}
+	return ttlNano(exp)
+}
+
+// Del removes key(s) from the store.
+func (db *SqliteDB) Del(keys []string) error {
+	b, err := db.Batch()
+	if err != nil {
+		return err
+	}
+	if err = b.Del(keys...); err != nil {
+		b.Discard()
+		return err
+	}
+	return b.Commit()
+}
+
+// Close ...
+func (db *SqliteDB) Close() error {
+	db.watchers.close()
+	return db.DB.Close()
+}
+
+// Keys gets matched keys.
+func (db *SqliteDB) Keys(prefix ...string) []string {
+	var prefix1 string
+	if len(prefix) > 0 {
+		prefix1 = prefix[0]
+	}
+	var keys []string
+	it := db.ScanPrefix(prefix1, 0)
+	defer func() { _ = it.Close() }()
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+// GC removes the expired keys and rebuilds the database file.
+func (db *SqliteDB) GC() error {
+	if err := db.gcExpired(time.Now().UnixNano()); err != nil {
+		return err
+	}
+	_, err := db.DB.Exec("VACUUM")
+	return err
+}
+
+// gcExpired deletes the expired keys, which are emitted to the watchers.
+func (db *SqliteDB) gcExpired(now int64) error {
+	return db.watchers.write(func() ([]Event, error) {
+		return db.deleteExpired(now)
+	})
+}
+
+func (db *SqliteDB) deleteExpired(now int64) ([]Event, error) {
+	if !db.watchers.active() {
+		_, err := db.DB.Exec("DELETE FROM kv WHERE exp > 0 AND exp <= ?", now)
+		return nil, err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query("SELECT k, v FROM kv WHERE exp > 0 AND exp <= ?", now)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	var events []Event
+	for rows.Next() {
+		e := Event{Type: EventExpire}
+		if err = rows.Scan(&e.Key, &e.Value); err != nil {
+			break
+		}
+		events = append(events, e)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM kv WHERE exp > 0 AND exp <= ?", now)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return events, tx.Commit()
+}
+
+// Scan streams the pairs in the range [start, end), in reverse order optionally.
+func (db *SqliteDB) Scan(start, end string, limit int, reverse ...bool) Iterator {
+	r := newScanRange(start, end, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// ScanPrefix streams the pairs of the keys with the prefix, in reverse order optionally.
+func (db *SqliteDB) ScanPrefix(prefix string, limit int, reverse ...bool) Iterator {
+	r := newPrefixRange(prefix, limit, reverse)
+	return newPageIterator(r, db.page(r))
+}
+
+// Batch begins a transaction.
+// The order of the writes is held until the batch is committed or discarded.
+func (db *SqliteDB) Batch() (Batch, error) {
+	db.watchers.order.Lock()
+	tx, err := db.DB.Begin()
+	if err != nil {
+		db.watchers.order.Unlock()
+		return nil, err
+	}
+	return &sqliteBatch{tx: tx, watchers: &db.watchers}, nil
+}
+
+// page queries the pairs of a scan after the last key.
+func (db *SqliteDB) page(r *scanRange) pageFunc {
+	return func(last []byte, size int) ([]kvPair, bool, error) {
+		where, args := []string{"(exp = 0 OR exp > ?)"}, []interface{}{time.Now().UnixNano()}
+		if r.start != nil {
+			where, args = append(where, "k >= ?"), append(args, r.start)
+		}
+		if r.end != nil {
+			where, args = append(where, "k < ?"), append(args, r.end)
+		}
+		order := "ASC"
+		if last != nil {
+			if r.reverse {
+				where = append(where, "k < ?")
+			} else {
+				where = append(where, "k > ?")
+			}
+			args = append(args, last)
+		}
+		if r.reverse {
+			order = "DESC"
+		}
+		rows, err := db.DB.Query("SELECT k, v, exp FROM kv WHERE "+strings.Join(where, " AND ")+" ORDER BY k "+order+" LIMIT "+strconv.Itoa(size), args...)
+		if err != nil {
+			return nil, true, err
+		}
+		defer func() { _ = rows.Close() }()
+
+		pairs := make([]kvPair, 0, size)
+		for rows.Next() {
+			var pair kvPair
+			var exp int64
+			if err = rows.Scan(&pair.key, &pair.value, &exp); err != nil {
+				return nil, true, err
+			}
+			pair.ttl = ttlNano(exp)
+			pairs = append(pairs, pair)
+		}
+		return pairs, len(pairs) < size, rows.Err()
+	}
+}
+
+type sqliteBatch struct {
+	tx       *sql.Tx
+	watchers *watchers
+	events   []Event
+	done     bool
+}
+
+func (b *sqliteBatch) Set(k, v string, ttl int) error {
+	return b.SetBytes([]byte(k), []byte(v), ttl)
+}
+
+func (b *sqliteBatch) SetBytes(k, v []byte, ttl int) error {
+	if _, err := b.tx.Exec("INSERT OR REPLACE INTO kv (k, v, exp) VALUES (?, ?, ?)", k, v, expiresAt(ttl)); err != nil {
+		return err
+	}
+	b.events = append(b.events, Event{Type: EventPut, Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+	return nil
+}
+
+func (b *sqliteBatch) Del(keys ...string) error {
+	for _, key := range keys {
+		if _, err := b.tx.Exec("DELETE FROM kv WHERE k = ?", []byte(key)); err != nil {
+			return err
+		}
+		b.events = append(b.events, Event{Type: EventDelete, Key: []byte(key)})
+	}
+	return nil
+}
+
+func (b *sqliteBatch) Commit() error {
+	if b.done {
+		return sql.ErrTxDone
+	}
+	defer b.release()
+	events := b.events
+	b.events = nil
+	if err := b.tx.Commit(); err != nil {
+		return err
+	}
+	b.watchers.notify(events...)
+	return nil
+}
+
+func (b *sqliteBatch) Discard() {
+	if !b.done {
+		defer b.release()
+		_ = b.tx.Rollback()
+	}
+}
+
+// release releases the order of the writes once.
+func (b *sqliteBatch) release() {
+	b.done = true
+	b.watchers.order.Unlock()
+}
+
+// Watch emits the changes of the keys with the prefix, the expired keys are emitted when they are removed by GC.
+func (db *SqliteDB) Watch(prefix string) (<-chan Event, func()) {
+	return db.watchers.watch(prefix)
+}
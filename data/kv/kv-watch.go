@@ -0,0 +1,148 @@
+package kv
+
+import (
+	"bytes"
+	"sync"
+)
+
+// WatchBuffer the buffer size of the channel of a watcher,
+// the events are dropped when it's full, then EventLagged is sent.
+var WatchBuffer = 256
+
+// EventType the type of a key change.
+type EventType byte
+
+const (
+	EventPut EventType = iota + 1
+	EventDelete
+	EventExpire
+	// EventLagged the watcher was too slow and some events were dropped, it should reload the keys.
+	EventLagged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventLagged:
+		return "lagged"
+	}
+	return "unknown"
+}
+
+// Event a key change of a watch, the key and value must not be modified.
+type Event struct {
+	Type  EventType
+	Key   []byte
+	Value []byte
+}
+
+type watcher struct {
+	prefix []byte
+	ch     chan Event
+	lagged bool
+}
+
+func newWatcher(prefix string) *watcher {
+	return &watcher{prefix: []byte(prefix), ch: make(chan Event, WatchBuffer)}
+}
+
+// send sends the event without blocking, EventLagged is sent first after the events were dropped.
+func (w *watcher) send(e Event) {
+	if w.lagged {
+		select {
+		case w.ch <- Event{Type: EventLagged}:
+			w.lagged = false
+		default:
+			return
+		}
+	}
+	select {
+	case w.ch <- e:
+	default:
+		w.lagged = true
+	}
+}
+
+// watchers notifies the watchers on the write path of a backend.
+// The backends without a write lock of their own use write, so the events are emitted in the order of the writes.
+type watchers struct {
+	mu    sync.Mutex
+	order sync.Mutex // held from a write until its events are notified
+	subs  map[*watcher]struct{}
+}
+
+func (ws *watchers) watch(prefix string) (<-chan Event, func()) {
+	w := newWatcher(prefix)
+	ws.mu.Lock()
+	if ws.subs == nil {
+		ws.subs = make(map[*watcher]struct{})
+	}
+	ws.subs[w] = struct{}{}
+	ws.mu.Unlock()
+	return w.ch, func() {
+		ws.mu.Lock()
+		defer ws.mu.Unlock()
+		if _, ok := ws.subs[w]; ok {
+			delete(ws.subs, w)
+			close(w.ch)
+		}
+	}
+}
+
+// active reports whether there are watchers.
+func (ws *watchers) active() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.subs) > 0
+}
+
+// write runs the write, and notifies its events before the next write runs.
+func (ws *watchers) write(fn func() ([]Event, error)) error {
+	ws.order.Lock()
+	defer ws.order.Unlock()
+	events, err := fn()
+	if err == nil {
+		ws.notify(events...)
+	}
+	return err
+}
+
+func (ws *watchers) notify(events ...Event) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.subs {
+		for _, e := range events {
+			if bytes.HasPrefix(e.Key, w.prefix) {
+				w.send(e)
+			}
+		}
+	}
+}
+
+// close closes the channels of all the watchers.
+func (ws *watchers) close() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.subs {
+		close(w.ch)
+	}
+	ws.subs = nil
+}
+
+// opEvents gets the events of the ops of a batch.
+func opEvents(ops []batchOp) []Event {
+	events := make([]Event, len(ops))
+	for i, op := range ops {
+		if op.del {
+			events[i] = Event{Type: EventDelete, Key: op.key}
+		} else {
+			events[i] = Event{Type: EventPut, Key: op.key, Value: op.value}
+		}
+	}
+	return events
+}
@@ -1,5 +1,25 @@
 package kv
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tidwall/buntdb"
+)
+
+// ErrNotFound the key is not found or expired.
+var ErrNotFound = errors.New("key not found")
+
+// IsNotFound reports whether the error of Get is the key not found of any backend.
+func IsNotFound(err error) bool {
+	return err == ErrNotFound || err == badger.ErrKeyNotFound || err == buntdb.ErrNotFound || err == leveldb.ErrNotFound
+}
+
 // KV key value database interface
 // Feature github.com/angenalZZZ/gofunc/data/kv/...
 type KV interface {
@@ -17,4 +37,284 @@ type KV interface {
 	Close() error
 	Keys(...string) []string
 	GC() error
+	Scan(start, end string, limit int, reverse ...bool) Iterator
+	ScanPrefix(prefix string, limit int, reverse ...bool) Iterator
+	Batch() (Batch, error)
+	// Watch emits the changes of the keys with the prefix, until the cancel func is called or the database is closed.
+	Watch(prefix string) (<-chan Event, func())
+}
+
+// Iterator streams the key-value pairs of a scan in key order,
+// it must be closed after use.
+//
+//	it := db.ScanPrefix("user:", 100)
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value(), it.TTL())
+//	}
+//	err := it.Err()
+type Iterator interface {
+	// Next moves to the next pair, returns false when the scan is done.
+	Next() bool
+	Key() []byte
+	Value() []byte
+	// TTL gets the time.seconds to live of the current pair, -1 no expiration.
+	TTL() int64
+	Err() error
+	Close() error
+}
+
+// Batch writes multiple keys atomically through the native transaction of the backend,
+// it must be committed or discarded.
+type Batch interface {
+	Set(string, string, int) error
+	SetBytes([]byte, []byte, int) error
+	Del(...string) error
+	Commit() error
+	Discard()
+}
+
+// scanRange the bounds of a scan: start inclusive, end exclusive, empty means unbounded.
+type scanRange struct {
+	start, end []byte
+	limit      int
+	reverse    bool
+}
+
+func newScanRange(start, end string, limit int, reverse []bool) *scanRange {
+	r := &scanRange{limit: limit, reverse: len(reverse) > 0 && reverse[0]}
+	if start != "" {
+		r.start = []byte(start)
+	}
+	if end != "" {
+		r.end = []byte(end)
+	}
+	return r
+}
+
+func newPrefixRange(prefix string, limit int, reverse []bool) *scanRange {
+	r := &scanRange{limit: limit, reverse: len(reverse) > 0 && reverse[0]}
+	if prefix != "" {
+		r.start, r.end = []byte(prefix), prefixEnd([]byte(prefix))
+	}
+	return r
+}
+
+// prefixEnd returns the smallest key greater than all the keys with the prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// errIterator an iterator of an error.
+type errIterator struct {
+	err error
+}
+
+func (it *errIterator) Next() bool    { return false }
+func (it *errIterator) Key() []byte   { return nil }
+func (it *errIterator) Value() []byte { return nil }
+func (it *errIterator) TTL() int64    { return -2 }
+func (it *errIterator) Err() error    { return it.err }
+func (it *errIterator) Close() error  { return nil }
+
+// ttlSeconds gets the time.seconds to live from the unix time of expiration, 0 means no expiration.
+func ttlSeconds(expiresAt int64) int64 {
+	if expiresAt <= 0 {
+		return -1
+	}
+	if ttl := expiresAt - time.Now().Unix(); ttl > 0 {
+		return ttl
+	}
+	return -2
+}
+
+// after reports whether the key is out of the end bound of a forward scan.
+func (r *scanRange) after(k []byte) bool {
+	return r.end != nil && bytes.Compare(k, r.end) >= 0
+}
+
+// before reports whether the key is out of the start bound of a reverse scan.
+func (r *scanRange) before(k []byte) bool {
+	return r.start != nil && bytes.Compare(k, r.start) < 0
+}
+
+var (
+	_ KV = (*BadgerDB)(nil)
+	_ KV = (*BuntDB)(nil)
+	_ KV = (*LevelDB)(nil)
+	_ KV = (*MemoryDB)(nil)
+	_ KV = (*SqliteDB)(nil)
+	_ KV = (*LogDB)(nil)
+	_ KV = (*Remote)(nil)
+)
+
+// Open creates and opens a database from the url: scheme://path, the path is optional.
+//
+//	badger:///data/kv    badger:// (in memory)
+//	bunt:///data/kv.db   bunt:// (in memory)
+//	level:///data/kv     level:// (temp dir)
+//	memory://
+//	sqlite:///data/kv.db sqlite:// (in memory)
+//	log:///data/kv.log   log:// (temp file), the pairs are kept in memory and replayed from the log
+//	kv://127.0.0.1:7070  (cmd/kvserver)
+func Open(url string) (KV, error) {
+	i := strings.Index(url, "://")
+	if i <= 0 {
+		return nil, fmt.Errorf("[kv] invalid url %q", url)
+	}
+	var db KV
+	switch scheme := strings.ToLower(url[:i]); scheme {
+	case "badger":
+		db = new(BadgerDB)
+	case "bunt", "buntdb":
+		db = new(BuntDB)
+	case "level", "leveldb":
+		db = new(LevelDB)
+	case "memory", "mem":
+		db = new(MemoryDB)
+	case "sqlite", "sqlite3":
+		db = new(SqliteDB)
+	case "log", "logdb":
+		db = new(LogDB)
+	case "kv", "remote":
+		db = new(Remote)
+	default:
+		return nil, fmt.Errorf("[kv] unknown scheme %q", scheme)
+	}
+	var path []string
+	if p := url[i+3:]; p != "" {
+		path = append(path, p)
+	}
+	if err := db.Open(path...); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// expiresAt gets the unix nano time of expiration from the time.seconds to live, 0 means no expiration.
+func expiresAt(ttl int) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+}
+
+// ttlNano gets the time.seconds to live (rounded up) from the unix nano time of expiration.
+func ttlNano(expiresAt int64) int64 {
+	if expiresAt <= 0 {
+		return -1
+	}
+	if d := expiresAt - time.Now().UnixNano(); d > 0 {
+		return (d + int64(time.Second) - 1) / int64(time.Second)
+	}
+	return -2
+}
+
+// kvPair a key-value pair read by a scan.
+type kvPair struct {
+	key, value []byte
+	ttl        int64
+}
+
+// pageSize the number of pairs read at a time by pageIterator.
+const pageSize = 256
+
+// pageFunc reads at most size pairs of a scan after the last key (nil on the first page),
+// done is true when there are no more pairs.
+type pageFunc func(last []byte, size int) (pairs []kvPair, done bool, err error)
+
+// pageIterator an iterator reading the pairs in pages, the database is not locked between the pages.
+type pageIterator struct {
+	r     *scanRange
+	fetch pageFunc
+	page  []kvPair
+	pos   int
+	n     int
+	last  []byte
+	done  bool
+	err   error
+}
+
+func newPageIterator(r *scanRange, fetch pageFunc) *pageIterator {
+	return &pageIterator{r: r, fetch: fetch}
+}
+
+func (it *pageIterator) Next() bool {
+	if it.err != nil || (it.r.limit > 0 && it.n >= it.r.limit) {
+		return false
+	}
+	for it.pos++; it.pos >= len(it.page); it.pos = 0 {
+		if it.done {
+			return false
+		}
+		size := pageSize
+		if it.r.limit > 0 && it.r.limit-it.n < size {
+			size = it.r.limit - it.n
+		}
+		if it.page, it.done, it.err = it.fetch(it.last, size); it.err != nil {
+			return false
+		}
+		if len(it.page) > 0 {
+			it.last = it.page[len(it.page)-1].key
+		}
+	}
+	it.n++
+	return true
+}
+
+func (it *pageIterator) Key() []byte   { return it.page[it.pos].key }
+func (it *pageIterator) Value() []byte { return it.page[it.pos].value }
+func (it *pageIterator) TTL() int64    { return it.page[it.pos].ttl }
+func (it *pageIterator) Err() error    { return it.err }
+
+func (it *pageIterator) Close() error {
+	it.page, it.done = nil, true
+	return nil
+}
+
+// batchOp a write of a batch, deletes the key when del is true.
+type batchOp struct {
+	key, value []byte
+	expiresAt  int64
+	del        bool
+}
+
+// opBatch buffers the writes and applies them on commit, for the backends without native transactions.
+type opBatch struct {
+	ops   []batchOp
+	apply func([]batchOp) error
+}
+
+func (b *opBatch) Set(k, v string, ttl int) error {
+	b.ops = append(b.ops, batchOp{key: []byte(k), value: []byte(v), expiresAt: expiresAt(ttl)})
+	return nil
+}
+
+func (b *opBatch) SetBytes(k, v []byte, ttl int) error {
+	return b.Set(string(k), string(v), ttl)
+}
+
+func (b *opBatch) Del(keys ...string) error {
+	for _, key := range keys {
+		b.ops = append(b.ops, batchOp{key: []byte(key), del: true})
+	}
+	return nil
+}
+
+func (b *opBatch) Commit() error {
+	ops := b.ops
+	b.ops = nil
+	return b.apply(ops)
+}
+
+func (b *opBatch) Discard() {
+	b.ops = nil
 }
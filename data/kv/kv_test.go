@@ -5,10 +5,14 @@ import (
 	"github.com/angenalZZZ/gofunc/data"
 	"github.com/angenalZZZ/gofunc/data/random"
 	"github.com/angenalZZZ/gofunc/f"
+	"github.com/syndtr/goleveldb/leveldb"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -113,3 +117,437 @@ func genVal(t *testing.T, db KV, key, expected string) {
 		t.Error(err)
 	}
 }
+
+// testBackends the urls of the backends for the conformance tests.
+var testBackends = []string{"badger://", "bunt://", "level://", "memory://", "sqlite://", "log://"}
+
+func TestConformance(t *testing.T) {
+	for _, url := range testBackends {
+		db, err := Open(url)
+		if err != nil {
+			t.Fatal(url, err)
+		}
+		t.Run(url+"basic", func(t *testing.T) { testBasic(t, db) })
+		t.Run(url+"scan", func(t *testing.T) { testScanBatch(t, db) })
+		t.Run(url+"incr", func(t *testing.T) { testIncrTTL(t, db) })
+		_ = db.Close()
+	}
+	if _, err := Open("unknown://"); err == nil {
+		t.Fatal("unknown scheme opened")
+	}
+}
+
+func testBasic(t *testing.T, db KV) {
+	if err := db.Set("a", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetBytes([]byte("b"), []byte("2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MSet(map[string]string{"c": "3", "d": "4"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("a"); err != nil || v != "1" {
+		t.Fatalf("get a: %q %v", v, err)
+	}
+	if v, err := db.GetBytes([]byte("b")); err != nil || string(v) != "2" {
+		t.Fatalf("get b: %q %v", v, err)
+	}
+	if _, err := db.Get("none"); err == nil {
+		t.Fatal("get none: no error")
+	}
+	if v := db.MGet([]string{"c", "none", "d"}); fmt.Sprint(v) != "[3  4]" {
+		t.Fatalf("mget: %q", v)
+	}
+	if n, err := db.Incr("n", 2); err != nil || n != 2 {
+		t.Fatalf("incr: %d %v", n, err)
+	}
+	if n, _ := db.Incr("n", 3); n != 5 {
+		t.Fatalf("incr: %d", n)
+	}
+	if err := db.Del([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.Keys(); fmt.Sprint(keys) != "[c d n]" {
+		t.Fatalf("keys: %v", keys)
+	}
+	if err := db.Del([]string{"c", "d", "n"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GC(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testIncrTTL Incr keeps the ttl of the key.
+func testIncrTTL(t *testing.T, db KV) {
+	_ = db.Set("n", "1", 60)
+	if n, err := db.Incr("n", 1); err != nil || n != 2 || db.TTL("n") < 59 {
+		t.Fatalf("incr: %d %v ttl %d", n, err, db.TTL("n"))
+	}
+	if n, err := db.Incr("m", 1); err != nil || n != 1 || db.TTL("m") != -1 {
+		t.Fatalf("incr: %d %v ttl %d", n, err, db.TTL("m"))
+	}
+	if err := db.Del([]string{"n", "m"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testScanBatch(t *testing.T, db KV) {
+	b, err := db.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 600; i++ {
+		if err = b.Set(fmt.Sprintf("user:%03d", i), fmt.Sprint(i), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = b.Set("other", "0", 60)
+	_ = b.Del("user:000")
+	if err = b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ = db.Batch()
+	_ = b.Set("discarded", "0", 0)
+	b.Discard()
+	if v, _ := db.Get("discarded"); v != "" {
+		t.Fatalf("discarded batch was written")
+	}
+
+	var keys []string
+	it := db.ScanPrefix("user:", 0)
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if err = it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	_ = it.Close()
+	if len(keys) != 599 || keys[0] != "user:001" || keys[598] != "user:599" {
+		t.Fatalf("prefix scan got %d keys", len(keys))
+	}
+
+	keys = keys[:0]
+	it = db.Scan("user:100", "user:300", 3, true)
+	for it.Next() {
+		keys = append(keys, string(it.Key())+"="+string(it.Value()))
+	}
+	_ = it.Close()
+	if fmt.Sprint(keys) != "[user:299=299 user:298=298 user:297=297]" {
+		t.Fatalf("reverse scan got %v", keys)
+	}
+
+	it = db.Scan("other", "user:", 0)
+	if !it.Next() || string(it.Key()) != "other" || it.TTL() <= 0 || it.Next() {
+		t.Fatalf("range scan failed")
+	}
+	_ = it.Close()
+}
+
+func TestLogDBReopen(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "kv-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db := new(LogDB)
+	if err = db.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		_ = db.Set(fmt.Sprintf("%05d", i), fmt.Sprint(i), 0)
+	}
+	for i := 0; i < 5000; i += 2 {
+		_ = db.Del([]string{fmt.Sprintf("%05d", i)})
+	}
+	_ = db.Close()
+
+	// a torn frame at the end is dropped
+	filename := filepath.Join(dir, "kv.log")
+	file, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = file.Write([]byte{1, 2, 3, 4, 5})
+	_ = file.Close()
+
+	db = new(LogDB)
+	if err = db.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.Keys(); len(keys) != 2500 || keys[0] != "00001" || keys[2499] != "04999" {
+		t.Fatalf("reopen got %d keys", len(keys))
+	}
+	size := db.Size()
+	if err = db.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Size() >= size {
+		t.Fatalf("gc size %d >= %d", db.Size(), size)
+	}
+	_ = db.Set("after", "gc", 0)
+	_ = db.Close()
+
+	db = new(LogDB)
+	if err = db.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if v, _ := db.Get("after"); v != "gc" || len(db.Keys()) != 2501 {
+		t.Fatalf("reopen after gc got %q %d", v, len(db.Keys()))
+	}
+
+	// the temp file is removed on close
+	temp := new(LogDB)
+	if err = temp.Open(); err != nil {
+		t.Fatal(err)
+	}
+	_ = temp.Set("k", "v", 0)
+	if err = temp.GC(); err != nil {
+		t.Fatal(err)
+	}
+	_ = temp.Close()
+	if f.PathExists(temp.path) {
+		t.Fatalf("the temp file %s is not removed", temp.path)
+	}
+}
+
+func TestMemoryDBIndex(t *testing.T) {
+	db := new(MemoryDB)
+	_ = db.Open()
+	defer func() { _ = db.Close() }()
+
+	// the key and value are copied
+	k, v := []byte("key"), []byte("value")
+	_ = db.SetBytes(k, v, 0)
+	k[0], v[0] = 'x', 'x'
+	if it := db.ScanPrefix("key", 0); !it.Next() || string(it.Value()) != "value" {
+		t.Fatal("scan the modified value")
+	}
+
+	// the index is rebuilt after the keys are deleted
+	_ = db.Del([]string{"key"})
+	for i := 0; i < 2000; i++ {
+		_ = db.Set(fmt.Sprintf("k%04d", i), "v", 0)
+	}
+	for i := 0; i < 2000; i += 2 {
+		_ = db.Del([]string{fmt.Sprintf("k%04d", i), fmt.Sprintf("k%04d", i+1)})
+	}
+	_ = db.Set("k9999", "v", 0)
+	_ = db.GC()
+	if db.deleted != 0 || db.index.len != 1 {
+		t.Fatalf("index: %d keys, %d deleted", db.index.len, db.deleted)
+	}
+	if it := db.Scan("k", "", 0); !it.Next() || string(it.Key()) != "k9999" || it.Next() {
+		t.Fatal("scan after the index is rebuilt")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	dbs := make([]KV, len(testBackends))
+	for i, url := range testBackends {
+		db, err := Open(url)
+		if err != nil {
+			t.Fatal(url, err)
+		}
+		defer func() { _ = db.Close() }()
+		dbs[i] = db
+
+		_ = db.Set("t1", "v", 1)
+		_ = db.Set("t2", "v", 60)
+		_ = db.Set("p", "v", 0)
+		b, _ := db.Batch()
+		_ = b.Set("t3", "v", 1)
+		_ = b.Commit()
+		if ttl := db.TTL("t2"); ttl < 59 || ttl > 60 {
+			t.Fatalf("%s ttl t2: %d", url, ttl)
+		}
+		if ttl := db.TTL("t1"); ttl != 1 {
+			t.Fatalf("%s ttl t1: %d", url, ttl)
+		}
+		if ttl := db.TTL("p"); ttl != -1 {
+			t.Fatalf("%s ttl p: %d", url, ttl)
+		}
+		if ttl := db.TTL("none"); ttl != -2 {
+			t.Fatalf("%s ttl none: %d", url, ttl)
+		}
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+	for i, url := range testBackends {
+		db := dbs[i]
+		for n := 0; n < 2; n++ {
+			if _, err := db.Get("t1"); err == nil {
+				t.Fatalf("%s get expired: no error", url)
+			}
+			if v := db.MGet([]string{"t3", "p"}); fmt.Sprint(v) != "[ v]" {
+				t.Fatalf("%s mget: %q", url, v)
+			}
+			if ttl := db.TTL("t3"); ttl != -2 {
+				t.Fatalf("%s ttl expired: %d", url, ttl)
+			}
+			if keys := db.Keys(); fmt.Sprint(keys) != "[p t2]" {
+				t.Fatalf("%s keys: %v", url, keys)
+			}
+			var keys []string
+			it := db.Scan("", "", 0)
+			for it.Next() {
+				keys = append(keys, string(it.Key()))
+			}
+			_ = it.Close()
+			if fmt.Sprint(keys) != "[p t2]" {
+				t.Fatalf("%s scan: %v", url, keys)
+			}
+			if err := db.GC(); err != nil {
+				t.Fatal(url, err)
+			}
+		}
+	}
+
+	// the expired pairs and the expiry index of LevelDB are removed by GC, p, t2 and the index of t2 and its marker are kept
+	db := dbs[2].(*LevelDB)
+	it := db.DB.NewIterator(nil, nil)
+	defer it.Release()
+	var n int
+	for ; it.Next(); n++ {
+	}
+	if n != 4 {
+		t.Fatalf("leveldb has %d raw keys after gc", n)
+	}
+}
+
+func TestLevelDBExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "kv-level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// a key with ttl saved by the old versions without the expiry index
+	db := new(LevelDB)
+	if err = db.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.DB.Put([]byte("old"), []byte(fmt.Sprintf("%d;v", time.Now().Unix()-1)), nil)
+	_ = db.DB.Delete(levelExpiryIndexed, nil)
+	_ = db.Close()
+
+	db = new(LevelDB)
+	if err = db.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err = db.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.DB.Get([]byte("old"), nil); err != leveldb.ErrNotFound {
+		t.Fatalf("the old key is not removed by gc: %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	for _, url := range testBackends {
+		db, err := Open(url)
+		if err != nil {
+			t.Fatal(url, err)
+		}
+		events, cancel := db.Watch("cfg.")
+
+		_ = db.Set("cfg.a", "1", 0)
+		_ = db.Set("other", "1", 0)
+		_ = db.Del([]string{"cfg.a"})
+		b, _ := db.Batch()
+		_ = b.Set("cfg.b", "2", 0)
+		_ = b.Commit()
+
+		var got []string
+		for len(got) < 3 {
+			select {
+			case e := <-events:
+				got = append(got, e.Type.String()+" "+string(e.Key)+"="+string(e.Value))
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s watch timeout: %v", url, got)
+			}
+		}
+		if fmt.Sprint(got) != "[put cfg.a=1 delete cfg.a= put cfg.b=2]" {
+			t.Fatalf("%s watch got %v", url, got)
+		}
+		cancel()
+		if _, ok := <-events; ok {
+			t.Fatalf("%s watch not closed", url)
+		}
+		_ = db.Close()
+	}
+}
+
+func TestWatchOrder(t *testing.T) {
+	for _, url := range testBackends {
+		db, err := Open(url)
+		if err != nil {
+			t.Fatal(url, err)
+		}
+		events, cancel := db.Watch("k")
+
+		// the last event of the key is the last write of it
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					_ = db.Set("k", fmt.Sprint(i, j), 0)
+				}
+			}(i)
+		}
+		wg.Wait()
+		value, _ := db.Get("k")
+		for n := 0; n < 80; n++ {
+			select {
+			case e := <-events:
+				if n == 79 && string(e.Value) != value {
+					t.Fatalf("%s last event %s, value %s", url, e.Value, value)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s watch timeout after %d events", url, n)
+			}
+		}
+		cancel()
+		_ = db.Close()
+	}
+}
+
+func TestWatchLaggedExpire(t *testing.T) {
+	buffer := WatchBuffer
+	WatchBuffer = 2
+	defer func() { WatchBuffer = buffer }()
+
+	db := new(MemoryDB)
+	_ = db.Open()
+	defer func() { _ = db.Close() }()
+	events, cancel := db.Watch("")
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		_ = db.Set(fmt.Sprint(i), "v", 0)
+	}
+	<-events
+	<-events
+	_ = db.Set("t", "v", 1)
+	if e := <-events; e.Type != EventLagged {
+		t.Fatalf("got %v, want lagged", e.Type)
+	}
+	if e := <-events; e.Type != EventPut || string(e.Key) != "t" {
+		t.Fatalf("got %v %s, want put t", e.Type, e.Key)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	_ = db.GC()
+	select {
+	case e := <-events:
+		if e.Type != EventExpire || string(e.Key) != "t" {
+			t.Fatalf("got %v %s, want expire t", e.Type, e.Key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expire timeout")
+	}
+}
@@ -0,0 +1,427 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"github.com/angenalZZZ/gofunc/f"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// delayIndexPrefix is the key prefix of the due time of an item ID,
+// it sorts after the item keys: due(8) + ID(8).
+var delayIndexPrefix = []byte{0xff}
+
+// delaySeqKey is the key of the last item ID, the IDs are not reused after the queue is drained.
+var delaySeqKey = append(append([]byte(nil), delayIndexPrefix...), "seq"...)
+
+// DelayQueue is a queue ordered by the due time of the items, the items are
+// dequeued after they become due.
+type DelayQueue struct {
+	sync.RWMutex
+	DataDir string
+	db      *leveldb.DB
+	timer   *f.Timer
+	wake    *f.TimerElement
+	wakeAt  int64         // the due time of the wake, unix nano
+	ready   chan struct{} // closed when an item becomes due
+	seq     uint64
+	length  uint64
+	isOpen  bool
+}
+
+// OpenDelayQueue opens a delay queue if one exists at the given directory.
+// If one does not already exist, a new delay queue is created.
+func OpenDelayQueue(dataDir string) (*DelayQueue, error) {
+	var err error
+
+	// Create a new DelayQueue.
+	dq := &DelayQueue{
+		DataDir: dataDir,
+		db:      &leveldb.DB{},
+		ready:   make(chan struct{}),
+		isOpen:  false,
+	}
+
+	// Open database for the delay queue.
+	dq.db, err = leveldb.OpenFile(dataDir, nil)
+	if err != nil {
+		return dq, err
+	}
+
+	// Check if this queue type can open the requested data directory.
+	ok, err := checkQueueType(dataDir, queueDelayQueue)
+	if err != nil {
+		_ = dq.db.Close()
+		return dq, err
+	}
+	if !ok {
+		_ = dq.db.Close()
+		return dq, ErrIncompatibleType
+	}
+
+	// Start the timing wheel, set isOpen and return.
+	dq.timer = f.NewTimer(time.Millisecond, 64)
+	dq.timer.Start()
+	dq.isOpen = true
+	if err = dq.init(); err != nil {
+		_ = dq.Close()
+		return dq, err
+	}
+	return dq, nil
+}
+
+// EnqueueAt adds an item to the queue, it becomes due at the time t.
+func (dq *DelayQueue) EnqueueAt(t time.Time, value []byte) (*DelayItem, error) {
+	dq.Lock()
+	defer dq.Unlock()
+
+	// Check if queue is closed.
+	if !dq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Create new DelayItem.
+	due := delayDue(t)
+	item := &DelayItem{
+		ID:    dq.seq + 1,
+		Due:   time.Unix(0, due),
+		Key:   delayKey(due, dq.seq+1),
+		Value: value,
+	}
+
+	// Add it to the queue, and store the sequence.
+	batch := new(leveldb.Batch)
+	batch.Put(item.Key, item.Value)
+	batch.Put(delayIndexKey(item.ID), item.Key[:8])
+	batch.Put(delaySeqKey, idToKey(item.ID))
+	if err := dq.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+
+	// Increment sequence and length.
+	dq.seq++
+	dq.length++
+	dq.schedule(due)
+
+	return item, nil
+}
+
+// EnqueueAfter adds an item to the queue, it becomes due after the duration d.
+func (dq *DelayQueue) EnqueueAfter(d time.Duration, value []byte) (*DelayItem, error) {
+	return dq.EnqueueAt(time.Now().Add(d), value)
+}
+
+// EnqueueString is a helper function for EnqueueAt that accepts a
+// value as a string rather than a byte slice.
+func (dq *DelayQueue) EnqueueString(t time.Time, value string) (*DelayItem, error) {
+	return dq.EnqueueAt(t, []byte(value))
+}
+
+// EnqueueObject is a helper function for EnqueueAt that accepts any
+// value type, which is then encoded into a byte slice using
+// encoding/gob.
+func (dq *DelayQueue) EnqueueObject(t time.Time, value interface{}) (*DelayItem, error) {
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return dq.EnqueueAt(t, buffer.Bytes())
+}
+
+// EnqueueObjectAsJSON is a helper function for EnqueueAt that accepts
+// any value type, which is then encoded into a JSON byte slice using
+// encoding/json.
+func (dq *DelayQueue) EnqueueObjectAsJSON(t time.Time, value interface{}) (*DelayItem, error) {
+	jsonBytes, err := f.EncodeJson(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return dq.EnqueueAt(t, jsonBytes)
+}
+
+// Dequeue removes the next due item in the queue and returns it,
+// ErrEmpty is returned if no item is due.
+func (dq *DelayQueue) Dequeue() (*DelayItem, error) {
+	dq.Lock()
+	defer dq.Unlock()
+
+	return dq.dequeue()
+}
+
+// DequeueReady waits until the next item becomes due, removes it and returns it.
+func (dq *DelayQueue) DequeueReady(ctx context.Context) (*DelayItem, error) {
+	for {
+		dq.Lock()
+		item, err := dq.dequeue()
+		ready := dq.ready
+		dq.Unlock()
+		if err != ErrEmpty {
+			return item, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ready:
+		}
+	}
+}
+
+// Peek returns the next item in the queue without removing it, it may be not due.
+func (dq *DelayQueue) Peek() (*DelayItem, error) {
+	dq.RLock()
+	defer dq.RUnlock()
+
+	// Check if queue is closed.
+	if !dq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return dq.getNextItem()
+}
+
+// Cancel removes the item with the given ID from the queue.
+func (dq *DelayQueue) Cancel(id uint64) error {
+	dq.Lock()
+	defer dq.Unlock()
+
+	// Check if queue is closed.
+	if !dq.isOpen {
+		return ErrDBClosed
+	}
+
+	due, err := dq.db.Get(delayIndexKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete(append(due, idToKey(id)...))
+	batch.Delete(delayIndexKey(id))
+	if err = dq.db.Write(batch, nil); err != nil {
+		return err
+	}
+	dq.length--
+	return nil
+}
+
+// Reschedule changes the due time of the item with the given ID.
+func (dq *DelayQueue) Reschedule(id uint64, t time.Time) (*DelayItem, error) {
+	dq.Lock()
+	defer dq.Unlock()
+
+	// Check if queue is closed.
+	if !dq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	due, err := dq.db.Get(delayIndexKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	oldKey := append(due, idToKey(id)...)
+	newDue := delayDue(t)
+	item := &DelayItem{ID: id, Due: time.Unix(0, newDue), Key: delayKey(newDue, id)}
+	if item.Value, err = dq.db.Get(oldKey, nil); err != nil {
+		return nil, err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete(oldKey)
+	batch.Put(item.Key, item.Value)
+	batch.Put(delayIndexKey(id), item.Key[:8])
+	if err = dq.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	dq.schedule(newDue)
+
+	return item, nil
+}
+
+// Length returns the total number of items in the queue.
+func (dq *DelayQueue) Length() uint64 {
+	dq.RLock()
+	defer dq.RUnlock()
+	return dq.length
+}
+
+// Close closes the LevelDB database of the queue, and wakes the waiters of DequeueReady.
+func (dq *DelayQueue) Close() error {
+	dq.Lock()
+	defer dq.Unlock()
+
+	// Check if queue is already closed.
+	if !dq.isOpen {
+		return nil
+	}
+
+	// Stop the timing wheel.
+	if dq.wake != nil {
+		dq.wake.Stop()
+	}
+	dq.timer.Stop()
+
+	// Close the LevelDB database.
+	if err := dq.db.Close(); err != nil {
+		return err
+	}
+
+	// Reset the queue and set isOpen to false.
+	dq.wake, dq.wakeAt = nil, 0
+	dq.seq, dq.length = 0, 0
+	dq.isOpen = false
+	close(dq.ready)
+
+	return nil
+}
+
+// Drop closes and deletes the LevelDB database of the queue.
+func (dq *DelayQueue) Drop() error {
+	if err := dq.Close(); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dq.DataDir)
+}
+
+// dequeue removes the next due item, dq must be locked.
+func (dq *DelayQueue) dequeue() (*DelayItem, error) {
+	// Check if queue is closed.
+	if !dq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	item, err := dq.getNextItem()
+	if err != nil {
+		return nil, err
+	}
+	if item.Due.After(time.Now()) {
+		dq.schedule(item.Due.UnixNano())
+		return nil, ErrEmpty
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete(item.Key)
+	batch.Delete(delayIndexKey(item.ID))
+	if err = dq.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	dq.length--
+
+	return item, nil
+}
+
+// getNextItem returns the item with the earliest due time.
+func (dq *DelayQueue) getNextItem() (*DelayItem, error) {
+	iter := dq.db.NewIterator(&util.Range{Limit: delayIndexPrefix}, nil)
+	defer iter.Release()
+	if !iter.First() {
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+		return nil, ErrEmpty
+	}
+
+	key := append([]byte(nil), iter.Key()...)
+	return &DelayItem{
+		ID:    keyToID(key[8:]),
+		Due:   time.Unix(0, int64(binary.BigEndian.Uint64(key))),
+		Key:   key,
+		Value: append([]byte(nil), iter.Value()...),
+	}, nil
+}
+
+// schedule wakes the waiters at the due time, unless an earlier wake is scheduled, dq must be locked.
+func (dq *DelayQueue) schedule(due int64) {
+	if dq.wake != nil && dq.wakeAt <= due {
+		return
+	}
+	if dq.wake != nil {
+		dq.wake.Stop()
+	}
+
+	// Round up to the tick of the timing wheel.
+	d := time.Duration(due-time.Now().UnixNano()) + time.Millisecond - 1
+	dq.wakeAt = due
+	dq.wake = dq.timer.AfterFunc(d, func() {
+		dq.Lock()
+		defer dq.Unlock()
+		if !dq.isOpen || dq.wakeAt != due {
+			return
+		}
+		dq.wake, dq.wakeAt = nil, 0
+		close(dq.ready)
+		dq.ready = make(chan struct{})
+	})
+}
+
+// init initializes the delay queue data.
+func (dq *DelayQueue) init() error {
+	// Count the items, and set the sequence to the stored or the last ID.
+	iter := dq.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()
+		switch {
+		case len(key) == 16:
+			dq.length++
+		case bytes.Equal(key, delaySeqKey):
+			if seq := keyToID(iter.Value()); seq > dq.seq {
+				dq.seq = seq
+			}
+		case len(key) == len(delayIndexPrefix)+8 && bytes.HasPrefix(key, delayIndexPrefix):
+			if id := keyToID(key[len(delayIndexPrefix):]); id > dq.seq {
+				dq.seq = id
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// Schedule the wake of the next item.
+	if item, err := dq.getNextItem(); err == nil {
+		dq.schedule(item.Due.UnixNano())
+	}
+	return nil
+}
+
+// delayDue returns the due time in unix nano, the times before 1970 (and the zero time) are due at 0,
+// the times after 2262 are due at the max.
+func delayDue(t time.Time) int64 {
+	if t.Before(time.Unix(0, 0)) {
+		return 0
+	}
+	if t.After(time.Unix(0, math.MaxInt64)) {
+		return math.MaxInt64
+	}
+	return t.UnixNano()
+}
+
+// delayKey returns the key of the due time in unix nano and the ID.
+func delayKey(due int64, id uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(due))
+	binary.BigEndian.PutUint64(key[8:], id)
+	return key
+}
+
+// delayIndexKey returns the index key of the ID.
+func delayIndexKey(id uint64) []byte {
+	return append(append([]byte(nil), delayIndexPrefix...), idToKey(id)...)
+}
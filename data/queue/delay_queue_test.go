@@ -0,0 +1,160 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDelayQueueIncompatibleType(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	defer q.Drop()
+
+	if _, err = OpenDelayQueue(file); err != ErrIncompatibleType {
+		t.Fatalf("Expected to get incompatible type error, got %v", err)
+	}
+}
+
+func TestDelayQueueDequeueReady(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	dq, err := OpenDelayQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dq.Drop()
+
+	start := time.Now()
+	if _, err = dq.EnqueueAfter(60*time.Millisecond, []byte("value for item 2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dq.EnqueueAfter(20*time.Millisecond, []byte("value for item 1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dq.Dequeue(); err != ErrEmpty {
+		t.Fatalf("Expected to get empty error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 1; i <= 2; i++ {
+		item, err := dq.DequeueReady(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.ToString() != fmt.Sprintf("value for item %d", i) {
+			t.Fatalf("Expected value for item %d, got %s", i, item.ToString())
+		}
+		if time.Now().Before(item.Due) {
+			t.Fatalf("Expected item %d to be due at %s, dequeued at %s", i, item.Due, time.Now())
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected to dequeue the items when they are due, elapsed %s", elapsed)
+	}
+
+	// The context is done before the next item is due.
+	if _, err = dq.EnqueueAfter(time.Hour, []byte("value for item 3")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = dq.DequeueReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected to get deadline exceeded error, got %v", err)
+	}
+}
+
+func TestDelayQueueCancelReschedule(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	dq, err := OpenDelayQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { dq.Drop() }()
+
+	item1, _ := dq.EnqueueAfter(time.Hour, []byte("value for item 1"))
+	item2, _ := dq.EnqueueAfter(time.Hour, []byte("value for item 2"))
+	if err = dq.Cancel(item1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = dq.Cancel(item1.ID); err != ErrNotFound {
+		t.Fatalf("Expected to get not found error, got %v", err)
+	}
+	if dq.Length() != 1 {
+		t.Fatalf("Expected queue length of 1, got %d", dq.Length())
+	}
+
+	// A waiter wakes when the item is rescheduled to an earlier time.
+	done := make(chan *DelayItem)
+	go func() {
+		item, _ := dq.DequeueReady(context.Background())
+		done <- item
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err = dq.Reschedule(item2.ID, time.Now().Add(20*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case item := <-done:
+		if item == nil || item.ID != item2.ID || item.ToString() != "value for item 2" {
+			t.Fatalf("Expected item 2, got %+v", item)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the rescheduled item to be dequeued")
+	}
+
+	// The items and the sequence persist.
+	item3, _ := dq.EnqueueAfter(time.Hour, []byte("value for item 3"))
+	dq.Close()
+	if dq, err = OpenDelayQueue(file); err != nil {
+		t.Fatal(err)
+	}
+	if dq.Length() != 1 {
+		t.Fatalf("Expected queue length of 1, got %d", dq.Length())
+	}
+	if item, err := dq.Peek(); err != nil || item.ID != item3.ID || !item.Due.Equal(item3.Due) {
+		t.Fatalf("Expected item 3, got %+v %v", item, err)
+	}
+	if item, _ := dq.EnqueueAfter(time.Hour, nil); item.ID != item3.ID+1 {
+		t.Fatalf("Expected ID %d, got %d", item3.ID+1, item.ID)
+	}
+}
+
+func TestDelayQueuePastDueAndDrained(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	dq, err := OpenDelayQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { dq.Drop() }()
+
+	// The zero and the pre-1970 times are due first.
+	if _, err = dq.EnqueueAfter(-time.Second, []byte("value for item 1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dq.EnqueueAt(time.Time{}, []byte("value for item 2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dq.EnqueueAt(time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC), []byte("value for item 3")); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{2, 3, 1} {
+		if item, err := dq.Dequeue(); err != nil || item.ID != id {
+			t.Fatalf("Expected item %d, got %+v %v", id, item, err)
+		}
+	}
+
+	// The sequence persists after the queue is drained.
+	dq.Close()
+	if dq, err = OpenDelayQueue(file); err != nil {
+		t.Fatal(err)
+	}
+	if item, _ := dq.EnqueueAfter(time.Hour, nil); item == nil || item.ID != 4 {
+		t.Fatalf("Expected ID 4, got %+v", item)
+	}
+}
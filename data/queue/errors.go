@@ -20,4 +20,20 @@ var (
 	// been called, causing the stack or queue to close, as well as
 	// its underlying database.
 	ErrDBClosed = errors.New("queue: Database is closed")
+
+	// ErrNotReserved is returned when the ID used to acknowledge an item
+	// isn't reserved.
+	ErrNotReserved = errors.New("queue: Item is not reserved")
+
+	// ErrNotFound is returned when the ID used to cancel or reschedule
+	// an item isn't found in the delay queue.
+	ErrNotFound = errors.New("queue: Item is not found")
+
+	// ErrCorrupted is returned when a record of the segment log
+	// fails the checksum.
+	ErrCorrupted = errors.New("queue: Segment log record is corrupted")
+
+	// ErrUnsupported is returned when the operation isn't supported
+	// by the segment log of the queue.
+	ErrUnsupported = errors.New("queue: Operation is not supported by segment log")
 )
@@ -15,6 +15,8 @@ const (
 	queueQueue
 	queuePriorityQueue
 	queuePrefixQueue
+	queueDelayQueue
+	queueSegmentQueue
 )
 
 // checkQueueType checks if the type of queue data structure
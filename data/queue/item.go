@@ -5,13 +5,16 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"github.com/angenalZZZ/gofunc/f"
+	"time"
 )
 
 // Item represents an entry in either a stack or queue.
 type Item struct {
-	ID    uint64
-	Key   []byte
-	Value []byte
+	ID       uint64
+	Key      []byte
+	Value    []byte
+	Attempts uint32 // the deliveries of a reserved item
+	Lease    uint64 // the lease token of a reserved item, Ack and Nack require it
 }
 
 // ToString returns the item value as a string.
@@ -86,6 +89,37 @@ func (pi *PriorityItem) ToObjectFromJSON(value interface{}) error {
 	return f.DecodeJson(pi.Value, value)
 }
 
+// DelayItem represents an entry in a delay queue.
+type DelayItem struct {
+	ID    uint64
+	Due   time.Time
+	Key   []byte
+	Value []byte
+}
+
+// ToString returns the delay item value as a string.
+func (di *DelayItem) ToString() string {
+	return string(di.Value)
+}
+
+// ToObject decodes the item value into the given value type using
+// encoding/gob.
+//
+// The value passed to this method should be a pointer to a variable
+// of the type you wish to decode into. The variable pointed to will
+// hold the decoded object.
+func (di *DelayItem) ToObject(value interface{}) error {
+	buffer := bytes.NewBuffer(di.Value)
+	dec := gob.NewDecoder(buffer)
+	return dec.Decode(value)
+}
+
+// ToObjectFromJSON decodes the item value into the given value type
+// using encoding/json.
+func (di *DelayItem) ToObjectFromJSON(value interface{}) error {
+	return f.DecodeJson(di.Value, value)
+}
+
 // idToKey converts and returns the given ID to a key.
 func idToKey(id uint64) []byte {
 	key := make([]byte, 8)
@@ -0,0 +1,21 @@
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package queue
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+func msync(b []byte) error {
+	return unix.Msync(b, unix.MS_SYNC)
+}
+
+func munmap(b []byte) error {
+	return unix.Munmap(b)
+}
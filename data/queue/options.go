@@ -0,0 +1,39 @@
+package queue
+
+// Option is a function that will set up option.
+type Option func(opts *Options)
+
+func loadOptions(options ...Option) *Options {
+	opts := &Options{SegmentSize: defaultSegmentSize}
+	for _, option := range options {
+		option(opts)
+	}
+	return opts
+}
+
+// Options are set when the queue opens.
+type Options struct {
+	// SegmentLog indicates whether the queue is stored in the memory-mapped segment files
+	// of an append-only log instead of LevelDB. The throughput of the segment log is stable
+	// for a large queue, and the consumed segments are deleted as a whole.
+	SegmentLog bool
+
+	// SegmentSize is the size of a segment file in bytes, 64MB by default.
+	SegmentSize int
+}
+
+// WithSegmentLog sets up the segment log storage of the queue.
+func WithSegmentLog() Option {
+	return func(opts *Options) {
+		opts.SegmentLog = true
+	}
+}
+
+// WithSegmentSize sets up the size of the segment files.
+func WithSegmentSize(size int) Option {
+	return func(opts *Options) {
+		if size > 0 {
+			opts.SegmentSize = size
+		}
+	}
+}
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"github.com/angenalZZZ/gofunc/f"
@@ -36,6 +37,7 @@ type PrefixQueue struct {
 	db      *leveldb.DB
 	size    uint64
 	isOpen  bool
+	notify  *notifier
 }
 
 // OpenPrefixQueue opens a prefix queue if one exists at the given directory.
@@ -48,6 +50,7 @@ func OpenPrefixQueue(dataDir string) (*PrefixQueue, error) {
 		DataDir: dataDir,
 		db:      &leveldb.DB{},
 		isOpen:  false,
+		notify:  newNotifier(),
 	}
 
 	// Open database for the prefix queue.
@@ -62,6 +65,7 @@ func OpenPrefixQueue(dataDir string) (*PrefixQueue, error) {
 		return nil, err
 	}
 	if !ok {
+		_ = pq.db.Close()
 		return nil, ErrIncompatibleType
 	}
 
@@ -72,6 +76,7 @@ func OpenPrefixQueue(dataDir string) (*PrefixQueue, error) {
 
 // Enqueue adds an item to the queue.
 func (pq *PrefixQueue) Enqueue(prefix, value []byte) (*Item, error) {
+	defer pq.notify.broadcast()
 	pq.Lock()
 	defer pq.Unlock()
 
@@ -197,6 +202,16 @@ func (pq *PrefixQueue) Dequeue(prefix []byte) (*Item, error) {
 	return item, nil
 }
 
+// DequeueWait removes the next item in the prefix queue and returns it,
+// it waits for an item to be enqueued if the prefix queue is empty.
+func (pq *PrefixQueue) DequeueWait(ctx context.Context, prefix []byte) (item *Item, err error) {
+	err = pq.notify.wait(ctx, func() error {
+		item, err = pq.Dequeue(prefix)
+		return err
+	})
+	return
+}
+
 // DequeueString is a helper function for Dequeue that accepts the prefix as a
 // string rather than a byte slice.
 func (pq *PrefixQueue) DequeueString(prefix string) (*Item, error) {
@@ -327,6 +342,7 @@ func (pq *PrefixQueue) Length() uint64 {
 
 // Close closes the LevelDB database of the prefix queue.
 func (pq *PrefixQueue) Close() error {
+	defer pq.notify.broadcast()
 	pq.Lock()
 	defer pq.Unlock()
 
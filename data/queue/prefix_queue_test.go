@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -538,6 +539,25 @@ func TestPrefixQueueOutOfBounds(t *testing.T) {
 	}
 }
 
+func TestPrefixQueueDequeueWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pq.Drop()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = pq.EnqueueString("other", "value for other")
+		_, _ = pq.EnqueueString("prefix", "value for item 1")
+	}()
+	item, err := pq.DequeueWait(context.Background(), []byte("prefix"))
+	if err != nil || item.ToString() != "value for item 1" {
+		t.Fatalf("Expected value for item 1, got %+v %v", item, err)
+	}
+}
+
 func BenchmarkPrefixQueueEnqueue(b *testing.B) {
 	// Open test database
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"github.com/angenalZZZ/gofunc/f"
 	"os"
@@ -45,6 +46,7 @@ type PriorityQueue struct {
 	levels   [256]*priorityLevel
 	curLevel uint8
 	isOpen   bool
+	notify   *notifier
 }
 
 // OpenPriorityQueue opens a priority queue if one exists at the given
@@ -59,6 +61,7 @@ func OpenPriorityQueue(dataDir string, order order) (*PriorityQueue, error) {
 		db:      &leveldb.DB{},
 		order:   order,
 		isOpen:  false,
+		notify:  newNotifier(),
 	}
 
 	// Open database for the priority queue.
@@ -73,6 +76,7 @@ func OpenPriorityQueue(dataDir string, order order) (*PriorityQueue, error) {
 		return pq, err
 	}
 	if !ok {
+		_ = pq.db.Close()
 		return pq, ErrIncompatibleType
 	}
 
@@ -83,6 +87,7 @@ func OpenPriorityQueue(dataDir string, order order) (*PriorityQueue, error) {
 
 // Enqueue adds an item to the priority queue.
 func (pq *PriorityQueue) Enqueue(priority uint8, value []byte) (*PriorityItem, error) {
+	defer pq.notify.broadcast()
 	pq.Lock()
 	defer pq.Unlock()
 
@@ -183,6 +188,16 @@ func (pq *PriorityQueue) Dequeue() (*PriorityItem, error) {
 	return item, nil
 }
 
+// DequeueWait removes the next item in the priority queue and returns it,
+// it waits for an item to be enqueued if the priority queue is empty.
+func (pq *PriorityQueue) DequeueWait(ctx context.Context) (item *PriorityItem, err error) {
+	err = pq.notify.wait(ctx, func() error {
+		item, err = pq.Dequeue()
+		return err
+	})
+	return
+}
+
 // DequeueByPriority removes the next item in the given priority level
 // and returns it.
 func (pq *PriorityQueue) DequeueByPriority(priority uint8) (*PriorityItem, error) {
@@ -346,6 +361,7 @@ func (pq *PriorityQueue) Length() uint64 {
 
 // Close closes the LevelDB database of the priority queue.
 func (pq *PriorityQueue) Close() error {
+	defer pq.notify.broadcast()
 	pq.Lock()
 	defer pq.Unlock()
 
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
@@ -1056,6 +1057,24 @@ func TestPriorityQueueOutOfBounds(t *testing.T) {
 	}
 }
 
+func TestPriorityQueueDequeueWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pq.Drop()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = pq.EnqueueString(3, "value for item 1")
+	}()
+	item, err := pq.DequeueWait(context.Background())
+	if err != nil || item.Priority != 3 || item.ToString() != "value for item 1" {
+		t.Fatalf("Expected value for item 1, got %+v %v", item, err)
+	}
+}
+
 func BenchmarkPriorityQueueEnqueue(b *testing.B) {
 	// Open test database
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
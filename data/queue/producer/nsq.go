@@ -42,11 +42,11 @@ func NewNsqProducer(addr string, config ...*nsq.Config) (p *NsqProducer, err err
 		return
 	}
 
-	np.SetLogger(p, nsq.LogLevel(int(ll)))
 	p = &NsqProducer{
 		Log:      l,
 		Producer: np,
 	}
+	np.SetLogger(p, nsq.LogLevel(int(ll)))
 	return
 }
 
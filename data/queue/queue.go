@@ -2,6 +2,7 @@ package queue
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"github.com/angenalZZZ/gofunc/f"
 	"os"
@@ -14,16 +15,28 @@ import (
 type Queue struct {
 	sync.RWMutex
 	DataDir string
-	db      *leveldb.DB
-	head    uint64
-	tail    uint64
-	isOpen  bool
+	// MaxAttempts is the max deliveries of a reserved item, then it's moved
+	// to the dead-letter queue, 0 means unlimited.
+	MaxAttempts uint32
+	db          *leveldb.DB
+	log         *segmentLog
+	head        uint64
+	tail        uint64
+	isOpen      bool
+	notify      *notifier
+	leases      map[uint64]*lease
+	leaseToken  uint64
+	expiry      leaseExpiry
+	deadLetters uint64
 }
 
 // OpenQueue opens a queue if one exists at the given directory. If one
 // does not already exist, a new queue is created.
-func OpenQueue(dataDir string) (*Queue, error) {
+//
+// The queue is stored in LevelDB, or the segment log with the option WithSegmentLog.
+func OpenQueue(dataDir string, options ...Option) (*Queue, error) {
 	var err error
+	opts := loadOptions(options...)
 
 	// Create a new Queue.
 	q := &Queue{
@@ -32,6 +45,11 @@ func OpenQueue(dataDir string) (*Queue, error) {
 		head:    0,
 		tail:    0,
 		isOpen:  false,
+		notify:  newNotifier(),
+	}
+
+	if opts.SegmentLog {
+		return q, q.openSegmentLog(opts.SegmentSize)
 	}
 
 	// Open database for the queue.
@@ -46,6 +64,7 @@ func OpenQueue(dataDir string) (*Queue, error) {
 		return q, err
 	}
 	if !ok {
+		_ = q.db.Close()
 		return q, ErrIncompatibleType
 	}
 
@@ -56,6 +75,7 @@ func OpenQueue(dataDir string) (*Queue, error) {
 
 // Enqueue adds an item to the queue.
 func (q *Queue) Enqueue(value []byte) (*Item, error) {
+	defer q.notify.broadcast()
 	q.Lock()
 	defer q.Unlock()
 
@@ -72,7 +92,11 @@ func (q *Queue) Enqueue(value []byte) (*Item, error) {
 	}
 
 	// Add it to the queue.
-	if err := q.db.Put(item.Key, item.Value, nil); err != nil {
+	if q.log != nil {
+		if err := q.log.append(item.Value); err != nil {
+			return nil, err
+		}
+	} else if err := q.db.Put(item.Key, item.Value, nil); err != nil {
 		return nil, err
 	}
 
@@ -137,7 +161,11 @@ func (q *Queue) Dequeue() (*Item, error) {
 	}
 
 	// Remove this item from the queue.
-	if err := q.db.Delete(item.Key, nil); err != nil {
+	if q.log != nil {
+		if err := q.log.advance(); err != nil {
+			return nil, err
+		}
+	} else if err := q.db.Delete(item.Key, nil); err != nil {
 		return nil, err
 	}
 
@@ -147,6 +175,16 @@ func (q *Queue) Dequeue() (*Item, error) {
 	return item, nil
 }
 
+// DequeueWait removes the next item in the queue and returns it,
+// it waits for an item to be enqueued if the queue is empty.
+func (q *Queue) DequeueWait(ctx context.Context) (item *Item, err error) {
+	err = q.notify.wait(ctx, func() error {
+		item, err = q.Dequeue()
+		return err
+	})
+	return
+}
+
 // Peek returns the next item in the queue without removing it.
 func (q *Queue) Peek() (*Item, error) {
 	q.RLock()
@@ -188,6 +226,7 @@ func (q *Queue) PeekByID(id uint64) (*Item, error) {
 }
 
 // Update updates an item in the queue without changing its position.
+// ErrUnsupported is returned for the segment log.
 func (q *Queue) Update(id uint64, newValue []byte) (*Item, error) {
 	q.Lock()
 	defer q.Unlock()
@@ -196,6 +235,9 @@ func (q *Queue) Update(id uint64, newValue []byte) (*Item, error) {
 	if !q.isOpen {
 		return nil, ErrDBClosed
 	}
+	if q.log != nil {
+		return nil, ErrUnsupported
+	}
 
 	// Check if item exists in queue.
 	if id <= q.head || id > q.tail {
@@ -259,8 +301,9 @@ func (q *Queue) Length() uint64 {
 	return q.tail - q.head
 }
 
-// Close closes the LevelDB database of the queue.
+// Close closes the LevelDB database or the segment log of the queue.
 func (q *Queue) Close() error {
+	defer q.notify.broadcast()
 	q.Lock()
 	defer q.Unlock()
 
@@ -269,8 +312,13 @@ func (q *Queue) Close() error {
 		return nil
 	}
 
-	// Close the LevelDB database.
-	if err := q.db.Close(); err != nil {
+	// Close the LevelDB database or the segment log.
+	if q.log != nil {
+		if err := q.log.close(); err != nil {
+			return err
+		}
+		q.log = nil
+	} else if err := q.db.Close(); err != nil {
 		return err
 	}
 
@@ -279,11 +327,13 @@ func (q *Queue) Close() error {
 	q.head = 0
 	q.tail = 0
 	q.isOpen = false
+	q.leases, q.expiry = nil, nil
+	q.deadLetters = 0
 
 	return nil
 }
 
-// Drop closes and deletes the LevelDB database of the queue.
+// Drop closes and deletes the LevelDB database or the segment log of the queue.
 func (q *Queue) Drop() error {
 	if err := q.Close(); err != nil {
 		return err
@@ -304,7 +354,12 @@ func (q *Queue) getItemByID(id uint64) (*Item, error) {
 	// GetHeader item from database.
 	var err error
 	item := &Item{ID: id, Key: idToKey(id)}
-	if item.Value, err = q.db.Get(item.Key, nil); err != nil {
+	if q.log != nil {
+		item.Value, err = q.log.read(id)
+	} else {
+		item.Value, err = q.db.Get(item.Key, nil)
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -317,15 +372,57 @@ func (q *Queue) init() error {
 	iter := q.db.NewIterator(nil, nil)
 	defer iter.Release()
 
-	// SetHeader queue head to the first item.
-	if iter.First() {
-		q.head = keyToID(iter.Key()) - 1
+	// SetHeader queue head to the first item, the keys of the reserved items are skipped.
+	found := false
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if len(iter.Key()) == 8 {
+			q.head, found = keyToID(iter.Key())-1, true
+			break
+		}
 	}
 
 	// SetHeader queue tail to the last item.
-	if iter.Last() {
-		q.tail = keyToID(iter.Key())
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		if len(iter.Key()) == 8 {
+			q.tail = keyToID(iter.Key())
+			break
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
 	}
 
-	return iter.Error()
+	// The IDs of the reserved items aren't reused.
+	maxID, err := q.initLeases()
+	if err != nil {
+		return err
+	}
+	if !found && maxID > q.tail {
+		q.head, q.tail = maxID, maxID
+	}
+	return nil
+}
+
+// openSegmentLog opens the segment log of the queue.
+func (q *Queue) openSegmentLog(segmentSize int) error {
+	if err := os.MkdirAll(q.DataDir, 0755); err != nil {
+		return err
+	}
+
+	// Check if this queue type can open the requested data directory.
+	ok, err := checkQueueType(q.DataDir, queueSegmentQueue)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrIncompatibleType
+	}
+
+	if q.log, err = openSegmentLog(q.DataDir, segmentSize); err != nil {
+		return err
+	}
+	q.head, q.tail = q.log.head, q.log.tail
+	q.leases = make(map[uint64]*lease)
+	q.isOpen = true
+	return nil
 }
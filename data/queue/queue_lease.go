@@ -0,0 +1,349 @@
+package queue
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The key prefixes of the reserved items and the dead-letter queue. The prefixes sort
+// after the item IDs, and the keys are longer than the item keys.
+var (
+	leaseKeyPrefix = []byte{0xff, 'r'}
+	deadKeyPrefix  = []byte{0xff, 'd'}
+)
+
+// leaseHeaderLen the length of the lease encoded before the value.
+const leaseHeaderLen = 20
+
+// lease the reservation of an item.
+type lease struct {
+	Deadline time.Time
+	Attempts uint32
+	Token    uint64 // changes on each delivery and Nack, Ack and Nack require it
+}
+
+// leaseExpiry a min-heap of the deadlines of the leases, the entries of the stale leases are dropped when popped.
+type leaseExpiry []leaseExpiryEntry
+
+type leaseExpiryEntry struct {
+	id       uint64
+	token    uint64
+	deadline int64
+}
+
+func (h leaseExpiry) Len() int            { return len(h) }
+func (h leaseExpiry) Less(i, j int) bool  { return h[i].deadline < h[j].deadline }
+func (h leaseExpiry) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *leaseExpiry) Push(x interface{}) { *h = append(*h, x.(leaseExpiryEntry)) }
+func (h *leaseExpiry) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Reserve returns the next item in the queue with a lease of the timeout.
+// The item is redelivered after the lease expires, unless it's acknowledged by Ack.
+//
+// The items of the expired leases and the nacked items are delivered first.
+// An item is moved to the dead-letter queue after MaxAttempts deliveries.
+// ErrUnsupported is returned for the segment log.
+func (q *Queue) Reserve(timeout time.Duration) (*Item, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	if q.log != nil {
+		return nil, ErrUnsupported
+	}
+
+	// Redeliver the item of the earliest expired lease.
+	now := time.Now()
+	for {
+		id := q.expired(now)
+		if id == 0 {
+			break
+		}
+		l := q.leases[id]
+		if q.MaxAttempts > 0 && l.Attempts >= q.MaxAttempts {
+			if err := q.moveToDeadLetter(id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		value, err := q.db.Get(leaseKey(id), nil)
+		if err != nil {
+			return nil, err
+		}
+		value = value[leaseHeaderLen:]
+		l = q.newLease(now.Add(timeout), l.Attempts+1)
+		if err = q.db.Put(leaseKey(id), encodeLease(l, value), nil); err != nil {
+			return nil, err
+		}
+		q.setLease(id, l)
+		return &Item{ID: id, Key: idToKey(id), Value: value, Attempts: l.Attempts, Lease: l.Token}, nil
+	}
+
+	// Reserve the next item in the queue.
+	item, err := q.getItemByID(q.head + 1)
+	if err != nil {
+		return nil, err
+	}
+	l := q.newLease(now.Add(timeout), 1)
+	batch := new(leveldb.Batch)
+	batch.Delete(item.Key)
+	batch.Put(leaseKey(item.ID), encodeLease(l, item.Value))
+	if err = q.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	q.head++
+	q.setLease(item.ID, l)
+	item.Attempts, item.Lease = l.Attempts, l.Token
+	return item, nil
+}
+
+// Ack acknowledges the reserved item by the lease token of Reserve, and deletes it.
+// ErrNotReserved is returned if the item isn't reserved, or the lease is stale.
+func (q *Queue) Ack(id, lease uint64) error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if l, ok := q.leases[id]; !ok || l.Token != lease {
+		return ErrNotReserved
+	}
+
+	if err := q.db.Delete(leaseKey(id), nil); err != nil {
+		return err
+	}
+	delete(q.leases, id)
+	return nil
+}
+
+// Nack releases the reserved item by the lease token of Reserve, it's redelivered after the delay.
+// The item is moved to the dead-letter queue if it's delivered MaxAttempts times.
+// ErrNotReserved is returned if the item isn't reserved, or the lease is stale.
+func (q *Queue) Nack(id, lease uint64, delay time.Duration) error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	l, ok := q.leases[id]
+	if !ok || l.Token != lease {
+		return ErrNotReserved
+	}
+	if q.MaxAttempts > 0 && l.Attempts >= q.MaxAttempts {
+		return q.moveToDeadLetter(id)
+	}
+	_, err := q.updateLease(id, q.newLease(time.Now().Add(delay), l.Attempts))
+	return err
+}
+
+// Touch extends the lease of the reserved item by the timeout, and returns the new lease token.
+// ErrNotReserved is returned if the item isn't reserved, or the lease is stale or expired.
+func (q *Queue) Touch(id, lease uint64, timeout time.Duration) (uint64, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return 0, ErrDBClosed
+	}
+	now := time.Now()
+	l, ok := q.leases[id]
+	if !ok || l.Token != lease || !l.Deadline.After(now) {
+		return 0, ErrNotReserved
+	}
+	return q.updateLease(id, q.newLease(now.Add(timeout), l.Attempts))
+}
+
+// ReservedLength returns the total number of the reserved and nacked items.
+func (q *Queue) ReservedLength() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	return uint64(len(q.leases))
+}
+
+// DeadLetterLength returns the total number of items in the dead-letter queue.
+func (q *Queue) DeadLetterLength() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	return q.deadLetters
+}
+
+// DequeueDeadLetter removes the next item in the dead-letter queue and returns it.
+func (q *Queue) DequeueDeadLetter() (*Item, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	if q.log != nil {
+		return nil, ErrEmpty
+	}
+
+	iter := q.db.NewIterator(util.BytesPrefix(deadKeyPrefix), nil)
+	defer iter.Release()
+	if !iter.First() {
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+		return nil, ErrEmpty
+	}
+	id := keyToID(iter.Key()[len(deadKeyPrefix):])
+	value := append([]byte(nil), iter.Value()...)
+	if err := q.db.Delete(iter.Key(), nil); err != nil {
+		return nil, err
+	}
+	q.deadLetters--
+	return &Item{ID: id, Key: idToKey(id), Value: value[leaseHeaderLen:], Attempts: binary.BigEndian.Uint32(value[8:])}, nil
+}
+
+// moveToDeadLetter moves the reserved item to the dead-letter queue.
+func (q *Queue) moveToDeadLetter(id uint64) error {
+	value, err := q.db.Get(leaseKey(id), nil)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(leaseKey(id))
+	batch.Put(deadKey(id), encodeLease(&lease{Attempts: q.leases[id].Attempts}, value[leaseHeaderLen:]))
+	if err = q.db.Write(batch, nil); err != nil {
+		return err
+	}
+	delete(q.leases, id)
+	q.deadLetters++
+	return nil
+}
+
+// updateLease updates the lease of the reserved item, and returns the lease token.
+func (q *Queue) updateLease(id uint64, l *lease) (uint64, error) {
+	value, err := q.db.Get(leaseKey(id), nil)
+	if err != nil {
+		return 0, err
+	}
+	if err = q.db.Put(leaseKey(id), encodeLease(l, value[leaseHeaderLen:]), nil); err != nil {
+		return 0, err
+	}
+	q.setLease(id, l)
+	return l.Token, nil
+}
+
+// newLease returns a lease of the deadline, its token is greater than the tokens of the previous leases.
+func (q *Queue) newLease(deadline time.Time, attempts uint32) *lease {
+	token := uint64(time.Now().UnixNano())
+	if token <= q.leaseToken {
+		token = q.leaseToken + 1
+	}
+	q.leaseToken = token
+	return &lease{Deadline: deadline, Attempts: attempts, Token: token}
+}
+
+// setLease sets the lease of the item, and pushes its deadline to the heap.
+// The heap is rebuilt if it's mostly the stale entries.
+func (q *Queue) setLease(id uint64, l *lease) {
+	q.leases[id] = l
+	if len(q.expiry) > 2*len(q.leases)+1024 {
+		q.initExpiry()
+	}
+	heap.Push(&q.expiry, leaseExpiryEntry{id: id, token: l.Token, deadline: l.Deadline.UnixNano()})
+}
+
+// initExpiry builds the heap of the deadlines of the leases.
+func (q *Queue) initExpiry() {
+	q.expiry = make(leaseExpiry, 0, len(q.leases))
+	for id, l := range q.leases {
+		q.expiry = append(q.expiry, leaseExpiryEntry{id: id, token: l.Token, deadline: l.Deadline.UnixNano()})
+	}
+	heap.Init(&q.expiry)
+}
+
+// expired returns the item ID of the earliest expired lease, or 0 if none.
+func (q *Queue) expired(now time.Time) uint64 {
+	for n := now.UnixNano(); len(q.expiry) > 0; heap.Pop(&q.expiry) {
+		e := q.expiry[0]
+		if l, ok := q.leases[e.id]; ok && l.Token == e.token {
+			if e.deadline > n {
+				return 0
+			}
+			return e.id
+		}
+	}
+	return 0
+}
+
+// initLeases loads the reserved items and the dead-letter queue, and returns the max ID of them.
+func (q *Queue) initLeases() (uint64, error) {
+	var maxID uint64
+	q.leases, q.deadLetters = make(map[uint64]*lease), 0
+
+	iter := q.db.NewIterator(util.BytesPrefix(leaseKeyPrefix), nil)
+	for iter.Next() {
+		id, value := keyToID(iter.Key()[len(leaseKeyPrefix):]), iter.Value()
+		l := decodeLease(value)
+		q.leases[id] = l
+		if l.Token > q.leaseToken {
+			q.leaseToken = l.Token
+		}
+		if id > maxID {
+			maxID = id
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	q.initExpiry()
+
+	iter = q.db.NewIterator(util.BytesPrefix(deadKeyPrefix), nil)
+	for iter.Next() {
+		if id := keyToID(iter.Key()[len(deadKeyPrefix):]); id > maxID {
+			maxID = id
+		}
+		q.deadLetters++
+	}
+	iter.Release()
+	return maxID, iter.Error()
+}
+
+func leaseKey(id uint64) []byte {
+	return append(append([]byte(nil), leaseKeyPrefix...), idToKey(id)...)
+}
+
+func deadKey(id uint64) []byte {
+	return append(append([]byte(nil), deadKeyPrefix...), idToKey(id)...)
+}
+
+// encodeLease encodes the lease and the value: deadline(8) unix nano, attempts(4), token(8), value.
+func encodeLease(l *lease, value []byte) []byte {
+	b := make([]byte, leaseHeaderLen, leaseHeaderLen+len(value))
+	if !l.Deadline.IsZero() {
+		binary.BigEndian.PutUint64(b, uint64(l.Deadline.UnixNano()))
+	}
+	binary.BigEndian.PutUint32(b[8:], l.Attempts)
+	binary.BigEndian.PutUint64(b[12:], l.Token)
+	return append(b, value...)
+}
+
+func decodeLease(b []byte) *lease {
+	return &lease{
+		Deadline: time.Unix(0, int64(binary.BigEndian.Uint64(b))),
+		Attempts: binary.BigEndian.Uint32(b[8:]),
+		Token:    binary.BigEndian.Uint64(b[12:]),
+	}
+}
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -588,6 +589,39 @@ func TestQueueOutOfBounds(t *testing.T) {
 	}
 }
 
+func TestQueueDequeueWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Drop()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = q.EnqueueString("value for item 1")
+	}()
+	item, err := q.DequeueWait(context.Background())
+	if err != nil || item.ToString() != "value for item 1" {
+		t.Fatalf("Expected value for item 1, got %+v %v", item, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = q.DequeueWait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected to get deadline exceeded error, got %v", err)
+	}
+
+	// The waiter wakes when the queue is closed.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+	}()
+	if _, err = q.DequeueWait(context.Background()); err != ErrDBClosed {
+		t.Fatalf("Expected to get database closed error, got %v", err)
+	}
+}
+
 func BenchmarkQueueEnqueue(b *testing.B) {
 	// Open test database
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
@@ -629,3 +663,98 @@ func BenchmarkQueueDequeue(b *testing.B) {
 		_, _ = q.Dequeue()
 	}
 }
+
+func TestQueueReserveAckNack(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Drop()
+	q.MaxAttempts = 2
+
+	for i := 1; i <= 3; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item1, err := q.Reserve(time.Minute)
+	if err != nil || item1.ID != 1 || item1.Attempts != 1 || item1.ToString() != "value for item 1" {
+		t.Fatalf("Expected item 1 reserved, got %+v %v", item1, err)
+	}
+	item2, _ := q.Reserve(20 * time.Millisecond)
+	if q.Length() != 1 || q.ReservedLength() != 2 {
+		t.Fatalf("Expected 1 item and 2 reserved, got %d and %d", q.Length(), q.ReservedLength())
+	}
+	if err = q.Ack(item1.ID, item1.Lease+1); err != ErrNotReserved {
+		t.Fatalf("Expected to get not reserved error of a wrong lease, got %v", err)
+	}
+	if err = q.Ack(item1.ID, item1.Lease); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Ack(item1.ID, item1.Lease); err != ErrNotReserved {
+		t.Fatalf("Expected to get not reserved error, got %v", err)
+	}
+
+	// The expired lease is redelivered first, and the stale lease is rejected.
+	time.Sleep(30 * time.Millisecond)
+	item, err := q.Reserve(time.Minute)
+	if err != nil || item.ID != item2.ID || item.Attempts != 2 || item.Lease == item2.Lease {
+		t.Fatalf("Expected item 2 redelivered, got %+v %v", item, err)
+	}
+	if err = q.Ack(item2.ID, item2.Lease); err != ErrNotReserved {
+		t.Fatalf("Expected to get not reserved error of a stale lease, got %v", err)
+	}
+	if err = q.Nack(item2.ID, item2.Lease, 0); err != ErrNotReserved {
+		t.Fatalf("Expected to get not reserved error of a stale lease, got %v", err)
+	}
+	if lease, err := q.Touch(item.ID, item.Lease, time.Minute); err != nil || lease == item.Lease {
+		t.Fatalf("Expected the lease touched, got %d %v", lease, err)
+	} else if _, err = q.Touch(item.ID, item.Lease, time.Minute); err != ErrNotReserved {
+		t.Fatalf("Expected to get not reserved error of a touched lease, got %v", err)
+	} else {
+		item.Lease = lease
+	}
+
+	// The item is moved to the dead-letter queue after the max attempts.
+	if err = q.Nack(item.ID, item.Lease, 0); err != nil {
+		t.Fatal(err)
+	}
+	if q.DeadLetterLength() != 1 || q.ReservedLength() != 0 {
+		t.Fatalf("Expected 1 dead letter and 0 reserved, got %d and %d", q.DeadLetterLength(), q.ReservedLength())
+	}
+
+	// Nack redelivers the item after the delay, and the leases persist.
+	item3, _ := q.Reserve(time.Minute)
+	if err = q.Nack(item3.ID, item3.Lease, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.Reserve(time.Minute); err != ErrEmpty {
+		t.Fatalf("Expected to get empty error, got %v", err)
+	}
+	_ = q.Close()
+	if q, err = OpenQueue(file); err != nil {
+		t.Fatal(err)
+	}
+	q.MaxAttempts = 2
+	if q.Length() != 0 || q.ReservedLength() != 1 || q.DeadLetterLength() != 1 {
+		t.Fatalf("Expected 0 items, 1 reserved and 1 dead letter after reopen, got %d, %d and %d", q.Length(), q.ReservedLength(), q.DeadLetterLength())
+	}
+	time.Sleep(30 * time.Millisecond)
+	if item, err = q.Reserve(time.Minute); err != nil || item.ID != item3.ID || item.Attempts != 2 {
+		t.Fatalf("Expected item 3 redelivered, got %+v %v", item, err)
+	}
+
+	// The IDs of the reserved items aren't reused.
+	if item, _ = q.EnqueueString("value for item 4"); item.ID != 4 {
+		t.Fatalf("Expected item 4, got %d", item.ID)
+	}
+
+	if item, err = q.DequeueDeadLetter(); err != nil || item.ID != item2.ID || item.Attempts != 2 || item.ToString() != "value for item 2" {
+		t.Fatalf("Expected dead letter item 2, got %+v %v", item, err)
+	}
+	if _, err = q.DequeueDeadLetter(); err != ErrEmpty {
+		t.Fatalf("Expected to get empty error, got %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package queue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSegmentSize = 64 * 1024 * 1024
+	segmentExt         = ".seg"
+	checkpointName     = "checkpoint"
+	checkpointSize     = 28
+	recordHeaderSize   = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segmentLog is the append-only log of a queue, made of the memory-mapped segment files,
+// the name of a segment is the ID of its first item:
+//
+//	<data>/00000000000000000001.seg  the records: crc32(4) + length(4) + value, the crc32 checks length + value
+//	<data>/checkpoint                the read offset: head(8) + first ID of the head segment(8) + offset(8) + crc32(4)
+//
+// The head segment is deleted as a whole after its items are consumed.
+type segmentLog struct {
+	dir        string
+	size       int
+	segments   []*segment
+	checkpoint *mmapFile
+	head, tail uint64
+	offset     int // the read offset of the head segment
+}
+
+// segment a segment file, the zero header of a record is the end of the segment.
+type segment struct {
+	*mmapFile
+	first uint64 // the ID of the first item
+	end   int    // the write offset of the last segment
+}
+
+// mmapFile a memory-mapped file.
+type mmapFile struct {
+	f    *os.File
+	data []byte
+}
+
+// openSegmentLog opens the segments in the directory, a torn record at the end of the last segment is truncated.
+func openSegmentLog(dir string, size int) (*segmentLog, error) {
+	l := &segmentLog{dir: dir, size: size}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s, err := openSegment(name, first, size)
+		if err != nil {
+			_ = l.close()
+			return nil, err
+		}
+		l.segments = append(l.segments, s)
+	}
+	if len(l.segments) == 0 {
+		if err = l.createSegment(1, size); err != nil {
+			return nil, err
+		}
+	}
+
+	// Set the tail to the last record of the last segment.
+	last := l.segments[len(l.segments)-1]
+	l.tail = last.first - 1
+	for {
+		_, next, err := last.record(last.end)
+		if err == ErrCorrupted {
+			last.truncate(last.end)
+		}
+		if err != nil {
+			break
+		}
+		last.end = next
+		l.tail++
+	}
+
+	// Set the head to the checkpoint, or the first segment if it's invalid.
+	if l.checkpoint, err = openMmapFile(filepath.Join(dir, checkpointName), checkpointSize); err != nil {
+		_ = l.close()
+		return nil, err
+	}
+	head, first, offset, ok := decodeCheckpoint(l.checkpoint.data)
+	for ok && len(l.segments) > 1 && l.segments[1].first <= first {
+		if err = l.segments[0].remove(); err != nil {
+			_ = l.close()
+			return nil, err
+		}
+		l.segments = l.segments[1:]
+	}
+	if s := l.segments[0]; !ok || first != s.first || head+1 < s.first || head > l.tail || offset > len(s.data) {
+		head, offset = s.first-1, 0
+	}
+	l.head, l.offset = head, offset
+	return l, l.compact()
+}
+
+// append appends the value to the last segment, a new segment is created if it's full.
+func (l *segmentLog) append(value []byte) error {
+	s := l.segments[len(l.segments)-1]
+	if n := recordHeaderSize + len(value); s.end+n > len(s.data) {
+		size := l.size
+		if n > size {
+			size = n
+		}
+		if err := s.sync(); err != nil {
+			return err
+		}
+		if err := l.createSegment(l.tail+1, size); err != nil {
+			return err
+		}
+		s = l.segments[len(l.segments)-1]
+	}
+
+	s.end = s.write(s.end, value)
+	l.tail++
+	return l.compact()
+}
+
+// read reads the value of the item, the item is found by the records from the read offset,
+// or the start of its segment.
+func (l *segmentLog) read(id uint64) ([]byte, error) {
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].first > id }) - 1
+	if i < 0 {
+		return nil, ErrOutOfBounds
+	}
+	s, first, offset := l.segments[i], l.segments[i].first, 0
+	if i == 0 {
+		first, offset = l.head+1, l.offset
+	}
+
+	var err error
+	for ; first < id; first++ {
+		if _, offset, err = s.record(offset); err != nil {
+			return nil, ErrCorrupted
+		}
+	}
+	value, _, err := s.record(offset)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// advance moves the read offset to the next record, and deletes the head segment if it's consumed.
+func (l *segmentLog) advance() error {
+	s := l.segments[0]
+	l.head++
+	l.offset += recordHeaderSize + int(binary.BigEndian.Uint32(s.data[l.offset+4:]))
+	return l.compact()
+}
+
+// compact deletes the head segment if the head is the last item of it, and saves the checkpoint.
+func (l *segmentLog) compact() error {
+	if len(l.segments) > 1 && l.segments[1].first == l.head+1 {
+		s := l.segments[0]
+		l.segments, l.offset = l.segments[1:], 0
+		l.saveCheckpoint()
+		return s.remove()
+	}
+	l.saveCheckpoint()
+	return nil
+}
+
+// close syncs and closes the segments.
+func (l *segmentLog) close() (err error) {
+	for _, s := range l.segments {
+		if e := s.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	l.segments = nil
+	if l.checkpoint != nil {
+		if e := l.checkpoint.close(); e != nil && err == nil {
+			err = e
+		}
+		l.checkpoint = nil
+	}
+	return
+}
+
+func (l *segmentLog) createSegment(first uint64, size int) error {
+	s, err := openSegment(filepath.Join(l.dir, fmt.Sprintf("%020d%s", first, segmentExt)), first, size)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, s)
+	return nil
+}
+
+func (l *segmentLog) saveCheckpoint() {
+	b := l.checkpoint.data
+	binary.BigEndian.PutUint64(b, l.head)
+	binary.BigEndian.PutUint64(b[8:], l.segments[0].first)
+	binary.BigEndian.PutUint64(b[16:], uint64(l.offset))
+	binary.BigEndian.PutUint32(b[24:], crc32.Checksum(b[:24], crcTable))
+}
+
+func decodeCheckpoint(b []byte) (head, first uint64, offset int, ok bool) {
+	if crc32.Checksum(b[:24], crcTable) != binary.BigEndian.Uint32(b[24:]) {
+		return
+	}
+	return binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:]), int(binary.BigEndian.Uint64(b[16:])), true
+}
+
+func openSegment(path string, first uint64, size int) (*segment, error) {
+	m, err := openMmapFile(path, size)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{mmapFile: m, first: first}, nil
+}
+
+// record reads the record at the offset, and returns the value and the offset of the next record.
+// io.EOF is returned at the end of the segment, ErrCorrupted is returned if the crc32 is mismatched.
+func (s *segment) record(offset int) ([]byte, int, error) {
+	if offset+recordHeaderSize > len(s.data) {
+		return nil, offset, io.EOF
+	}
+	sum, n := binary.BigEndian.Uint32(s.data[offset:]), binary.BigEndian.Uint32(s.data[offset+4:])
+	if sum == 0 && n == 0 {
+		return nil, offset, io.EOF
+	}
+	end := offset + recordHeaderSize + int(n)
+	if end > len(s.data) || crc32.Checksum(s.data[offset+4:end], crcTable) != sum {
+		return nil, offset, ErrCorrupted
+	}
+	return s.data[offset+recordHeaderSize : end], end, nil
+}
+
+// write writes the record at the offset, and returns the offset of the next record.
+func (s *segment) write(offset int, value []byte) int {
+	end := offset + recordHeaderSize + len(value)
+	binary.BigEndian.PutUint32(s.data[offset+4:], uint32(len(value)))
+	copy(s.data[offset+recordHeaderSize:], value)
+	binary.BigEndian.PutUint32(s.data[offset:], crc32.Checksum(s.data[offset+4:end], crcTable))
+	return end
+}
+
+// truncate zeroes the segment from the offset.
+func (s *segment) truncate(offset int) {
+	for i := offset; i < len(s.data); i++ {
+		s.data[i] = 0
+	}
+}
+
+// openMmapFile maps the file, it's extended to the size if it's smaller.
+func openMmapFile(path string, size int) (*mmapFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() < int64(size) {
+		err = f.Truncate(int64(size))
+	} else if err == nil {
+		size = int(fi.Size())
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	data, err := mmap(f, size)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &mmapFile{f: f, data: data}, nil
+}
+
+func (m *mmapFile) sync() error {
+	return msync(m.data)
+}
+
+func (m *mmapFile) close() error {
+	err := m.sync()
+	if e := munmap(m.data); e != nil && err == nil {
+		err = e
+	}
+	if e := m.f.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func (m *mmapFile) remove() error {
+	_ = munmap(m.data)
+	_ = m.f.Close()
+	return os.Remove(m.f.Name())
+}
@@ -0,0 +1,136 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueSegmentLog(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file, WithSegmentLog(), WithSegmentSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = q.Drop() }()
+
+	// Each segment holds 9 items: 256 / (8 + 18).
+	for i := 1; i <= 100; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if segments, _ := filepath.Glob(filepath.Join(file, "*"+segmentExt)); len(segments) != 12 {
+		t.Fatalf("Expected 12 segments, got %d", len(segments))
+	}
+
+	for i := 1; i <= 50; i++ {
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.ID != uint64(i) || item.ToString() != fmt.Sprintf("value for item %03d", i) {
+			t.Fatalf("Expected item %d, got %d %s", i, item.ID, item.ToString())
+		}
+	}
+
+	// The consumed segments are deleted.
+	if segments, _ := filepath.Glob(filepath.Join(file, "*"+segmentExt)); len(segments) != 7 {
+		t.Fatalf("Expected 7 segments, got %d", len(segments))
+	}
+	if item, err := q.PeekByOffset(10); err != nil || item.ID != 61 || item.ToString() != "value for item 061" {
+		t.Fatalf("Expected item 61, got %v %v", item, err)
+	}
+	if item, err := q.PeekByID(51); err != nil || item.ToString() != "value for item 051" {
+		t.Fatalf("Expected item 51, got %v %v", item, err)
+	}
+	if _, err = q.PeekByID(50); err != ErrOutOfBounds {
+		t.Fatalf("Expected to get out of bounds error, got %v", err)
+	}
+	if _, err = q.Update(51, []byte("value")); err != ErrUnsupported {
+		t.Fatalf("Expected to get unsupported error, got %v", err)
+	}
+
+	// The read offset and the items persist, an item larger than the segment size is written to its own segment.
+	large := make([]byte, 1000)
+	if _, err = q.Enqueue(large); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.Enqueue(nil); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	if q, err = OpenQueue(file, WithSegmentLog(), WithSegmentSize(256)); err != nil {
+		t.Fatal(err)
+	}
+	if q.Length() != 52 {
+		t.Fatalf("Expected queue length of 52, got %d", q.Length())
+	}
+	for i := 51; i <= 102; i++ {
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i <= 100 && item.ToString() != fmt.Sprintf("value for item %03d", i) ||
+			i == 101 && len(item.Value) != 1000 || i == 102 && len(item.Value) != 0 {
+			t.Fatalf("Expected item %d, got %d %s", i, item.ID, item.ToString())
+		}
+	}
+	if _, err = q.Dequeue(); err != ErrEmpty {
+		t.Fatalf("Expected to get empty error, got %v", err)
+	}
+	if segments, _ := filepath.Glob(filepath.Join(file, "*"+segmentExt)); len(segments) != 1 {
+		t.Fatalf("Expected 1 segment, got %d", len(segments))
+	}
+
+	// The LevelDB queue can't open the segment log.
+	if _, err = OpenQueue(file); err != ErrIncompatibleType {
+		t.Fatalf("Expected to get incompatible type error, got %v", err)
+	}
+}
+
+func TestQueueSegmentLogTornRecord(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file, WithSegmentLog(), WithSegmentSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = q.Drop() }()
+
+	for i := 1; i <= 3; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = q.Dequeue(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// Corrupt the last record.
+	f, err := os.OpenFile(filepath.Join(file, fmt.Sprintf("%020d%s", 1, segmentExt)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("x"), 2*(recordHeaderSize+16)+recordHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	if q, err = OpenQueue(file, WithSegmentLog(), WithSegmentSize(1024)); err != nil {
+		t.Fatal(err)
+	}
+	if q.Length() != 1 {
+		t.Fatalf("Expected queue length of 1, got %d", q.Length())
+	}
+	if _, err = q.EnqueueString("value for item 4"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"value for item 2", "value for item 4"} {
+		if item, err := q.Dequeue(); err != nil || item.ToString() != expected {
+			t.Fatalf("Expected %s, got %v %v", expected, item, err)
+		}
+	}
+}
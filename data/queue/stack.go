@@ -2,6 +2,7 @@ package queue
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"github.com/angenalZZZ/gofunc/f"
 	"os"
@@ -18,6 +19,7 @@ type Stack struct {
 	head    uint64
 	tail    uint64
 	isOpen  bool
+	notify  *notifier
 }
 
 // OpenStack opens a stack if one exists at the given directory. If one
@@ -32,6 +34,7 @@ func OpenStack(dataDir string) (*Stack, error) {
 		head:    0,
 		tail:    0,
 		isOpen:  false,
+		notify:  newNotifier(),
 	}
 
 	// Open database for the stack.
@@ -46,6 +49,7 @@ func OpenStack(dataDir string) (*Stack, error) {
 		return s, err
 	}
 	if !ok {
+		_ = s.db.Close()
 		return s, ErrIncompatibleType
 	}
 
@@ -56,6 +60,7 @@ func OpenStack(dataDir string) (*Stack, error) {
 
 // Push adds an item to the stack.
 func (s *Stack) Push(value []byte) (*Item, error) {
+	defer s.notify.broadcast()
 	s.Lock()
 	defer s.Unlock()
 
@@ -147,6 +152,16 @@ func (s *Stack) Pop() (*Item, error) {
 	return item, nil
 }
 
+// PopWait removes the next item in the stack and returns it,
+// it waits for an item to be pushed if the stack is empty.
+func (s *Stack) PopWait(ctx context.Context) (item *Item, err error) {
+	err = s.notify.wait(ctx, func() error {
+		item, err = s.Pop()
+		return err
+	})
+	return
+}
+
 // Peek returns the next item in the stack without removing it.
 func (s *Stack) Peek() (*Item, error) {
 	s.RLock()
@@ -261,6 +276,7 @@ func (s *Stack) Length() uint64 {
 
 // Close closes the LevelDB database of the stack.
 func (s *Stack) Close() error {
+	defer s.notify.broadcast()
 	s.Lock()
 	defer s.Unlock()
 
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -588,6 +589,24 @@ func TestStackOutOfBounds(t *testing.T) {
 	}
 }
 
+func TestStackPopWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Drop()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = s.PushString("value for item 1")
+	}()
+	item, err := s.PopWait(context.Background())
+	if err != nil || item.ToString() != "value for item 1" {
+		t.Fatalf("Expected value for item 1, got %+v %v", item, err)
+	}
+}
+
 func BenchmarkStackPush(b *testing.B) {
 	// Open test database
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"context"
+	"sync"
+)
+
+// notifier wakes the waiters of a blocking dequeue with a condition variable.
+// It has its own lock, broadcast is called after the lock of the queue is released.
+type notifier struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+}
+
+func newNotifier() *notifier {
+	n := new(notifier)
+	n.cond = sync.NewCond(&n.mu)
+	return n
+}
+
+// broadcast wakes all the waiters, it's called after an item is added or the queue is closed.
+func (n *notifier) broadcast() {
+	n.mu.Lock()
+	n.cond.Broadcast()
+	n.mu.Unlock()
+}
+
+// wait calls try until it returns an error other than ErrEmpty, or the ctx is done.
+func (n *notifier) wait(ctx context.Context, try func() error) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Wake the waiter when the ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.broadcast()
+		case <-stop:
+		}
+	}()
+
+	for {
+		if err := try(); err != ErrEmpty {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n.cond.Wait()
+	}
+}
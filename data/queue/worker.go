@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/angenalZZZ/gofunc/f"
+)
+
+// Worker runs the goroutines that dequeue items and handle them, it's drained
+// gracefully on the death signals: stops dequeuing and waits for the handled items.
+type Worker struct {
+	// Concurrency is the number of goroutines that handle the items.
+	// Optional. Default: runtime.NumCPU()
+	Concurrency int
+	// Signals are the death signals to drain the worker.
+	// Optional. Default: SIGINT, SIGTERM
+	Signals []os.Signal
+	// PanicHandler is called with the item and the recovered value when the handler panics.
+	// Optional. Default: prints the panic to the stderr.
+	PanicHandler func(item interface{}, err interface{})
+
+	dequeue func(ctx context.Context) (interface{}, error)
+	handler func(item interface{})
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+}
+
+// NewWorker creates a worker, the dequeue is a blocking dequeue of a queue structure:
+//
+//	w := queue.NewWorker(func(ctx context.Context) (interface{}, error) {
+//		return q.DequeueWait(ctx)
+//	}, func(item interface{}) {
+//		fmt.Println(item.(*queue.Item).ToString())
+//	})
+func NewWorker(dequeue func(ctx context.Context) (interface{}, error), handler func(item interface{})) *Worker {
+	return &Worker{
+		Concurrency: runtime.NumCPU(),
+		Signals:     []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+		dequeue:     dequeue,
+		handler:     handler,
+	}
+}
+
+// Run dequeues items and handles them until the ctx is done, Stop is called or a death signal
+// is received, then it waits for the handled items and returns. It returns the error of the
+// dequeue, e.g. ErrDBClosed when the queue is closed.
+func (w *Worker) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w.mu.Lock()
+	w.cancel = cancel
+	w.mu.Unlock()
+
+	// Drain the worker on the death signals.
+	if len(w.Signals) > 0 {
+		death := f.NewDeath(w.Signals...)
+		defer death.FallOnSword()
+		go death.WaitForDeathWithFunc(cancel)
+	}
+
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	var wg sync.WaitGroup
+	pool, err := f.GoWithFunc(concurrency, func(item interface{}) {
+		defer wg.Done()
+		w.handle(item)
+	})
+	if err != nil {
+		return err
+	}
+	defer pool.Release()
+
+	for {
+		item, err := w.dequeue(ctx)
+		if err != nil {
+			wg.Wait()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		if err = pool.Invoke(item); err != nil {
+			wg.Done()
+			wg.Wait()
+			return err
+		}
+	}
+}
+
+// Stop drains the worker, Run returns after the handled items.
+func (w *Worker) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// handle calls the handler with the item, and recovers the panic.
+func (w *Worker) handle(item interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			if w.PanicHandler != nil {
+				w.PanicHandler(item, err)
+			} else {
+				_, _ = fmt.Fprintf(os.Stderr, "queue/worker: panic handling item %v: %v\n", item, err)
+			}
+		}
+	}()
+	w.handler(item)
+}
@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorker(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 100; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var handled, panics int32
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	w := NewWorker(func(ctx context.Context) (interface{}, error) {
+		return q.DequeueWait(ctx)
+	}, func(item interface{}) {
+		value := item.(*Item).ToString()
+		if value == "value for item 50" {
+			panic("handler panic")
+		}
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		seen[value] = true
+		mu.Unlock()
+		atomic.AddInt32(&handled, 1)
+	})
+	w.Concurrency = 4
+	w.Signals = nil
+	w.PanicHandler = func(item interface{}, err interface{}) {
+		atomic.AddInt32(&panics, 1)
+	}
+
+	done := make(chan error)
+	go func() { done <- w.Run(context.Background()) }()
+
+	// Stop drains the worker after the items are handled.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&handled)+atomic.LoadInt32(&panics) < 100 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	w.Stop()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if handled != 99 || panics != 1 || len(seen) != 99 {
+		t.Fatalf("Expected 99 handled items and 1 panic, got %d and %d", handled, panics)
+	}
+
+	// Run returns the dequeue error.
+	q.Close()
+	if err = w.Run(context.Background()); err != ErrDBClosed {
+		t.Fatalf("Expected to get database closed error, got %v", err)
+	}
+}
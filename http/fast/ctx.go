@@ -404,8 +404,54 @@ func (ctx *Ctx) FormValue(key string) (value string) {
 	return GetString(ctx.C.FormValue(key))
 }
 
-// Fresh is not implemented yet, pull requests are welcome!
+// Fresh returns true when the response is still "fresh" in the client's cache,
+// it checks the If-None-Match and If-Modified-Since request headers against the ETag and Last-Modified
+// response headers, a request with Cache-Control: no-cache is never fresh.
+// https://tools.ietf.org/html/rfc7232
 func (ctx *Ctx) Fresh() bool {
+	modifiedSince := ctx.GetHeader("If-Modified-Since")
+	noneMatch := ctx.GetHeader("If-None-Match")
+	// unconditional request
+	if modifiedSince == "" && noneMatch == "" {
+		return false
+	}
+	// always stale when Cache-Control: no-cache
+	if cc := ctx.GetHeader("Cache-Control"); cc != "" && strings.Contains(strings.ToLower(cc), "no-cache") {
+		return false
+	}
+
+	if noneMatch != "" && noneMatch != "*" {
+		// If-None-Match takes precedence over If-Modified-Since
+		etag := GetString(ctx.C.Response.Header.Peek("ETag"))
+		return etag != "" && etagMatch(etag, noneMatch)
+	}
+
+	if modifiedSince != "" {
+		lastModified := ctx.C.Response.Header.Peek("Last-Modified")
+		if len(lastModified) == 0 {
+			return false
+		}
+		lastModifiedTime, err := fasthttp.ParseHTTPDate(lastModified)
+		if err != nil {
+			return false
+		}
+		modifiedSinceTime, err := fasthttp.ParseHTTPDate([]byte(modifiedSince))
+		if err != nil {
+			return false
+		}
+		return !lastModifiedTime.After(modifiedSinceTime)
+	}
+	return true
+}
+
+// etagMatch checks the weak comparison of the etag with a list of If-None-Match.
+func etagMatch(etag, noneMatch string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(noneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
 	return false
 }
 
@@ -842,7 +888,7 @@ func (ctx *Ctx) Subdomains(offset ...int) []string {
 	return subdomains
 }
 
-// Stale is not implemented yet, pull requests are welcome!
+// Stale is the opposite of Fresh.
 func (ctx *Ctx) Stale() bool {
 	return !ctx.Fresh()
 }
@@ -0,0 +1,297 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	datacache "github.com/angenalZZZ/gofunc/data/cache"
+	"github.com/angenalZZZ/gofunc/data/cache/store"
+	"github.com/angenalZZZ/gofunc/http/fast"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	// HeaderXCache is the response header of a cache HIT or MISS
+	HeaderXCache = "X-Cache"
+	// localsTags is the key of the Ctx.Locals for the cache tags of a response
+	localsTags = "fast_cache_tags"
+	// localsSkip is the key of the Ctx.Locals to skip caching a response
+	localsSkip = "fast_cache_skip"
+)
+
+// Config defines the config for Cache middleware
+type Config struct {
+	// Filter defines a function to skip middleware.
+	// Optional. Default: nil
+	Filter func(*fast.Ctx) bool
+	// Cache stores the responses, e.g. a chain of memory and redis.
+	// Required.
+	Cache datacache.Interface
+	// Expiration is the time to live of a response without Cache-Control max-age.
+	// Optional. Default: 1 minute
+	Expiration time.Duration
+	// Queries is the whitelist of the query keys in the cache key, the others are ignored.
+	// Optional. Default: nil
+	Queries []string
+	// Vary is the request headers in the cache key, they are added to the Vary response header.
+	// Optional. Default: nil
+	Vary []string
+	// KeyPrefix is the prefix of the cache keys.
+	// Optional. Default: "fast_cache:"
+	KeyPrefix string
+}
+
+// entry a cached response
+type entry struct {
+	Status  int        `msgpack:"s"`
+	Headers [][]string `msgpack:"h"`
+	Body    []byte     `msgpack:"b"`
+}
+
+// the cacheable status codes by default (rfc7231#section-6.1)
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+// the response headers not cached
+var skipHeaders = map[string]bool{"Date": true, "Content-Length": true, HeaderXCache: true}
+
+// Tag attaches cache tags to the response, it's purged by the tags.
+//
+//	app.Get("/books/:id", func(c *fast.Ctx) {
+//	  cache.Tag(c, "books", "book:"+c.Params("id"))
+//	})
+func Tag(c *fast.Ctx, tags ...string) {
+	if v, ok := c.Locals(localsTags).([]string); ok {
+		tags = append(v, tags...)
+	}
+	c.Locals(localsTags, tags)
+}
+
+// Skip skips caching the response.
+func Skip(c *fast.Ctx) {
+	c.Locals(localsSkip, true)
+}
+
+// New middleware.
+//
+//	app.Use(cache.New(cache.Config{
+//	  Cache:   datacache.New(store.NewMemory(nil)),
+//	  Queries: []string{"page"},
+//	}))
+func New(config ...Config) func(*fast.Ctx) {
+	// Init config
+	var cfg Config
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	if cfg.Cache == nil {
+		panic("[cache] Config.Cache is required")
+	}
+	if cfg.Expiration <= 0 {
+		cfg.Expiration = time.Minute
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = "fast_cache:"
+	}
+	vary := strings.Join(cfg.Vary, ", ")
+
+	// Return middleware handler
+	return func(c *fast.Ctx) {
+		// Filter request to skip middleware
+		method := c.Method()
+		if (cfg.Filter != nil && cfg.Filter(c)) || (method != "GET" && method != "HEAD") {
+			c.Next()
+			return
+		}
+		key := cfg.key(c)
+		cacheControl := strings.ToLower(c.GetHeader("Cache-Control"))
+
+		// Serve the cached response, unless the client requires revalidation
+		if !hasDirective(cacheControl, "no-cache") {
+			if e := cfg.get(key); e != nil {
+				e.write(c)
+				c.SetHeader(HeaderXCache, "HIT")
+				if c.Fresh() {
+					c.C.Response.ResetBody()
+					c.Status(304)
+				}
+				return
+			}
+		}
+
+		c.Next()
+
+		if vary != "" {
+			c.Vary(cfg.Vary...)
+		}
+		resp := &c.C.Response
+		if skip, _ := c.Locals(localsSkip).(bool); skip || !cacheableStatus[resp.StatusCode()] ||
+			hasDirective(cacheControl, "no-store") || len(resp.Header.Peek("Set-Cookie")) > 0 {
+			return
+		}
+		respCacheControl := strings.ToLower(fast.GetString(resp.Header.Peek("Cache-Control")))
+		if hasDirective(respCacheControl, "no-store") || hasDirective(respCacheControl, "private") {
+			return
+		}
+		expiration := maxAge(respCacheControl, cfg.Expiration)
+		if expiration <= 0 {
+			return
+		}
+
+		body := resp.Body()
+		if len(resp.Header.Peek("ETag")) == 0 {
+			c.SetHeader("ETag", fmt.Sprintf(`W/"%x-%x"`, len(body), crc32.ChecksumIEEE(body)))
+		}
+		e := &entry{Status: resp.StatusCode(), Body: body}
+		resp.Header.VisitAll(func(k, v []byte) {
+			if name := string(k); !skipHeaders[name] {
+				e.Headers = append(e.Headers, []string{name, string(v)})
+			}
+		})
+		tags, _ := c.Locals(localsTags).([]string)
+		if data, err := msgpack.Marshal(e); err == nil {
+			_ = cfg.Cache.Set(key, data, &store.Options{Expiration: expiration, Tags: tags})
+		}
+
+		c.SetHeader(HeaderXCache, "MISS")
+		if c.Fresh() {
+			resp.ResetBody()
+			c.Status(304)
+		}
+	}
+}
+
+// key derives the cache key from the method, the path, the whitelist queries and the vary headers.
+func (cfg *Config) key(c *fast.Ctx) string {
+	var b strings.Builder
+	b.WriteString(cfg.KeyPrefix)
+	b.WriteString(c.Method())
+	b.WriteByte(':')
+	b.WriteString(c.Path())
+	if len(cfg.Queries) > 0 {
+		values := url.Values{}
+		for _, k := range cfg.Queries {
+			if v := c.Query(k); v != "" {
+				values.Set(k, v)
+			}
+		}
+		if len(values) > 0 {
+			b.WriteByte('?')
+			b.WriteString(values.Encode()) // sorted by key
+		}
+	}
+	for _, h := range cfg.Vary {
+		b.WriteByte('|')
+		b.WriteString(c.GetHeader(h))
+	}
+	return b.String()
+}
+
+// get gets the cached response.
+func (cfg *Config) get(key string) *entry {
+	v, err := cfg.Cache.Get(key)
+	if err != nil {
+		return nil
+	}
+	var data []byte
+	switch v := v.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return nil
+	}
+	e := new(entry)
+	if msgpack.Unmarshal(data, e) != nil {
+		return nil
+	}
+	return e
+}
+
+// write writes the cached response.
+func (e *entry) write(c *fast.Ctx) {
+	resp := &c.C.Response
+	resp.Reset()
+	seen := make(map[string]bool, len(e.Headers))
+	for _, h := range e.Headers {
+		if len(h) != 2 {
+			continue
+		}
+		if seen[h[0]] {
+			resp.Header.Add(h[0], h[1])
+		} else {
+			resp.Header.Set(h[0], h[1])
+			seen[h[0]] = true
+		}
+	}
+	resp.SetStatusCode(e.Status)
+	resp.SetBody(e.Body)
+}
+
+// hasDirective checks the Cache-Control directive.
+func hasDirective(cacheControl, directive string) bool {
+	for _, d := range strings.Split(cacheControl, ",") {
+		d = strings.TrimSpace(d)
+		if d == directive || strings.HasPrefix(d, directive+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAge gets the expiration of the s-maxage or max-age directive.
+func maxAge(cacheControl string, expiration time.Duration) time.Duration {
+	ages := map[string]time.Duration{}
+	for _, d := range strings.Split(cacheControl, ",") {
+		d = strings.TrimSpace(d)
+		if i := strings.IndexByte(d, '='); i > 0 {
+			if n, err := strconv.Atoi(strings.Trim(d[i+1:], `"`)); err == nil {
+				ages[d[:i]] = time.Duration(n) * time.Second
+			}
+		}
+	}
+	if d, ok := ages["s-maxage"]; ok {
+		return d
+	}
+	if d, ok := ages["max-age"]; ok {
+		return d
+	}
+	return expiration
+}
+
+// Purge returns an admin handler that purges the cached responses by tags.
+//
+//	app.Post("/admin/cache/purge", cache.Purge(cfg.Cache))
+//	POST /admin/cache/purge?tags=books,book:1
+func Purge(cache datacache.Interface) func(*fast.Ctx) {
+	return func(c *fast.Ctx) {
+		var tags []string
+		for _, tag := range strings.Split(c.Query("tags"), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			sendJSON(c, 400, map[string]string{"error": "tags are required"})
+			return
+		}
+		sort.Strings(tags)
+		if err := cache.Invalidate(store.InvalidateOptions{Tags: tags}); err != nil {
+			sendJSON(c, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		sendJSON(c, 200, map[string][]string{"purged": tags})
+	}
+}
+
+func sendJSON(c *fast.Ctx, status int, v interface{}) {
+	data, _ := json.Marshal(v)
+	c.C.Response.Header.SetContentType("application/json")
+	c.Status(status).SendBytes(data)
+}
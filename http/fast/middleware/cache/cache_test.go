@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	datacache "github.com/angenalZZZ/gofunc/data/cache"
+	"github.com/angenalZZZ/gofunc/data/cache/store"
+	"github.com/angenalZZZ/gofunc/http/fast"
+)
+
+func TestCache(t *testing.T) {
+	calls := 0
+	cache := datacache.New(store.NewMemory(nil))
+	app := fast.New()
+	app.Use(New(Config{Cache: cache, Queries: []string{"page"}, Vary: []string{"Accept-Language"}}))
+	app.Get("/books", func(c *fast.Ctx) {
+		calls++
+		Tag(c, "books")
+		c.SetHeader("Content-Type", "text/plain")
+		c.SendString("books " + c.Query("page") + " " + c.GetHeader("Accept-Language"))
+	})
+	app.Get("/private", func(c *fast.Ctx) {
+		calls++
+		c.SetHeader("Cache-Control", "private")
+		c.SendString("private")
+	})
+	app.Post("/admin/cache/purge", Purge(cache))
+
+	do := func(method, url string, headers ...string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, url, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, body := do("GET", "http://localhost/books?page=1&x=1")
+	etag := res.Header.Get("ETag")
+	if res.Header.Get(HeaderXCache) != "MISS" || body != "books 1 " || etag == "" || calls != 1 {
+		t.Fatalf("miss %s %q %s %d", res.Header.Get(HeaderXCache), body, etag, calls)
+	}
+	// The query not in the whitelist is ignored.
+	res, body = do("GET", "http://localhost/books?x=2&page=1")
+	if res.Header.Get(HeaderXCache) != "HIT" || body != "books 1 " || res.Header.Get("ETag") != etag ||
+		res.Header.Get("Content-Type") != "text/plain" || res.Header.Get("Vary") != "Accept-Language" || calls != 1 {
+		t.Fatalf("hit %s %q %v %d", res.Header.Get(HeaderXCache), body, res.Header, calls)
+	}
+	// The vary header and the query in the whitelist are in the key.
+	if _, body = do("GET", "http://localhost/books?page=1", "Accept-Language", "zh"); body != "books 1 zh" || calls != 2 {
+		t.Fatalf("vary %q %d", body, calls)
+	}
+	if _, body = do("GET", "http://localhost/books?page=2"); body != "books 2 " || calls != 3 {
+		t.Fatalf("query %q %d", body, calls)
+	}
+
+	// If-None-Match
+	if res, body = do("GET", "http://localhost/books?page=1", "If-None-Match", etag); res.StatusCode != 304 || body != "" {
+		t.Fatalf("if-none-match %d %q", res.StatusCode, body)
+	}
+	if res, _ = do("GET", "http://localhost/books?page=1", "If-None-Match", `W/"0-0"`); res.StatusCode != 200 {
+		t.Fatalf("if-none-match %d", res.StatusCode)
+	}
+	// Cache-Control: no-cache revalidates.
+	if res, _ = do("GET", "http://localhost/books?page=1", "Cache-Control", "no-cache"); res.Header.Get(HeaderXCache) != "MISS" || calls != 4 {
+		t.Fatalf("no-cache %s %d", res.Header.Get(HeaderXCache), calls)
+	}
+
+	// The private response is not cached.
+	do("GET", "http://localhost/private")
+	if res, _ = do("GET", "http://localhost/private"); res.Header.Get(HeaderXCache) != "" || calls != 6 {
+		t.Fatalf("private %s %d", res.Header.Get(HeaderXCache), calls)
+	}
+
+	// Purge by tag.
+	if res, body = do("POST", "http://localhost/admin/cache/purge?tags=books"); res.StatusCode != 200 || body != `{"purged":["books"]}` {
+		t.Fatalf("purge %d %q", res.StatusCode, body)
+	}
+	if res, _ = do("GET", "http://localhost/books?page=1"); res.Header.Get(HeaderXCache) != "MISS" || calls != 7 {
+		t.Fatalf("purged %s %d", res.Header.Get(HeaderXCache), calls)
+	}
+	if res, _ = do("POST", "http://localhost/admin/cache/purge"); res.StatusCode != 400 {
+		t.Fatalf("purge without tags %d", res.StatusCode)
+	}
+}
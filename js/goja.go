@@ -17,6 +17,7 @@ import (
 	"github.com/angenalZZZ/gofunc/f"
 	ht "github.com/angenalZZZ/gofunc/http"
 	"github.com/angenalZZZ/gofunc/log"
+	nat "github.com/angenalZZZ/gofunc/rpc/nats"
 	"github.com/dop251/goja"
 	"github.com/go-redis/redis/v7"
 	"github.com/go-resty/resty/v2"
@@ -605,6 +606,7 @@ func Db(r *goja.Runtime, d *sqlx.DB, dbs ...string) {
 //  console.log(nats.subject)
 // 	nats.pub('data'); nats.pub('subj','data')
 // 	nats.req('data'); nats.pub('data',3); nats.pub('subj','data',3) // timeout:3s
+// The messages are wrapped with the envelope nat.Seal if it is set.
 func Nats(r *goja.Runtime, nc *nats.Conn, subj string) {
 	natsObj := r.NewObject()
 
@@ -615,13 +617,13 @@ func Nats(r *goja.Runtime, nc *nats.Conn, subj string) {
 		v, l := goja.Null(), len(c.Arguments)
 		if l == 1 && subj != "" {
 			data := c.Arguments[0].String()
-			if err := nc.Publish(subj, f.Bytes(data)); err != nil {
+			if err := nat.Publish(nc, subj, f.Bytes(data)); err != nil {
 				return r.ToValue(err)
 			}
 			return r.ToValue(0)
 		} else if l == 2 {
 			subj, data := c.Arguments[0].String(), c.Arguments[1].String()
-			if err := nc.Publish(subj, f.Bytes(data)); err != nil {
+			if err := nat.Publish(nc, subj, f.Bytes(data)); err != nil {
 				return r.ToValue(err)
 			}
 			return r.ToValue(0)
@@ -633,7 +635,7 @@ func Nats(r *goja.Runtime, nc *nats.Conn, subj string) {
 		v, l := goja.Null(), len(c.Arguments)
 		if l == 1 && subj != "" {
 			data := c.Arguments[0].String()
-			msg, err := nc.Request(subj, f.Bytes(data), 3*time.Second)
+			msg, err := nat.Request(nc, subj, f.Bytes(data), 3*time.Second)
 			if err != nil {
 				return r.ToValue(err)
 			}
@@ -643,7 +645,7 @@ func Nats(r *goja.Runtime, nc *nats.Conn, subj string) {
 			return r.ToValue(string(msg.Data))
 		} else if l == 2 && subj != "" {
 			data, ms := c.Arguments[0].String(), c.Arguments[1].ToInteger()
-			msg, err := nc.Request(subj, f.Bytes(data), time.Duration(ms)*time.Second)
+			msg, err := nat.Request(nc, subj, f.Bytes(data), time.Duration(ms)*time.Second)
 			if err != nil {
 				return r.ToValue(err)
 			}
@@ -653,7 +655,7 @@ func Nats(r *goja.Runtime, nc *nats.Conn, subj string) {
 			return r.ToValue(string(msg.Data))
 		} else if l == 3 {
 			subj, data, ms := c.Arguments[0].String(), c.Arguments[1].String(), c.Arguments[2].ToInteger()
-			msg, err := nc.Request(subj, f.Bytes(data), time.Duration(ms)*time.Second)
+			msg, err := nat.Request(nc, subj, f.Bytes(data), time.Duration(ms)*time.Second)
 			if err != nil {
 				return r.ToValue(err)
 			}
@@ -940,7 +942,10 @@ func Ajax(r *goja.Runtime) {
 //  var val = cache.get("key")
 //  var has = cache.has("key")
 //  cache.set("key",123)
+//  cache.set("key",123,60) // expires after 60 seconds
 //  cache.del("key")
+//  var keys = cache.keys()
+//  cache.each(function(key, val){ return true }) // return false to stop
 //  cache.reset(); cache.clear(); cache.clear('cache-01');
 //  try { cache.save('cache-01'); cache.load('cache-01'); } catch (e) { throw(e) }
 func Cache(r *goja.Runtime, cache *fastcache.Cache, cacheDir string, maxBytes ...int) {
@@ -975,8 +980,8 @@ func Cache(r *goja.Runtime, cache *fastcache.Cache, cacheDir string, maxBytes ..
 			return v
 		}
 
-		p := cache.Get(nil, f.Bytes(key))
-		if p == nil || len(p) == 0 {
+		p, _ := cache.GetAny(nil, f.Bytes(key))
+		if len(p) == 0 {
 			return v
 		}
 
@@ -998,11 +1003,18 @@ func Cache(r *goja.Runtime, cache *fastcache.Cache, cacheDir string, maxBytes ..
 			return v
 		}
 
-		val := c.Arguments[1].Export()
-		if p, err := json.Marshal(val); err != nil {
-			cache.Set(f.Bytes(key), []byte{})
+		val, ttl := c.Arguments[1].Export(), time.Duration(0)
+		if l > 2 {
+			ttl = time.Duration(c.Arguments[2].ToFloat() * float64(time.Second))
+		}
+		p, err := json.Marshal(val)
+		if err != nil {
+			p = []byte{}
+		}
+		if len(p) <= fastcache.MaxSubvalueLen {
+			cache.SetWithTTL(f.Bytes(key), p, ttl)
 		} else {
-			cache.Set(f.Bytes(key), p)
+			cache.SetBigWithTTL(f.Bytes(key), p, ttl)
 		}
 
 		return v
@@ -1039,6 +1051,37 @@ func Cache(r *goja.Runtime, cache *fastcache.Cache, cacheDir string, maxBytes ..
 		return v
 	})
 
+	_ = cObj.Set("keys", func(c goja.FunctionCall) goja.Value {
+		keys := make([]interface{}, 0)
+		cache.Visit(func(k, v []byte) bool {
+			keys = append(keys, string(k))
+			return true
+		})
+		return r.ToValue(keys)
+	})
+
+	_ = cObj.Set("each", func(c goja.FunctionCall) goja.Value {
+		if len(c.Arguments) < 1 {
+			return goja.Undefined()
+		}
+		fn, ok := goja.AssertFunction(c.Arguments[0])
+		if !ok {
+			panic("cache.each requires a function")
+		}
+		cache.Visit(func(k, v []byte) bool {
+			var val interface{}
+			if err := json.Unmarshal(v, &val); err != nil {
+				return true
+			}
+			res, err := fn(goja.Undefined(), r.ToValue(string(k)), r.ToValue(val))
+			if err != nil {
+				panic(err.Error())
+			}
+			return goja.IsUndefined(res) || res.ToBoolean()
+		})
+		return goja.Undefined()
+	})
+
 	_ = cObj.Set("reset", func(c goja.FunctionCall) goja.Value {
 		cache.Reset()
 		return goja.Undefined()
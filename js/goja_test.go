@@ -3,12 +3,14 @@ package js
 import (
 	"encoding/xml"
 	"fmt"
+	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/angenalZZZ/gofunc/data"
 
 	"github.com/angenalZZZ/gofunc/configfile"
+	"github.com/angenalZZZ/gofunc/data/cache/fastcache"
 	"github.com/angenalZZZ/gofunc/data/cache/store"
 	"github.com/angenalZZZ/gofunc/data/id"
 	"github.com/angenalZZZ/gofunc/data/random"
@@ -194,6 +196,9 @@ console.log("key =", cache.get("key"))
 cache.set("key",123)
 console.log("key =", cache.get("key"))
 cache.set("key",123456)
+cache.set("big",new Array(100000).join("x"),60)
+console.log("keys =", cache.keys().length, cache.get("big").length)
+cache.each(function(key, val){ console.log("each", key, typeof val); return false })
 try { cache.save(); cache.load(); } catch (e) { throw(e) }
 console.log("key =",cache.get("key"))
 console.log("ok!")
@@ -205,6 +210,32 @@ cache.clear()
 	}
 }
 
+func TestCacheValueSize(t *testing.T) {
+	r := goja.New()
+	cache := fastcache.New(32 * 1024 * 1024)
+	Cache(r, cache, filepath.Join(os.TempDir(), ".nats01"))
+
+	// The small values are stored by Set, the values larger than fastcache.MaxSubvalueLen by SetBig.
+	script := `
+cache.set("small", 123)
+cache.set("big", new Array(100000).join("x"), 60)
+cache.get("small") === 123 && cache.get("big").length === 99999 && cache.keys().length === 2
+`
+	v, err := r.RunString(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.ToBoolean() {
+		t.Fatal("cache.get returns a different value")
+	}
+	if p := cache.Get(nil, []byte("small")); string(p) != "123" {
+		t.Fatalf("cache.set small value: %q", p)
+	}
+	if p := cache.GetBig(nil, []byte("big")); len(p) != 99999+2 {
+		t.Fatalf("cache.set big value: %d", len(p))
+	}
+}
+
 func TestRedis(t *testing.T) {
 	r := goja.New()
 	defer func() { r.ClearInterrupt() }()
@@ -0,0 +1,144 @@
+package bridge
+
+import (
+	"fmt"
+
+	"github.com/angenalZZZ/gofunc/configfile"
+	"github.com/angenalZZZ/gofunc/data/queue/producer"
+	"github.com/angenalZZZ/gofunc/http/longpoll"
+	"github.com/angenalZZZ/gofunc/log"
+	nat "github.com/angenalZZZ/gofunc/rpc/nats"
+	"github.com/nats-io/nats.go"
+)
+
+// Config Defines From A Config File, the routes of a bridge:
+//
+//	routes:
+//	  - name: paid-orders
+//	    source: orders.>
+//	    filter: status=="paid"
+//	    sinks:
+//	      - {type: nats, target: billing.{subject}}
+//	      - {type: http, target: "http://localhost:8080/hooks/orders"}
+type Config struct {
+	Routes []*RouteConfig
+}
+
+// LoadConfig loads the routes from a yaml config file.
+func LoadConfig(filename string) (*Config, error) {
+	config := new(Config)
+	if err := configfile.YamlTo(filename, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Bridge subscribes to the source subjects of the routes and forwards the messages to their sinks.
+type Bridge struct {
+	// Conn the nats connection of the sources and the nats sinks.
+	Conn *nats.Conn
+	// Longpoll the manager of the longpoll sinks.
+	Longpoll *longpoll.LongpollManager
+	// Log logger for routes.
+	Log    *log.Logger
+	Routes []*Route
+
+	producers map[string]*producer.NsqProducer
+	subs      []*nats.Subscription
+}
+
+// New creates a bridge of the routes.
+func New(nc *nats.Conn, config *Config, lp *longpoll.LongpollManager) (*Bridge, error) {
+	b := &Bridge{
+		Conn:      nc,
+		Longpoll:  lp,
+		Log:       nat.Log,
+		producers: make(map[string]*producer.NsqProducer),
+	}
+	if b.Log == nil {
+		b.Log = log.InitConsole("15:04:05.000", false)
+	}
+	if err := checkLoops(config.Routes); err != nil {
+		return nil, err
+	}
+	for _, c := range config.Routes {
+		sinks := make([]Sink, 0, len(c.Sinks))
+		for _, sc := range c.Sinks {
+			sink, err := b.newSink(sc)
+			if err != nil {
+				b.Stop()
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		}
+		if len(sinks) == 0 {
+			b.Stop()
+			return nil, fmt.Errorf("[bridge] route %q has no sinks", c.Name)
+		}
+		r, err := NewRoute(c, sinks...)
+		if err != nil {
+			b.Stop()
+			return nil, err
+		}
+		r.OnError = b.logError
+		b.Routes = append(b.Routes, r)
+	}
+	return b, nil
+}
+
+// Start subscribes to the source subjects of all the routes,
+// the messages are sent to the sinks by the workers of the routes.
+// The routes are unsubscribed and stopped when a subscription fails.
+func (b *Bridge) Start() error {
+	for i, r := range b.Routes {
+		r := r
+		r.Start()
+		handler := func(msg *nats.Msg) {
+			if err := r.Dispatch(msg.Subject, msg.Data); err != nil {
+				b.logError(err)
+			}
+		}
+		var (
+			sub *nats.Subscription
+			err error
+		)
+		if r.Queue != "" {
+			sub, err = b.Conn.QueueSubscribe(r.Source, r.Queue, handler)
+		} else {
+			sub, err = b.Conn.Subscribe(r.Source, handler)
+		}
+		if err != nil {
+			b.Log.Error().Msgf("[bridge] route %q failed listening on %q > %v", r.Name, r.Source, err)
+			for _, sub := range b.subs {
+				_ = sub.Unsubscribe()
+			}
+			b.subs = nil
+			for _, r := range b.Routes[:i+1] {
+				r.Stop()
+			}
+			return err
+		}
+		b.Log.Info().Msgf("[bridge] route %q listening on %q", r.Name, r.Source)
+		b.subs = append(b.subs, sub)
+	}
+	return b.Conn.Flush()
+}
+
+// Stop unsubscribes the routes, waits for the queued messages and stops the nsq producers.
+func (b *Bridge) Stop() {
+	for _, sub := range b.subs {
+		_ = sub.Unsubscribe()
+	}
+	b.subs = nil
+	for _, r := range b.Routes {
+		r.Stop()
+	}
+	for addr, p := range b.producers {
+		p.Stop()
+		delete(b.producers, addr)
+	}
+}
+
+func (b *Bridge) logError(err error) {
+	b.Log.Error().Msgf("%v", err)
+}
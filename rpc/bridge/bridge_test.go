@@ -0,0 +1,170 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+type testSink struct {
+	sent  [][]byte
+	fails int
+}
+
+func (s *testSink) Name() string { return "test" }
+
+func (s *testSink) Send(_ string, data []byte) error {
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("failure")
+	}
+	s.sent = append(s.sent, data)
+	return nil
+}
+
+func TestRouteFilter(t *testing.T) {
+	sink := new(testSink)
+	r, err := NewRoute(&RouteConfig{
+		Source:  "orders.>",
+		Filter:  `status=="paid"`,
+		Project: map[string]string{"id": "id", "total": "price"},
+	}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Handle("orders.created", []byte(`{"id":1,"status":"new","price":10}`))
+	_ = r.Handle("orders.paid", []byte(`{"id":2,"status":"paid","price":20}`))
+	if len(sink.sent) != 1 || gjson.GetBytes(sink.sent[0], "total").Int() != 20 || gjson.GetBytes(sink.sent[0], "status").Exists() {
+		t.Fatal(sink.sent)
+	}
+	if r.Stats.Received != 2 || r.Stats.Filtered != 1 || r.Stats.Sent != 1 {
+		t.Fatal(r.Stats)
+	}
+}
+
+func TestRouteProjectOrder(t *testing.T) {
+	r, err := NewRoute(&RouteConfig{
+		Source:  "orders.>",
+		Project: map[string]string{"a.b": "price", "a": "item", "a.c": "id"},
+	}, new(testSink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		data, err := r.Apply("orders.a", []byte(`{"id":1,"price":10,"item":{"name":"x"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != `{"a":{"c":1,"b":10,"name":"x"}}` {
+			t.Fatal(string(data))
+		}
+	}
+}
+
+func TestRouteScript(t *testing.T) {
+	sink := new(testSink)
+	r, err := NewRoute(&RouteConfig{
+		Source:    "orders.>",
+		Filter:    `js: msg.price * msg.qty > 100`,
+		Transform: `js: msg.qty > 10 ? null : {id: msg.id, total: msg.price * msg.qty, subject: subject}`,
+	}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Handle("orders.a", []byte(`{"id":1,"price":10,"qty":1}`))
+	_ = r.Handle("orders.b", []byte(`{"id":2,"price":10,"qty":20}`))
+	_ = r.Handle("orders.c", []byte(`{"id":3,"price":50,"qty":3}`))
+	if len(sink.sent) != 1 || gjson.GetBytes(sink.sent[0], "total").Int() != 150 || gjson.GetBytes(sink.sent[0], "subject").String() != "orders.c" {
+		t.Fatal(sink.sent)
+	}
+}
+
+func TestRouteRetryAndBreaker(t *testing.T) {
+	sink := &testSink{fails: 2}
+	r, err := NewRoute(&RouteConfig{
+		Source:  "orders",
+		Retry:   &RetryConfig{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, MaxElapsedTime: 100 * time.Millisecond},
+		Breaker: &BreakerConfig{Failures: 1, Timeout: time.Minute},
+	}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Handle("orders", []byte(`{}`)); err != nil || len(sink.sent) != 1 {
+		t.Fatal(err)
+	}
+
+	sink.fails = 1 << 30
+	if err = r.Handle("orders", []byte(`{}`)); err == nil {
+		t.Fail()
+	}
+	// the breaker is open
+	start := time.Now()
+	if err = r.Handle("orders", []byte(`{}`)); err == nil || time.Since(start) > 50*time.Millisecond {
+		t.Fatal(err)
+	}
+}
+
+type blockingSink struct {
+	testSink
+	release chan struct{}
+}
+
+func (s *blockingSink) Send(subject string, data []byte) error {
+	<-s.release
+	return s.testSink.Send(subject, data)
+}
+
+func TestRouteDispatch(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	r, err := NewRoute(&RouteConfig{Source: "orders", QueueSize: 2}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+
+	// the worker is blocked on the first message, the next two are queued and the last one is dropped
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		err = r.Dispatch("orders", []byte(`{}`))
+		if i == 0 {
+			for len(r.queues[0]) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if err == nil || r.Stats.Dropped != 1 || time.Since(start) > time.Second {
+		t.Fatal(err, r.Stats)
+	}
+	close(sink.release)
+	r.Stop()
+	if len(sink.sent) != 3 || r.Stats.Sent != 3 {
+		t.Fatal(len(sink.sent), r.Stats)
+	}
+	if err = r.Dispatch("orders", []byte(`{}`)); err == nil {
+		t.Fail()
+	}
+}
+
+func TestCheckLoops(t *testing.T) {
+	for _, c := range []struct {
+		routes []*RouteConfig
+		loop   bool
+	}{
+		{[]*RouteConfig{{Source: "orders.>", Sinks: []*SinkConfig{{Type: SinkNats, Target: "billing.{subject}"}}}}, false},
+		{[]*RouteConfig{{Source: "orders.>", Sinks: []*SinkConfig{{Type: SinkNats, Target: "orders.copy"}}}}, true},
+		{[]*RouteConfig{{Source: "a.*", Sinks: []*SinkConfig{{Type: SinkNats, Target: "a.{subject}"}}}}, false},
+		{[]*RouteConfig{{Source: "a.>", Sinks: []*SinkConfig{{Type: SinkNats, Target: "a.{subject}"}}}}, true},
+		{[]*RouteConfig{{Source: "orders.*", Sinks: []*SinkConfig{{Type: SinkHttp, Target: "orders.copy"}}}}, false},
+		{[]*RouteConfig{
+			{Source: "a", Sinks: []*SinkConfig{{Type: SinkNats, Target: "b"}}},
+			{Source: "b", Sinks: []*SinkConfig{{Type: SinkNats, Target: "c"}}},
+			{Source: "c", Sinks: []*SinkConfig{{Type: SinkNats, Target: "a"}}},
+		}, true},
+	} {
+		if err := checkLoops(c.routes); (err != nil) != c.loop {
+			t.Fatal(c.routes[0].Source, err)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/f"
+	"github.com/dop251/goja"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ScriptPrefix the filter and transform expressions with this prefix are javascript,
+// the variables msg (the parsed json message) and subject are defined in the expressions.
+const ScriptPrefix = "js:"
+
+// RouteConfig a route from a nats subject to the sinks.
+type RouteConfig struct {
+	Name string
+	// nats subject, may contain the wildcards * and >
+	Source string
+	// queue group of the subscription, the route is load balanced when not empty
+	Queue string
+	// filter expression, gjson query e.g. `status=="paid"`, or javascript e.g. `js: msg.total > 100`
+	Filter string
+	// transform expression, javascript returns the new message or null to drop it
+	Transform string
+	// project fields: new path -> gjson path, only the projected fields are kept,
+	// the new paths are set in sorted order
+	Project map[string]string
+	// the size of the queue of each sink, the messages are dropped when it's full, 1024 by default
+	QueueSize int `yaml:"queueSize"`
+	Sinks     []*SinkConfig
+	Retry     *RetryConfig
+	Breaker   *BreakerConfig
+}
+
+// RetryConfig the retry with exponential backoff of a sink, via f.RetryOperation.
+type RetryConfig struct {
+	InitialInterval time.Duration `yaml:"initialInterval"`
+	MaxInterval     time.Duration `yaml:"maxInterval"`
+	MaxElapsedTime  time.Duration `yaml:"maxElapsedTime"`
+}
+
+// BreakerConfig the circuit breaking of a sink, via f.CircuitBreaker.
+type BreakerConfig struct {
+	// the number of consecutive failures to open the breaker
+	Failures uint32
+	// the number of requests allowed when the breaker is half-open
+	MaxRequests uint32 `yaml:"maxRequests"`
+	// the cyclic period of the closed state to clear the counts
+	Interval time.Duration
+	// the period of the open state, after which the state becomes half-open
+	Timeout time.Duration
+}
+
+// RouteStats the counters of a route.
+type RouteStats struct {
+	Received uint64
+	Filtered uint64
+	Sent     uint64
+	Failed   uint64
+	Dropped  uint64
+}
+
+// routeMsg a message in the queue of a sink.
+type routeMsg struct {
+	subject string
+	data    []byte
+}
+
+// Route filters, transforms and sends the messages of a source subject to the sinks.
+type Route struct {
+	*RouteConfig
+	Stats RouteStats
+
+	sinks    []Sink
+	breakers []*f.CircuitBreaker
+	retry    RetryConfig
+	vm       *goja.Runtime
+	filter   goja.Callable
+	trans    goja.Callable
+	project  []string   // the sorted new paths of the Project
+	lock     sync.Mutex // a lock for the javascript runtime
+	queues   []chan routeMsg
+	qmu      sync.RWMutex // a lock for the queues, closed by Stop
+	wg       sync.WaitGroup
+	// OnError handles the errors of the dispatched messages.
+	OnError func(err error)
+}
+
+// NewRoute creates a route with the sinks.
+func NewRoute(c *RouteConfig, sinks ...Sink) (*Route, error) {
+	if c.Source == "" {
+		return nil, fmt.Errorf("[bridge] route %q has no source", c.Name)
+	}
+	r := &Route{RouteConfig: c, sinks: sinks}
+	if c.Name == "" {
+		c.Name = c.Source
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1024
+	}
+
+	for to := range c.Project {
+		r.project = append(r.project, to)
+	}
+	sort.Strings(r.project)
+
+	var err error
+	if strings.HasPrefix(c.Filter, ScriptPrefix) {
+		if r.filter, err = r.compile(c.Filter); err != nil {
+			return nil, err
+		}
+	}
+	if c.Transform != "" {
+		if r.trans, err = r.compile(c.Transform); err != nil {
+			return nil, err
+		}
+	}
+
+	r.retry = RetryConfig{InitialInterval: 100 * time.Millisecond, MaxInterval: 2 * time.Second, MaxElapsedTime: 10 * time.Second}
+	if c.Retry != nil {
+		if c.Retry.InitialInterval > 0 {
+			r.retry.InitialInterval = c.Retry.InitialInterval
+		}
+		if c.Retry.MaxInterval > 0 {
+			r.retry.MaxInterval = c.Retry.MaxInterval
+		}
+		if c.Retry.MaxElapsedTime > 0 {
+			r.retry.MaxElapsedTime = c.Retry.MaxElapsedTime
+		}
+	}
+
+	for _, sink := range sinks {
+		st := f.BreakerSettings{Name: c.Name + " > " + sink.Name()}
+		if c.Breaker != nil {
+			st.MaxRequests, st.Interval, st.Timeout = c.Breaker.MaxRequests, c.Breaker.Interval, c.Breaker.Timeout
+			if failures := c.Breaker.Failures; failures > 0 {
+				st.ReadyToTrip = func(counts f.BreakerCounts) bool {
+					return counts.ConsecutiveFailures >= failures
+				}
+			}
+		}
+		r.breakers = append(r.breakers, f.NewCircuitBreaker(st))
+	}
+	return r, nil
+}
+
+// compile a javascript expression into a function(msg, subject).
+func (r *Route) compile(expr string) (goja.Callable, error) {
+	if r.vm == nil {
+		r.vm = goja.New()
+	}
+	expr = strings.TrimSpace(strings.TrimPrefix(expr, ScriptPrefix))
+	v, err := r.vm.RunString("(function(msg, subject) { return (" + expr + "); })")
+	if err != nil {
+		return nil, fmt.Errorf("[bridge] route %q script > %v", r.Name, err)
+	}
+	fn, ok := goja.AssertFunction(v)
+	if !ok {
+		return nil, fmt.Errorf("[bridge] route %q script is not a function", r.Name)
+	}
+	return fn, nil
+}
+
+// Match reports whether the message passes the filter.
+func (r *Route) Match(subject string, data []byte) (bool, error) {
+	if r.Filter == "" {
+		return true, nil
+	}
+	if r.filter != nil {
+		v, err := r.call(r.filter, subject, data)
+		if err != nil {
+			return false, err
+		}
+		return v.ToBoolean(), nil
+	}
+	// the gjson query runs on an array of the message
+	array := make([]byte, 0, len(data)+2)
+	array = append(append(append(array, '['), data...), ']')
+	return gjson.GetBytes(array, "#("+r.Filter+")").Exists(), nil
+}
+
+// Apply transforms the message, returns nil to drop it.
+func (r *Route) Apply(subject string, data []byte) ([]byte, error) {
+	var err error
+	if len(r.project) > 0 {
+		out := []byte("{}")
+		for _, to := range r.project {
+			if v := gjson.GetBytes(data, r.Project[to]); v.Exists() {
+				if out, err = sjson.SetRawBytes(out, to, []byte(v.Raw)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		data = out
+	}
+	if r.trans != nil {
+		v, err := r.call(r.trans, subject, data)
+		if err != nil {
+			return nil, err
+		}
+		if goja.IsNull(v) || goja.IsUndefined(v) {
+			return nil, nil
+		}
+		if s, ok := v.Export().(string); ok {
+			return []byte(s), nil
+		}
+		return json.Marshal(v.Export())
+	}
+	return data, nil
+}
+
+func (r *Route) call(fn goja.Callable, subject string, data []byte) (goja.Value, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	msg := f.DecodedJson(data)
+	if msg == nil {
+		msg = string(data)
+	}
+	return fn(goja.Undefined(), r.vm.ToValue(msg), r.vm.ToValue(subject))
+}
+
+// Handle filters, transforms and sends a message to all the sinks synchronously,
+// each sink is retried with backoff and protected by its circuit breaker.
+func (r *Route) Handle(subject string, data []byte) error {
+	data, err := r.prepare(subject, data)
+	if err != nil || data == nil {
+		return err
+	}
+
+	var errs f.Errors
+	for i := range r.sinks {
+		if err := r.send(i, subject, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Dispatch filters and transforms a message, and queues it to all the sinks without waiting for them,
+// the sinks are sent by the workers of Start. The message is dropped by a sink whose queue is full.
+func (r *Route) Dispatch(subject string, data []byte) error {
+	data, err := r.prepare(subject, data)
+	if err != nil || data == nil {
+		return err
+	}
+
+	r.qmu.RLock()
+	defer r.qmu.RUnlock()
+	if r.queues == nil {
+		atomic.AddUint64(&r.Stats.Dropped, 1)
+		return fmt.Errorf("[bridge] route %q is not started", r.Name)
+	}
+
+	var errs f.Errors
+	for i, q := range r.queues {
+		select {
+		case q <- routeMsg{subject: subject, data: data}:
+		default:
+			atomic.AddUint64(&r.Stats.Dropped, 1)
+			errs = append(errs, fmt.Errorf("[bridge] route %q > %s > queue is full", r.Name, r.sinks[i].Name()))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Start starts a worker with a queue for each sink of the route.
+func (r *Route) Start() {
+	r.qmu.Lock()
+	defer r.qmu.Unlock()
+	if r.queues != nil {
+		return
+	}
+	r.queues = make([]chan routeMsg, len(r.sinks))
+	for i := range r.sinks {
+		q := make(chan routeMsg, r.QueueSize)
+		r.queues[i] = q
+		r.wg.Add(1)
+		go func(i int) {
+			defer r.wg.Done()
+			for m := range q {
+				if err := r.send(i, m.subject, m.data); err != nil && r.OnError != nil {
+					r.OnError(err)
+				}
+			}
+		}(i)
+	}
+}
+
+// Stop stops the workers after the queued messages are sent.
+func (r *Route) Stop() {
+	r.qmu.Lock()
+	for _, q := range r.queues {
+		close(q)
+	}
+	r.queues = nil
+	r.qmu.Unlock()
+	r.wg.Wait()
+}
+
+// prepare filters and transforms a message, returns nil when it's filtered.
+func (r *Route) prepare(subject string, data []byte) ([]byte, error) {
+	atomic.AddUint64(&r.Stats.Received, 1)
+	ok, err := r.Match(subject, data)
+	if err != nil {
+		atomic.AddUint64(&r.Stats.Failed, 1)
+		return nil, err
+	}
+	if !ok {
+		atomic.AddUint64(&r.Stats.Filtered, 1)
+		return nil, nil
+	}
+	if data, err = r.Apply(subject, data); err != nil {
+		atomic.AddUint64(&r.Stats.Failed, 1)
+		return nil, err
+	}
+	if data == nil {
+		atomic.AddUint64(&r.Stats.Filtered, 1)
+	}
+	return data, nil
+}
+
+// send sends a message to a sink, with the retry and the circuit breaker of the sink.
+func (r *Route) send(i int, subject string, data []byte) error {
+	sink := r.sinks[i]
+	_, err := r.breakers[i].Execute(func() (interface{}, error) {
+		return nil, f.NewRetryOperation(func() error {
+			return sink.Send(subject, data)
+		}, r.retry.InitialInterval, r.retry.MaxInterval, r.retry.MaxElapsedTime, 0, 0).Retry()
+	})
+	if err != nil {
+		atomic.AddUint64(&r.Stats.Failed, 1)
+		return fmt.Errorf("[bridge] route %q > %s > %v", r.Name, sink.Name(), err)
+	}
+	atomic.AddUint64(&r.Stats.Sent, 1)
+	return nil
+}
+
+// checkLoops returns an error if the messages of a route can be forwarded back to its source
+// by the nats sinks of the routes, the {subject} of a target is replaced with the source.
+func checkLoops(configs []*RouteConfig) error {
+	next := func(c *RouteConfig) (routes []int) {
+		for _, sc := range c.Sinks {
+			if sc.Type != SinkNats {
+				continue
+			}
+			target := strings.Replace(sc.Target, "{subject}", c.Source, -1)
+			for j, d := range configs {
+				if subjectsOverlap(target, d.Source) {
+					routes = append(routes, j)
+				}
+			}
+		}
+		return
+	}
+
+	for i, c := range configs {
+		visited, stack := make(map[int]bool), next(c)
+		for len(stack) > 0 {
+			j := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if j == i {
+				return fmt.Errorf("[bridge] route %q forwards the messages back to its source %q", c.Name, c.Source)
+			}
+			if !visited[j] {
+				visited[j] = true
+				stack = append(stack, next(configs[j])...)
+			}
+		}
+	}
+	return nil
+}
+
+// subjectsOverlap reports whether a subject can match both of the subjects with the wildcards * and >.
+func subjectsOverlap(a, b string) bool {
+	at, bt := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(at) && i < len(bt); i++ {
+		if at[i] == ">" || bt[i] == ">" {
+			return true
+		}
+		if at[i] != bt[i] && at[i] != "*" && bt[i] != "*" {
+			return false
+		}
+	}
+	return len(at) == len(bt)
+}
@@ -0,0 +1,148 @@
+package bridge
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/data/queue/producer"
+	"github.com/angenalZZZ/gofunc/f"
+	"github.com/angenalZZZ/gofunc/http/longpoll"
+	"github.com/go-resty/resty/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// Sink types of a route.
+const (
+	SinkNats     = "nats"
+	SinkNsq      = "nsq"
+	SinkHttp     = "http"
+	SinkLongpoll = "longpoll"
+)
+
+// Sink sends the messages of a route to a destination.
+type Sink interface {
+	// Name the sink type and target, e.g. nats:orders.copy
+	Name() string
+	// Send the data received on the subject.
+	Send(subject string, data []byte) error
+}
+
+// SinkConfig the destination of a route.
+//   - type: nats      target: subject, {subject} is replaced with the source subject
+//   - type: nsq       target: topic    addr: nsqd tcp address
+//   - type: http      target: webhook url, method: POST, headers: {...}, timeout: 3s
+//   - type: longpoll  target: category
+type SinkConfig struct {
+	Type    string
+	Target  string
+	Addr    string
+	Method  string
+	Headers map[string]string
+	Timeout time.Duration
+}
+
+// natsSink forwards the messages to a nats subject.
+type natsSink struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func (s *natsSink) Name() string { return SinkNats + ":" + s.subject }
+
+func (s *natsSink) Send(subject string, data []byte) error {
+	return s.nc.Publish(strings.Replace(s.subject, "{subject}", subject, -1), data)
+}
+
+// nsqSink forwards the messages to a nsq topic.
+type nsqSink struct {
+	p     *producer.NsqProducer
+	topic string
+}
+
+func (s *nsqSink) Name() string { return SinkNsq + ":" + s.topic }
+
+func (s *nsqSink) Send(_ string, data []byte) error {
+	return s.p.Publish(s.topic, data)
+}
+
+// httpSink forwards the messages to a webhook.
+type httpSink struct {
+	client  *resty.Client
+	url     string
+	method  string
+	headers map[string]string
+}
+
+func (s *httpSink) Name() string { return SinkHttp + ":" + s.url }
+
+func (s *httpSink) Send(subject string, data []byte) error {
+	res, err := s.client.R().
+		SetHeaders(s.headers).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("X-Nats-Subject", subject).
+		SetBody(data).
+		Execute(s.method, s.url)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode() >= http.StatusBadRequest {
+		return fmt.Errorf("[bridge] %s %s > %s", s.method, s.url, res.Status())
+	}
+	return nil
+}
+
+// longpollSink publishes the messages to a longpoll category.
+type longpollSink struct {
+	m        *longpoll.LongpollManager
+	category string
+}
+
+func (s *longpollSink) Name() string { return SinkLongpoll + ":" + s.category }
+
+func (s *longpollSink) Send(_ string, data []byte) error {
+	if v := f.DecodedJson(data); v != nil {
+		return s.m.Publish(s.category, v)
+	}
+	return s.m.Publish(s.category, string(data))
+}
+
+// newSink creates a sink from the config, the nsq producers are shared by address.
+func (b *Bridge) newSink(c *SinkConfig) (Sink, error) {
+	if c.Target == "" {
+		return nil, fmt.Errorf("[bridge] %s sink has no target", c.Type)
+	}
+	switch c.Type {
+	case SinkNats:
+		if b.Conn == nil {
+			return nil, fmt.Errorf("[bridge] nats sink %q has no connection", c.Target)
+		}
+		return &natsSink{nc: b.Conn, subject: c.Target}, nil
+	case SinkNsq:
+		p, ok := b.producers[c.Addr]
+		if !ok {
+			var err error
+			if p, err = producer.NewNsqProducer(c.Addr); err != nil {
+				return nil, err
+			}
+			b.producers[c.Addr] = p
+		}
+		return &nsqSink{p: p, topic: c.Target}, nil
+	case SinkHttp:
+		method, timeout := strings.ToUpper(c.Method), c.Timeout
+		if method == "" {
+			method = http.MethodPost
+		}
+		if timeout <= 0 {
+			timeout = 3 * time.Second
+		}
+		return &httpSink{client: resty.New().SetTimeout(timeout), url: c.Target, method: method, headers: c.Headers}, nil
+	case SinkLongpoll:
+		if b.Longpoll == nil {
+			return nil, fmt.Errorf("[bridge] longpoll sink %q has no manager", c.Target)
+		}
+		return &longpollSink{m: b.Longpoll, category: c.Target}, nil
+	}
+	return nil, fmt.Errorf("[bridge] unknown sink type %q", c.Type)
+}
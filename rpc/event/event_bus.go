@@ -2,8 +2,14 @@ package event
 
 import (
 	"fmt"
+	"os"
 	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
+
+	"github.com/angenalZZZ/gofunc/f"
+	"github.com/angenalZZZ/gofunc/log"
 )
 
 // BusSubscriber defines subscription-related bus behavior
@@ -20,6 +26,12 @@ type BusPublisher interface {
 	Publish(topic string, args ...interface{})
 }
 
+// BusMiddleware defines the middleware chains of the bus
+type BusMiddleware interface {
+	UsePublish(middleware ...PublishMiddleware)
+	UseSubscribe(middleware ...HandlerMiddleware)
+}
+
 // BusController defines bus control behavior (checking handler's presence, synchronization)
 type BusController interface {
 	HasCallback(topic string) bool
@@ -33,11 +45,35 @@ type IBus interface {
 	BusPublisher
 }
 
+// BusExtension defines the priority and typed subscriptions, the synchronous publishing
+// and the error handling of a bus
+type BusExtension interface {
+	SubscribeWithPriority(topic string, fn interface{}, priority int) error
+	On(topic string, fn interface{}, priority ...int) error
+	PublishSync(topic string, args ...interface{}) error
+	OnError(fn func(topic string, err error))
+}
+
+// IBusExt - the IBus with the extensions and the middleware
+type IBusExt interface {
+	IBus
+	BusExtension
+	BusMiddleware
+}
+
 // EventBus - box for handlers and callbacks.
+// Topics are dot-separated tokens, a subscription topic of the bus of NewExt may contain
+// the wildcards `*` (matches one token) and `>` (matches the remaining tokens),
+// the topics of the bus of New are matched exactly.
 type Bus struct {
-	handlers map[string][]*eventHandler
-	lock     sync.Mutex // a lock for the map
-	wg       sync.WaitGroup
+	handlers  map[string][]*eventHandler
+	lock      sync.Mutex // a lock for the map
+	wg        sync.WaitGroup
+	seq       uint64
+	wildcards bool
+	pubMws    []PublishMiddleware
+	subMws    []HandlerMiddleware
+	onError   func(topic string, err error)
 }
 
 type eventHandler struct {
@@ -45,19 +81,28 @@ type eventHandler struct {
 	flagOnce      bool
 	async         bool
 	transactional bool
+	priority      int
+	seq           uint64
 	sync.Mutex    // lock for an event handler - useful for running async callbacks serially
 }
 
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
 // New returns new EventBus with empty handlers.
 func New() IBus {
 	b := &Bus{
-		make(map[string][]*eventHandler),
-		sync.Mutex{},
-		sync.WaitGroup{},
+		handlers: make(map[string][]*eventHandler),
 	}
 	return IBus(b)
 }
 
+// NewExt returns new EventBus with empty handlers, and the extensions and the wildcard topics.
+func NewExt() IBusExt {
+	b := New().(*Bus)
+	b.wildcards = true
+	return b
+}
+
 // doSubscribe handles the subscription logic and is utilized by the public Subscribe functions
 func (bus *Bus) doSubscribe(topic string, fn interface{}, handler *eventHandler) error {
 	bus.lock.Lock()
@@ -65,6 +110,12 @@ func (bus *Bus) doSubscribe(topic string, fn interface{}, handler *eventHandler)
 	if !(reflect.TypeOf(fn).Kind() == reflect.Func) {
 		return fmt.Errorf("%s is not of type reflect.Func", reflect.TypeOf(fn).Kind())
 	}
+	if bus.wildcards {
+		if err := validTopic(topic); err != nil {
+			return err
+		}
+	}
+	handler.seq = atomic.AddUint64(&bus.seq, 1)
 	bus.handlers[topic] = append(bus.handlers[topic], handler)
 	return nil
 }
@@ -73,17 +124,46 @@ func (bus *Bus) doSubscribe(topic string, fn interface{}, handler *eventHandler)
 // Returns error if `fn` is not a function.
 func (bus *Bus) Subscribe(topic string, fn interface{}) error {
 	return bus.doSubscribe(topic, fn, &eventHandler{
-		reflect.ValueOf(fn), false, false, false, sync.Mutex{},
+		callBack: reflect.ValueOf(fn),
 	})
 }
 
+// SubscribeWithPriority subscribes to a topic, handlers with a higher priority are called first.
+// Returns error if `fn` is not a function.
+func (bus *Bus) SubscribeWithPriority(topic string, fn interface{}, priority int) error {
+	return bus.doSubscribe(topic, fn, &eventHandler{
+		callBack: reflect.ValueOf(fn), priority: priority,
+	})
+}
+
+// On subscribes a typed handler to a topic, e.g. bus.On("order.created", func(e *OrderCreated) {}).
+// The handler must take exactly one argument and return nothing or an error;
+// the signature is checked here, and events of another type are rejected with an error on publish.
+func (bus *Bus) On(topic string, fn interface{}, priority ...int) error {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func {
+		return fmt.Errorf("%v is not of type reflect.Func", t)
+	}
+	if t.NumIn() != 1 || t.IsVariadic() {
+		return fmt.Errorf("handler %s must take exactly one argument", t)
+	}
+	if t.NumOut() > 1 || (t.NumOut() == 1 && t.Out(0) != errorType) {
+		return fmt.Errorf("handler %s must return nothing or an error", t)
+	}
+	handler := &eventHandler{callBack: reflect.ValueOf(fn)}
+	if len(priority) > 0 {
+		handler.priority = priority[0]
+	}
+	return bus.doSubscribe(topic, fn, handler)
+}
+
 // SubscribeAsync subscribes to a topic with an asynchronous callback
 // Transactional determines whether subsequent callbacks for a topic are
 // run serially (true) or concurrently (false)
 // Returns error if `fn` is not a function.
 func (bus *Bus) SubscribeAsync(topic string, fn interface{}, transactional bool) error {
 	return bus.doSubscribe(topic, fn, &eventHandler{
-		reflect.ValueOf(fn), false, true, transactional, sync.Mutex{},
+		callBack: reflect.ValueOf(fn), async: true, transactional: transactional,
 	})
 }
 
@@ -91,7 +171,7 @@ func (bus *Bus) SubscribeAsync(topic string, fn interface{}, transactional bool)
 // Returns error if `fn` is not a function.
 func (bus *Bus) SubscribeOnce(topic string, fn interface{}) error {
 	return bus.doSubscribe(topic, fn, &eventHandler{
-		reflect.ValueOf(fn), true, false, false, sync.Mutex{},
+		callBack: reflect.ValueOf(fn), flagOnce: true,
 	})
 }
 
@@ -100,21 +180,31 @@ func (bus *Bus) SubscribeOnce(topic string, fn interface{}) error {
 // Returns error if `fn` is not a function.
 func (bus *Bus) SubscribeOnceAsync(topic string, fn interface{}) error {
 	return bus.doSubscribe(topic, fn, &eventHandler{
-		reflect.ValueOf(fn), true, true, false, sync.Mutex{},
+		callBack: reflect.ValueOf(fn), flagOnce: true, async: true,
 	})
 }
 
-// HasCallback returns true if exists any callback subscribed to the topic.
+// HasCallback returns true if exists any callback subscribed to the topic,
+// including callbacks subscribed with a matching wildcard topic.
 func (bus *Bus) HasCallback(topic string) bool {
 	bus.lock.Lock()
 	defer bus.lock.Unlock()
-	_, ok := bus.handlers[topic]
-	if ok {
-		return len(bus.handlers[topic]) > 0
+	for pattern, handlers := range bus.handlers {
+		if len(handlers) > 0 && bus.match(pattern, topic) {
+			return true
+		}
 	}
 	return false
 }
 
+// match reports whether the published topic matches the subscription topic.
+func (bus *Bus) match(pattern, topic string) bool {
+	if bus.wildcards {
+		return matchTopic(pattern, topic)
+	}
+	return pattern == topic
+}
+
 // Unsubscribe removes callback defined for a topic.
 // Returns error if there are no callbacks subscribed to the topic.
 func (bus *Bus) Unsubscribe(topic string, handler interface{}) error {
@@ -128,44 +218,127 @@ func (bus *Bus) Unsubscribe(topic string, handler interface{}) error {
 }
 
 // Publish executes callback defined for a topic. Any additional argument will be transferred to the callback.
+// Errors of the middleware and the callbacks are passed to the OnError handler, use PublishSync to collect them.
 func (bus *Bus) Publish(topic string, args ...interface{}) {
-	bus.lock.Lock() // will unlock if handler is not found or always after setUpPublish
+	bus.handleError(topic, bus.publishChain(bus.doPublishTopic)(topic, args))
+}
+
+// PublishSync executes all callbacks defined for a topic synchronously, also the asynchronous ones,
+// and returns the errors of the callbacks as f.Errors.
+func (bus *Bus) PublishSync(topic string, args ...interface{}) error {
+	return bus.publishChain(bus.doPublishTopicSync)(topic, args)
+}
+
+// matchHandlers returns the handlers subscribed to the topic ordered by priority,
+// and removes the handlers subscribed once.
+func (bus *Bus) matchHandlers(topic string) []*eventHandler {
+	bus.lock.Lock()
 	defer bus.lock.Unlock()
-	if handlers, ok := bus.handlers[topic]; ok && 0 < len(handlers) {
-		// Handlers slice may be changed by removeHandler and Unsubscribe during iteration,
-		// so make a copy and iterate the copied slice.
-		copyHandlers := make([]*eventHandler, len(handlers))
-		copy(copyHandlers, handlers)
-		for i, handler := range copyHandlers {
+	var matched []*eventHandler
+	for pattern, handlers := range bus.handlers {
+		if len(handlers) == 0 || !bus.match(pattern, topic) {
+			continue
+		}
+		// Handlers slice is changed by removeHandler during iteration,
+		// so append a copy and iterate the copied slice.
+		n := len(matched)
+		matched = append(matched, handlers...)
+		for _, handler := range matched[n:] {
 			if handler.flagOnce {
-				bus.removeHandler(topic, i)
+				bus.removeHandler(pattern, bus.findHandler(pattern, handler))
 			}
-			if !handler.async {
-				bus.doPublish(handler, args...)
-			} else {
-				bus.wg.Add(1)
-				if handler.transactional {
-					bus.lock.Unlock()
-					handler.Lock()
-					bus.lock.Lock()
-				}
-				go bus.doPublishAsync(handler, args...)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].priority != matched[j].priority {
+			return matched[i].priority > matched[j].priority
+		}
+		return matched[i].seq < matched[j].seq
+	})
+	return matched
+}
+
+func (bus *Bus) doPublishTopic(topic string, args []interface{}) error {
+	for _, handler := range bus.matchHandlers(topic) {
+		if !handler.async {
+			bus.handleError(topic, bus.doPublish(topic, handler, args...))
+		} else {
+			bus.wg.Add(1)
+			if handler.transactional {
+				handler.Lock()
 			}
+			go bus.doPublishAsync(topic, handler, args...)
 		}
 	}
+	return nil
 }
 
-func (bus *Bus) doPublish(handler *eventHandler, args ...interface{}) {
-	passedArguments := bus.setUpPublish(handler, args...)
-	handler.callBack.Call(passedArguments)
+func (bus *Bus) doPublishTopicSync(topic string, args []interface{}) error {
+	var errs f.Errors
+	for _, handler := range bus.matchHandlers(topic) {
+		if handler.transactional {
+			handler.Lock()
+		}
+		err := bus.doPublish(topic, handler, args...)
+		if handler.transactional {
+			handler.Unlock()
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
-func (bus *Bus) doPublishAsync(handler *eventHandler, args ...interface{}) {
+func (bus *Bus) doPublish(topic string, handler *eventHandler, args ...interface{}) error {
+	return bus.handlerChain(handler)(topic, args)
+}
+
+func (bus *Bus) doPublishAsync(topic string, handler *eventHandler, args ...interface{}) {
 	defer bus.wg.Done()
 	if handler.transactional {
 		defer handler.Unlock()
 	}
-	bus.doPublish(handler, args...)
+	bus.handleError(topic, bus.doPublish(topic, handler, args...))
+}
+
+// OnError sets the handler of the errors of Publish, the errors are logged by default.
+func (bus *Bus) OnError(fn func(topic string, err error)) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.onError = fn
+}
+
+func (bus *Bus) handleError(topic string, err error) {
+	if err == nil {
+		return
+	}
+	bus.lock.Lock()
+	fn := bus.onError
+	bus.lock.Unlock()
+	if fn != nil {
+		fn(topic, err)
+	} else if log.Log != nil {
+		log.Log.Error().Str("topic", topic).Err(err).Send()
+	} else {
+		_, _ = fmt.Fprintf(os.Stderr, "event: topic %s: %v\n", topic, err)
+	}
+}
+
+// call invokes the callback, the last result of type error is returned.
+func (handler *eventHandler) call(topic string, args []interface{}) error {
+	passedArguments, err := setUpPublish(handler, args...)
+	if err != nil {
+		return fmt.Errorf("topic %s: %v", topic, err)
+	}
+	out := handler.callBack.Call(passedArguments)
+	if n := len(out); n > 0 && out[n-1].Type() == errorType && !out[n-1].IsNil() {
+		return out[n-1].Interface().(error)
+	}
+	return nil
 }
 
 func (bus *Bus) removeHandler(topic string, idx int) {
@@ -195,18 +368,48 @@ func (bus *Bus) findHandlerIdx(topic string, callback reflect.Value) int {
 	return -1
 }
 
-func (bus *Bus) setUpPublish(callback *eventHandler, args ...interface{}) []reflect.Value {
+func (bus *Bus) findHandler(topic string, handler *eventHandler) int {
+	for idx, h := range bus.handlers[topic] {
+		if h == handler {
+			return idx
+		}
+	}
+	return -1
+}
+
+// setUpPublish checks the arguments against the callback signature instead of panic in reflect.Call.
+func setUpPublish(callback *eventHandler, args ...interface{}) ([]reflect.Value, error) {
 	funcType := callback.callBack.Type()
+	numIn := funcType.NumIn()
+	if funcType.IsVariadic() {
+		if len(args) < numIn-1 {
+			return nil, fmt.Errorf("handler %s takes at least %d arguments, got %d", funcType, numIn-1, len(args))
+		}
+	} else if len(args) != numIn {
+		return nil, fmt.Errorf("handler %s takes %d arguments, got %d", funcType, numIn, len(args))
+	}
+
 	passedArguments := make([]reflect.Value, len(args))
 	for i, v := range args {
+		in := variadicIn(funcType, i)
 		if v == nil {
-			passedArguments[i] = reflect.New(funcType.In(i)).Elem()
+			// the zero value of the argument type
+			passedArguments[i] = reflect.New(in).Elem()
+		} else if t := reflect.TypeOf(v); !t.AssignableTo(in) {
+			return nil, fmt.Errorf("handler %s argument %d: %s is not assignable to %s", funcType, i, t, in)
 		} else {
 			passedArguments[i] = reflect.ValueOf(v)
 		}
 	}
 
-	return passedArguments
+	return passedArguments, nil
+}
+
+func variadicIn(funcType reflect.Type, i int) reflect.Type {
+	if n := funcType.NumIn(); funcType.IsVariadic() && i >= n-1 {
+		return funcType.In(n - 1).Elem()
+	}
+	return funcType.In(i)
 }
 
 // WaitAsync waits for all async callbacks to complete
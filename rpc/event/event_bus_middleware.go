@@ -0,0 +1,133 @@
+package event
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/log"
+)
+
+// PublishFunc publishes the arguments to a topic.
+type PublishFunc func(topic string, args []interface{}) error
+
+// PublishMiddleware wraps the publishing of every topic.
+type PublishMiddleware func(next PublishFunc) PublishFunc
+
+// HandlerFunc calls a subscribed handler with the published arguments.
+type HandlerFunc func(topic string, args []interface{}) error
+
+// HandlerMiddleware wraps the call of every subscribed handler.
+type HandlerMiddleware func(next HandlerFunc) HandlerFunc
+
+// UsePublish appends middleware to the publish chain, the first one is the outermost.
+func (bus *Bus) UsePublish(middleware ...PublishMiddleware) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.pubMws = append(bus.pubMws, middleware...)
+}
+
+// UseSubscribe appends middleware to the handler chain, the first one is the outermost.
+func (bus *Bus) UseSubscribe(middleware ...HandlerMiddleware) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.subMws = append(bus.subMws, middleware...)
+}
+
+func (bus *Bus) publishChain(fn PublishFunc) PublishFunc {
+	bus.lock.Lock()
+	mws := bus.pubMws
+	bus.lock.Unlock()
+	for i := len(mws) - 1; i >= 0; i-- {
+		fn = mws[i](fn)
+	}
+	return fn
+}
+
+func (bus *Bus) handlerChain(handler *eventHandler) HandlerFunc {
+	bus.lock.Lock()
+	mws := bus.subMws
+	bus.lock.Unlock()
+	fn := HandlerFunc(handler.call)
+	for i := len(mws) - 1; i >= 0; i-- {
+		fn = mws[i](fn)
+	}
+	return fn
+}
+
+// Recover returns a handler middleware that recovers from a panic in a handler and returns it as an error.
+func Recover() HandlerMiddleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(topic string, args []interface{}) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("topic %s: handler panic: %v", topic, r)
+				}
+			}()
+			return next(topic, args)
+		}
+	}
+}
+
+// Logger returns a handler middleware that logs the duration and error of every handler call.
+func Logger(logger *log.Logger) HandlerMiddleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(topic string, args []interface{}) error {
+			start := time.Now()
+			err := next(topic, args)
+			if err != nil {
+				logger.Error().Str("topic", topic).Dur("elapsed", time.Since(start)).Err(err).Send()
+			} else {
+				logger.Debug().Str("topic", topic).Dur("elapsed", time.Since(start)).Send()
+			}
+			return err
+		}
+	}
+}
+
+// Metrics counts the published topics and the handler calls of a bus.
+type Metrics struct {
+	Published uint64
+	Handled   uint64
+	Failed    uint64
+}
+
+// NewMetrics creates the metrics, use Metrics.Use to install it in a bus.
+func NewMetrics() *Metrics {
+	return new(Metrics)
+}
+
+// Use installs the publish and handler middleware of the metrics in the bus.
+func (m *Metrics) Use(bus BusMiddleware) {
+	bus.UsePublish(m.PublishMiddleware)
+	bus.UseSubscribe(m.HandlerMiddleware)
+}
+
+// PublishMiddleware counts the published topics.
+func (m *Metrics) PublishMiddleware(next PublishFunc) PublishFunc {
+	return func(topic string, args []interface{}) error {
+		atomic.AddUint64(&m.Published, 1)
+		return next(topic, args)
+	}
+}
+
+// HandlerMiddleware counts the handler calls and the failed ones.
+func (m *Metrics) HandlerMiddleware(next HandlerFunc) HandlerFunc {
+	return func(topic string, args []interface{}) error {
+		atomic.AddUint64(&m.Handled, 1)
+		err := next(topic, args)
+		if err != nil {
+			atomic.AddUint64(&m.Failed, 1)
+		}
+		return err
+	}
+}
+
+// Snapshot returns a consistent copy of the counters.
+func (m *Metrics) Snapshot() Metrics {
+	return Metrics{
+		Published: atomic.LoadUint64(&m.Published),
+		Handled:   atomic.LoadUint64(&m.Handled),
+		Failed:    atomic.LoadUint64(&m.Failed),
+	}
+}
@@ -1,8 +1,11 @@
 package event
 
 import (
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/angenalZZZ/gofunc/f"
 )
 
 func TestNew(t *testing.T) {
@@ -183,3 +186,143 @@ func TestSubscribeAsync(t *testing.T) {
 
 	time.Sleep(10 * time.Millisecond)
 }
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"order.created", "order.created", true},
+		{"order.*", "order.created", true},
+		{"order.*", "order.item.created", false},
+		{"order.>", "order.item.created", true},
+		{"order.>", "order", false},
+		{"*.created", "order.created", true},
+		{"order.*.created", "order.item.created", true},
+	}
+	for _, c := range cases {
+		if matchTopic(c.pattern, c.topic) != c.match {
+			t.Errorf("matchTopic(%q, %q) != %v", c.pattern, c.topic, c.match)
+		}
+	}
+	if validTopic("order.>.created") == nil {
+		t.Fail()
+	}
+}
+
+func TestPublishWildcard(t *testing.T) {
+	bus := NewExt()
+	flag := 0
+	_ = bus.Subscribe("order.*", func() { flag += 1 })
+	_ = bus.Subscribe("order.>", func() { flag += 10 })
+	bus.Publish("order.created")
+	bus.Publish("order.item.created")
+	if flag != 21 {
+		t.Fail()
+	}
+	if !bus.HasCallback("order.paid") || bus.HasCallback("user.created") {
+		t.Fail()
+	}
+}
+
+func TestPublishExactTopic(t *testing.T) {
+	bus := New()
+	flag := 0
+	if err := bus.Subscribe("order.*", func() { flag += 1 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Subscribe("order.>.created", func() { flag += 10 }); err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish("order.created")
+	bus.Publish("order.*")
+	bus.Publish("order.>.created")
+	if flag != 11 || bus.HasCallback("order.paid") {
+		t.Fatal(flag)
+	}
+}
+
+func TestPublishNil(t *testing.T) {
+	bus := NewExt()
+	results := make([]int, 0)
+	_ = bus.Subscribe("topic", func(a int, b []byte) { results = append(results, a, len(b)) })
+	if err := bus.PublishSync("topic", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0] != 0 || results[1] != 0 {
+		t.Fatal(results)
+	}
+}
+
+func TestSubscribeWithPriority(t *testing.T) {
+	bus := NewExt()
+	var results []int
+	_ = bus.SubscribeWithPriority("topic", func() { results = append(results, 1) }, 1)
+	_ = bus.SubscribeWithPriority("topic", func() { results = append(results, 3) }, 3)
+	_ = bus.Subscribe("topic", func() { results = append(results, 0) })
+	bus.Publish("topic")
+	if len(results) != 3 || results[0] != 3 || results[1] != 1 || results[2] != 0 {
+		t.Fatal(results)
+	}
+}
+
+type orderCreated struct {
+	ID int
+}
+
+func TestOn(t *testing.T) {
+	bus := NewExt()
+	if bus.On("order", func(a, b int) {}) == nil {
+		t.Fail()
+	}
+	if bus.On("order", func(e *orderCreated) int { return 0 }) == nil {
+		t.Fail()
+	}
+	id := 0
+	if err := bus.On("order", func(e *orderCreated) { id = e.ID }); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.PublishSync("order", &orderCreated{ID: 1}); err != nil || id != 1 {
+		t.Fatal(err)
+	}
+	if err := bus.PublishSync("order", "mismatched"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestPublishSyncErrors(t *testing.T) {
+	bus := NewExt()
+	_ = bus.Subscribe("topic", func() error { return errors.New("failure") })
+	_ = bus.SubscribeAsync("topic", func() error { return nil }, false)
+	_ = bus.Subscribe("topic", func() { panic("panic") })
+	metrics := NewMetrics()
+	metrics.Use(bus)
+	bus.UseSubscribe(Recover())
+	err := bus.PublishSync("topic")
+	if errs, ok := err.(f.Errors); !ok || len(errs) != 2 {
+		t.Fatal(err)
+	}
+	if m := metrics.Snapshot(); m.Published != 1 || m.Handled != 3 || m.Failed != 2 {
+		t.Fatal(m)
+	}
+}
+
+func TestPublishErrors(t *testing.T) {
+	bus := NewExt()
+	var errs []string
+	bus.OnError(func(topic string, err error) { errs = append(errs, topic+": "+err.Error()) })
+	_ = bus.Subscribe("topic", func() error { return errors.New("failure") })
+	bus.UsePublish(func(next PublishFunc) PublishFunc {
+		return func(topic string, args []interface{}) error {
+			if topic == "denied" {
+				return errors.New("denied")
+			}
+			return next(topic, args)
+		}
+	})
+	bus.Publish("topic")
+	bus.Publish("denied")
+	if len(errs) != 2 || errs[0] != "topic: failure" || errs[1] != "denied: denied" {
+		t.Fatal(errs)
+	}
+}
@@ -0,0 +1,62 @@
+package event
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// TopicSeparator separates the tokens of a topic.
+	TopicSeparator = "."
+	// TopicWildcardOne matches exactly one token of a topic, e.g. "order.*" matches "order.created".
+	TopicWildcardOne = "*"
+	// TopicWildcardAll matches one or more tokens at the end of a topic, e.g. "order.>" matches "order.item.created".
+	TopicWildcardAll = ">"
+)
+
+// validTopic checks the position of the wildcards in a subscription topic.
+func validTopic(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("topic is empty")
+	}
+	if !hasWildcard(topic) {
+		return nil
+	}
+	tokens := strings.Split(topic, TopicSeparator)
+	for i, token := range tokens {
+		if token == "" {
+			return fmt.Errorf("topic %s has an empty token", topic)
+		}
+		if token == TopicWildcardAll && i != len(tokens)-1 {
+			return fmt.Errorf("topic %s: wildcard %s must be the last token", topic, TopicWildcardAll)
+		}
+	}
+	return nil
+}
+
+func hasWildcard(topic string) bool {
+	return strings.Contains(topic, TopicWildcardOne) || strings.Contains(topic, TopicWildcardAll)
+}
+
+// matchTopic reports whether the published topic matches the subscription pattern.
+func matchTopic(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+	if !hasWildcard(pattern) {
+		return false
+	}
+	patterns, tokens := strings.Split(pattern, TopicSeparator), strings.Split(topic, TopicSeparator)
+	for i, p := range patterns {
+		if p == TopicWildcardAll {
+			return len(tokens) > i
+		}
+		if i >= len(tokens) {
+			return false
+		}
+		if p != TopicWildcardOne && p != tokens[i] {
+			return false
+		}
+	}
+	return len(patterns) == len(tokens)
+}
@@ -0,0 +1,330 @@
+package nats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+)
+
+// Seal the global envelope for the publishers, e.g. the js nats.pub and nats.req bindings.
+var Seal *Envelope
+
+// Compression algorithm of an Envelope.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+	CompressionGzip
+)
+
+const (
+	envelopeMagic   = "\x00NE" // the signature of an envelope, plain binary messages may also start with 0x00
+	envelopeVersion = 0x01
+	envelopeHeader  = 6 // magic,version,compression,keyID length
+
+	defaultEnvelopeMaxSize = 1048576
+)
+
+var (
+	ErrEnvelopeHeader  = errors.New("[nats] invalid envelope header")
+	ErrEnvelopeKeyID   = errors.New("[nats] unknown envelope key id")
+	ErrEnvelopeVersion = errors.New("[nats] unsupported envelope version")
+	ErrEnvelopeSize    = errors.New("[nats] envelope payload exceeds the max size")
+)
+
+var (
+	zstdEncoder  *zstd.Encoder
+	zstdDecoders = make(map[int]*zstd.Decoder) // by the max size
+	zstdOnce     sync.Once
+	zstdMu       sync.Mutex
+)
+
+// Envelope compresses and encrypts the payloads of nats messages.
+//
+// The header of an envelope is: 0x00 'N' 'E', version, compression, keyID length, keyID, [12 bytes nonce],
+// followed by the payload, which is encrypted with AES-GCM when the keyID is not empty.
+// Plain messages are accepted by Unwrap, so publishers and subscribers can be migrated separately.
+type Envelope struct {
+	// Compression algorithm of the published messages.
+	Compression Compression
+	// MinSize the published messages smaller than it are not compressed.
+	MinSize int
+	// KeyID the key of the published messages, not encrypted when empty.
+	KeyID string
+	// MaxSize the max size of the unwrapped messages, 1MB by default, limits the decompression.
+	MaxSize int
+	// Keys AES keys (16, 24 or 32 bytes) by key id, e.g. the old keys are kept to unwrap while rotating.
+	Keys map[string][]byte
+	// Reject handles the messages that fail to unwrap.
+	Reject func(msg *nats.Msg, err error)
+}
+
+// NewEnvelope creates an envelope that compresses and encrypts with the key,
+// the keyID is optional and the key is also optional.
+func NewEnvelope(compression Compression, keyID string, key []byte) *Envelope {
+	e := &Envelope{Compression: compression, MinSize: 256, MaxSize: defaultEnvelopeMaxSize, Keys: make(map[string][]byte)}
+	if keyID != "" && key != nil {
+		e.KeyID, e.Keys[keyID] = keyID, key
+	}
+	return e
+}
+
+// IsEnvelope reports whether the data is wrapped in an envelope.
+func IsEnvelope(data []byte) bool {
+	return len(data) >= envelopeHeader && string(data[:len(envelopeMagic)]) == envelopeMagic
+}
+
+// Limit returns a copy of the envelope with the max size, if it is not set, e.g. the BytesLimit of a subscription.
+func (e *Envelope) Limit(maxSize int) *Envelope {
+	if e == nil || e.MaxSize > 0 || maxSize <= 0 {
+		return e
+	}
+	c := *e
+	c.MaxSize = maxSize
+	return &c
+}
+
+// Wrap compresses and encrypts the data.
+func (e *Envelope) Wrap(data []byte) ([]byte, error) {
+	compression := e.Compression
+	if len(data) < e.MinSize {
+		compression = CompressionNone
+	}
+	payload, err := compress(compression, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.KeyID) > 255 {
+		return nil, fmt.Errorf("[nats] envelope key id is too long")
+	}
+
+	header := make([]byte, envelopeHeader, envelopeHeader+len(e.KeyID))
+	copy(header, envelopeMagic)
+	header[3], header[4], header[5] = envelopeVersion, byte(compression), byte(len(e.KeyID))
+	header = append(header, e.KeyID...)
+	if e.KeyID == "" {
+		return append(header, payload...), nil
+	}
+
+	aead, err := e.aead(e.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, payload, header), nil
+}
+
+// Unwrap decrypts and decompresses the data, plain data is returned unchanged.
+func (e *Envelope) Unwrap(data []byte) ([]byte, error) {
+	if !IsEnvelope(data) {
+		return data, nil
+	}
+	if data[3] != envelopeVersion {
+		return nil, ErrEnvelopeVersion
+	}
+	compression, n := Compression(data[4]), envelopeHeader+int(data[5])
+	if len(data) < n {
+		return nil, ErrEnvelopeHeader
+	}
+	header, payload := data[:n], data[n:]
+	if keyID := string(header[envelopeHeader:]); keyID != "" {
+		aead, err := e.aead(keyID)
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) < aead.NonceSize() {
+			return nil, ErrEnvelopeHeader
+		}
+		nonce := payload[:aead.NonceSize()]
+		if payload, err = aead.Open(nil, nonce, payload[aead.NonceSize():], header); err != nil {
+			return nil, err
+		}
+	}
+	maxSize := e.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultEnvelopeMaxSize
+	}
+	return decompress(compression, payload, maxSize)
+}
+
+// Handler wraps the next handler with unwrapping the messages.
+func (e *Envelope) Handler(next nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		if e.Handle(msg) {
+			next(msg)
+		}
+	}
+}
+
+// Handle unwraps the message data in place, returns false when the message is rejected.
+func (e *Envelope) Handle(msg *nats.Msg) bool {
+	data, err := e.Unwrap(msg.Data)
+	if err != nil {
+		if e.Reject != nil {
+			e.Reject(msg, err)
+		} else {
+			Log.Error().Msgf("[nats] reject message on %q > %v", msg.Subject, err)
+		}
+		return false
+	}
+	msg.Data = data
+	return true
+}
+
+// Publish wraps the data and publishes it to the subject.
+func (e *Envelope) Publish(nc *nats.Conn, subj string, data []byte) error {
+	data, err := e.Wrap(data)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(subj, data)
+}
+
+// Request wraps the data, sends a request and unwraps the response.
+func (e *Envelope) Request(nc *nats.Conn, subj string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	data, err := e.Wrap(data)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := nc.Request(subj, data, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Data, err = e.Unwrap(msg.Data); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Publish publishes the data to the subject, wrapped with the global Seal if it is set.
+func Publish(nc *nats.Conn, subj string, data []byte) error {
+	if Seal != nil {
+		return Seal.Publish(nc, subj, data)
+	}
+	return nc.Publish(subj, data)
+}
+
+// Request sends a request, wrapped with the global Seal if it is set.
+func Request(nc *nats.Conn, subj string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	if Seal != nil {
+		return Seal.Request(nc, subj, data, timeout)
+	}
+	return nc.Request(subj, data, timeout)
+}
+
+func (e *Envelope) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := e.Keys[keyID]
+	if !ok {
+		return nil, ErrEnvelopeKeyID
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+	})
+}
+
+// zstdDecoder gets the decoder that stops decoding at the max size.
+func zstdDecoder(maxSize int) (*zstd.Decoder, error) {
+	zstdMu.Lock()
+	defer zstdMu.Unlock()
+	if d, ok := zstdDecoders[maxSize]; ok {
+		return d, nil
+	}
+	d, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+	zstdDecoders[maxSize] = d
+	return d, nil
+}
+
+func compress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	case CompressionZstd:
+		initZstd()
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("[nats] unknown envelope compression %d", compression)
+}
+
+// decompress decompresses the data, ErrEnvelopeSize is returned when the output exceeds the max size.
+func decompress(compression Compression, data []byte, maxSize int) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		if len(data) > maxSize {
+			return nil, ErrEnvelopeSize
+		}
+		return data, nil
+	case CompressionSnappy:
+		if n, err := snappy.DecodedLen(data); err != nil {
+			return nil, err
+		} else if n > maxSize {
+			return nil, ErrEnvelopeSize
+		}
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		d, err := zstdDecoder(maxSize)
+		if err != nil {
+			return nil, err
+		}
+		out, err := d.DecodeAll(data, nil)
+		switch {
+		case err == zstd.ErrDecoderSizeExceeded, err == zstd.ErrFrameSizeExceeded, err == zstd.ErrWindowSizeExceeded:
+			return nil, ErrEnvelopeSize
+		case err == nil && len(out) > maxSize:
+			return nil, ErrEnvelopeSize
+		}
+		return out, err
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = r.Close() }()
+		out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+		if err == nil && len(out) > maxSize {
+			return nil, ErrEnvelopeSize
+		}
+		return out, err
+	}
+	return nil, fmt.Errorf("[nats] unknown envelope compression %d", compression)
+}
@@ -0,0 +1,74 @@
+package nats_test
+
+import (
+	"bytes"
+	"testing"
+
+	nat "github.com/angenalZZZ/gofunc/rpc/nats"
+	"github.com/nats-io/nats.go"
+)
+
+func TestEnvelope(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"id":1,"name":"abc"}`), 100)
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, c := range []nat.Compression{nat.CompressionNone, nat.CompressionSnappy, nat.CompressionZstd, nat.CompressionGzip} {
+		for _, keyID := range []string{"", "k1"} {
+			e := nat.NewEnvelope(c, keyID, key)
+			wrapped, err := e.Wrap(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !nat.IsEnvelope(wrapped) || (c != nat.CompressionNone && len(wrapped) >= len(data)) {
+				t.Fatalf("compression %d key %q: %d bytes", c, keyID, len(wrapped))
+			}
+			unwrapped, err := e.Unwrap(wrapped)
+			if err != nil || !bytes.Equal(unwrapped, data) {
+				t.Fatalf("compression %d key %q: %v", c, keyID, err)
+			}
+		}
+	}
+
+	// key rotation and unknown keys
+	e1, e2 := nat.NewEnvelope(nat.CompressionSnappy, "k1", key), nat.NewEnvelope(nat.CompressionSnappy, "k2", key[:16])
+	wrapped, _ := e1.Wrap(data)
+	if _, err := e2.Unwrap(wrapped); err != nat.ErrEnvelopeKeyID {
+		t.Fatal(err)
+	}
+	e2.Keys["k1"] = key
+	if unwrapped, err := e2.Unwrap(wrapped); err != nil || !bytes.Equal(unwrapped, data) {
+		t.Fatal(err)
+	}
+
+	// tampered data
+	wrapped[len(wrapped)-1] ^= 0xff
+	if _, err := e1.Unwrap(wrapped); err == nil {
+		t.Fail()
+	}
+
+	// plain messages during migration, binary messages may start with 0x00
+	for _, data := range [][]byte{[]byte(`{"id":1}`), {0x00, 0x01, 0x00, 0x00, 0xff}} {
+		msg := &nats.Msg{Subject: "test", Data: data}
+		if !e1.Handle(msg) || !bytes.Equal(msg.Data, data) {
+			t.Fatal(msg.Data)
+		}
+	}
+}
+
+func TestEnvelopeMaxSize(t *testing.T) {
+	data := make([]byte, 4096)
+	for _, c := range []nat.Compression{nat.CompressionNone, nat.CompressionSnappy, nat.CompressionZstd, nat.CompressionGzip} {
+		e := nat.NewEnvelope(c, "", nil)
+		wrapped, err := e.Wrap(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = e.Limit(1024).Unwrap(wrapped); err != nil {
+			t.Fatalf("compression %d: %v", c, err)
+		}
+		e.MaxSize = 0
+		if _, err = e.Limit(1024).Unwrap(wrapped); err != nat.ErrEnvelopeSize {
+			t.Fatalf("compression %d: %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package nats
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/configfile"
+	"github.com/angenalZZZ/gofunc/log"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ManagerConfig Defines From A Config File, named connections:
+//
+//	nats:
+//	  default:
+//	    servers: [nats://127.0.0.1:4222, nats://127.0.0.1:4223]
+//	    token: HGJ766GR767FKJU0
+//	    reconnectWait: 2s
+type ManagerConfig struct {
+	Nats map[string]*ConnectionConfig
+}
+
+// ConnectionConfig a named connection with multiple servers, reconnect and credentials settings.
+type ConnectionConfig struct {
+	// 集群地址
+	Servers []string
+	// 身份认证
+	Token string
+	Cred  string
+	// 客户端证书 and 根证书
+	Cert string
+	Key  string
+	CA   string
+	// 最大重连次数: -1=无限
+	MaxReconnects int `yaml:"maxReconnects"`
+	// 重连间隔,每次失败后加倍,直到最大重连间隔
+	ReconnectWait    time.Duration `yaml:"reconnectWait"`
+	MaxReconnectWait time.Duration `yaml:"maxReconnectWait"`
+	ReconnectJitter  time.Duration `yaml:"reconnectJitter"`
+	// 连接超时 and 心跳间隔
+	Timeout      time.Duration
+	PingInterval time.Duration `yaml:"pingInterval"`
+	// 检查证书文件变化的间隔
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// Manager owns named connections to nats-servers,
+// reloads the tls certs and creds files when they change on disk,
+// and collects the connection stats for Prometheus.
+type Manager struct {
+	// Log logger for connections.
+	Log *log.Logger
+	// OnDisconnect is called when a connection is disconnected.
+	OnDisconnect func(name string, err error)
+	// OnReconnect is called when a connection is reconnected.
+	OnReconnect func(name string, url string)
+
+	configs map[string]*ConnectionConfig
+	conns   map[string]*managedConn
+	lock    sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+}
+
+type managedConn struct {
+	*nats.Conn
+	name     string
+	config   *ConnectionConfig
+	tls      atomic.Value // *tlsFiles
+	modTimes map[string]time.Time
+}
+
+// tlsFiles the client cert and root CAs loaded from files.
+type tlsFiles struct {
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+var (
+	statsDesc = map[string]*prometheus.Desc{
+		"in_msgs":    prometheus.NewDesc("nats_in_msgs_total", "The number of messages received", []string{"name"}, nil),
+		"out_msgs":   prometheus.NewDesc("nats_out_msgs_total", "The number of messages sent", []string{"name"}, nil),
+		"in_bytes":   prometheus.NewDesc("nats_in_bytes_total", "The number of bytes received", []string{"name"}, nil),
+		"out_bytes":  prometheus.NewDesc("nats_out_bytes_total", "The number of bytes sent", []string{"name"}, nil),
+		"reconnects": prometheus.NewDesc("nats_reconnects_total", "The number of reconnects", []string{"name"}, nil),
+		"connected":  prometheus.NewDesc("nats_connected", "Whether the connection is connected", []string{"name"}, nil),
+	}
+)
+
+// NewManager creates a connection manager of the named connections.
+func NewManager(configs map[string]*ConnectionConfig) *Manager {
+	m := &Manager{
+		configs: make(map[string]*ConnectionConfig),
+		conns:   make(map[string]*managedConn),
+		done:    make(chan struct{}),
+	}
+	for name, config := range configs {
+		m.configs[name] = config
+	}
+	if m.Log = Log; m.Log == nil {
+		m.Log = log.InitConsole("15:04:05.000", false)
+	}
+	return m
+}
+
+// NewManagerFromFile creates a connection manager from a yaml config file.
+func NewManagerFromFile(filename string) (*Manager, error) {
+	config := new(ManagerConfig)
+	if err := configfile.YamlTo(filename, config); err != nil {
+		return nil, err
+	}
+	if len(config.Nats) == 0 {
+		return nil, fmt.Errorf("[nats] no connections in %q", filename)
+	}
+	return NewManager(config.Nats), nil
+}
+
+// Names returns the sorted names of the connections.
+func (m *Manager) Names() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0, len(m.configs))
+	for name := range m.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Conn returns the named connection, connects it on first use.
+// The manager isn't locked while connecting, a connection of a concurrent call is closed.
+func (m *Manager) Conn(name string) (*nats.Conn, error) {
+	m.lock.Lock()
+	if mc, ok := m.conns[name]; ok {
+		m.lock.Unlock()
+		return mc.Conn, nil
+	}
+	config, ok := m.configs[name]
+	m.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("[nats] connection %q is not configured", name)
+	}
+
+	mc, err := m.connect(name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	select {
+	case <-m.done:
+		mc.Close()
+		return nil, nats.ErrConnectionClosed
+	default:
+	}
+	if c, ok := m.conns[name]; ok {
+		mc.Close()
+		return c.Conn, nil
+	}
+	m.conns[name] = mc
+	if config.ReloadInterval > 0 && len(mc.modTimes) > 0 {
+		go m.watch(mc)
+	}
+	return mc.Conn, nil
+}
+
+// ConnectAll connects all the named connections.
+func (m *Manager) ConnectAll() error {
+	for _, name := range m.Names() {
+		if _, err := m.Conn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the stats of the named connection, including its number of reconnects.
+func (m *Manager) Stats(name string) (stats nats.Statistics, ok bool) {
+	m.lock.Lock()
+	mc, ok := m.conns[name]
+	m.lock.Unlock()
+	if ok {
+		stats = mc.Stats()
+	}
+	return
+}
+
+// Close drains and closes all the connections.
+func (m *Manager) Close() {
+	m.once.Do(func() { close(m.done) })
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for name, mc := range m.conns {
+		if err := mc.Drain(); err != nil {
+			mc.Close()
+		}
+		delete(m.conns, name)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Manager) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range statsDesc {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Manager) Collect(ch chan<- prometheus.Metric) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for name, mc := range m.conns {
+		stats, connected := mc.Stats(), 0.0
+		if mc.IsConnected() {
+			connected = 1
+		}
+		ch <- prometheus.MustNewConstMetric(statsDesc["in_msgs"], prometheus.CounterValue, float64(stats.InMsgs), name)
+		ch <- prometheus.MustNewConstMetric(statsDesc["out_msgs"], prometheus.CounterValue, float64(stats.OutMsgs), name)
+		ch <- prometheus.MustNewConstMetric(statsDesc["in_bytes"], prometheus.CounterValue, float64(stats.InBytes), name)
+		ch <- prometheus.MustNewConstMetric(statsDesc["out_bytes"], prometheus.CounterValue, float64(stats.OutBytes), name)
+		ch <- prometheus.MustNewConstMetric(statsDesc["reconnects"], prometheus.CounterValue, float64(stats.Reconnects), name)
+		ch <- prometheus.MustNewConstMetric(statsDesc["connected"], prometheus.GaugeValue, connected, name)
+	}
+}
+
+func (m *Manager) connect(name string, config *ConnectionConfig) (*managedConn, error) {
+	mc := &managedConn{name: name, config: config, modTimes: make(map[string]time.Time)}
+	ops, err := m.options(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := nats.DefaultURL
+	if len(config.Servers) > 0 {
+		addr = strings.Join(config.Servers, ",")
+	}
+	if mc.Conn, err = nats.Connect(addr, ops...); err != nil {
+		return nil, err
+	}
+	m.Log.Info().Msgf("[nats] %s connected %q", name, mc.ConnectedUrl())
+	return mc, nil
+}
+
+func (m *Manager) options(mc *managedConn) ([]nats.Option, error) {
+	config, name := mc.config, mc.name
+	ops := []nats.Option{nats.Name(name)}
+
+	if config.Cred != "" {
+		// The creds file is read on every connect, so rotated creds apply to the next reconnect.
+		ops = append(ops, nats.UserCredentials(config.Cred))
+		mc.modTime(config.Cred)
+	}
+	if config.Token != "" {
+		ops = append(ops, nats.Token(config.Token))
+	}
+	if config.Cert != "" || config.CA != "" {
+		if err := mc.loadTLS(); err != nil {
+			return nil, err
+		}
+		ops = append(ops, nats.Secure(mc.tlsConfig()))
+		for _, filename := range []string{config.Cert, config.Key, config.CA} {
+			if filename != "" {
+				mc.modTime(filename)
+			}
+		}
+	}
+
+	maxReconnects, reconnectWait, maxReconnectWait, jitter := config.MaxReconnects, config.ReconnectWait, config.MaxReconnectWait, config.ReconnectJitter
+	if maxReconnects == 0 {
+		maxReconnects = 1200
+	}
+	if reconnectWait <= 0 {
+		reconnectWait = 2 * time.Second
+	}
+	if maxReconnectWait < reconnectWait {
+		maxReconnectWait = reconnectWait
+	}
+	timeout, pingInterval := config.Timeout, config.PingInterval
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	if pingInterval <= 0 {
+		pingInterval = time.Minute
+	}
+
+	ops = append(ops,
+		nats.MaxReconnects(maxReconnects),
+		nats.CustomReconnectDelay(func(attempts int) time.Duration {
+			return reconnectDelay(attempts, reconnectWait, maxReconnectWait, jitter)
+		}),
+		nats.PingInterval(pingInterval),
+		nats.Timeout(timeout),
+		nats.SyncQueueLen(100000000),     // sets number of messages will buffer internally.
+		nats.ReconnectBufSize(104857600), // 100Mb size of messages kept while busy reconnecting.
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			m.Log.Error().Msgf("[nats] %s disconnected due to: %v", name, err)
+			if m.OnDisconnect != nil {
+				m.OnDisconnect(name, err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			m.Log.Warn().Msgf("[nats] %s reconnected %q", name, nc.ConnectedUrl())
+			if m.OnReconnect != nil {
+				m.OnReconnect(name, nc.ConnectedUrl())
+			}
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			m.Log.Warn().Msgf("[nats] %s closed", name)
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			if sub != nil {
+				m.Log.Error().Msgf("[nats] %s error on %q > %v", name, sub.Subject, err)
+			} else {
+				m.Log.Error().Msgf("[nats] %s error > %v", name, err)
+			}
+		}),
+	)
+	return ops, nil
+}
+
+// reconnectDelay doubles the wait after each failed attempt up to the max wait, and adds a random jitter.
+func reconnectDelay(attempts int, wait, maxWait, jitter time.Duration) time.Duration {
+	for i := 1; i < attempts && wait < maxWait; i++ {
+		wait *= 2
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	if jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return wait
+}
+
+// watch reloads the tls files when they change on disk.
+func (m *Manager) watch(mc *managedConn) {
+	ticker := time.NewTicker(mc.config.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			if mc.IsClosed() {
+				return
+			}
+			changed, modTimes := mc.changedFiles()
+			if len(changed) == 0 {
+				continue
+			}
+			// The files are reloaded again on the next tick until they are loaded.
+			if mc.config.Cert != "" || mc.config.CA != "" {
+				if err := mc.loadTLS(); err != nil {
+					m.Log.Error().Msgf("[nats] %s reload tls files > %v", mc.name, err)
+					continue
+				}
+			}
+			for filename, t := range modTimes {
+				mc.modTimes[filename] = t
+			}
+			m.Log.Info().Msgf("[nats] %s reloaded %s, applies to the next connect", mc.name, strings.Join(changed, ","))
+		}
+	}
+}
+
+// modTime returns the last modification time of the file, and records it.
+func (mc *managedConn) modTime(filename string) time.Time {
+	t := fileModTime(filename)
+	mc.modTimes[filename] = t
+	return t
+}
+
+// changedFiles returns the files modified since they are recorded, and their modification times to record.
+func (mc *managedConn) changedFiles() (changed []string, modTimes map[string]time.Time) {
+	modTimes = make(map[string]time.Time)
+	for filename, t := range mc.modTimes {
+		if mt := fileModTime(filename); !mt.Equal(t) {
+			changed = append(changed, filename)
+			modTimes[filename] = mt
+		}
+	}
+	sort.Strings(changed)
+	return
+}
+
+// fileModTime returns the last modification time of the file, or the zero time if it doesn't exist.
+func fileModTime(filename string) time.Time {
+	if fi, err := os.Stat(filename); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+func (mc *managedConn) loadTLS() error {
+	files := new(tlsFiles)
+	if mc.config.Cert != "" && mc.config.Key != "" {
+		cert, err := tls.LoadX509KeyPair(mc.config.Cert, mc.config.Key)
+		if err != nil {
+			return fmt.Errorf("[nats] error loading client certificate: %v", err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("[nats] error parsing client certificate: %v", err)
+		}
+		files.cert = &cert
+	}
+	if mc.config.CA != "" {
+		rootPEM, err := ioutil.ReadFile(mc.config.CA)
+		if err != nil || rootPEM == nil {
+			return fmt.Errorf("[nats] error loading root ca certificate: %v", err)
+		}
+		files.pool = x509.NewCertPool()
+		if !files.pool.AppendCertsFromPEM(rootPEM) {
+			return fmt.Errorf("[nats] failed to parse root ca certificate")
+		}
+	}
+	mc.tls.Store(files)
+	return nil
+}
+
+// tlsConfig returns a tls.Config that always uses the last loaded tls files,
+// the verification of the server certificate is done in VerifyConnection with the current root CAs.
+func (mc *managedConn) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if files := mc.tls.Load().(*tlsFiles); files.cert != nil {
+				return files.cert, nil
+			}
+			return new(tls.Certificate), nil
+		},
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			opts := x509.VerifyOptions{
+				Roots:         mc.tls.Load().(*tlsFiles).pool,
+				DNSName:       cs.ServerName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
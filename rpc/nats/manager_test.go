@@ -0,0 +1,197 @@
+package nats_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/angenalZZZ/gofunc/configfile"
+	nat "github.com/angenalZZZ/gofunc/rpc/nats"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+)
+
+func TestNewManagerFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	filename := filepath.Join(dir, "nats.yaml")
+	config := []byte(`nats:
+  default:
+    servers: [nats://127.0.0.1:4222, nats://127.0.0.1:4223]
+    token: HGJ766GR767FKJU0
+    reconnectWait: 2s
+    maxReconnectWait: 1m
+  backup:
+    servers: [nats://127.0.0.1:4224]
+`)
+	if err = ioutil.WriteFile(filename, config, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := nat.NewManagerFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := m.Names(); len(names) != 2 || names[0] != "backup" || names[1] != "default" {
+		t.Fatal(names)
+	}
+	if _, err = m.Conn("unknown"); err == nil {
+		t.Fail()
+	}
+	if _, ok := m.Stats("default"); ok {
+		t.Fail()
+	}
+	m.Close()
+
+	c := new(nat.ManagerConfig)
+	if err = configfile.YamlTo(filename, c); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.Nats["default"]; len(d.Servers) != 2 || d.ReconnectWait != 2*time.Second || d.MaxReconnectWait != time.Minute {
+		t.Fatal(d)
+	}
+}
+
+func runServer(port int, cert *tls.Certificate) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = port
+	if cert != nil {
+		opts.TLS, opts.TLSTimeout = true, 2
+		opts.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12}
+	}
+	return natsserver.RunServer(&opts)
+}
+
+// testCert creates a CA and a server certificate of 127.0.0.1 signed by it.
+func testCert(t *testing.T) (caPEM []byte, cert tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return caPEM, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestManagerReconnect(t *testing.T) {
+	srv := runServer(14222, nil)
+	m := nat.NewManager(map[string]*nat.ConnectionConfig{
+		"default": {
+			Servers:         []string{"nats://127.0.0.1:14222"},
+			MaxReconnects:   -1,
+			ReconnectWait:   20 * time.Millisecond,
+			ReconnectJitter: 20 * time.Millisecond,
+		},
+	})
+	defer m.Close()
+	disconnected, reconnected := make(chan error, 1), make(chan string, 1)
+	m.OnDisconnect = func(name string, err error) { disconnected <- err }
+	m.OnReconnect = func(name string, url string) { reconnected <- url }
+
+	if _, err := m.Conn("default"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Shutdown()
+	<-disconnected
+	srv = runServer(14222, nil)
+	defer srv.Shutdown()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if stats, ok := m.Stats("default"); !ok || stats.Reconnects != 1 {
+		t.Fatal(stats)
+	}
+}
+
+func TestManagerReloadTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	ca := filepath.Join(dir, "ca.pem")
+	caPEM, cert := testCert(t)
+	if err = ioutil.WriteFile(ca, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := runServer(14223, &cert)
+	m := nat.NewManager(map[string]*nat.ConnectionConfig{
+		"default": {
+			Servers:        []string{"tls://127.0.0.1:14223"},
+			CA:             ca,
+			MaxReconnects:  -1,
+			ReconnectWait:  20 * time.Millisecond,
+			ReloadInterval: 20 * time.Millisecond,
+		},
+	})
+	defer m.Close()
+	reconnected := make(chan string, 1)
+	m.OnReconnect = func(name string, url string) { reconnected <- url }
+
+	if _, err = m.Conn("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partially written CA file fails to load, it's reloaded until it's complete with the same modification time.
+	modTime := time.Now().Add(time.Second)
+	if err = ioutil.WriteFile(ca, caPEM[:len(caPEM)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(ca, modTime, modTime)
+	time.Sleep(100 * time.Millisecond)
+
+	// The server certificate is signed by a new CA, the connection reconnects with the reloaded CA file.
+	caPEM, cert = testCert(t)
+	if err = ioutil.WriteFile(ca, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(ca, modTime, modTime)
+	srv.Shutdown()
+	srv = runServer(14223, &cert)
+	defer srv.Shutdown()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
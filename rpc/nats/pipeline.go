@@ -0,0 +1,459 @@
+package nats
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/angenalZZZ/gofunc/configfile"
+	"github.com/angenalZZZ/gofunc/data/id/snowid"
+	"github.com/angenalZZZ/gofunc/f"
+	"github.com/nats-io/nats.go"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Enrich computed field values of a Pipeline.
+const (
+	EnrichSnowId    = "snowid"    // snowid.NextId()
+	EnrichTimestamp = "timestamp" // receive time in unix milliseconds
+	EnrichTime      = "time"      // receive time in RFC3339
+	EnrichSubject   = "subject"   // message subject
+)
+
+// Pipeline the validation and transformation stage for the messages of a subscriber.
+//
+// Each JSON message is validated against the json Schema and the f.ValidateMap Rules,
+// then its fields are renamed, removed and projected with gjson/sjson paths,
+// and enriched with computed fields. Messages that fail are routed to the Reject handler.
+type Pipeline struct {
+	// JSON Schema: type,required,properties,additionalProperties,items,enum,
+	// minimum,maximum,minLength,maxLength,pattern,minItems,maxItems
+	Schema map[string]interface{}
+	// f.ValidateMap rules, e.g. {"name": "required,alpha"}
+	Rules map[string]interface{}
+	// rename fields: old path -> new path
+	Rename map[string]string
+	// remove fields: paths
+	Remove []string
+	// project fields: new path -> old path, only the projected fields are kept
+	Project map[string]string
+	// computed fields: path -> snowid,timestamp,time,subject
+	Enrich map[string]string
+	// Reject handles the messages that fail.
+	Reject func(msg *nats.Msg, err error) `yaml:"-"`
+
+	once     sync.Once
+	err      error
+	patterns map[string]*regexp.Regexp
+}
+
+// Pipelines the declarative pipelines per subject, a subject may contain the wildcards * and >.
+//
+//	pipelines:
+//	  orders.>:
+//	    rules: {id: "required,int", name: "required"}
+//	    enrich: {_id: snowid, _t: timestamp}
+type Pipelines map[string]*Pipeline
+
+// LoadPipelines loads the pipelines per subject from a yaml config file.
+func LoadPipelines(filename string) (Pipelines, error) {
+	config := &struct{ Pipelines Pipelines }{}
+	if err := configfile.YamlTo(filename, config); err != nil {
+		return nil, err
+	}
+	for subject, p := range config.Pipelines {
+		if err := p.Compile(); err != nil {
+			return nil, fmt.Errorf("[nats] pipeline %q > %v", subject, err)
+		}
+	}
+	return config.Pipelines, nil
+}
+
+// Match returns the pipeline of the subject, the exact subject takes precedence over the wildcards.
+func (ps Pipelines) Match(subject string) *Pipeline {
+	return ps.match(ps.subjects(), subject)
+}
+
+// Handler wraps the next handler with the pipeline matched by the subject of each message,
+// a message without any pipeline is passed through.
+func (ps Pipelines) Handler(next nats.MsgHandler) nats.MsgHandler {
+	subjects := ps.subjects()
+	return func(msg *nats.Msg) {
+		if p := ps.match(subjects, msg.Subject); p == nil || p.Handle(msg) {
+			next(msg)
+		}
+	}
+}
+
+func (ps Pipelines) match(subjects []string, subject string) *Pipeline {
+	if p, ok := ps[subject]; ok {
+		return p
+	}
+	for _, s := range subjects {
+		if MatchSubject(s, subject) {
+			return ps[s]
+		}
+	}
+	return nil
+}
+
+// subjects returns the subjects, the longer subject is more specific.
+func (ps Pipelines) subjects() []string {
+	subjects := make([]string, 0, len(ps))
+	for s := range ps {
+		subjects = append(subjects, s)
+	}
+	sort.Slice(subjects, func(i, j int) bool {
+		if len(subjects[i]) != len(subjects[j]) {
+			return len(subjects[i]) > len(subjects[j])
+		}
+		return subjects[i] < subjects[j]
+	})
+	return subjects
+}
+
+// MatchSubject reports whether the subject matches the pattern with the wildcards * and >.
+func MatchSubject(pattern, subject string) bool {
+	if pattern == subject {
+		return true
+	}
+	patterns, tokens := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, p := range patterns {
+		if p == ">" {
+			return len(tokens) > i
+		}
+		if i >= len(tokens) || (p != "*" && p != tokens[i]) {
+			return false
+		}
+	}
+	return len(patterns) == len(tokens)
+}
+
+// Compile normalizes the yaml maps and compiles the schema patterns.
+func (p *Pipeline) Compile() error {
+	p.once.Do(func() { p.err = p.compile() })
+	return p.err
+}
+
+func (p *Pipeline) compile() error {
+	if p.Schema != nil {
+		p.Schema = normalizeMap(p.Schema)
+	}
+	if p.Rules != nil {
+		p.Rules = normalizeMap(p.Rules)
+	}
+	for path, v := range p.Enrich {
+		switch v {
+		case EnrichSnowId, EnrichTimestamp, EnrichTime, EnrichSubject:
+		default:
+			return fmt.Errorf("unknown enrich value %q of %q", v, path)
+		}
+	}
+	p.patterns = make(map[string]*regexp.Regexp)
+	return p.compilePatterns(p.Schema)
+}
+
+func (p *Pipeline) compilePatterns(schema map[string]interface{}) error {
+	for k, v := range schema {
+		switch v := v.(type) {
+		case string:
+			if k == "pattern" {
+				re, err := regexp.Compile(v)
+				if err != nil {
+					return err
+				}
+				p.patterns[v] = re
+			}
+		case map[string]interface{}:
+			if err := p.compilePatterns(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handler wraps the next handler with the pipeline.
+func (p *Pipeline) Handler(next nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		if p.Handle(msg) {
+			next(msg)
+		}
+	}
+}
+
+// Handle processes the message data in place, returns false when the message is rejected.
+func (p *Pipeline) Handle(msg *nats.Msg) bool {
+	data, err := p.Process(msg.Subject, msg.Data)
+	if err != nil {
+		if p.Reject != nil {
+			p.Reject(msg, err)
+		} else {
+			Log.Error().Msgf("[nats] reject message on %q > %v", msg.Subject, err)
+		}
+		return false
+	}
+	msg.Data = data
+	return true
+}
+
+// Process validates and transforms the JSON data of a message.
+func (p *Pipeline) Process(subject string, data []byte) ([]byte, error) {
+	if err := p.Compile(); err != nil {
+		return nil, err
+	}
+	if !gjson.ValidBytes(data) {
+		return nil, fmt.Errorf("invalid json")
+	}
+
+	if p.Schema != nil || p.Rules != nil {
+		var v interface{}
+		if err := f.DecodeJson(data, &v); err != nil {
+			return nil, err
+		}
+		if p.Schema != nil {
+			if err := p.validate(p.Schema, v, "$"); err != nil {
+				return nil, err
+			}
+		}
+		if p.Rules != nil {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("rules validator has to be for the json object only")
+			}
+			if ok, err := f.ValidateMap(m, p.Rules); err != nil {
+				return nil, err
+			} else if !ok {
+				return nil, fmt.Errorf("rules validation failed")
+			}
+		}
+	}
+
+	var err error
+	for _, from := range sortedKeys(p.Rename) {
+		to := p.Rename[from]
+		if r := gjson.GetBytes(data, from); r.Exists() {
+			if data, err = sjson.SetRawBytes(data, to, []byte(r.Raw)); err != nil {
+				return nil, err
+			}
+			if data, err = sjson.DeleteBytes(data, from); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, path := range p.Remove {
+		if data, err = sjson.DeleteBytes(data, path); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.Project) > 0 {
+		out := []byte("{}")
+		for _, to := range sortedKeys(p.Project) {
+			from := p.Project[to]
+			if r := gjson.GetBytes(data, from); r.Exists() {
+				if out, err = sjson.SetRawBytes(out, to, []byte(r.Raw)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		data = out
+	}
+	if len(p.Enrich) > 0 {
+		now := time.Now()
+		for _, path := range sortedKeys(p.Enrich) {
+			v := p.Enrich[path]
+			var value interface{}
+			switch v {
+			case EnrichSnowId:
+				value = snowid.NextId()
+			case EnrichTimestamp:
+				value = now.UnixNano() / int64(time.Millisecond)
+			case EnrichTime:
+				value = now.Format(time.RFC3339Nano)
+			case EnrichSubject:
+				value = subject
+			}
+			if data, err = sjson.SetBytes(data, path, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// sortedKeys returns the keys in order, the fields are renamed, projected and enriched deterministically.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validate the value against a subset of the JSON Schema.
+func (p *Pipeline) validate(schema map[string]interface{}, v interface{}, path string) error {
+	if t, ok := schema["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, s := range t {
+				types = append(types, fmt.Sprint(s))
+			}
+		}
+		ok = false
+		for _, s := range types {
+			if jsonTypeOf(v, s) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: expected type %s", path, strings.Join(types, ","))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value %v is not in enum", path, v)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := v[fmt.Sprint(name)]; !ok {
+					return fmt.Errorf("%s.%v: required field missing", path, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, value := range v {
+			if s, ok := properties[name].(map[string]interface{}); ok {
+				if err := p.validate(s, value, path+"."+name); err != nil {
+					return err
+				}
+			} else if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				return fmt.Errorf("%s.%s: additional field not allowed", path, name)
+			}
+		}
+	case []interface{}:
+		if n, ok := toFloat(schema["minItems"]); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s: expected at least %v items", path, n)
+		}
+		if n, ok := toFloat(schema["maxItems"]); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s: expected at most %v items", path, n)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := p.validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(v))
+		if min, ok := toFloat(schema["minLength"]); ok && n < min {
+			return fmt.Errorf("%s: expected min length %v", path, min)
+		}
+		if max, ok := toFloat(schema["maxLength"]); ok && n > max {
+			return fmt.Errorf("%s: expected max length %v", path, max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re := p.patterns[pattern]; re != nil && !re.MatchString(v) {
+				return fmt.Errorf("%s: does not match pattern %s", path, pattern)
+			}
+		}
+	case float64:
+		if min, ok := toFloat(schema["minimum"]); ok && v < min {
+			return fmt.Errorf("%s: expected minimum %v", path, min)
+		}
+		if max, ok := toFloat(schema["maximum"]); ok && v > max {
+			return fmt.Errorf("%s: expected maximum %v", path, max)
+		}
+	}
+	return nil
+}
+
+func jsonTypeOf(v interface{}, t string) bool {
+	switch t {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// normalizeMap converts the map[interface{}]interface{} decoded by yaml to map[string]interface{}.
+func normalizeMap(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		m[k] = normalizeValue(v)
+	}
+	return m
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, o := range v {
+			m[fmt.Sprint(k)] = normalizeValue(o)
+		}
+		return m
+	case map[string]interface{}:
+		return normalizeMap(v)
+	case []interface{}:
+		for i, o := range v {
+			v[i] = normalizeValue(o)
+		}
+		return v
+	}
+	return v
+}
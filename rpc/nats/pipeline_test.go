@@ -0,0 +1,106 @@
+package nats_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	nat "github.com/angenalZZZ/gofunc/rpc/nats"
+	"github.com/nats-io/nats.go"
+	"github.com/tidwall/gjson"
+)
+
+func TestPipeline(t *testing.T) {
+	p := &nat.Pipeline{
+		Schema: map[string]interface{}{
+			"type":     "object",
+			"required": []interface{}{"id", "name"},
+			"properties": map[string]interface{}{
+				"id":   map[string]interface{}{"type": "integer", "minimum": 1},
+				"name": map[string]interface{}{"type": "string", "pattern": "^[a-z]+$"},
+			},
+		},
+		Rename:  map[string]string{"name": "user.name"},
+		Project: map[string]string{"id": "id", "name": "user.name"},
+		Enrich:  map[string]string{"_id": nat.EnrichSnowId, "_s": nat.EnrichSubject},
+	}
+
+	data, err := p.Process("orders.created", []byte(`{"id":1,"name":"abc","secret":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gjson.ParseBytes(data)
+	if r.Get("id").Int() != 1 || r.Get("name").String() != "abc" || r.Get("secret").Exists() ||
+		r.Get("_id").Uint() == 0 || r.Get("_s").String() != "orders.created" {
+		t.Fatal(string(data))
+	}
+
+	rejected := 0
+	p.Reject = func(msg *nats.Msg, err error) { rejected++ }
+	for _, s := range []string{`{"id":0,"name":"abc"}`, `{"id":1,"name":"ABC"}`, `{"id":1}`, `not json`} {
+		if p.Handle(&nats.Msg{Subject: "orders.created", Data: []byte(s)}) {
+			t.Errorf("accepted %s", s)
+		}
+	}
+	if rejected != 4 {
+		t.Fatal(rejected)
+	}
+}
+
+func TestLoadPipelines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	filename := filepath.Join(dir, "pipelines.yaml")
+	config := []byte(`pipelines:
+  orders.>:
+    rules: {id: "required", name: "required"}
+    enrich: {_t: timestamp}
+  orders.created:
+    remove: [secret]
+`)
+	if err = ioutil.WriteFile(filename, config, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ps, err := nat.LoadPipelines(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.Match("orders.created") != ps["orders.created"] || ps.Match("orders.item.paid") != ps["orders.>"] || ps.Match("users") != nil {
+		t.Fail()
+	}
+	data, err := ps.Match("orders.paid").Process("orders.paid", []byte(`{"id":"1","name":"abc"}`))
+	if err != nil || !gjson.GetBytes(data, "_t").Exists() {
+		t.Fatal(err, string(data))
+	}
+	if _, err = ps.Match("orders.paid").Process("orders.paid", []byte(`{"id":"1"}`)); err == nil {
+		t.Fail()
+	}
+}
+
+func TestPipelinesHandler(t *testing.T) {
+	ps := nat.Pipelines{
+		"orders.eu": {Remove: []string{"secret"}},
+		"orders.us": {Rename: map[string]string{"a": "x", "b": "x"}},
+	}
+	var received []string
+	hand := ps.Handler(func(msg *nats.Msg) { received = append(received, string(msg.Data)) })
+
+	// The pipelines are matched by the subject of each message, not the subscribed subject orders.*.
+	for _, msg := range []*nats.Msg{
+		{Subject: "orders.eu", Data: []byte(`{"id":1,"secret":"x"}`)},
+		{Subject: "orders.us", Data: []byte(`{"a":1,"b":2}`)},
+		{Subject: "orders.cn", Data: []byte(`{"id":3,"secret":"x"}`)},
+	} {
+		hand(msg)
+	}
+	// The fields are renamed in the order of the paths.
+	if len(received) != 3 || received[0] != `{"id":1}` || received[1] != `{"x":2}` || received[2] != `{"id":3,"secret":"x"}` {
+		t.Fatal(received)
+	}
+}
@@ -15,6 +15,8 @@ type Subscriber struct {
 	sub        *nats.Subscription
 	Subj       string
 	Hand       nats.MsgHandler
+	Pipeline   *Pipeline // sets the validation and transformation stage for this subscription.
+	Envelope   *Envelope // sets the messages are unwrapped from the envelope for this subscription.
 	Since      *f.TimeStamp
 	MsgLimit   int // sets the limits for pending messages for this subscription.
 	BytesLimit int // sets the limits for a message's bytes for this subscription.
@@ -58,7 +60,14 @@ func (sub *Subscriber) Run(waitFunc ...func()) {
 	}()
 
 	// Async Subscriber.
-	sub.sub, err = sub.Conn.Subscribe(sub.Subj, sub.Hand)
+	hand := sub.Hand
+	if sub.Pipeline != nil {
+		hand = sub.Pipeline.Handler(hand)
+	}
+	if sub.Envelope != nil {
+		hand = sub.Envelope.Limit(sub.BytesLimit).Handler(hand)
+	}
+	sub.sub, err = sub.Conn.Subscribe(sub.Subj, hand)
 	// Set listening.
 	SubscribeErrorHandle(sub.sub, true, err)
 	if err != nil {
@@ -35,6 +35,8 @@ type SubscriberFast struct {
 	BytesLimit   int   // sets the limits for a message's bytes for this subscription.
 	OnceAmount   int64 // sets amount allocated at one time
 	OnceInterval time.Duration
+	Pipeline     *Pipeline // sets the validation and transformation stage for this subscription.
+	Envelope     *Envelope // sets the messages are unwrapped from the envelope for this subscription.
 	async        bool
 	err          error
 }
@@ -102,7 +104,14 @@ func (sub *SubscriberFast) Run(waitFunc ...func()) {
 	}()
 
 	// Async Subscriber.
+	envelope := sub.Envelope.Limit(sub.BytesLimit)
 	sub.sub, sub.err = sub.Conn.Subscribe(sub.Subj, func(msg *nats.Msg) {
+		if envelope != nil && !envelope.Handle(msg) {
+			return
+		}
+		if sub.Pipeline != nil && !sub.Pipeline.Handle(msg) {
+			return
+		}
 		key, val := atomic.AddUint64(&sub.Count, 1), msg.Data
 		sub.Cache.Set(key, val)
 	})
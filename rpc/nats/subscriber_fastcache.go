@@ -20,6 +20,10 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
+// fastCacheWAL the cache data and the write-ahead log of a running subscriber in the CacheDir,
+// they are recovered by the next run after a crash.
+const fastCacheWAL = "wal"
+
 // SubscriberFastCache The NatS Subscriber with Fast Cache Temporary Storage.
 type SubscriberFastCache struct {
 	*nats.Conn
@@ -35,6 +39,8 @@ type SubscriberFastCache struct {
 	BytesLimit   int   // sets the limits for a message's bytes for this subscription.
 	OnceAmount   int64 // sets amount allocated at one time
 	OnceInterval time.Duration
+	Pipeline     *Pipeline // sets the validation and transformation stage for this subscription.
+	Envelope     *Envelope // sets the messages are unwrapped from the envelope for this subscription.
 	Running      bool
 	async        bool
 	err          error
@@ -95,8 +101,7 @@ func (sub *SubscriberFastCache) LimitAmount(onceAmount int64, onceInterval time.
 
 // Process messages for this subscription.
 func (sub *SubscriberFastCache) Process(msg *CacheMsg) error {
-	key, val := msg.Key, msg.Val
-	sub.Cache.Set(f.BytesUint64(key), val)
+	setFastCache(sub.Cache, f.BytesUint64(msg.Key), msg.Val)
 	return nil
 }
 
@@ -133,11 +138,23 @@ func (sub *SubscriberFastCache) Run(waitFunc ...func()) {
 		sub.Running = false
 	}()
 
+	// Log the received data, it's recovered after a crash.
+	if err := sub.Cache.OpenWAL(filepath.Join(sub.CacheDir, fastCacheWAL)); err != nil {
+		Log.Error().Msgf("[nats] open cache wal > %s", err)
+	}
+
 	// Async Subscriber.
+	envelope := sub.Envelope.Limit(sub.BytesLimit)
 	sub.sub, sub.err = sub.Conn.Subscribe(sub.Subj, func(msg *nats.Msg) {
+		if envelope != nil && !envelope.Handle(msg) {
+			return
+		}
+		if sub.Pipeline != nil && !sub.Pipeline.Handle(msg) {
+			return
+		}
 		key, val := atomic.AddUint64(&sub.Count, 1), msg.Data
 		//sub.pool.Process(&CacheMsg{Key: key, Val: val}) // It's slow
-		sub.Cache.Set(f.BytesUint64(key), val)
+		setFastCache(sub.Cache, f.BytesUint64(key), val)
 	})
 	// Set listening.
 	SubscribeErrorHandle(sub.sub, sub.async, sub.err)
@@ -242,7 +259,7 @@ func (sub *SubscriberFastCache) init(ctx context.Context) {
 			var handData = make([][]byte, 0, indexSize)
 			for i, c, dataIndex := indexZero, uint64(count), int64(0); i <= c; i++ {
 				if key := f.BytesUint64(i); cache.Has(key) {
-					val := cache.Get(nil, key)
+					val := getFastCache(cache, key)
 					handData = append(handData, val)
 					if dataIndex++; dataIndex == onceRecords || i == c {
 						// bulk handle
@@ -252,7 +269,7 @@ func (sub *SubscriberFastCache) init(ctx context.Context) {
 							if i > indexZero {
 								clearCache(cache, int64(indexZero)-1, int64(i))
 								dirname1, filename1 := sub.dirnames(since, i-1, c), sub.filenames(since, i-1, c)
-								saveFastCache(cache, dir, dirname1, filename1)
+								_ = saveFastCache(cache, dir, dirname1, filename1)
 								_ = os.Remove(oldFile)
 								_ = os.RemoveAll(filePath)
 							}
@@ -287,6 +304,7 @@ func (sub *SubscriberFastCache) init(ctx context.Context) {
 		if len(dir1) != 14 || dir1 == dir0 {
 			continue
 		}
+		recoverFastCache(oldDir, dir1)
 		if datFiles, err := filepath.Glob(filepath.Join(oldDir, "*.json")); err != nil || datFiles == nil || len(datFiles) == 0 {
 			continue
 		}
@@ -344,7 +362,7 @@ func (sub *SubscriberFastCache) hand(ctx context.Context) {
 		var handData = make([][]byte, 0, indexSize)
 		for dataIndex := int64(0); dataIndex < indexSize && index < count; runCount++ {
 			index++ // key equals index
-			val := sub.Cache.Get(nil, f.BytesUint64(index))
+			val := getFastCache(sub.Cache, f.BytesUint64(index))
 			if val == nil {
 				val = []byte{}
 			}
@@ -430,15 +448,59 @@ func (sub *SubscriberFastCache) filenames(since string, index, count uint64) str
 }
 
 // Save the Cache Data of some records not processed.
+// The data is saved by a checkpoint of the write-ahead log, if it's opened by Run.
 func (sub *SubscriberFastCache) Save(cacheDir string) {
+	walPath := filepath.Join(sub.CacheDir, fastCacheWAL)
 	if sub.Count == 0 || sub.Hand == nil || sub.Index == sub.Count {
+		if sub.Cache.CloseWAL() == nil {
+			removeFastCacheWAL(walPath)
+		}
 		return
 	}
 
-	saveFastCache(sub.Cache, cacheDir, sub.Dirname(), sub.Filename())
+	if err := sub.Cache.Checkpoint(); err != nil {
+		if err != fastcache.ErrWALClosed {
+			Log.Error().Msgf("[nats] save cache wal > %s", err)
+		}
+		_ = sub.Cache.CloseWAL()
+		_ = saveFastCache(sub.Cache, cacheDir, sub.Dirname(), sub.Filename())
+		return
+	}
+	if err := sub.Cache.CloseWAL(); err != nil {
+		Log.Error().Msgf("[nats] close cache wal > %s", err)
+	}
+	moveFastCache(sub.Cache, walPath, cacheDir, sub.Dirname(), sub.Filename())
 }
 
-func saveFastCache(cache *fastcache.Cache, cacheDir, dirname, filename string) {
+// setFastCache sets a message by Set, or by SetBig if it's larger than a sub-value.
+func setFastCache(cache *fastcache.Cache, key, val []byte) {
+	if len(val) <= fastcache.MaxSubvalueLen {
+		cache.Set(key, val)
+	} else {
+		cache.SetBig(key, val)
+	}
+}
+
+// getFastCache gets a message stored by Set or SetBig.
+func getFastCache(cache *fastcache.Cache, key []byte) []byte {
+	val, _ := cache.GetAny(nil, key)
+	return val
+}
+
+func saveFastCache(cache *fastcache.Cache, cacheDir, dirname, filename string) error {
+	saveFastCacheStats(cache, cacheDir, filename)
+
+	dirPath := filepath.Join(cacheDir, dirname)
+	err := cache.SaveToFileConcurrent(dirPath, 0)
+	if err != nil {
+		Log.Error().Msgf("[nats] save cache data > %s", err)
+	} else {
+		cache.Reset() // Reset removes all the items from the cache.
+	}
+	return err
+}
+
+func saveFastCacheStats(cache *fastcache.Cache, cacheDir, filename string) {
 	fileStat := new(fastcache.Stats)
 	cache.UpdateStats(fileStat)
 	handData, err := f.EncodeJson(fileStat)
@@ -451,11 +513,61 @@ func saveFastCache(cache *fastcache.Cache, cacheDir, dirname, filename string) {
 	if err != nil {
 		Log.Error().Msgf("[nats] save cache stats > %s", err)
 	}
+}
+
+// moveFastCache moves the cache data saved by a checkpoint to the dirname, the stats is saved before,
+// so the data is recovered from the write-ahead log if it's not moved.
+func moveFastCache(cache *fastcache.Cache, walPath, cacheDir, dirname, filename string) {
+	saveFastCacheStats(cache, cacheDir, filename)
 
 	dirPath := filepath.Join(cacheDir, dirname)
-	if err = cache.SaveToFileConcurrent(dirPath, 0); err != nil {
+	if err := os.RemoveAll(dirPath); err != nil {
 		Log.Error().Msgf("[nats] save cache data > %s", err)
-	} else {
-		cache.Reset() // Reset removes all the items from the cache.
+		return
+	}
+	if err := os.Rename(walPath, dirPath); err != nil {
+		Log.Error().Msgf("[nats] save cache data > %s", err)
+		return
+	}
+	removeFastCacheWAL(walPath)
+	cache.Reset() // Reset removes all the items from the cache.
+}
+
+// recoverFastCache saves the cache data of a crashed subscriber from its write-ahead log,
+// the records not processed are the remaining keys.
+func recoverFastCache(dir, since string) {
+	walPath := filepath.Join(dir, fastCacheWAL)
+	if !f.PathExists(walPath) && !f.PathExists(walPath+".wal") {
+		return
+	}
+
+	cache := fastcache.LoadFromFileOrNew(walPath, 1073741824)
+	defer cache.Reset()
+	var first, count uint64
+	cache.Visit(func(k, _ []byte) bool {
+		if len(k) == 8 {
+			key := f.Uint64Bytes(k)
+			if first == 0 || key < first {
+				first = key
+			}
+			if key > count {
+				count = key
+			}
+		}
+		return true
+	})
+	if count > 0 {
+		index := first - 1
+		Log.Warn().Msgf("[nats] recover cache data > %s > %d/%d", since, index, count)
+		if saveFastCache(cache, dir, fmt.Sprintf("%s.%d.%d", since, index, count), fmt.Sprintf("%s.%d.%d.json", since, index, count)) != nil {
+			return
+		}
 	}
+	removeFastCacheWAL(walPath)
+}
+
+// removeFastCacheWAL removes the cache data and the write-ahead log.
+func removeFastCacheWAL(walPath string) {
+	_ = os.RemoveAll(walPath)
+	_ = os.RemoveAll(walPath + ".wal")
 }
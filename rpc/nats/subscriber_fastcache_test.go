@@ -2,14 +2,22 @@ package nats_test
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/angenalZZZ/gofunc/data"
+	"github.com/angenalZZZ/gofunc/data/cache/fastcache"
 	"github.com/angenalZZZ/gofunc/data/random"
 	"github.com/angenalZZZ/gofunc/f"
+	"github.com/angenalZZZ/gofunc/log"
 	nat "github.com/angenalZZZ/gofunc/rpc/nats"
+	"github.com/nats-io/nats.go"
 )
 
 func TestSubscriberFastCache(t *testing.T) {
@@ -110,3 +118,57 @@ func TestBenchSubscriberFastCache(t *testing.T) {
 	t.Logf("Publish Number: %d, Successful Number: %d, Failed Number %d", publishedNumber, succeededNumber, failedNumber)
 	t.Logf("Take time %s, handle received messages %d qps", ts, 1000*succeededNumber/ts.Milliseconds())
 }
+
+func TestSubscriberFastCacheRecover(t *testing.T) {
+	srv := runServer(14223, nil)
+	defer srv.Shutdown()
+	nc, err := nats.Connect("nats://127.0.0.1:14223")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nat.Log == nil {
+		nat.Log = log.InitConsole("15:04:05.000", false)
+	}
+
+	// The write-ahead log of a crashed subscriber.
+	dir, _ := ioutil.TempDir("", "nats")
+	defer func() { _ = os.RemoveAll(dir) }()
+	walPath := filepath.Join(dir, "20200101000000", "wal")
+	cache := fastcache.New(32 * 1024 * 1024)
+	if err = cache.OpenWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 5; i++ {
+		cache.Set(f.BytesUint64(i), []byte(fmt.Sprintf("msg%d", i)))
+	}
+	cache.Del(f.BytesUint64(1))
+	cache.Del(f.BytesUint64(2))
+	if err = cache.CloseWAL(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, wait := f.ContextWithWait(context.Background())
+	sub := nat.NewSubscriberFastCache(nc, "TestSubscriberFastCacheRecover", dir)
+	var received []string
+	sub.Hand = func(list [][]byte) error {
+		for _, item := range list {
+			received = append(received, string(item))
+		}
+		if len(received) == 3 {
+			f.DoneContext(ctx)
+		}
+		return nil
+	}
+	go func() {
+		time.Sleep(5 * time.Second)
+		f.DoneContext(ctx)
+	}()
+	sub.Run(wait)
+
+	if strings.Join(received, ",") != "msg3,msg4,msg5" {
+		t.Fatalf("recovered %q", received)
+	}
+	if f.PathExists(walPath) || f.PathExists(filepath.Join(sub.CacheDir, "wal.wal")) {
+		t.Fatal("the write-ahead log is not removed")
+	}
+}
@@ -31,6 +31,8 @@ type SubscriberFastDb struct {
 	BytesLimit   int   // sets the limits for a message's bytes for this subscription.
 	OnceAmount   int64 // sets amount allocated at one time
 	OnceInterval time.Duration
+	Pipeline     *Pipeline // sets the validation and transformation stage for this subscription.
+	Envelope     *Envelope // sets the messages are unwrapped from the envelope for this subscription.
 	async        bool
 	err          error
 }
@@ -128,7 +130,14 @@ func (sub *SubscriberFastDb) Run(waitFunc ...func()) {
 	}()
 
 	// Async Subscriber.
+	envelope := sub.Envelope.Limit(sub.BytesLimit)
 	sub.sub, sub.err = sub.Conn.Subscribe(sub.Subj, func(msg *nats.Msg) {
+		if envelope != nil && !envelope.Handle(msg) {
+			return
+		}
+		if sub.Pipeline != nil && !sub.Pipeline.Handle(msg) {
+			return
+		}
 		key, val := atomic.AddUint64(&sub.Count, 1), msg.Data
 		_ = sub.Cache.Update(func(tx *nutsdb.Tx) (err error) {
 			return tx.Put(sub.Subj, f.BytesUint64(key), val, 0)
@@ -15,6 +15,8 @@ type Subscribers struct {
 	sub        []*nats.Subscription
 	Subj       []string
 	Hand       []nats.MsgHandler
+	Pipelines  Pipelines // sets the validation and transformation stage per subject.
+	Envelope   *Envelope // sets the messages are unwrapped from the envelope for this subscription.
 	Since      *f.TimeStamp
 	MsgLimit   int // sets the limits for pending messages for this subscription.
 	BytesLimit int // sets the limits for a message's bytes for this subscription.
@@ -62,7 +64,14 @@ func (sub *Subscribers) Run(waitFunc ...func()) {
 	// Async Subscriber.
 	sub.sub = make([]*nats.Subscription, len(sub.Subj))
 	for i, subj := range sub.Subj {
-		sub.sub[i], err = sub.Conn.Subscribe(subj, sub.Hand[i])
+		hand := sub.Hand[i]
+		if len(sub.Pipelines) > 0 {
+			hand = sub.Pipelines.Handler(hand)
+		}
+		if sub.Envelope != nil {
+			hand = sub.Envelope.Limit(sub.BytesLimit).Handler(hand)
+		}
+		sub.sub[i], err = sub.Conn.Subscribe(subj, hand)
 
 		// Set listening.
 		SubscribeErrorHandle(sub.sub[i], true, err)